@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Print the configuration in effect",
+	Long: `Print the configuration send and receive would run with, as JSON, after merging
+the defaults with the config file. Credentials are shown as REDACTED.
+
+The configuration is printed even if it is invalid, followed by the reason it was rejected.`,
+	// Replaces the root's pre-run, which refuses to go on with an invalid configuration
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		loadConfig()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if file := viper.ConfigFileUsed(); file != "" {
+			log.Printf("Using config file: %s", file)
+		} else {
+			log.Printf("No config file found, using defaults")
+		}
+
+		output, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode config: %v", err)
+		}
+		fmt.Println(string(output))
+
+		if err := cfg.Validate(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		if err := cfg.ValidateSignaling(); err != nil {
+			log.Printf("Warning: %v, signalling needs it unless the offer and answer are exchanged as files", err)
+		}
+		for _, warning := range cfg.Warnings() {
+			log.Printf("Warning: %s", warning)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+}
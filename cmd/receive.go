@@ -1,9 +1,16 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"time"
 	"yapfs/internal/app"
+	"yapfs/internal/processor"
+	"yapfs/internal/s3"
+	"yapfs/internal/transport"
 	"yapfs/pkg/utils"
 
 	"github.com/spf13/cobra"
@@ -11,10 +18,36 @@ import (
 )
 
 type ReceiveFlags struct {
-	DestPath string
+	DestPath       string
+	KeepOnMismatch bool
+	Resume         bool
+	NoClobberNewer bool
+	VerifyCode     string
+	OnConflict     string
+	Force          bool
+	SkipIdentical  bool
+	WriteMode      string
+	StrictMime     bool
+	CheckMime      bool
+	ValidateFormat bool
+	PinFingerprint string
+	FileMode       string
+	Handoff        bool
+	AllowRelay     bool
+	MaxDuration    time.Duration
+	Dedup          bool
+	OfferIn        string
+	AnswerOut      string
+	AcceptFrom     []string
+	FailureLog     string
+	ChannelLabel   string
+	RouteByTag     string
+	Passphrase     string
+	As             string
+	Mkdirs         bool
+	Timeout        time.Duration
 	// Future flags can be easily added here:
 	// Verbose  bool
-	// Timeout  int
 	// Port     int
 }
 
@@ -44,25 +77,159 @@ Use --dst to specify directory where to save the received file (defaults to curr
 	},
 }
 
+// splitDestinationFile makes a --dst that isn't a directory the path of the received file itself:
+// the file is saved in its parent directory, which must exist, under its base name as with --as.
+// A --dst ending in a path separator is always a directory, created when needed.
+func splitDestinationFile(flags *ReceiveFlags) error {
+	if os.IsPathSeparator(flags.DestPath[len(flags.DestPath)-1]) {
+		return nil
+	}
+	if info, err := os.Stat(flags.DestPath); err == nil && info.IsDir() {
+		return nil
+	}
+
+	name := filepath.Base(flags.DestPath)
+	if name == "." || name == ".." {
+		return nil
+	}
+	if flags.As != "" {
+		return fmt.Errorf("--as can't be used with a --dst that isn't a directory, %s names the file already", flags.DestPath)
+	}
+
+	dir := filepath.Dir(flags.DestPath)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("invalid destination path: parent directory does not exist: %s", dir)
+	}
+
+	flags.DestPath, flags.As = dir, name
+	log.Printf("Destination %s is not a directory, saving the file as %s in %s", filepath.Join(dir, name), name, dir)
+	return nil
+}
+
 // validateReceiveFlags validates the receive command flags
 func validateReceiveFlags(flags *ReceiveFlags) error {
 	if flags.DestPath == "" {
 		flags.DestPath = "." // Default to current directory
 	}
 
-	// Resolve and validate destination path
-	resolvedPath, err := utils.ResolveDestinationPath(flags.DestPath)
+	if s3.IsURL(flags.DestPath) {
+		if err := validateS3Destination(flags); err != nil {
+			return err
+		}
+	} else {
+		if flags.Mkdirs {
+			if err := os.MkdirAll(flags.DestPath, 0755); err != nil {
+				return fmt.Errorf("failed to create destination directory: %w", err)
+			}
+		}
+
+		if err := splitDestinationFile(flags); err != nil {
+			return err
+		}
+
+		// Resolve and validate destination path
+		resolvedPath, err := utils.ResolveDestinationPath(flags.DestPath)
+		if err != nil {
+			return fmt.Errorf("invalid destination path: %w", err)
+		}
+
+		// Update the flag with the resolved path
+		flags.DestPath = resolvedPath
+	}
+
+	if flags.As != "" {
+		if err := processor.ValidateFileName(flags.As); err != nil {
+			return fmt.Errorf("invalid --as: %w", err)
+		}
+	}
+
+	policy, err := processor.ParseConflictPolicy(flags.OnConflict)
 	if err != nil {
-		return fmt.Errorf("invalid destination path: %w", err)
+		return fmt.Errorf("invalid --on-conflict: %w", err)
+	}
+	if flags.Force && policy != processor.ConflictFail && policy != processor.ConflictOverwrite {
+		return fmt.Errorf("--force overwrites existing files, it can't be combined with --on-conflict %s", policy)
 	}
 
-	// Update the flag with the resolved path
-	flags.DestPath = resolvedPath
+	if _, err := processor.ParseWriteMode(flags.WriteMode); err != nil {
+		return fmt.Errorf("invalid --write-mode: %w", err)
+	}
+
+	if flags.FileMode != "" {
+		if _, err := processor.ParseFileMode(flags.FileMode); err != nil {
+			return fmt.Errorf("invalid --file-mode: %w", err)
+		}
+	}
+
+	if flags.VerifyCode != "" {
+		code, err := utils.ParseVerifyCode(flags.VerifyCode)
+		if err != nil {
+			return fmt.Errorf("invalid --verify-code: %w", err)
+		}
+		flags.VerifyCode = code
+	}
+
+	if flags.PinFingerprint != "" {
+		fingerprint, err := utils.ParseFingerprint(flags.PinFingerprint)
+		if err != nil {
+			return fmt.Errorf("invalid --pin-fingerprint: %w", err)
+		}
+		flags.PinFingerprint = fingerprint
+
+		// The fingerprint is checked in the DTLS handshake, which a relayed transfer doesn't have
+		if flags.AllowRelay {
+			return fmt.Errorf("--allow-signaling-relay can't be combined with --pin-fingerprint")
+		}
+	}
+
+	// A relayed transfer carries no identity to check
+	if len(flags.AcceptFrom) > 0 && flags.AllowRelay {
+		return fmt.Errorf("--allow-signaling-relay can't be combined with --accept-from")
+	}
+
+	if err := validateFileExchange("--offer-in", flags.OfferIn, "--answer-out", flags.AnswerOut, flags.AllowRelay); err != nil {
+		return err
+	}
+
+	if flags.MaxDuration < 0 {
+		return fmt.Errorf("--max-duration must not be negative")
+	}
+
+	if flags.Timeout < 0 {
+		return fmt.Errorf("--timeout must not be negative")
+	}
+
+	return nil
+}
+
+// validateS3Destination checks an s3:// destination and rejects flags that only make sense on local disk
+func validateS3Destination(flags *ReceiveFlags) error {
+	if _, _, err := s3.ParseURL(flags.DestPath); err != nil {
+		return fmt.Errorf("invalid destination: %w", err)
+	}
+
+	unsupported := []struct {
+		flag string
+		set  bool
+	}{
+		{"--resume", flags.Resume},
+		{"--handoff", flags.Handoff},
+		{"--on-conflict", flags.OnConflict != string(processor.ConflictFail)},
+		{"--skip-identical", flags.SkipIdentical},
+		{"--no-clobber-newer", flags.NoClobberNewer},
+		{"--keep-on-mismatch", flags.KeepOnMismatch},
+		{"--file-mode", flags.FileMode != ""},
+		{"--dedup", flags.Dedup},
+		{"--check-mime", flags.CheckMime},
+		{"--validate-format", flags.ValidateFormat},
+		{"--mkdirs", flags.Mkdirs},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return fmt.Errorf("%s is not supported with an s3:// destination", u.flag)
+		}
+	}
 
-	// Future validations can be easily added here:
-	// if flags.Timeout <= 0 {
-	//     return fmt.Errorf("timeout must be positive")
-	// }
 	return nil
 }
 
@@ -70,35 +237,117 @@ func init() {
 	rootCmd.AddCommand(receiveCmd)
 
 	// Define flags with struct binding
-	receiveCmd.Flags().StringVarP(&receiveFlags.DestPath, "dst", "d", ".", "Destination directory to save received file (defaults to current directory)")
+	receiveCmd.Flags().StringVarP(&receiveFlags.DestPath, "dst", "d", ".", "Destination directory to save received file (defaults to current directory), a file path to save a single file as, or s3://bucket/prefix to upload it")
+	receiveCmd.Flags().StringVar(&receiveFlags.As, "as", "", "Save the received file in --dst under this name instead of the sender's, skipping MIME and tag routing (single files only)")
+	receiveCmd.Flags().BoolVar(&receiveFlags.Mkdirs, "mkdirs", false, "Create --dst and any missing parent directories of it")
+	receiveCmd.Flags().BoolVar(&receiveFlags.Resume, "resume", false, "Keep partial files on interruption and resume them when the same file is sent again")
+	receiveCmd.Flags().BoolVar(&receiveFlags.Handoff, "handoff", false, "On Ctrl-C mid-transfer, keep the partial file and have the sender wait for another receiver to take over (implies --resume)")
+	receiveCmd.Flags().StringVar(&receiveFlags.OnConflict, "on-conflict", string(processor.ConflictFail), "What to do when the file already exists: fail, overwrite, rename (to \"name (1).ext\") or skip")
+	receiveCmd.Flags().BoolVar(&receiveFlags.Force, "force", false, "Overwrite an existing file with the received one, the same as --on-conflict overwrite")
+	receiveCmd.Flags().BoolVar(&receiveFlags.SkipIdentical, "skip-identical", false, "Skip the transfer if an existing file has the same checksum; a different file is handled by --on-conflict")
+	receiveCmd.Flags().StringVar(&receiveFlags.WriteMode, "write-mode", string(processor.WriteModeDirect), "How the file is written: direct to its final path, or atomic via a .part file renamed into place once verified")
+	receiveCmd.Flags().StringVar(&receiveFlags.FileMode, "file-mode", "", "Permissions of received files in octal (e.g. 0640), set exactly regardless of umask")
+	receiveCmd.Flags().BoolVar(&receiveFlags.StrictMime, "strict-mime", false, "Reject a file whose content doesn't match its extension (e.g. a .jpg that is really a script) instead of only warning")
+	receiveCmd.Flags().BoolVar(&receiveFlags.CheckMime, "check-mime", false, "After writing, check that each file's content looks like the MIME type the sender declared and flag any mismatch in the summary")
+	receiveCmd.Flags().BoolVar(&receiveFlags.ValidateFormat, "validate-format", false, "After writing, open each zip, gzip, png or jpeg file as its format and fail the transfer if it doesn't open, keeping the file for inspection")
+	receiveCmd.Flags().StringVar(&receiveFlags.RouteByTag, "route-by-tag", "", "Put each file in the subdirectory named by the value of this tag from the sender's --meta (e.g. project puts project=acme in dst/acme/)")
+	receiveCmd.Flags().BoolVar(&receiveFlags.NoClobberNewer, "no-clobber-newer", false, "Refuse to overwrite an existing file that was modified more recently than the incoming file")
+	receiveCmd.Flags().StringVar(&receiveFlags.VerifyCode, "verify-code", "", "Verification code shown by the sender (--print-verify-code); the received file must match it")
+	receiveCmd.Flags().StringVar(&receiveFlags.Passphrase, "passphrase", "", "Passphrase the sender encrypts file data with (its --passphrase); a sender that doesn't encrypt with one is rejected")
+	receiveCmd.Flags().StringVar(&receiveFlags.PinFingerprint, "pin-fingerprint", "", "Certificate fingerprint shown by the sender (--print-fingerprint); the connection is dropped before any data flows if the peer's differs")
+	receiveCmd.Flags().StringSliceVar(&receiveFlags.AcceptFrom, "accept-from", nil, "Only accept senders identifying with one of these names (their --identity), comma-separated; a coarse filter, identities are not authenticated")
+	receiveCmd.Flags().StringVar(&receiveFlags.FailureLog, "failure-log", "", "Append a JSON line with the time, code, peer and reason to this file for each transfer that is rejected or fails")
+	receiveCmd.Flags().StringVar(&receiveFlags.ChannelLabel, "channel-label", transport.DefaultChannelLabel, "Only accept a data channel with this label, matching the sender's --channel-label")
+	receiveCmd.Flags().StringVar(&receiveFlags.OfferIn, "offer-in", "", "Read the sender's offer (its --offer-out) from this file instead of asking for a code (needs --answer-out)")
+	receiveCmd.Flags().StringVar(&receiveFlags.AnswerOut, "answer-out", "", "Write the answer to this file, for the sender's --answer-in")
+	receiveCmd.Flags().BoolVar(&receiveFlags.AllowRelay, "allow-signaling-relay", false, "If no direct connection can be made, accept a small file relayed through the signalling server; slow, and the server stores the data on the way")
+	receiveCmd.Flags().DurationVar(&receiveFlags.MaxDuration, "max-duration", 0, "Abort a transfer still running this long after the sender connected (e.g. 30m) and remove its partial file; 0 for no limit")
+	receiveCmd.Flags().DurationVar(&receiveFlags.Timeout, "timeout", 0, "Give up if the whole receive, from waiting for the sender on, hasn't finished this long after starting (e.g. 10m); the partial file is removed unless kept for --resume; 0 for no limit")
+	receiveCmd.Flags().BoolVar(&receiveFlags.Dedup, "dedup", false, "When replacing an existing file, reuse the parts of it that didn't change so only the differences are sent")
+	receiveCmd.Flags().BoolVar(&receiveFlags.KeepOnMismatch, "keep-on-mismatch", false, "Keep a file that fails checksum validation as <name>.corrupt instead of deleting it")
 
 	// Bind flags to viper for environment variable support
 	viper.BindPFlag("receive.dst", receiveCmd.Flags().Lookup("dst"))
+	viper.BindPFlag("receive.as", receiveCmd.Flags().Lookup("as"))
+	viper.BindPFlag("receive.mkdirs", receiveCmd.Flags().Lookup("mkdirs"))
+	viper.BindPFlag("receive.resume", receiveCmd.Flags().Lookup("resume"))
+	viper.BindPFlag("receive.handoff", receiveCmd.Flags().Lookup("handoff"))
+	viper.BindPFlag("receive.on_conflict", receiveCmd.Flags().Lookup("on-conflict"))
+	viper.BindPFlag("receive.force", receiveCmd.Flags().Lookup("force"))
+	viper.BindPFlag("receive.skip_identical", receiveCmd.Flags().Lookup("skip-identical"))
+	viper.BindPFlag("receive.write_mode", receiveCmd.Flags().Lookup("write-mode"))
+	viper.BindPFlag("receive.file_mode", receiveCmd.Flags().Lookup("file-mode"))
+	viper.BindPFlag("receive.strict_mime", receiveCmd.Flags().Lookup("strict-mime"))
+	viper.BindPFlag("receive.check_mime", receiveCmd.Flags().Lookup("check-mime"))
+	viper.BindPFlag("receive.validate_format", receiveCmd.Flags().Lookup("validate-format"))
+	viper.BindPFlag("receive.route_by_tag", receiveCmd.Flags().Lookup("route-by-tag"))
+	viper.BindPFlag("receive.passphrase", receiveCmd.Flags().Lookup("passphrase"))
+	viper.BindPFlag("receive.no_clobber_newer", receiveCmd.Flags().Lookup("no-clobber-newer"))
+	viper.BindPFlag("receive.max_duration", receiveCmd.Flags().Lookup("max-duration"))
+	viper.BindPFlag("receive.timeout", receiveCmd.Flags().Lookup("timeout"))
+	viper.BindPFlag("receive.dedup", receiveCmd.Flags().Lookup("dedup"))
+	viper.BindPFlag("receive.keep_on_mismatch", receiveCmd.Flags().Lookup("keep-on-mismatch"))
+	viper.BindPFlag("receive.verify_code", receiveCmd.Flags().Lookup("verify-code"))
+	viper.BindPFlag("receive.allow_signaling_relay", receiveCmd.Flags().Lookup("allow-signaling-relay"))
+	viper.BindPFlag("receive.pin_fingerprint", receiveCmd.Flags().Lookup("pin-fingerprint"))
+	viper.BindPFlag("receive.accept_from", receiveCmd.Flags().Lookup("accept-from"))
+	viper.BindPFlag("receive.failure_log", receiveCmd.Flags().Lookup("failure-log"))
+	viper.BindPFlag("receive.channel_label", receiveCmd.Flags().Lookup("channel-label"))
+	viper.BindPFlag("receive.offer_in", receiveCmd.Flags().Lookup("offer-in"))
+	viper.BindPFlag("receive.answer_out", receiveCmd.Flags().Lookup("answer-out"))
 
 	// Future flag bindings can be easily added here:
 	// viper.BindPFlag("receive.verbose", receiveCmd.Flags().Lookup("verbose"))
-	// viper.BindPFlag("receive.timeout", receiveCmd.Flags().Lookup("timeout"))
 }
 
 // runReceiverApp creates and runs the receiver application
 func runReceiverApp(flags *ReceiveFlags) error {
-	peerService, dataChannelService, signalingService := createServices()
+	peerService, dataChannelService, signalingService := createServices(fileExchange(flags.OfferIn, flags.AnswerOut))
 
 	// Future flag processing can be easily added here:
 	// if flags.Verbose {
 	//     log.Printf("Verbose mode enabled")
 	//     // Configure services for verbose logging
 	// }
-	// if flags.Timeout > 0 {
-	//     // Apply timeout to context or services
-	// }
 
 	// Create receiver options from flags
 	opts := &app.ReceiverOptions{
-		DestPath: flags.DestPath,
+		DestPath:       flags.DestPath,
+		KeepOnMismatch: flags.KeepOnMismatch,
+		Resume:         flags.Resume,
+		NoClobberNewer: flags.NoClobberNewer,
+		VerifyCode:     flags.VerifyCode,
+		OnConflict:     flags.OnConflict,
+		Force:          flags.Force,
+		SkipIdentical:  flags.SkipIdentical,
+		WriteMode:      flags.WriteMode,
+		StrictMime:     flags.StrictMime,
+		CheckMime:      flags.CheckMime,
+		ValidateFormat: flags.ValidateFormat,
+		FileMode:       flags.FileMode,
+		Handoff:        flags.Handoff,
+		AllowRelay:     flags.AllowRelay,
+		PinFingerprint: flags.PinFingerprint,
+		MaxDuration:    flags.MaxDuration,
+		Timeout:        flags.Timeout,
+		Dedup:          flags.Dedup,
+		AcceptFrom:     flags.AcceptFrom,
+		FailureLog:     flags.FailureLog,
+		ChannelLabel:   flags.ChannelLabel,
+		RouteByTag:     flags.RouteByTag,
+		As:             flags.As,
+		Passphrase:     flags.Passphrase,
+		Notify:         notify,
+		Report:         reportOptions(),
 	}
 
 	receiverApp := app.NewReceiverApp(cfg, peerService, dataChannelService, signalingService)
 
-	return receiverApp.Run(createContext(), opts)
+	// The progress reporter already prints the summary
+	_, err := receiverApp.Run(createContext(), opts)
+	if errors.Is(err, transport.ErrHandedOff) {
+		log.Printf("Transfer handed off, the sender shows a new code for the receiver taking over (it needs --resume and access to the partial file to continue from it)")
+		return nil
+	}
+	return err
 }
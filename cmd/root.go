@@ -2,22 +2,30 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"yapfs/internal/config"
+	"yapfs/internal/reporter"
 	"yapfs/internal/signalling"
 	"yapfs/internal/transport"
+	"yapfs/pkg/utils"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	cfg     *config.Config
-	cfgFile string
+	cfg            *config.Config
+	cfgFile        string
+	units          string
+	summaryOneline bool
+	notify         bool
+	tui            bool
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -36,35 +44,34 @@ Usage:
 
 Both peers will exchange SDP offers/answers manually to establish the connection.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if units != utils.UnitsBytes && units != utils.UnitsBits {
+			log.Fatalf("Invalid --units value %q: must be %q or %q", units, utils.UnitsBytes, utils.UnitsBits)
+		}
 
-		// Initialize viper configuration
-		initConfig()
-
-		// Initialize configuration with defaults
-		cfg = config.NewDefaultConfig()
+		loadConfig()
 
-		// Only unmarshal if a config file was actually found and read
-		if viper.ConfigFileUsed() != "" {
-			// Unmarshal config from file, overriding defaults
-			if err := viper.Unmarshal(cfg); err != nil {
-				log.Fatalf("Failed to unmarshal config: %v", err)
-			}
+		// Validate the final configuration
+		if err := cfg.Validate(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		for _, warning := range cfg.Warnings() {
+			log.Printf("Warning: %s", warning)
+		}
 
-			// Manually override Firebase config as workaround for Viper unmarshal issue
-			if projectID := viper.GetString("firebase.project_id"); projectID != "" {
-				cfg.Firebase.ProjectID = projectID
-			}
-			if databaseURL := viper.GetString("firebase.database_url"); databaseURL != "" {
-				cfg.Firebase.DatabaseURL = databaseURL
-			}
-			if credentialsPath := viper.GetString("firebase.credentials_path"); credentialsPath != "" {
-				cfg.Firebase.CredentialsPath = credentialsPath
+		// Buffers too large for this machine are reduced up front, rather than running out of memory mid-transfer
+		if cfg.MinFreeMemoryMB > 0 {
+			if available, ok := utils.AvailableMemory(); ok {
+				for _, reduction := range cfg.LimitToMemory(available) {
+					log.Printf("Warning: %s", reduction)
+				}
 			}
 		}
 
-		// Validate the final configuration
-		if err := cfg.Validate(); err != nil {
-			log.Fatalf("Invalid configuration: %v", err)
+		// Clients are created from the default transport later on, they all inherit the proxy
+		if cfg.Proxy != "" {
+			proxyURL, _ := utils.ParseProxyURL(cfg.Proxy)
+			utils.UseProxyForHTTP(proxyURL)
+			log.Printf("Connecting through proxy %s", cfg.Redacted().Proxy)
 		}
 	},
 }
@@ -72,12 +79,58 @@ Both peers will exchange SDP offers/answers manually to establish the connection
 func init() {
 	// Add global flags
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.yapfs.yaml)")
+	rootCmd.PersistentFlags().StringVar(&units, "units", utils.UnitsBytes, "Throughput display units: bytes (MB/s) or bits (Mbps)")
+	rootCmd.PersistentFlags().BoolVar(&notify, "notify", false, "Show a desktop notification when the transfer ends, or ring the terminal bell where none can be shown")
+	rootCmd.PersistentFlags().BoolVar(&summaryOneline, "summary-oneline", false, "Print the completion summary as a single line (useful for scripts and logs)")
+	rootCmd.PersistentFlags().String("proxy", "", "SOCKS5 proxy (socks5://[user:password@]host:port) for signalling, other HTTP requests and TURN over TCP, also read from YAPFS_PROXY")
+	viper.BindPFlag("proxy", rootCmd.PersistentFlags().Lookup("proxy"))
+	rootCmd.PersistentFlags().BoolVar(&tui, "tui", false, "Show a full-screen dashboard with progress, a throughput graph, the connection state and recent log lines instead of the progress line")
 
 	// Set up viper environment variable support
 	viper.SetEnvPrefix("YAPFS")
 	viper.AutomaticEnv()
 }
 
+// loadConfig builds cfg from the defaults and the config file, if one is found
+func loadConfig() {
+	// Initialize viper configuration
+	initConfig()
+
+	// Initialize configuration with defaults
+	cfg = config.NewDefaultConfig()
+
+	// Only unmarshal if a config file was actually found and read
+	if viper.ConfigFileUsed() != "" {
+		// Unmarshal config from file, overriding defaults (keys follow the json tags)
+		if err := viper.Unmarshal(cfg, func(dc *mapstructure.DecoderConfig) {
+			dc.TagName = "json"
+		}); err != nil {
+			log.Fatalf("Failed to unmarshal config: %v", err)
+		}
+
+		// Manually override Firebase config as workaround for Viper unmarshal issue
+		if projectID := viper.GetString("firebase.project_id"); projectID != "" {
+			cfg.Firebase.ProjectID = projectID
+		}
+		if databaseURL := viper.GetString("firebase.database_url"); databaseURL != "" {
+			cfg.Firebase.DatabaseURL = databaseURL
+		}
+		if credentialsPath := viper.GetString("firebase.credentials_path"); credentialsPath != "" {
+			cfg.Firebase.CredentialsPath = credentialsPath
+		}
+	}
+
+	// The flag or YAPFS_PROXY override the config file
+	if proxy := viper.GetString("proxy"); proxy != "" {
+		cfg.Proxy = proxy
+	}
+
+	// send --chunk-size overrides the config file, an out of range size is rejected with the rest of the config
+	if viper.IsSet("send.chunk_size") {
+		cfg.WebRTC.ChunkSize = viper.GetInt("send.chunk_size")
+	}
+}
+
 // initConfig reads in config file and ENV variables
 func initConfig() {
 	if cfgFile != "" {
@@ -113,6 +166,32 @@ func Execute() {
 	}
 }
 
+// fileExchange returns the file exchange to signal through when offerPath and answerPath are set, nil for Firebase
+func fileExchange(offerPath, answerPath string) signalling.SignalingServer {
+	if offerPath == "" {
+		return nil
+	}
+	return signalling.NewFileExchange(offerPath, answerPath)
+}
+
+// validateFileExchange checks the offer and answer file flags are given together, and not with the signalling relay
+func validateFileExchange(offerFlag, offerPath, answerFlag, answerPath string, allowRelay bool) error {
+	if offerPath == "" && answerPath == "" {
+		return nil
+	}
+	if offerPath == "" || answerPath == "" {
+		return fmt.Errorf("%s and %s must be used together", offerFlag, answerFlag)
+	}
+	if offerPath == answerPath {
+		return fmt.Errorf("%s and %s must be different files", offerFlag, answerFlag)
+	}
+	// There is no signalling session to relay through
+	if allowRelay {
+		return fmt.Errorf("--allow-signaling-relay can't be combined with %s", offerFlag)
+	}
+	return nil
+}
+
 // createContext creates a context that cancels on interrupt signals
 func createContext() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -130,12 +209,50 @@ func createContext() context.Context {
 	return ctx
 }
 
-// createServices creates and wires up all the application services
-func createServices() (*transport.PeerService, *transport.DataChannelService, *signalling.SignalingService) {
+// createFollowContext is createContext for send --follow: the first interrupt only stops following,
+// so the file ends with what was appended so far and is verified, a second one cancels
+func createFollowContext() (context.Context, <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan struct{})
+
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		log.Println("\nReceived interrupt signal, ending the file with what has been appended so far (interrupt again to abort)...")
+		close(stop)
+
+		<-sigChan
+		log.Println("\nReceived interrupt signal, shutting down...")
+		cancel()
+	}()
+
+	return ctx, stop
+}
+
+// reportOptions builds progress display options from the global flags
+func reportOptions() reporter.Options {
+	return reporter.Options{
+		Units:          units,
+		SummaryOneline: summaryOneline,
+		TUI:            tui,
+		ChecksumFormat: cfg.ChecksumEncoding,
+	}
+}
+
+// createServices creates and wires up all the application services, signalling through server or Firebase if it is nil
+func createServices(server signalling.SignalingServer) (*transport.PeerService, *transport.DataChannelService, *signalling.SignalingService) {
 	// Create services
-	signalingService, err := signalling.NewDefaultSignalingService(cfg)
-	if err != nil {
-		log.Fatalf("Failed to create signaling service: %v", err)
+	var signalingService *signalling.SignalingService
+	if server != nil {
+		signalingService = signalling.NewSignalingService(server, signalling.NewWebRTCHandler(&cfg.WebRTC))
+	} else {
+		var err error
+		signalingService, err = signalling.NewDefaultSignalingService(cfg)
+		if err != nil {
+			log.Fatalf("Failed to create signaling service: %v", err)
+		}
 	}
 
 	peerService := transport.NewPeerService(cfg)
@@ -1,20 +1,49 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"time"
 	"yapfs/internal/app"
+	"yapfs/internal/config"
+	"yapfs/internal/processor"
+	"yapfs/internal/transport"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 type SendFlags struct {
-	FilePath string
+	FilePath         string
+	PrintVerifyCode  bool
+	PrintFingerprint bool
+	AllowRelay       bool
+	FollowSymlinks   bool
+	SelfCheck        bool
+	Encrypt          bool
+	Compress         bool
+	CompressAlgo     string
+	CompressLevel    string
+	Passphrase       string
+	OfferOut         string
+	AnswerIn         string
+	Identity         string
+	Resume           bool
+	ChannelLabel     string
+	Schedule         string
+	ChecksumSampleMB int
+	Follow           bool
+	HashWorkers      int
+	Order            string
+	Include          []string
+	Exclude          []string
+	Nice             bool
+	Meta             map[string]string
+	Timeout          time.Duration
 	// Future flags can be easily added here:
 	// Verbose  bool
-	// Timeout  int
 	// Port     int
 }
 
@@ -31,7 +60,11 @@ var sendCmd = &cobra.Command{
 3. Wait for you to exchange SDP with the receiver
 4. Send the specified file once connected
 
-Use --file to specify the path to the file you want to send.`,
+Use --file to specify the path to the file you want to send. A directory is sent
+with all its files; if an earlier transfer of it was interrupted, files the
+receiver already has are skipped (run the receiver with --resume to also continue
+a partially received file). An http:// or https:// URL is streamed to the receiver
+without saving it to disk first.`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		return validateSendFlags(&sendFlags)
 	},
@@ -47,17 +80,69 @@ func init() {
 	rootCmd.AddCommand(sendCmd)
 
 	// Define flags with struct binding
-	sendCmd.Flags().StringVarP(&sendFlags.FilePath, "file", "f", "", "Path to file to send (required)")
+	sendCmd.Flags().StringVarP(&sendFlags.FilePath, "file", "f", "", "Path to file or directory, or http(s) URL of a file, to send (required)")
+
+	sendCmd.Flags().BoolVar(&sendFlags.FollowSymlinks, "follow-symlinks", true, "If --file is a symlink, send its target's contents; with --follow-symlinks=false the link itself is recreated on the receiver")
+	sendCmd.Flags().BoolVar(&sendFlags.SelfCheck, "self-check", false, "Read each file twice before sending it and abort if the two reads disagree")
+	sendCmd.Flags().BoolVar(&sendFlags.Encrypt, "encrypt", false, "Also encrypt file data with a random per-session key sent over the data channel, as defense in depth on top of DTLS")
+	sendCmd.Flags().StringVar(&sendFlags.Passphrase, "passphrase", "", "Encrypt file data end to end with a key derived from this passphrase, which the receiver must give with its --passphrase; never sent anywhere")
+	sendCmd.Flags().BoolVar(&sendFlags.Compress, "compress", false, "Compress file data on the wire, for files whose start compresses well (others are sent as they are)")
+	sendCmd.Flags().StringVar(&sendFlags.CompressAlgo, "compress-algo", "gzip", "Algorithm --compress uses: gzip, or zstd, which is faster and sends less but needs a receiver that knows zstd")
+	sendCmd.Flags().StringVar(&sendFlags.CompressLevel, "compress-level", "fast", "How hard --compress works: 1 (fast) to 9 (best), or fast or best; higher levels send less at more CPU cost")
+	sendCmd.Flags().BoolVar(&sendFlags.PrintVerifyCode, "print-verify-code", false, "Print a short checksum code for the receiver to check with --verify-code")
+	sendCmd.Flags().BoolVar(&sendFlags.AllowRelay, "allow-signaling-relay", false, "If no direct connection can be made, relay a small file (relay.max_bytes) through the signalling server; slow, and the server stores the data on the way")
+	sendCmd.Flags().BoolVar(&sendFlags.Resume, "resume", false, "Cache checkpoints of how far each file got, so after a restart the receiver's partial file (receive --resume) is confirmed without rereading all of it")
+	sendCmd.Flags().StringVar(&sendFlags.Identity, "identity", "", "Name to identify as to the receiver, for a receiver that only accepts certain senders (--accept-from); not authenticated")
+	sendCmd.Flags().StringVar(&sendFlags.OfferOut, "offer-out", "", "Write the offer to this file instead of using the signalling server, for the receiver's --offer-in (needs --answer-in)")
+	sendCmd.Flags().StringVar(&sendFlags.AnswerIn, "answer-in", "", "Wait for the receiver's answer (its --answer-out) to appear in this file")
+	sendCmd.Flags().StringVar(&sendFlags.Schedule, "schedule", "", "Limit the send rate by local time of day, e.g. \"09:00-17:00=1MB,17:00-09:00=10MB\" (per second; unlimited outside the windows)")
+	sendCmd.Flags().IntVar(&sendFlags.ChecksumSampleMB, "checksum-sample", 0, "Only checksum the first and last this many MB of larger files plus their size, a fast but weak check instead of SHA-256 of the whole file (0 hashes it all)")
+	sendCmd.Flags().BoolVar(&sendFlags.Follow, "follow", false, "Keep the file open and send data appended to it as it arrives, like tail -f; interrupt once to end the file there, twice to abort")
+	sendCmd.Flags().IntVar(&sendFlags.HashWorkers, "hash-workers", 1, "Checksum this many files of a directory at once before sending, faster for many files on fast storage (1 checksums each file as it is sent)")
+	sendCmd.Flags().StringVar(&sendFlags.Order, "order", string(processor.SendOrderListed), "Order the files of a directory are sent in: as-listed (by path), name (by file name), size-asc (smallest first) or size-desc (largest first)")
+	sendCmd.Flags().StringArrayVar(&sendFlags.Include, "include", nil, "Only send the files of a directory matching this glob, e.g. \"*.go\" for any name along the path or \"docs/*\" for a path within it; repeatable")
+	sendCmd.Flags().StringArrayVar(&sendFlags.Exclude, "exclude", nil, "Leave out the files of a directory matching this glob, even if included, e.g. \"vendor/*\"; repeatable")
+	sendCmd.Flags().BoolVar(&sendFlags.Nice, "nice", false, "Yield to interactive traffic: send in small chunks, backing off while the round trip time is raised and speeding up while the link is idle; no fixed rate cap")
+	sendCmd.Flags().StringToStringVar(&sendFlags.Meta, "meta", nil, "Tag every file sent with key=value pairs (e.g. --meta project=acme), for a receiver routing by tag with --route-by-tag")
+	sendCmd.Flags().StringVar(&sendFlags.ChannelLabel, "channel-label", transport.DefaultChannelLabel, "Label of the data channel file data is sent on, the receiver's --channel-label must match")
+	sendCmd.Flags().Int("chunk-size", 0, fmt.Sprintf("Bytes of file data per message, overriding webrtc.chunk_size (%d to %d)", config.MinChunkSize, config.MaxChunkSize))
+	sendCmd.Flags().DurationVar(&sendFlags.Timeout, "timeout", 0, "Give up if the whole send, from waiting for the receiver on, hasn't finished this long after starting (e.g. 10m); 0 for no limit")
+	sendCmd.Flags().BoolVar(&sendFlags.PrintFingerprint, "print-fingerprint", false, "Print this peer's DTLS certificate fingerprint for the receiver to pin with --pin-fingerprint")
 
 	// Mark required flags
 	sendCmd.MarkFlagRequired("file")
 
 	// Bind flags to viper for environment variable support
 	viper.BindPFlag("send.file", sendCmd.Flags().Lookup("file"))
+	viper.BindPFlag("send.follow_symlinks", sendCmd.Flags().Lookup("follow-symlinks"))
+	viper.BindPFlag("send.print_verify_code", sendCmd.Flags().Lookup("print-verify-code"))
+	viper.BindPFlag("send.allow_signaling_relay", sendCmd.Flags().Lookup("allow-signaling-relay"))
+	viper.BindPFlag("send.print_fingerprint", sendCmd.Flags().Lookup("print-fingerprint"))
+	viper.BindPFlag("send.self_check", sendCmd.Flags().Lookup("self-check"))
+	viper.BindPFlag("send.encrypt", sendCmd.Flags().Lookup("encrypt"))
+	viper.BindPFlag("send.compress", sendCmd.Flags().Lookup("compress"))
+	viper.BindPFlag("send.compress_algo", sendCmd.Flags().Lookup("compress-algo"))
+	viper.BindPFlag("send.compress_level", sendCmd.Flags().Lookup("compress-level"))
+	viper.BindPFlag("send.passphrase", sendCmd.Flags().Lookup("passphrase"))
+	viper.BindPFlag("send.resume", sendCmd.Flags().Lookup("resume"))
+	viper.BindPFlag("send.identity", sendCmd.Flags().Lookup("identity"))
+	viper.BindPFlag("send.offer_out", sendCmd.Flags().Lookup("offer-out"))
+	viper.BindPFlag("send.answer_in", sendCmd.Flags().Lookup("answer-in"))
+	viper.BindPFlag("send.channel_label", sendCmd.Flags().Lookup("channel-label"))
+	viper.BindPFlag("send.schedule", sendCmd.Flags().Lookup("schedule"))
+	viper.BindPFlag("send.checksum_sample", sendCmd.Flags().Lookup("checksum-sample"))
+	viper.BindPFlag("send.follow", sendCmd.Flags().Lookup("follow"))
+	viper.BindPFlag("send.hash_workers", sendCmd.Flags().Lookup("hash-workers"))
+	viper.BindPFlag("send.order", sendCmd.Flags().Lookup("order"))
+	viper.BindPFlag("send.include", sendCmd.Flags().Lookup("include"))
+	viper.BindPFlag("send.exclude", sendCmd.Flags().Lookup("exclude"))
+	viper.BindPFlag("send.nice", sendCmd.Flags().Lookup("nice"))
+	viper.BindPFlag("send.meta", sendCmd.Flags().Lookup("meta"))
+	viper.BindPFlag("send.chunk_size", sendCmd.Flags().Lookup("chunk-size"))
+	viper.BindPFlag("send.timeout", sendCmd.Flags().Lookup("timeout"))
 
 	// Future flag bindings can be easily added here:
 	// viper.BindPFlag("send.verbose", sendCmd.Flags().Lookup("verbose"))
-	// viper.BindPFlag("send.timeout", sendCmd.Flags().Lookup("timeout"))
 }
 
 // validateSendFlags validates the send command flags
@@ -66,6 +151,70 @@ func validateSendFlags(flags *SendFlags) error {
 		return fmt.Errorf("file path is required")
 	}
 
+	if flags.ChecksumSampleMB < 0 {
+		return fmt.Errorf("--checksum-sample must not be negative")
+	}
+
+	if flags.HashWorkers < 1 {
+		return fmt.Errorf("--hash-workers must be at least 1")
+	}
+
+	if flags.Timeout < 0 {
+		return fmt.Errorf("--timeout must not be negative")
+	}
+
+	if _, err := processor.ParseSendOrder(flags.Order); err != nil {
+		return fmt.Errorf("invalid --order: %w", err)
+	}
+
+	filter := processor.DirectoryFilter{Include: flags.Include, Exclude: flags.Exclude}
+	if err := filter.Validate(); err != nil {
+		return fmt.Errorf("invalid --include or --exclude: %w", err)
+	}
+
+	if _, err := transport.ParseCompressAlgo(flags.CompressAlgo); err != nil {
+		return fmt.Errorf("invalid --compress-algo: %w", err)
+	}
+	if _, err := transport.ParseCompressLevel(flags.CompressLevel); err != nil {
+		return fmt.Errorf("invalid --compress-level: %w", err)
+	}
+
+	if flags.Passphrase != "" && flags.Encrypt {
+		return fmt.Errorf("--passphrase already encrypts file data, it can't be combined with --encrypt")
+	}
+
+	for key := range flags.Meta {
+		if key == "" {
+			return fmt.Errorf("--meta tags must be key=value with a non-empty key")
+		}
+	}
+
+	if flags.Schedule != "" {
+		if _, err := transport.ParseRateSchedule(flags.Schedule); err != nil {
+			return fmt.Errorf("invalid --schedule: %w", err)
+		}
+	}
+
+	if err := validateFileExchange("--offer-out", flags.OfferOut, "--answer-in", flags.AnswerIn, flags.AllowRelay); err != nil {
+		return err
+	}
+
+	if err := validateFollowFlags(flags); err != nil {
+		return err
+	}
+
+	// A remote file is checked when it is prepared for sending
+	if processor.IsRemoteSource(flags.FilePath) {
+		return nil
+	}
+
+	// A symlink sent as a link only needs to exist, its target may be missing or unreadable
+	if !flags.FollowSymlinks {
+		if linkInfo, err := os.Lstat(flags.FilePath); err == nil && linkInfo.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+	}
+
 	// Check if file exists and is accessible
 	fileInfo, err := os.Stat(flags.FilePath)
 	if err != nil {
@@ -75,9 +224,12 @@ func validateSendFlags(flags *SendFlags) error {
 		return fmt.Errorf("cannot access file: %s (%v)", flags.FilePath, err)
 	}
 
-	// Check if it's a regular file (not a directory)
+	// A directory's files are checked as they are listed and sent
 	if fileInfo.IsDir() {
-		return fmt.Errorf("path is a directory, not a file: %s", flags.FilePath)
+		if flags.Follow {
+			return fmt.Errorf("--follow needs a file, %s is a directory", flags.FilePath)
+		}
+		return nil
 	}
 
 	// Check if file is readable
@@ -87,32 +239,81 @@ func validateSendFlags(flags *SendFlags) error {
 	}
 	file.Close()
 
-	// Future validations can be easily added here:
-	// if flags.Timeout <= 0 {
-	//     return fmt.Errorf("timeout must be positive")
-	// }
+	return nil
+}
+
+// validateFollowFlags rejects options that need the whole file up front, which a followed file never is until it ends
+func validateFollowFlags(flags *SendFlags) error {
+	if !flags.Follow {
+		return nil
+	}
+	if processor.IsRemoteSource(flags.FilePath) {
+		return fmt.Errorf("--follow needs a local file, not a URL")
+	}
+
+	for flag, set := range map[string]bool{
+		"--self-check":            flags.SelfCheck,
+		"--checksum-sample":       flags.ChecksumSampleMB > 0,
+		"--resume":                flags.Resume,
+		"--print-verify-code":     flags.PrintVerifyCode,
+		"--allow-signaling-relay": flags.AllowRelay,
+	} {
+		if set {
+			return fmt.Errorf("%s can't be used with --follow", flag)
+		}
+	}
 	return nil
 }
 
 // runSenderApp creates and runs the sender application
 func runSenderApp(flags *SendFlags) error {
-	peerService, dataChannelService, signalingService := createServices()
+	peerService, dataChannelService, signalingService := createServices(fileExchange(flags.OfferOut, flags.AnswerIn))
 
 	// Future flag processing can be easily added here:
 	// if flags.Verbose {
 	//     log.Printf("Verbose mode enabled")
 	//     // Configure services for verbose logging
 	// }
-	// if flags.Timeout > 0 {
-	//     // Apply timeout to context or services
-	// }
 
 	// Create sender options from flags
 	opts := &app.SenderOptions{
-		FilePath: flags.FilePath,
+		FilePath:         flags.FilePath,
+		PrintVerifyCode:  flags.PrintVerifyCode,
+		PrintFingerprint: flags.PrintFingerprint,
+		AllowRelay:       flags.AllowRelay,
+		FollowSymlinks:   flags.FollowSymlinks,
+		SelfCheck:        flags.SelfCheck,
+		Encrypt:          flags.Encrypt,
+		Compress:         flags.Compress,
+		CompressAlgo:     flags.CompressAlgo,
+		CompressLevel:    flags.CompressLevel,
+		Passphrase:       flags.Passphrase,
+		Identity:         flags.Identity,
+		Resume:           flags.Resume,
+		ChannelLabel:     flags.ChannelLabel,
+		Schedule:         flags.Schedule,
+		ChecksumSample:   int64(flags.ChecksumSampleMB) * 1024 * 1024,
+		Follow:           flags.Follow,
+		HashWorkers:      flags.HashWorkers,
+		Order:            flags.Order,
+		Include:          flags.Include,
+		Exclude:          flags.Exclude,
+		Nice:             flags.Nice,
+		Tags:             flags.Meta,
+		Timeout:          flags.Timeout,
+		Notify:           notify,
+		Report:           reportOptions(),
 	}
 
 	senderApp := app.NewSenderApp(cfg, peerService, dataChannelService, signalingService)
 
-	return senderApp.Run(createContext(), opts)
+	// The progress reporter already prints the summary
+	var ctx context.Context
+	if flags.Follow {
+		ctx, opts.StopFollowing = createFollowContext()
+	} else {
+		ctx = createContext()
+	}
+	_, err := senderApp.Run(ctx, opts)
+	return err
 }
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"yapfs/pkg/utils"
+
+	"github.com/spf13/cobra"
+)
+
+type VerifyFlags struct {
+	FilePath string
+	Checksum string
+}
+
+var verifyFlags VerifyFlags
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check a file against its SHA-256 checksum",
+	Long: `Recompute the SHA-256 checksum of a file, to confirm a received file independently of
+the transfer. With --checksum (hex or base64, as the sender's summary shows it) the
+command exits non-zero if the file doesn't match; without it the checksum is printed.`,
+	// Nothing is sent or received, the configuration isn't needed
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateVerifyFlags(&verifyFlags)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if verifyFlags.Checksum == "" {
+			checksum, err := utils.CalculateFileChecksum(verifyFlags.FilePath)
+			if err != nil {
+				log.Fatalf("Verify failed: %v", err)
+			}
+			fmt.Println(checksum)
+			return
+		}
+
+		matched, err := utils.IsFileChecksumMatched(verifyFlags.FilePath, verifyFlags.Checksum)
+		if err != nil {
+			log.Fatalf("Verify failed: %v", err)
+		}
+		if !matched {
+			log.Fatalf("Checksum mismatch: %s does not have SHA-256 checksum %s", verifyFlags.FilePath, verifyFlags.Checksum)
+		}
+		fmt.Printf("OK %s\n", verifyFlags.FilePath)
+	},
+}
+
+// validateVerifyFlags validates the verify command flags
+func validateVerifyFlags(flags *VerifyFlags) error {
+	info, err := os.Stat(flags.FilePath)
+	if err != nil {
+		return fmt.Errorf("cannot access file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory, only files can be verified", flags.FilePath)
+	}
+
+	// The file's checksum is computed in hex
+	if flags.Checksum != "" {
+		checksum, err := utils.NormalizeChecksum(flags.Checksum)
+		if err != nil {
+			return fmt.Errorf("invalid --checksum: %w", err)
+		}
+		flags.Checksum = checksum
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVarP(&verifyFlags.FilePath, "file", "f", "", "Path to the file to verify (required)")
+	verifyCmd.Flags().StringVar(&verifyFlags.Checksum, "checksum", "", "Expected SHA-256 checksum in hex or base64, the file's checksum is printed if omitted")
+
+	verifyCmd.MarkFlagRequired("file")
+}
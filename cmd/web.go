@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"yapfs/internal/signalling"
+	"yapfs/internal/transport"
+	"yapfs/internal/web"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type WebFlags struct {
+	Addr string
+}
+
+var webFlags WebFlags
+
+// webCmd represents the web command
+var webCmd = &cobra.Command{
+	Use:   "web",
+	Short: "Serve a local web page to send and receive files",
+	Long: `Serve a small web page to start transfers from a browser instead of the terminal.
+Pick a file to upload, or give a path on this machine, to send it and show the
+code for the receiver; or enter a code from a sender to receive its file into a
+directory on this machine. Progress is shown on the page as it goes.
+
+One transfer runs at a time. The page can read and write anything this user can,
+so --addr defaults to localhost; don't expose it to a network you don't trust.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if _, _, err := net.SplitHostPort(webFlags.Addr); err != nil {
+			return fmt.Errorf("invalid --addr: %w", err)
+		}
+		return cfg.ValidateSignaling()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runWebServer(&webFlags); err != nil {
+			log.Fatalf("Web server failed: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(webCmd)
+
+	webCmd.Flags().StringVar(&webFlags.Addr, "addr", "localhost:8080", "Address to serve the page on")
+
+	viper.BindPFlag("web.addr", webCmd.Flags().Lookup("addr"))
+}
+
+// runWebServer serves the web page until interrupted
+func runWebServer(flags *WebFlags) error {
+	if host, _, _ := net.SplitHostPort(flags.Addr); !web.IsLoopback(host) {
+		log.Printf("Warning: serving on %s, anyone who can reach it can send and receive files as this user", flags.Addr)
+	}
+
+	newServices := func() (*transport.PeerService, *transport.DataChannelService, *signalling.SignalingService) {
+		return createServices(nil)
+	}
+	server := &http.Server{
+		Addr:    flags.Addr,
+		Handler: web.NewServer(cfg, flags.Addr, newServices, reportOptions()).Handler(),
+	}
+
+	ctx := createContext()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("Serving the web page on http://%s", flags.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
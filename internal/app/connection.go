@@ -0,0 +1,21 @@
+package app
+
+import (
+	"yapfs/internal/transport"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// connectionState returns a description of peerConn for the dashboard, with the peer's address once connected
+func connectionState(peerConn *transport.PeerConnection) func() string {
+	return func() string {
+		state := peerConn.ConnectionState()
+		if state != webrtc.PeerConnectionStateConnected {
+			return state.String()
+		}
+		if address := peerConn.RemoteAddress(); address != "" {
+			return "connected to " + address
+		}
+		return state.String()
+	}
+}
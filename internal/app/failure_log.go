@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"yapfs/internal/processor"
+	"yapfs/internal/signalling"
+	"yapfs/internal/transport"
+)
+
+// failureEntry is one line of the failure log, a JSON object per rejected or failed transfer
+type failureEntry struct {
+	Time        time.Time `json:"time"`
+	Code        string    `json:"code,omitempty"`
+	Destination string    `json:"destination"`
+	PeerAddress string    `json:"peer_address,omitempty"`
+	Reason      string    `json:"reason"` // One of the failureReasons, "failed" for anything else
+	Error       string    `json:"error"`
+}
+
+// failureReasons names the causes an operator may want to count, checked in order
+var failureReasons = []struct {
+	err    error
+	reason string
+}{
+	{transport.ErrSenderNotAccepted, "sender_not_accepted"},
+	{transport.ErrFingerprintMismatch, "fingerprint_mismatch"},
+	{transport.ErrChannelLabelMismatch, "channel_label_mismatch"},
+	{transport.ErrPassphraseNotUsed, "passphrase_not_used"},
+	{transport.ErrDecryptionFailed, "decryption_failed"},
+	{processor.ErrContentMismatch, "content_mismatch"},
+	{processor.ErrExistingNewer, "existing_newer"},
+	{processor.ErrVerifyCodeMismatch, "verify_code_mismatch"},
+	{transport.ErrChunkAccounting, "chunk_accounting"},
+	{transport.ErrSegmentMismatch, "segment_mismatch"},
+	{processor.ErrChecksumMismatch, "checksum_mismatch"},
+	{processor.ErrInvalidFormat, "invalid_format"},
+	{ErrMaxDurationExceeded, "max_duration"},
+	{syscall.ENOSPC, "disk_full"},
+	{signalling.ErrInvalidRemoteSDP, "invalid_offer"},
+}
+
+// failureReason classifies why a transfer failed
+func failureReason(err error) string {
+	for _, known := range failureReasons {
+		if errors.Is(err, known.err) {
+			return known.reason
+		}
+	}
+	return "failed"
+}
+
+// logFailure appends an entry for a transfer that ended with err to the failure log at path.
+// A transfer the user cancelled or handed off didn't fail and isn't logged.
+func logFailure(path string, attempt *receiveAttempt, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, transport.ErrHandedOff) {
+		return nil
+	}
+
+	line, encodeErr := json.Marshal(failureEntry{
+		Time:        time.Now(),
+		Code:        attempt.code,
+		Destination: attempt.destination,
+		PeerAddress: attempt.peerAddress,
+		Reason:      failureReason(err),
+		Error:       err.Error(),
+	})
+	if encodeErr != nil {
+		return fmt.Errorf("failed to encode failure log entry: %w", encodeErr)
+	}
+
+	file, openErr := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if openErr != nil {
+		return fmt.Errorf("failed to open failure log: %w", openErr)
+	}
+	defer file.Close()
+
+	if _, writeErr := file.Write(append(line, '\n')); writeErr != nil {
+		return fmt.Errorf("failed to write failure log: %w", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package app
+
+import (
+	"yapfs/internal/reporter"
+	"yapfs/pkg/types"
+)
+
+// metadataHandler returns the transport's OnMetadata callback for an app option: without one metadata stays in
+// the progress stream, with one it goes to the console reporter as well as the caller
+func metadataHandler(progressReporter *reporter.ProgressReporter, onMetadata func(*types.FileMetadata)) func(*types.FileMetadata) {
+	if onMetadata == nil {
+		return nil
+	}
+
+	return func(metadata *types.FileMetadata) {
+		progressReporter.SetMetadata(metadata)
+		onMetadata(metadata)
+	}
+}
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// notifyTitle is the title of completion notifications
+const notifyTitle = "yapfs"
+
+// notifyCompletion tells the user how a transfer ended with a desktop notification, or the terminal bell without one.
+// action names the transfer ("Sending", "Receiving") and done its success ("Sent", "Received").
+// A transfer the user cancelled needs no notification, they are at the terminal.
+func notifyCompletion(action, done string, result *types.TransferResult, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if err != nil {
+		utils.Notify(notifyTitle, fmt.Sprintf("%s failed: %v", action, err))
+		return
+	}
+
+	switch {
+	case result.Skipped:
+		utils.Notify(notifyTitle, fmt.Sprintf("%s skipped, the existing copy of %s was kept", action, result.Name))
+	case result.Files > 1:
+		utils.Notify(notifyTitle, fmt.Sprintf("%s %s: %d files, %s", done, result.Name, result.Files, utils.FormatFileSize(result.Size)))
+	default:
+		utils.Notify(notifyTitle, fmt.Sprintf("%s %s (%s)", done, result.Name, utils.FormatFileSize(result.Size)))
+	}
+}
@@ -2,24 +2,89 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"yapfs/internal/config"
+	"yapfs/internal/reporter"
 	"yapfs/internal/signalling"
 	"yapfs/internal/transport"
+	"yapfs/pkg/types"
 	"yapfs/pkg/utils"
-	"yapfs/internal/reporter"
 )
 
 // ReceiverOptions configures the receiver application behavior
 type ReceiverOptions struct {
-	DestPath string // Required: destination directory or file path to save received file
+	DestPath       string           // Required: destination directory or file path to save received file
+	Code           string           // Code from the sender, asked for on the console if empty
+	KeepOnMismatch bool             // Keep files that fail checksum validation as <name>.corrupt for inspection
+	Resume         bool             // Keep partial files on interruption and resume them on the next transfer
+	NoClobberNewer bool             // Refuse to overwrite an existing file newer than the incoming one
+	VerifyCode     string           // Checksum prefix read out by the sender, checked after the transfer
+	SyncProgress   bool             // Deliver every progress update even if the consumer is slow, at the cost of throughput
+	OnConflict     string           // What to do when the destination file exists: fail (default), overwrite, rename or skip
+	Force          bool             // Overwrite an existing destination file instead of what OnConflict says
+	SkipIdentical  bool             // Skip the transfer if an identical file already exists
+	WriteMode      string           // direct (default) writes to the final path, atomic writes a .part file and renames it
+	StrictMime     bool             // Reject a file whose content doesn't match its extension instead of only warning
+	CheckMime      bool             // Flag received files whose detected content type disagrees with the declared MIME type
+	ValidateFormat bool             // Fail a received zip, gzip, png or jpeg file that doesn't open as its format
+	FileMode       string           // Octal permissions for received files (e.g. 0640), empty keeps the default
+	Handoff        bool             // When cancelled mid-transfer, keep the partial file and have the sender wait for another receiver
+	Notify         bool             // Show a desktop notification (or ring the terminal bell) once the transfer ends
+	AllowRelay     bool             // Accept a small file relayed through the signalling session if no direct connection can be made
+	PinFingerprint string           // Sender's certificate fingerprint conveyed out of band, the connection is dropped if it differs
+	MaxDuration    time.Duration    // Abort the transfer if it takes longer than this once the sender has connected, 0 for no limit
+	Timeout        time.Duration    // Give up on the receive if it hasn't finished this long after Run was called, 0 for no limit
+	Dedup          bool             // Reuse unchanged chunks of an existing file being replaced instead of receiving them again
+	AcceptFrom     []string         // Sender identities accepted, empty to accept any sender
+	ChannelLabel   string           // Label the sender's data channel must have, empty for the default
+	FailureLog     string           // File to append a JSON line to for each transfer that is rejected or fails, with the reason
+	RouteByTag     string           // Put files in the subdirectory named by the value of this tag of theirs, if they have it
+	As             string           // Save the file in DestPath under this name instead of its own, for a single file
+	Passphrase     string           // Only accept file data encrypted with a key derived from this passphrase
+	Report         reporter.Options // Progress and summary display options
+
+	// Called with the transfer's metadata, which then no longer arrives as a zero-byte progress update
+	OnMetadata func(*types.FileMetadata)
+
 	// Future options can be added here:
 	// Verbose  bool
-	// Timeout  time.Duration
 }
 
+// ErrMaxDurationExceeded is returned when a transfer is aborted for running longer than ReceiverOptions.MaxDuration
+var ErrMaxDurationExceeded = errors.New("transfer exceeded maximum allowed duration")
+
+// receiveViaRelay receives the file through the signalling session code after the peer connection failed, if it hasn't started yet
+func (r *ReceiverApp) receiveViaRelay(code string) bool {
+	relay, err := r.signalingService.Relay(code)
+	if err != nil {
+		log.Printf("Can't fall back to a relayed transfer: %v", err)
+		return false
+	}
+
+	return r.dataChannelService.ReceiveViaRelay(relay)
+}
+
+// handOff leaves the transfer to another receiver and gives the sender a moment to get the message and close the connection
+func (r *ReceiverApp) handOff(exitCh <-chan error) error {
+	if err := r.dataChannelService.HandOff(); err != nil {
+		return err
+	}
+
+	select {
+	case <-exitCh:
+	case <-time.After(receiveSettleTimeout):
+	}
+
+	return nil
+}
+
+// receiveSettleTimeout bounds how long to wait for in-flight messages after the connection closes
+const receiveSettleTimeout = 2 * time.Second
+
 // ReceiverApp implements receiver application logic
 type ReceiverApp struct {
 	config             *config.Config
@@ -43,11 +108,37 @@ func NewReceiverApp(
 	}
 }
 
-// Run starts the receiver application with the given options
-func (r *ReceiverApp) Run(ctx context.Context, opts *ReceiverOptions) error {
+// Run starts the receiver application with the given options and returns a summary of the transfer
+func (r *ReceiverApp) Run(ctx context.Context, opts *ReceiverOptions) (*types.TransferResult, error) {
+	ctx, cancel := withTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	attempt := &receiveAttempt{destination: opts.DestPath}
+	result, err := r.run(ctx, opts, attempt)
+	err = timeoutError(ctx, err, opts.Timeout)
+	if err != nil && opts.FailureLog != "" {
+		if logErr := logFailure(opts.FailureLog, attempt, err); logErr != nil {
+			log.Printf("Warning: %v", logErr)
+		}
+	}
+	if opts.Notify {
+		notifyCompletion("Receiving", "Received", result, err)
+	}
+	return result, err
+}
+
+// receiveAttempt is what run learned about the transfer on the way, for the failure log
+type receiveAttempt struct {
+	code        string
+	destination string
+	peerAddress string
+}
+
+// run receives the file, Run adds what happens once it has ended
+func (r *ReceiverApp) run(ctx context.Context, opts *ReceiverOptions, attempt *receiveAttempt) (*types.TransferResult, error) {
 	// Validate required options
 	if opts.DestPath == "" {
-		return fmt.Errorf("destination path is required")
+		return nil, fmt.Errorf("destination path is required")
 	}
 
 	log.Printf("Preparing to receive file to: %s", opts.DestPath)
@@ -74,7 +165,7 @@ func (r *ReceiverApp) Run(ctx context.Context, opts *ReceiverOptions) error {
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create peer connection: %w", err)
+		return nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
 
 	// Single cleanup function
@@ -83,57 +174,164 @@ func (r *ReceiverApp) Run(ctx context.Context, opts *ReceiverOptions) error {
 			log.Printf("Error closing peer connection: %v", err)
 		}
 
+		// The session is cleared even when ctx has been cancelled or timed out
 		if code != "" {
-			if err := r.signalingService.ClearSession(ctx, code); err != nil {
+			if err := r.signalingService.ClearSession(context.WithoutCancel(ctx), code); err != nil {
 				log.Printf("Warning: Failed to clear Firebase session: %v", err)
 			}
 		}
 	}
 
-	// Prompt the user to input code (session ID)
-	code, err := utils.AskForCode(ctx)
-	if err != nil {
-		cleanup("")
-		return fmt.Errorf("failed to get code from user: %w", err)
+	// Prompt the user to input code (session ID), unless the signalling server has only one session
+	code, fixed := r.signalingService.FixedSession()
+	if !fixed && opts.Code != "" {
+		code = opts.Code
+	} else if !fixed {
+		code, err = utils.AskForCode(ctx)
+		if err != nil {
+			cleanup("")
+			return nil, fmt.Errorf("failed to get code from user: %w", err)
+		}
 	}
 
+	attempt.code = code
+
 	// Start signalling process
 	err = r.signalingService.StartReceiverSignallingProcess(ctx, peerConn.PeerConnection, code)
 	if err != nil {
 		cleanup(code)
-		return fmt.Errorf("failed during signalling process: %w", err)
+		return nil, fmt.Errorf("failed during signalling process: %w", err)
+	}
+
+	// The time limit runs from when the sender has connected, waiting for a code doesn't count.
+	// It is detached from ctx so that its expiry is told apart from the user cancelling.
+	var limitCtx context.Context
+	var limitDone <-chan struct{}
+	if opts.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		limitCtx, cancel = context.WithTimeoutCause(context.WithoutCancel(ctx), opts.MaxDuration, ErrMaxDurationExceeded)
+		defer cancel()
+		limitDone = limitCtx.Done()
 	}
 
+	propressReporter := reporter.NewProgressReporter(opts.Report)
+	propressReporter.WatchConnection(connectionState(peerConn))
+
 	// Setup file receiver
-	err = r.dataChannelService.SetupFileReceiver(ctx, peerConn.PeerConnection, opts.DestPath)
+	err = r.dataChannelService.SetupFileReceiver(ctx, peerConn.PeerConnection, transport.ReceiveOptions{
+		DestPath:       opts.DestPath,
+		KeepOnMismatch: opts.KeepOnMismatch,
+		Resume:         opts.Resume,
+		NoClobberNewer: opts.NoClobberNewer,
+		VerifyCode:     opts.VerifyCode,
+		SyncProgress:   opts.SyncProgress,
+		OnConflict:     opts.OnConflict,
+		Force:          opts.Force,
+		SkipIdentical:  opts.SkipIdentical,
+		WriteMode:      opts.WriteMode,
+		StrictMime:     opts.StrictMime,
+		CheckMime:      opts.CheckMime,
+		ValidateFormat: opts.ValidateFormat,
+		FileMode:       opts.FileMode,
+		Handoff:        opts.Handoff,
+		PinFingerprint: opts.PinFingerprint,
+		Dedup:          opts.Dedup,
+		AcceptFrom:     opts.AcceptFrom,
+		ChannelLabel:   opts.ChannelLabel,
+		RouteByTag:     opts.RouteByTag,
+		As:             opts.As,
+		Passphrase:     opts.Passphrase,
+		OnMetadata:     metadataHandler(propressReporter, opts.OnMetadata),
+		OnTypeMismatch: propressReporter.AddTypeMismatch,
+	})
 	if err != nil {
 		cleanup(code)
-		return fmt.Errorf("failed to setup file receiver data channel handler: %w", err)
+		return nil, fmt.Errorf("failed to setup file receiver data channel handler: %w", err)
 	}
 
 	// Start file receive with progress tracking
 	progressCh, err := r.dataChannelService.ReceiveFile()
 	if err != nil {
 		cleanup(code)
-		return fmt.Errorf("failed to start file receive: %w", err)
+		return nil, fmt.Errorf("failed to start file receive: %w", err)
 	}
 
 	// Start updating progress on UI
-	propressReporter := reporter.NewProgressReporter()
 	go propressReporter.StartUpdatingProgress(ctx, progressCh)
 
 	// Wait for any exit condition
 	var exitErr error
+	relayed := false
 
 	select {
 	case <-ctx.Done():
 		// Context cancelled
 		exitErr = ctx.Err()
+		timedOut := errors.Is(context.Cause(ctx), ErrTimeout)
+		if opts.Handoff && !timedOut {
+			if err := r.handOff(exitCh); err != nil {
+				log.Printf("Not handing the transfer off: %v", err)
+			} else {
+				exitErr = transport.ErrHandedOff
+			}
+		}
+		if exitErr != transport.ErrHandedOff {
+			if timedOut {
+				log.Printf("Receive didn't finish within %v, stopping", opts.Timeout)
+			}
+			// Tell the sender why the transfer ends and clear the partial file, then give the sender a moment to close the connection
+			r.dataChannelService.StopReceive(stopReason(ctx, opts.Timeout))
+			select {
+			case <-exitCh:
+			case <-time.After(receiveSettleTimeout):
+			}
+		}
+	case <-limitDone:
+		exitErr = context.Cause(limitCtx)
+		log.Printf("Transfer took longer than %v, aborting", opts.MaxDuration)
+		r.dataChannelService.AbortReceive(exitErr)
+
+		// Give the sender a moment to get the error and close the connection
+		select {
+		case <-exitCh:
+		case <-time.After(receiveSettleTimeout):
+		}
 	case exitErr = <-exitCh:
-		// Connection closed or error
+		// Connection closed or error, without a direct path the file may still come through the signalling session
+		if exitErr != nil && opts.AllowRelay {
+			propressReporter.WatchConnection(func() string { return "relayed through the signalling session" })
+			relayed = r.receiveViaRelay(code)
+			if relayed {
+				exitErr = nil
+			}
+		}
+	}
+
+	// Read the peer address while the connection is still up
+	peerAddress := peerConn.RemoteAddress()
+	iceRole := peerConn.ICERole().String()
+	if relayed {
+		// The sender reads our status from the session and clears it once done
+		peerAddress = "signalling relay"
+		iceRole = ""
+		code = ""
 	}
+	attempt.peerAddress = peerAddress
 
 	cleanup(code)
 
-	return exitErr
+	if exitErr != nil {
+		return nil, exitErr
+	}
+
+	// The connection closing doesn't mean the file was received, check how the transfer ended
+	if err := r.dataChannelService.WaitForReceive(receiveSettleTimeout); err != nil {
+		return nil, err
+	}
+
+	result := r.dataChannelService.ReceiveResult()
+	result.PeerAddress = peerAddress
+	result.ICERole = iceRole
+
+	return result, nil
 }
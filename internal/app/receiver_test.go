@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"yapfs/internal/config"
+	"yapfs/internal/signalling"
+	"yapfs/internal/transport"
+)
+
+// newTestServices wires the services the way the commands do, signalling through offer and answer files in dir
+func newTestServices(dir string) (*config.Config, *transport.PeerService, *transport.DataChannelService, *signalling.SignalingService) {
+	cfg := config.NewDefaultConfig()
+	cfg.WebRTC.ICEServers = nil
+	exchange := signalling.NewFileExchange(filepath.Join(dir, "offer.txt"), filepath.Join(dir, "answer.txt"))
+	return cfg,
+		transport.NewPeerService(cfg),
+		transport.NewDataChannelService(cfg),
+		signalling.NewSignalingService(exchange, signalling.NewWebRTCHandler(&cfg.WebRTC))
+}
+
+// waitForFile polls until path exists and is not empty
+func waitForFile(t *testing.T, path string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s did not appear within %v", path, timeout)
+}
+
+func TestCancelledReceiveRemovesPartialFile(t *testing.T) {
+	exchangeDir, destDir := t.TempDir(), t.TempDir()
+
+	srcPath := filepath.Join(t.TempDir(), "file.bin")
+	content := make([]byte, 8*1024*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(srcPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sendCtx, stopSending := context.WithTimeout(context.Background(), 30*time.Second)
+	defer stopSending()
+	sendDone := make(chan error, 1)
+	go func() {
+		cfg, peerService, dataChannelService, signalingService := newTestServices(exchangeDir)
+		// The rate limit keeps the transfer going long enough to cancel it halfway
+		_, err := NewSenderApp(cfg, peerService, dataChannelService, signalingService).Run(sendCtx, &SenderOptions{
+			FilePath: srcPath,
+			Schedule: "00:00-00:00=1MB",
+		})
+		sendDone <- err
+	}()
+
+	// The receiver reads the offer when it starts, so it has to be written first
+	waitForFile(t, filepath.Join(exchangeDir, "offer.txt"), 10*time.Second)
+
+	recvCtx, cancelReceive := context.WithCancel(context.Background())
+	defer cancelReceive()
+	recvDone := make(chan error, 1)
+	go func() {
+		cfg, peerService, dataChannelService, signalingService := newTestServices(exchangeDir)
+		_, err := NewReceiverApp(cfg, peerService, dataChannelService, signalingService).Run(recvCtx, &ReceiverOptions{
+			DestPath:  destDir,
+			WriteMode: "atomic",
+		})
+		recvDone <- err
+	}()
+
+	partPath := filepath.Join(destDir, "file.bin.part")
+	waitForFile(t, partPath, 20*time.Second)
+	cancelReceive()
+
+	select {
+	case err := <-recvDone:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("receive error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("receiver did not stop after being cancelled")
+	}
+
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Errorf("partial file still there after cancelling: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "file.bin")); !os.IsNotExist(err) {
+		t.Errorf("destination file exists after cancelling: %v", err)
+	}
+
+	select {
+	case err := <-sendDone:
+		if err == nil {
+			t.Error("send succeeded although the receiver cancelled")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("sender did not stop after the receiver cancelled")
+	}
+}
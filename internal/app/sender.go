@@ -2,21 +2,64 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"yapfs/internal/config"
 	"yapfs/internal/reporter"
 	"yapfs/internal/signalling"
 	"yapfs/internal/transport"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
 )
 
 // SenderOptions configures the sender application behavior
 type SenderOptions struct {
-	FilePath string // Required: path to file to send
+	FilePath         string           // Required: path to file to send
+	PrintVerifyCode  bool             // Print a short checksum code the receiver can verify out of band
+	PrintFingerprint bool             // Print the DTLS certificate fingerprint for the receiver to pin out of band
+	FollowSymlinks   bool             // Send the target of a symlinked file, otherwise recreate the link on the receiver
+	SelfCheck        bool             // Read each file twice before sending it and abort if the reads disagree
+	Encrypt          bool             // Encrypt file data with an ephemeral key on top of DTLS
+	Compress         bool             // Compress file data on the wire for files that compress well
+	CompressAlgo     string           // Algorithm to compress with: gzip (default) or zstd
+	CompressLevel    string           // Level to compress at: 1 (fast, default) to 9 (best), or fast or best
+	Passphrase       string           // Encrypt file data with a key derived from this, the receiver must know it too; not with Encrypt
+	Identity         string           // Name to identify as, for a receiver that only accepts certain senders
+	Resume           bool             // Cache how far each file got, so a restarted sender resumes the receiver's partial file quickly
+	SyncProgress     bool             // Deliver every progress update even if the consumer is slow, at the cost of throughput
+	Notify           bool             // Show a desktop notification (or ring the terminal bell) once the transfer ends
+	AllowRelay       bool             // Relay a small file through the signalling session if no direct connection can be made
+	Schedule         string           // Send rate limits by time of day, e.g. "09:00-17:00=1MB,17:00-09:00=10MB"
+	ChecksumSample   int64            // Only checksum this many bytes at each end of larger files, 0 for a full SHA-256
+	Follow           bool             // Keep sending what is appended to the file, like tail -f, until StopFollowing is closed
+	HashWorkers      int              // Checksum this many files of a directory at once before sending, 1 or less for one at a time as sent
+	ChannelLabel     string           // Label of the data channel file data is sent on, empty for the default; the receiver must expect the same
+	Timeout          time.Duration    // Give up on the send if it hasn't finished this long after Run was called, 0 for no limit
+	Order            string           // Sequence the files of a directory are sent in: as-listed (default), name, size-asc or size-desc
+	Nice             bool             // Yield to other traffic: small chunks, backing off when the round trip time rises
+	Report           reporter.Options // Progress and summary display options
+
+	// Glob patterns picking the files of a directory to send: only those matching an include, none matching an exclude
+	Include []string
+	Exclude []string
+
+	// Key=value tags sent with every file, a receiver can route files into subdirectories by them
+	Tags map[string]string
+
+	// Called with the transfer's metadata, which then no longer arrives as a zero-byte progress update
+	OnMetadata func(*types.FileMetadata)
+
+	// Called with the code for the receiver each time one is created, before waiting for the receiver
+	OnCode func(code string)
+
+	// Closed to end a followed file with what has been appended to it so far, the transfer then completes as usual
+	StopFollowing <-chan struct{}
+
 	// Future options can be added here:
 	// Verbose  bool
-	// Timeout  time.Duration
 }
 
 // SenderApp implements sender application logic
@@ -42,10 +85,163 @@ func NewSenderApp(
 	}
 }
 
-// Run starts the sender application with the given options
-func (s *SenderApp) Run(ctx context.Context, opts *SenderOptions) error {
+// senderSession is the connection to one receiver, a handed off transfer continues in a new session
+type senderSession struct {
+	peerConn  *transport.PeerConnection
+	sessionID string
+	exitCh    chan error // Exit conditions of this connection
+}
+
+// Run starts the sender application with the given options and returns a summary of the transfer
+func (s *SenderApp) Run(ctx context.Context, opts *SenderOptions) (*types.TransferResult, error) {
+	ctx, cancel := withTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	result, err := s.run(ctx, opts)
+	err = timeoutError(ctx, err, opts.Timeout)
+	if opts.Notify {
+		notifyCompletion("Sending", "Sent", result, err)
+	}
+	return result, err
+}
+
+// run sends the file, Run adds what happens once it has ended
+func (s *SenderApp) run(ctx context.Context, opts *SenderOptions) (*types.TransferResult, error) {
+	// Checked before a session is created, a receiver would otherwise be given a code for a send that can't start
+	if opts.Encrypt && opts.Passphrase != "" {
+		return nil, transport.ErrEncryptWithPassphrase
+	}
+
 	log.Printf("Preparing to send file: %s", opts.FilePath)
 
+	session, err := s.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	propressReporter := reporter.NewProgressReporter(opts.Report)
+
+	label := opts.ChannelLabel
+	if label == "" {
+		label = transport.DefaultChannelLabel
+	}
+
+	// Create data channel for file transfer and initialize everything
+	err = s.dataChannelService.CreateFileSenderDataChannel(ctx, session.peerConn.PeerConnection, label, transport.SendOptions{
+		FilePath:       opts.FilePath,
+		FollowSymlinks: opts.FollowSymlinks,
+		SelfCheck:      opts.SelfCheck,
+		Encrypt:        opts.Encrypt,
+		Compress:       opts.Compress,
+		CompressAlgo:   opts.CompressAlgo,
+		CompressLevel:  opts.CompressLevel,
+		Passphrase:     opts.Passphrase,
+		Identity:       opts.Identity,
+		Resume:         opts.Resume,
+		SyncProgress:   opts.SyncProgress,
+		Schedule:       opts.Schedule,
+		ChecksumSample: opts.ChecksumSample,
+		Follow:         opts.Follow,
+		HashWorkers:    opts.HashWorkers,
+		Order:          opts.Order,
+		Nice:           opts.Nice,
+		Include:        opts.Include,
+		Exclude:        opts.Exclude,
+		Tags:           opts.Tags,
+		StopFollowing:  opts.StopFollowing,
+		OnMetadata:     metadataHandler(propressReporter, opts.OnMetadata),
+	})
+	if err != nil {
+		s.closeSession(ctx, session)
+		return nil, fmt.Errorf("failed to create file sender data channel: %w", err)
+	}
+
+	if opts.PrintVerifyCode {
+		if checksum := s.dataChannelService.SendMetadata().Checksum; checksum != "" {
+			log.Printf("Verification code (read this to the receiver for --verify-code): %s", utils.FormatVerifyCode(checksum))
+		} else {
+			log.Printf("No verification code for a directory, each file is verified by its checksum")
+		}
+	}
+
+	if err := s.connect(ctx, session, opts); err != nil {
+		s.closeSession(ctx, session)
+		return nil, err
+	}
+	propressReporter.WatchConnection(connectionState(session.peerConn))
+
+	// Start file transfer in background, it outlives sessions
+	transferCh := make(chan error, 1)
+	go func() {
+		progressCh, err := s.dataChannelService.SendFile()
+		if err != nil {
+			transferCh <- err
+			return
+		}
+
+		propressReporter.StartUpdatingProgress(ctx, progressCh)
+
+		transferCh <- s.dataChannelService.SendErr()
+	}()
+
+	// Wait for any exit condition, moving to a new session whenever the receiver hands the transfer off
+	var exitErr error
+	relayed := false
+	for exited := false; !exited; {
+		select {
+		case exitErr = <-transferCh:
+			exited = true
+		case exitErr = <-session.exitCh:
+			// Connection closed or failed, without a direct path the file may still go through the signalling session
+			if exitErr != nil && opts.AllowRelay && s.useRelay(session) {
+				exitErr = nil
+				relayed = true
+				propressReporter.WatchConnection(func() string { return "relayed through the signalling session" })
+				continue
+			}
+			exited = true
+		case <-s.dataChannelService.HandoffRequested():
+			s.closeSession(ctx, session)
+			propressReporter.WatchConnection(func() string { return "waiting for the receiver taking over" })
+
+			session, err = s.handOver(ctx, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect the receiver taking over: %w", err)
+			}
+			propressReporter.WatchConnection(connectionState(session.peerConn))
+		case <-ctx.Done():
+			exitErr = ctx.Err()
+			exited = true
+			if errors.Is(context.Cause(ctx), ErrTimeout) {
+				log.Printf("Send didn't finish within %v, stopping", opts.Timeout)
+			}
+			s.dataChannelService.StopSend(stopReason(ctx, opts.Timeout))
+		}
+	}
+
+	// Read the peer address while the connection is still up
+	peerAddress := session.peerConn.RemoteAddress()
+	iceRole := session.peerConn.ICERole()
+
+	s.closeSession(ctx, session)
+
+	if exitErr != nil {
+		return nil, exitErr
+	}
+
+	result := s.dataChannelService.SendResult()
+	result.PeerAddress = peerAddress
+	result.ICERole = iceRole.String()
+	if relayed {
+		result.PeerAddress = "signalling relay"
+		result.ICERole = ""
+	}
+
+	return result, nil
+}
+
+// newSession creates the peer connection for the next receiver
+func (s *SenderApp) newSession(ctx context.Context) (*senderSession, error) {
 	// Single channel for all exit conditions
 	exitCh := make(chan error, 1)
 
@@ -71,61 +267,74 @@ func (s *SenderApp) Run(ctx context.Context, opts *SenderOptions) error {
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create peer connection: %w", err)
+		return nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
 
-	// Cleanup function
-	cleanup := func(sessionID string) {
-		if err := peerConn.Close(); err != nil {
-			log.Printf("Error closing peer connection: %v", err)
-		}
+	return &senderSession{peerConn: peerConn, exitCh: exitCh}, nil
+}
 
-		if sessionID != "" {
-			if err := s.signalingService.ClearSession(ctx, sessionID); err != nil {
-				log.Printf("Warning: Failed to clear Firebase session: %v", err)
-			}
+// connect signals session's offer to the receiver and waits for its answer
+func (s *SenderApp) connect(ctx context.Context, session *senderSession, opts *SenderOptions) error {
+	if opts.PrintFingerprint {
+		fingerprint, err := session.peerConn.LocalFingerprint()
+		if err != nil {
+			return fmt.Errorf("failed to get certificate fingerprint: %w", err)
 		}
+		log.Printf("Certificate fingerprint (give this to the receiver for --pin-fingerprint): %s", fingerprint)
 	}
 
-	// Create data channel for file transfer and initialize everything
-	err = s.dataChannelService.CreateFileSenderDataChannel(ctx, peerConn.PeerConnection, "fileTransfer", opts.FilePath)
+	// Start signalling process
+	sessionID, err := s.signalingService.StartSenderSignallingProcess(ctx, session.peerConn.PeerConnection, opts.OnCode)
+	session.sessionID = sessionID
 	if err != nil {
-		cleanup("")
-		return fmt.Errorf("failed to create file sender data channel: %w", err)
+		return fmt.Errorf("failed during signalling process: %w", err)
 	}
 
-	// Start signalling process
-	sessionID, err := s.signalingService.StartSenderSignallingProcess(ctx, peerConn.PeerConnection)
-	if err != nil {
-		cleanup(sessionID)
+	return nil
+}
 
-		return fmt.Errorf("failed during signalling process: %w", err)
+// handOver starts a session with the receiver taking over a handed off transfer, under a new code
+func (s *SenderApp) handOver(ctx context.Context, opts *SenderOptions) (*senderSession, error) {
+	session, err := s.newSession(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	// Start file transfer in background
-	go func() {
-		progressCh, err := s.dataChannelService.SendFile()
-		if err != nil {
-			exitCh <- err
-			return
-		}
+	if err := s.dataChannelService.HandOver(session.peerConn.PeerConnection); err != nil {
+		s.closeSession(ctx, session)
+		return nil, fmt.Errorf("failed to create file sender data channel: %w", err)
+	}
 
-		propressReporter := reporter.NewProgressReporter()
-		propressReporter.StartUpdatingProgress(ctx, progressCh)
+	log.Printf("Waiting for another receiver to take over the transfer with a new code")
+	if err := s.connect(ctx, session, opts); err != nil {
+		s.closeSession(ctx, session)
+		return nil, err
+	}
 
-		exitCh <- nil
-	}()
+	return session, nil
+}
 
-	// Wait for any exit condition
-	var exitErr error
-	select {
-	case exitErr = <-exitCh:
-		// Transfer completed, connection closed, or error
-	case <-ctx.Done():
-		exitErr = ctx.Err()
+// useRelay moves the transfer to the signalling session after the peer connection failed, if it hasn't started yet
+func (s *SenderApp) useRelay(session *senderSession) bool {
+	relay, err := s.signalingService.Relay(session.sessionID)
+	if err != nil {
+		log.Printf("Can't fall back to relaying the file: %v", err)
+		return false
 	}
 
-	cleanup(sessionID)
+	return s.dataChannelService.SendViaRelay(relay)
+}
+
+// closeSession closes the session's peer connection and clears its signalling session
+func (s *SenderApp) closeSession(ctx context.Context, session *senderSession) {
+	if err := session.peerConn.Close(); err != nil {
+		log.Printf("Error closing peer connection: %v", err)
+	}
 
-	return exitErr
+	// The session is cleared even when ctx has been cancelled or timed out
+	if session.sessionID != "" {
+		if err := s.signalingService.ClearSession(context.WithoutCancel(ctx), session.sessionID); err != nil {
+			log.Printf("Warning: Failed to clear Firebase session: %v", err)
+		}
+	}
 }
@@ -0,0 +1,27 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"yapfs/internal/transport"
+)
+
+func TestSenderRejectsEncryptWithPassphrase(t *testing.T) {
+	exchangeDir := t.TempDir()
+	cfg, peerService, dataChannelService, signalingService := newTestServices(exchangeDir)
+	_, err := NewSenderApp(cfg, peerService, dataChannelService, signalingService).Run(context.Background(), &SenderOptions{
+		FilePath:   "file.bin",
+		Encrypt:    true,
+		Passphrase: "secret",
+	})
+	if !errors.Is(err, transport.ErrEncryptWithPassphrase) {
+		t.Fatalf("Run() error = %v, want %v", err, transport.ErrEncryptWithPassphrase)
+	}
+	if _, err := os.Stat(filepath.Join(exchangeDir, "offer.txt")); !os.IsNotExist(err) {
+		t.Fatalf("an offer was written for a send that can't start: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTimeout is returned when a send or receive is stopped for not completing within its Timeout
+var ErrTimeout = errors.New("transfer timed out")
+
+// ErrInterrupted is what the peer is told when a transfer is stopped by cancelling its context, e.g. on Ctrl-C
+var ErrInterrupted = errors.New("transfer interrupted")
+
+// withTimeout bounds ctx by timeout if it is above 0, ErrTimeout is then the cause of its expiry
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, ErrTimeout)
+}
+
+// timeoutError reports err as ErrTimeout if ctx ran out of time, wherever the transfer had got to
+func timeoutError(ctx context.Context, err error, timeout time.Duration) error {
+	if err == nil || errors.Is(err, ErrTimeout) || !errors.Is(context.Cause(ctx), ErrTimeout) {
+		return err
+	}
+	return fmt.Errorf("%w after %v: %w", ErrTimeout, timeout, err)
+}
+
+// stopReason returns why a transfer whose ctx is done was stopped, to tell the peer
+func stopReason(ctx context.Context, timeout time.Duration) error {
+	if errors.Is(context.Cause(ctx), ErrTimeout) {
+		return fmt.Errorf("%w after %v", ErrTimeout, timeout)
+	}
+	return ErrInterrupted
+}
@@ -2,22 +2,77 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+
+	"yapfs/pkg/utils"
 
 	"github.com/pion/webrtc/v4"
 )
 
+const (
+	// MinChunkSize is the smallest chunk size accepted, smaller chunks are mostly message framing
+	MinChunkSize = 256
+	// MaxChunkSize is the largest chunk size accepted, larger messages aren't carried by every SCTP implementation
+	MaxChunkSize = 256 * 1024
+	// EfficientChunkSize is the chunk size below which per-message overhead noticeably slows a transfer
+	EfficientChunkSize = 1024
+)
+
+// Signalling backends, the servers peers exchange the offer and answer through
+const (
+	SignalingFirebase = "firebase"
+	SignalingHTTP     = "http"
+)
+
 var (
 	ErrInvalidBufferConfig        = errors.New("buffered amount low threshold must be less than max buffered amount")
-	ErrInvalidPacketSize          = errors.New("packet size must be greater than 0")
+	ErrInvalidPacketSize          = errors.New("chunk size is too small")
+	ErrChunkSizeTooLarge          = errors.New("chunk size is too large")
 	ErrInvalidFirebaseConfig      = errors.New("Firebase credentials path must be set")
 	ErrInvalidFirebaseProjectID   = errors.New("Firebase project ID must be set")
 	ErrInvalidFirebaseDatabaseURL = errors.New("Firebase database URL must be set")
+	ErrInvalidAnswerInitialDelay  = errors.New("answer initial delay must not be negative")
+	ErrInvalidOfferWait           = errors.New("offer wait must not be negative")
+	ErrInvalidSignalingBackend    = errors.New("signaling backend must be firebase or http")
+	ErrInvalidSignalingURL        = errors.New("signaling URL must be an http or https URL")
+	ErrInvalidMimeRoute           = errors.New("invalid MIME route")
+	ErrInvalidMessageConcurrency  = errors.New("control message concurrency must be greater than 0")
+	ErrInvalidMinICECandidates    = errors.New("min ICE candidates must not be negative")
+	ErrInvalidMaxMetadataSize     = errors.New("max metadata size must be greater than 0")
+	ErrInvalidMaxChunkSize        = errors.New("max chunk size must be 0 or at least the minimum chunk size")
+	ErrInvalidReadSize            = errors.New("read size must be at least the chunk size")
+	ErrInvalidReadAhead           = errors.New("read ahead must be greater than 0")
+	ErrInvalidMaxQueuedBytes      = errors.New("max queued bytes must not be negative")
+	ErrInvalidWriteBufferSize     = errors.New("write buffer size must not be negative")
+	ErrInvalidSessionEndTimeout   = errors.New("session end timeout must be greater than 0")
+	ErrInvalidStallTimeout        = errors.New("stall timeout must be greater than 0")
+	ErrInvalidBufferWatchdog      = errors.New("buffer watchdog must not be negative")
+	ErrInvalidFlowControlTimeout  = errors.New("flow control timeout and margin must be greater than 0")
+	ErrInvalidReconnectConfig     = errors.New("reconnect attempts must not be negative and reconnect timeout must be greater than 0")
+	ErrInvalidChecksumEncoding    = errors.New("checksum encoding must be hex or base64")
+	ErrInvalidRateWindow          = errors.New("rate window must be greater than 0")
+	ErrInvalidS3PartSize          = errors.New("s3 part size must be at least 5 MB")
+	ErrInvalidRelayConfig         = errors.New("relay max bytes, chunk size, poll interval and timeout must be greater than 0")
+	ErrInvalidProxy               = errors.New("invalid proxy")
+	ErrInvalidMinFreeMemory       = errors.New("min free memory must not be negative")
 )
 
 // Config holds all application configuration
 type Config struct {
-	WebRTC   WebRTCConfig   `json:"webrtc"`
-	Firebase FirebaseConfig `json:"firebase"`
+	WebRTC    WebRTCConfig    `json:"webrtc"`
+	Signaling SignalingConfig `json:"signaling"`
+	Firebase  FirebaseConfig  `json:"firebase"`
+	Receiver  ReceiverConfig  `json:"receiver"`
+	S3        S3Config        `json:"s3"`
+	Relay     RelayConfig     `json:"relay"`
+
+	ChecksumEncoding string `json:"checksum_encoding"`  // How checksums are written in metadata and summaries: hex or base64
+	RateWindowMs     int    `json:"rate_window_ms"`     // Span of recent transfer the throughput in progress updates is measured over
+	Proxy            string `json:"proxy"`              // SOCKS5 proxy for signalling, other HTTP requests and TURN over TCP, e.g. socks5://host:1080
+	MinFreeMemoryMB  int    `json:"min_free_memory_mb"` // Memory to leave to the system, buffers are reduced to fit in the rest of what's available, 0 to not check
 }
 
 // WebRTCConfig holds WebRTC-specific configuration
@@ -26,13 +81,70 @@ type WebRTCConfig struct {
 	BufferedAmountLowThreshold uint64             `json:"buffered_amount_low_threshold"`
 	MaxBufferedAmount          uint64             `json:"max_buffered_amount"`
 	ChunkSize                  int                `json:"chunk_size"`
+	ReadSize                   int                `json:"read_size"`                   // Bytes read from disk at once, sliced into chunk_size messages
+	ReadAhead                  int                `json:"read_ahead"`                  // Chunks read ahead of the one being sent
+	ControlMessageConcurrency  int                `json:"control_message_concurrency"` // Control messages handled at once, file data stays ordered
+	MinICECandidates           int                `json:"min_ice_candidates"`          // Proceed once this many candidates are gathered, 0 waits for gathering to complete
+	ICEProceedOnSrflx          bool               `json:"ice_proceed_on_srflx"`        // Proceed once a host and a server reflexive candidate are gathered
+	TrickleICE                 bool               `json:"trickle_ice"`                 // Send candidates as they are gathered where the signalling server can carry them, instead of waiting for them all
+	StrictICERole              bool               `json:"strict_ice_role"`             // Fail the connection instead of warning when a peer isn't in the ICE role its description gives it
+	SessionEndTimeoutMs        int                `json:"session_end_timeout_ms"`      // How long the sender waits for the receiver to acknowledge the end of the session
+	StallTimeoutMs             int                `json:"stall_timeout_ms"`            // Declare the peer unreachable when queued data hasn't drained for this long
+	BufferWatchdogMs           int                `json:"buffer_watchdog_ms"`          // Warn when the send buffer stays full for this long, 0 to never warn
+	FlowControlTimeoutMs       int                `json:"flow_control_timeout_ms"`     // Longest wait for the send buffer to drain before the drain rate is known
+	FlowControlMarginMs        int                `json:"flow_control_margin_ms"`      // Slack added to the time the buffer should take to drain at the measured rate
+	ReconnectAttempts          int                `json:"reconnect_attempts"`          // Times a data channel lost mid-file is reopened to resume the file, 0 to fail right away
+	ReconnectTimeoutMs         int                `json:"reconnect_timeout_ms"`        // How long a reopened data channel may take to open
+}
+
+// SignalingConfig chooses the server peers exchange the offer and answer through
+type SignalingConfig struct {
+	Backend string `json:"backend"` // firebase (default) or http
+	URL     string `json:"url"`     // Base URL of the HTTP signalling server, for the http backend
 }
 
 // FirebaseConfig holds Firebase client configuration
 type FirebaseConfig struct {
-	ProjectID       string `json:"project_id"`
-	DatabaseURL     string `json:"database_url"`
-	CredentialsPath string `json:"credentials_path"`
+	ProjectID            string `json:"project_id"`
+	DatabaseURL          string `json:"database_url"`
+	CredentialsPath      string `json:"credentials_path"`
+	AnswerInitialDelayMs int    `json:"answer_initial_delay_ms"` // Wait before polling for the receiver's answer again after the first check
+	OfferWaitMs          int    `json:"offer_wait_ms"`           // How long the receiver keeps checking for a session the sender hasn't created yet, 0 to fail right away
+}
+
+// ReceiverConfig holds receiver-side configuration
+type ReceiverConfig struct {
+	MimeRoutes      []MimeRoute `json:"mime_routes"`       // Checked in order, the first matching route wins
+	MaxMetadataSize int         `json:"max_metadata_size"` // Largest metadata message accepted from a sender, in bytes
+	MaxChunkSize    int         `json:"max_chunk_size"`    // Largest chunk the sender may use, 0 for no limit
+	MaxQueuedBytes  int         `json:"max_queued_bytes"`  // Ask the sender for smaller chunks once this much file data waits to be written, 0 to never ask
+	WriteBufferSize int         `json:"write_buffer_size"` // Bytes of received data gathered before writing them to disk, 0 writes each chunk as it arrives
+}
+
+// S3Config holds the S3-compatible storage used when receiving to an s3:// destination.
+// Empty credentials, region and endpoint fall back to the standard AWS environment variables.
+type S3Config struct {
+	Endpoint        string `json:"endpoint"`          // Base URL of the storage service, empty for AWS
+	Region          string `json:"region"`            // Region requests are signed for, us-east-1 if unset anywhere
+	AccessKeyID     string `json:"access_key_id"`     // Access key, AWS_ACCESS_KEY_ID if empty
+	SecretAccessKey string `json:"secret_access_key"` // Secret key, AWS_SECRET_ACCESS_KEY if empty
+	SessionToken    string `json:"session_token"`     // Only needed for temporary credentials
+	ForcePathStyle  bool   `json:"force_path_style"`  // Address buckets as endpoint/bucket, which most non-AWS servers need
+	PartSizeMB      int    `json:"part_size_mb"`      // Size of each part of a multipart upload
+}
+
+// RelayConfig limits the fallback that carries file data through the signalling session when the peers can't connect directly
+type RelayConfig struct {
+	MaxBytes       int64 `json:"max_bytes"`        // Largest file that may be relayed, its data is stored in the session on the way
+	ChunkSize      int   `json:"chunk_size"`       // File data per relayed message in bytes, before base64 encoding
+	PollIntervalMs int   `json:"poll_interval_ms"` // How often the session is checked for the next relayed message
+	TimeoutMs      int   `json:"timeout_ms"`       // Longest wait for the next relayed message before giving up
+}
+
+// MimeRoute maps a MIME type pattern to a destination subdirectory
+type MimeRoute struct {
+	Pattern string `json:"pattern"` // MIME type or wildcard pattern, e.g. "application/pdf" or "image/*"
+	Dir     string `json:"dir"`     // Subdirectory of the destination path, e.g. "pdfs"
 }
 
 // NewDefaultConfig returns a configuration with sensible defaults
@@ -47,11 +159,41 @@ func NewDefaultConfig() *Config {
 			BufferedAmountLowThreshold: 512 * 1024,  // 512 KB
 			MaxBufferedAmount:          1024 * 1024, // 1 MB
 			ChunkSize:                  1024,        // 1 KB packets
+			ReadSize:                   1024 * 1024, // 1 MB
+			ReadAhead:                  16,
+			ControlMessageConcurrency:  4,
+			TrickleICE:                 true,
+			SessionEndTimeoutMs:        5000,  // 5 seconds
+			StallTimeoutMs:             10000, // 10 seconds
+			BufferWatchdogMs:           2000,  // 2 seconds
+			FlowControlTimeoutMs:       30000, // 30 seconds
+			FlowControlMarginMs:        5000,  // 5 seconds
+			ReconnectAttempts:          3,
+			ReconnectTimeoutMs:         10000, // 10 seconds
+		},
+		Receiver: ReceiverConfig{
+			MaxMetadataSize: 64 * 1024, // 64 KB
+		},
+		ChecksumEncoding: utils.ChecksumHex,
+		RateWindowMs:     3000, // 3 seconds
+		MinFreeMemoryMB:  64,
+		S3: S3Config{
+			PartSizeMB: 8,
+		},
+		Relay: RelayConfig{
+			MaxBytes:       10 * 1024 * 1024, // 10 MB
+			ChunkSize:      256 * 1024,       // 256 KB
+			PollIntervalMs: 250,
+			TimeoutMs:      60000, // 1 minute
+		},
+		Signaling: SignalingConfig{
+			Backend: SignalingFirebase,
 		},
 		Firebase: FirebaseConfig{
-			ProjectID:       "",
-			DatabaseURL:     "",
-			CredentialsPath: "",
+			ProjectID:            "",
+			DatabaseURL:          "",
+			CredentialsPath:      "",
+			AnswerInitialDelayMs: 500,
 		},
 	}
 }
@@ -61,17 +203,222 @@ func (c *Config) Validate() error {
 	if c.WebRTC.BufferedAmountLowThreshold >= c.WebRTC.MaxBufferedAmount {
 		return ErrInvalidBufferConfig
 	}
-	if c.WebRTC.ChunkSize <= 0 {
-		return ErrInvalidPacketSize
+	if c.WebRTC.ChunkSize < MinChunkSize {
+		return fmt.Errorf("%w: %d bytes, the minimum is %d bytes", ErrInvalidPacketSize, c.WebRTC.ChunkSize, MinChunkSize)
+	}
+	if c.WebRTC.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("%w: %d bytes, the maximum is %d bytes", ErrChunkSizeTooLarge, c.WebRTC.ChunkSize, MaxChunkSize)
+	}
+	if c.WebRTC.ReadSize < c.WebRTC.ChunkSize {
+		return fmt.Errorf("%w: %d bytes, the chunk size is %d bytes", ErrInvalidReadSize, c.WebRTC.ReadSize, c.WebRTC.ChunkSize)
+	}
+	if c.WebRTC.ReadAhead <= 0 {
+		return ErrInvalidReadAhead
+	}
+	if c.WebRTC.ControlMessageConcurrency <= 0 {
+		return ErrInvalidMessageConcurrency
+	}
+	if c.WebRTC.MinICECandidates < 0 {
+		return ErrInvalidMinICECandidates
+	}
+	if c.WebRTC.SessionEndTimeoutMs <= 0 {
+		return ErrInvalidSessionEndTimeout
+	}
+	if c.WebRTC.StallTimeoutMs <= 0 {
+		return ErrInvalidStallTimeout
+	}
+	if c.WebRTC.BufferWatchdogMs < 0 {
+		return ErrInvalidBufferWatchdog
+	}
+	if c.WebRTC.FlowControlTimeoutMs <= 0 || c.WebRTC.FlowControlMarginMs <= 0 {
+		return ErrInvalidFlowControlTimeout
+	}
+	if c.WebRTC.ReconnectAttempts < 0 || c.WebRTC.ReconnectTimeoutMs <= 0 {
+		return ErrInvalidReconnectConfig
+	}
+	if c.Signaling.Backend != "" && c.Signaling.Backend != SignalingFirebase && c.Signaling.Backend != SignalingHTTP {
+		return ErrInvalidSignalingBackend
+	}
+	if c.Firebase.AnswerInitialDelayMs < 0 {
+		return ErrInvalidAnswerInitialDelay
+	}
+	if c.Firebase.OfferWaitMs < 0 {
+		return ErrInvalidOfferWait
+	}
+	if c.ChecksumEncoding != utils.ChecksumHex && c.ChecksumEncoding != utils.ChecksumBase64 {
+		return ErrInvalidChecksumEncoding
+	}
+	if c.RateWindowMs <= 0 {
+		return ErrInvalidRateWindow
+	}
+	if c.MinFreeMemoryMB < 0 {
+		return ErrInvalidMinFreeMemory
+	}
+	if c.Proxy != "" {
+		if _, err := utils.ParseProxyURL(c.Proxy); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidProxy, err)
+		}
+	}
+	if c.Receiver.MaxMetadataSize <= 0 {
+		return ErrInvalidMaxMetadataSize
+	}
+	if c.Receiver.MaxChunkSize < 0 || (c.Receiver.MaxChunkSize > 0 && c.Receiver.MaxChunkSize < MinChunkSize) {
+		return fmt.Errorf("%w: %d bytes, the minimum is %d bytes", ErrInvalidMaxChunkSize, c.Receiver.MaxChunkSize, MinChunkSize)
+	}
+	if c.Receiver.MaxQueuedBytes < 0 {
+		return ErrInvalidMaxQueuedBytes
+	}
+	if c.Receiver.WriteBufferSize < 0 {
+		return ErrInvalidWriteBufferSize
+	}
+	if c.S3.PartSizeMB < 5 {
+		return ErrInvalidS3PartSize
+	}
+	if c.Relay.MaxBytes <= 0 || c.Relay.ChunkSize <= 0 || c.Relay.PollIntervalMs <= 0 || c.Relay.TimeoutMs <= 0 {
+		return ErrInvalidRelayConfig
 	}
-	if c.Firebase.CredentialsPath == "" {
+	for _, route := range c.Receiver.MimeRoutes {
+		if err := route.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateSignaling ensures the configured signalling server can be connected to, it is only needed when signalling
+// through it rather than exchanging files
+func (c *Config) ValidateSignaling() error {
+	if c.Signaling.Backend != SignalingHTTP {
+		return c.Firebase.Validate()
+	}
+
+	signalingURL, err := url.Parse(c.Signaling.URL)
+	if err != nil || (signalingURL.Scheme != "http" && signalingURL.Scheme != "https") || signalingURL.Host == "" {
+		return ErrInvalidSignalingURL
+	}
+	return nil
+}
+
+// Validate ensures Firebase can be connected to, it is only needed when signalling through it
+func (f FirebaseConfig) Validate() error {
+	if f.CredentialsPath == "" {
 		return ErrInvalidFirebaseConfig
 	}
-	if c.Firebase.ProjectID == "" {
+	if f.ProjectID == "" {
 		return ErrInvalidFirebaseProjectID
 	}
-	if c.Firebase.DatabaseURL == "" {
+	if f.DatabaseURL == "" {
 		return ErrInvalidFirebaseDatabaseURL
 	}
 	return nil
 }
+
+// Warnings describes settings that are valid but likely to make transfers slow
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.WebRTC.ChunkSize < EfficientChunkSize {
+		warnings = append(warnings, fmt.Sprintf("chunk size of %d bytes is below %d bytes, per-message overhead will slow the transfer down", c.WebRTC.ChunkSize, EfficientChunkSize))
+	}
+	// The flow control deadline is at least its margin, a stuck buffer can fail the transfer that soon
+	if limit := min(c.WebRTC.StallTimeoutMs, c.WebRTC.FlowControlMarginMs); c.WebRTC.BufferWatchdogMs >= limit {
+		warnings = append(warnings, fmt.Sprintf("buffer watchdog of %d ms is not below the stall timeout and flow control margin (%d ms), the transfer may fail before it can warn", c.WebRTC.BufferWatchdogMs, limit))
+	}
+	if c.Receiver.MaxChunkSize > 0 && c.Receiver.MaxChunkSize < EfficientChunkSize {
+		warnings = append(warnings, fmt.Sprintf("max chunk size of %d bytes is below %d bytes, per-message overhead will slow the transfer down", c.Receiver.MaxChunkSize, EfficientChunkSize))
+	}
+	return warnings
+}
+
+// Shares of the memory left after MinFreeMemoryMB that each buffer may take, they can all be full at once: data queued
+// on the data channel, the chunk being read or written, file data waiting to be written and an S3 part being uploaded
+const (
+	bufferedShare = 4
+	chunkShare    = 16
+	queuedShare   = 4
+	s3PartShare   = 4
+)
+
+// LimitToMemory reduces the sizes of the in-flight buffers and chunks that don't fit in available bytes of memory less
+// MinFreeMemoryMB, never below the smallest valid sizes, and describes each reduction. The configuration stays valid.
+func (c *Config) LimitToMemory(available uint64) []string {
+	reserve := uint64(c.MinFreeMemoryMB) * 1024 * 1024
+	var budget uint64
+	if available > reserve {
+		budget = available - reserve
+	}
+
+	var reductions []string
+	fits := fmt.Sprintf("to fit in the memory available (%s, keeping %d MB free)", utils.FormatFileSize(int64(available)), c.MinFreeMemoryMB)
+	reduce := func(setting string, value *int, limit, floor uint64) {
+		limit = max(limit, floor)
+		if uint64(*value) <= limit {
+			return
+		}
+		reductions = append(reductions, fmt.Sprintf("%s reduced from %d to %d %s", setting, *value, limit, fits))
+		*value = int(limit)
+	}
+
+	reduce("chunk size", &c.WebRTC.ChunkSize, budget/chunkShare, MinChunkSize)
+	reduce("read size", &c.WebRTC.ReadSize, budget/chunkShare, uint64(c.WebRTC.ChunkSize))
+	if c.Receiver.MaxChunkSize > 0 {
+		reduce("max chunk size", &c.Receiver.MaxChunkSize, budget/chunkShare, MinChunkSize)
+	}
+	if c.Receiver.MaxQueuedBytes > 0 {
+		reduce("max queued bytes", &c.Receiver.MaxQueuedBytes, budget/queuedShare, uint64(c.WebRTC.ChunkSize))
+	}
+	reduce("s3 part size (MB)", &c.S3.PartSizeMB, budget/s3PartShare/(1024*1024), 5)
+
+	// The low threshold has to stay below the maximum, halving it keeps the buffer refilled as often as before
+	if limit := max(budget/bufferedShare, 2*uint64(c.WebRTC.ChunkSize)); c.WebRTC.MaxBufferedAmount > limit {
+		reductions = append(reductions, fmt.Sprintf("max buffered amount reduced from %d to %d %s", c.WebRTC.MaxBufferedAmount, limit, fits))
+		c.WebRTC.MaxBufferedAmount = limit
+		if c.WebRTC.BufferedAmountLowThreshold >= limit {
+			c.WebRTC.BufferedAmountLowThreshold = limit / 2
+		}
+	}
+	return reductions
+}
+
+// redacted replaces a secret that is set, so printing the config shows it's there without revealing it
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the config with credentials replaced, safe to print
+func (c *Config) Redacted() *Config {
+	copied := *c
+
+	copied.WebRTC.ICEServers = make([]webrtc.ICEServer, len(c.WebRTC.ICEServers))
+	for i, server := range c.WebRTC.ICEServers {
+		if server.Credential != nil {
+			server.Credential = redacted
+		}
+		copied.WebRTC.ICEServers[i] = server
+	}
+
+	if copied.S3.SecretAccessKey != "" {
+		copied.S3.SecretAccessKey = redacted
+	}
+	if copied.S3.SessionToken != "" {
+		copied.S3.SessionToken = redacted
+	}
+	if proxyURL, err := url.Parse(c.Proxy); err == nil && proxyURL.User != nil {
+		if _, hasPassword := proxyURL.User.Password(); hasPassword {
+			proxyURL.User = url.UserPassword(proxyURL.User.Username(), redacted)
+			copied.Proxy = proxyURL.String()
+		}
+	}
+	return &copied
+}
+
+// Validate ensures the MIME route has a valid pattern and stays inside the destination directory
+func (r MimeRoute) Validate() error {
+	if r.Pattern == "" {
+		return fmt.Errorf("%w: pattern must be set", ErrInvalidMimeRoute)
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("%w: bad pattern %q: %v", ErrInvalidMimeRoute, r.Pattern, err)
+	}
+	if !filepath.IsLocal(r.Dir) {
+		return fmt.Errorf("%w: directory %q for pattern %q must be a relative path inside the destination", ErrInvalidMimeRoute, r.Dir, r.Pattern)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Package netsim simulates adverse network conditions on a data channel link, for tests.
+// It wraps the send side of a channel with injected latency, jitter and message loss
+// so transfer handling (checksums, resume, timeouts) can be exercised without a bad network.
+package netsim
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flushPollInterval is how often Flush checks whether all messages have been delivered
+const flushPollInterval = 10 * time.Millisecond
+
+// queueSize bounds the number of in-flight messages, Send blocks once it is reached
+const queueSize = 1024
+
+// Conditions describes the impairments applied to a link
+type Conditions struct {
+	Latency     time.Duration // Fixed delay added to every message
+	Jitter      time.Duration // Random extra delay in [0, Jitter) added to every message
+	DropRate    float64       // Probability in [0, 1] that a message is silently dropped
+	DropControl bool          // Also drop text (control) messages, by default only binary file data is dropped
+	Retransmit  time.Duration // Deliver a dropped message this much later instead of losing it, like SCTP resending a lost packet
+	Window      int           // Most bytes in flight at once, sending blocks past it like on a full congestion window, 0 for no limit
+	Seed        int64         // Seed for the random source, the same seed reproduces the same drops and delays
+}
+
+// Enabled reports whether the conditions change anything about the link
+func (c Conditions) Enabled() bool {
+	return c.Latency > 0 || c.Jitter > 0 || c.DropRate > 0
+}
+
+// MessageSender is the send side of a data channel
+type MessageSender interface {
+	Send(data []byte) error
+	SendText(text string) error
+}
+
+// pendingMessage is a message waiting for its delivery time
+type pendingMessage struct {
+	data      []byte
+	isText    bool
+	deliverAt time.Time
+}
+
+// Link wraps a MessageSender and delivers messages to it according to its conditions.
+// Delivery order is preserved, like on an ordered data channel.
+type Link struct {
+	next     MessageSender
+	cond     Conditions
+	queue    chan pendingMessage
+	done     chan struct{}
+	inFlight atomic.Int64 // Messages queued but not yet handed to the wrapped sender
+	resent   atomic.Int64 // Messages dropped and delivered again after Retransmit
+
+	mu          sync.Mutex
+	rng         *rand.Rand
+	lastDeliver time.Time
+	err         error // First error returned by the wrapped sender
+	closeOnce   sync.Once
+
+	windowMu    sync.Mutex
+	windowFree  *sync.Cond // Signalled when bytes in flight are delivered or the link closes
+	windowBytes int        // Bytes in flight, counted against cond.Window
+}
+
+// NewLink creates a link that applies cond to messages before passing them to next
+func NewLink(next MessageSender, cond Conditions) *Link {
+	l := &Link{
+		next:  next,
+		cond:  cond,
+		queue: make(chan pendingMessage, queueSize),
+		done:  make(chan struct{}),
+		rng:   rand.New(rand.NewSource(cond.Seed)),
+	}
+	l.windowFree = sync.NewCond(&l.windowMu)
+
+	go l.deliverLoop()
+
+	return l
+}
+
+// Send queues a binary message for delayed delivery
+func (l *Link) Send(data []byte) error {
+	return l.enqueue(append([]byte(nil), data...), false)
+}
+
+// SendText queues a text message for delayed delivery
+func (l *Link) SendText(text string) error {
+	return l.enqueue([]byte(text), true)
+}
+
+// Flush blocks until every queued message has been handed to the wrapped sender
+func (l *Link) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+
+	for l.inFlight.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Retransmitted returns how many messages were dropped and delivered again so far
+func (l *Link) Retransmitted() int64 {
+	return l.resent.Load()
+}
+
+// Close stops delivery, messages still in flight are lost
+func (l *Link) Close() {
+	if l == nil {
+		return
+	}
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.windowMu.Lock()
+		l.windowFree.Broadcast()
+		l.windowMu.Unlock()
+	})
+}
+
+// acquireWindow waits for room for n more bytes in flight, it returns false if the link closed meanwhile.
+// A message larger than the whole window goes once nothing else is in flight.
+func (l *Link) acquireWindow(n int) bool {
+	if l.cond.Window <= 0 {
+		return true
+	}
+
+	l.windowMu.Lock()
+	defer l.windowMu.Unlock()
+	for l.windowBytes > 0 && l.windowBytes+n > l.cond.Window {
+		select {
+		case <-l.done:
+			return false
+		default:
+		}
+		l.windowFree.Wait()
+	}
+	l.windowBytes += n
+	return true
+}
+
+// releaseWindow frees the room n bytes took once they are delivered or lost
+func (l *Link) releaseWindow(n int) {
+	if l.cond.Window <= 0 {
+		return
+	}
+
+	l.windowMu.Lock()
+	l.windowBytes -= n
+	l.windowFree.Broadcast()
+	l.windowMu.Unlock()
+}
+
+// enqueue decides the fate of a message and schedules it
+func (l *Link) enqueue(data []byte, isText bool) error {
+	if !l.acquireWindow(len(data)) {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.err != nil {
+		err := l.err
+		l.mu.Unlock()
+		l.releaseWindow(len(data))
+		return err
+	}
+
+	delay := l.cond.Latency
+	if l.cond.Jitter > 0 {
+		delay += time.Duration(l.rng.Int63n(int64(l.cond.Jitter)))
+	}
+
+	// Lose the message like a lossy network would, silently unless it is sent again
+	if (!isText || l.cond.DropControl) && l.rng.Float64() < l.cond.DropRate {
+		if l.cond.Retransmit <= 0 {
+			l.mu.Unlock()
+			l.releaseWindow(len(data))
+			return nil
+		}
+		delay += l.cond.Retransmit
+		l.resent.Add(1)
+	}
+
+	// Never deliver before an earlier message, the channel is ordered
+	deliverAt := time.Now().Add(delay)
+	if deliverAt.Before(l.lastDeliver) {
+		deliverAt = l.lastDeliver
+	}
+	l.lastDeliver = deliverAt
+	l.mu.Unlock()
+
+	l.inFlight.Add(1)
+	select {
+	case l.queue <- pendingMessage{data: data, isText: isText, deliverAt: deliverAt}:
+	case <-l.done:
+		l.inFlight.Add(-1)
+		l.releaseWindow(len(data))
+	}
+	return nil
+}
+
+// deliverLoop hands messages to the wrapped sender once their delivery time has come
+func (l *Link) deliverLoop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		var msg pendingMessage
+		select {
+		case msg = <-l.queue:
+		case <-l.done:
+			return
+		}
+
+		if wait := time.Until(msg.deliverAt); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-l.done:
+				return
+			}
+		}
+
+		var err error
+		if msg.isText {
+			err = l.next.SendText(string(msg.data))
+		} else {
+			err = l.next.Send(msg.data)
+		}
+
+		l.inFlight.Add(-1)
+		l.releaseWindow(len(msg.data))
+
+		if err != nil {
+			l.mu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"yapfs/internal/s3"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// Content-defined chunk sizes. Boundaries are cut where the content says so (FastCDC with normalized chunking),
+// so an insertion only changes the chunks around it and the rest still match a copy of the file without it.
+const (
+	cdcMinSize = 16 * 1024  // No boundary is cut before this many bytes
+	cdcAvgSize = 64 * 1024  // Boundaries are cut at about this size on average
+	cdcMaxSize = 256 * 1024 // A boundary is forced at this size
+)
+
+// Boundary masks: harder to match before the average size and easier after it, which keeps chunk sizes close
+// to the average. The top bits of the gear hash depend on the last 64 bytes, the low bits only on the last few.
+const (
+	cdcMaskSmall uint64 = 0xffffc00000000000 // Top 18 bits
+	cdcMaskLarge uint64 = 0xfffc000000000000 // Top 14 bits
+)
+
+// gearTable maps each byte to a random value for the rolling hash. It is generated from a fixed seed,
+// sender and receiver must cut the same content at the same places.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x79617066732d6364) // "yapfs-cd"
+	for i := range table {
+		// SplitMix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cdcCutPoint returns the length of the chunk at the start of data, which holds at most cdcMaxSize bytes
+func cdcCutPoint(data []byte) int {
+	n := min(len(data), cdcMaxSize)
+	if n <= cdcMinSize {
+		return n
+	}
+
+	var fingerprint uint64
+	i := cdcMinSize
+	for normal := min(n, cdcAvgSize); i < normal; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&cdcMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&cdcMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// ChunkHash identifies a content-defined chunk by the first half of its SHA-256, in hex
+func ChunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// contentChunker splits a stream into content-defined chunks
+type contentChunker struct {
+	r     io.Reader
+	buf   []byte
+	start int // Start of the data not yet chunked
+	end   int // End of the data read into buf
+	eof   bool
+}
+
+// newContentChunker creates a chunker reading from r
+func newContentChunker(r io.Reader) *contentChunker {
+	return &contentChunker{r: r, buf: make([]byte, cdcMaxSize)}
+}
+
+// next returns the next chunk, or io.EOF once the stream is exhausted
+func (c *contentChunker) next() ([]byte, error) {
+	// A boundary can only be found with a full window ahead, or with the rest of the stream
+	if c.end-c.start < cdcMaxSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cdcCutPoint(c.buf[c.start:c.end])
+	chunk := make([]byte, n)
+	copy(chunk, c.buf[c.start:c.start+n])
+	c.start += n
+	return chunk, nil
+}
+
+// startReadingContent reads the file in content-defined chunks, each with its ChunkHash.
+// Closing stop makes reading end and the source close, even with chunks nobody is left to take.
+func (r *readerService) startReadingContent(reader *fileReader, stop <-chan struct{}) (<-chan DataChunk, <-chan error) {
+	dataCh := make(chan DataChunk, 1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(dataCh)
+		defer close(errCh)
+
+		if reader.source == nil {
+			send(dataCh, DataChunk{Data: nil, EOF: true}, stop)
+			return
+		}
+
+		content, err := reader.source.Open(reader.offset)
+		if err != nil {
+			send(errCh, fmt.Errorf("failed to open %s: %w", reader.filePath, err), stop)
+			return
+		}
+		defer content.Close()
+
+		chunker := newContentChunker(content)
+		for {
+			data, err := chunker.next()
+			if err == io.EOF {
+				send(dataCh, DataChunk{Data: nil, EOF: true}, stop)
+				return
+			}
+			if err != nil {
+				send(errCh, fmt.Errorf("failed to read file: %w", err), stop)
+				return
+			}
+
+			if !send(dataCh, DataChunk{Data: data, Hash: ChunkHash(data)}, stop) {
+				return
+			}
+		}
+	}()
+
+	return dataCh, errCh
+}
+
+// chunkLocation is where a content-defined chunk lies in a file
+type chunkLocation struct {
+	offset int64
+	size   int
+}
+
+// DedupSource is an existing copy of a file being received, split into content-defined chunks.
+// Chunks the sender finds in it are copied from here instead of being sent.
+type DedupSource struct {
+	file   *os.File
+	path   string
+	hashes []string                 // Chunk hashes in file order, duplicates left out
+	chunks map[string]chunkLocation // Where each chunk lies in the file
+}
+
+// openDedupSource chunks the existing file at path, returning nil if there is no regular, non-empty file to reuse
+func (f *FileService) openDedupSource(path string) (*DedupSource, error) {
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing file info: %w", err)
+	}
+	if !stat.Mode().IsRegular() || stat.Size() == 0 {
+		return nil, nil
+	}
+
+	file, err := f.openReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open existing file: %w", err)
+	}
+
+	source := &DedupSource{file: file, path: path, chunks: make(map[string]chunkLocation)}
+	chunker := newContentChunker(file)
+	var offset int64
+	for {
+		data, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read existing file: %w", err)
+		}
+
+		hash := ChunkHash(data)
+		if _, ok := source.chunks[hash]; !ok {
+			source.chunks[hash] = chunkLocation{offset: offset, size: len(data)}
+			source.hashes = append(source.hashes, hash)
+		}
+		offset += int64(len(data))
+	}
+
+	log.Printf("Indexed existing file %s for reuse: %d chunks, %s", path, len(source.hashes), utils.FormatFileSize(offset))
+	return source, nil
+}
+
+// Hashes returns the hashes of the chunks in the existing file
+func (s *DedupSource) Hashes() []string {
+	return s.hashes
+}
+
+// Read returns the chunk with the given hash from the existing file, checking it still has that content
+func (s *DedupSource) Read(hash string) ([]byte, error) {
+	location, ok := s.chunks[hash]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s is not in %s", hash, s.path)
+	}
+
+	data := make([]byte, location.size)
+	if _, err := s.file.ReadAt(data, location.offset); err != nil {
+		return nil, fmt.Errorf("failed to read chunk from %s: %w", s.path, err)
+	}
+	if ChunkHash(data) != hash {
+		return nil, fmt.Errorf("%s changed while it was being reused", s.path)
+	}
+	return data, nil
+}
+
+// Close closes the existing file
+func (s *DedupSource) Close() error {
+	return s.file.Close()
+}
+
+// StartReadingContent starts reading the prepared file in content-defined chunks, for a receiver with a copy to reuse
+func (d *DataProcessor) StartReadingContent(stop <-chan struct{}) (<-chan DataChunk, <-chan error) {
+	if d.currentReader == nil {
+		return nil, nil
+	}
+
+	return d.readerService.startReadingContent(d.currentReader, stop)
+}
+
+// OpenDedupSource indexes the existing file the incoming one would replace, so matching chunks can be reused.
+// It returns nil if there is nothing to reuse.
+func (d *DataProcessor) OpenDedupSource(destDir string, metadata *types.FileMetadata, opts WriterOptions) (*DedupSource, error) {
+	if s3.IsURL(destDir) || metadata.SymlinkTarget != "" {
+		return nil, nil
+	}
+
+	return d.fileService.openDedupSource(d.writerService.resolveDestPath(destDir, metadata, opts))
+}
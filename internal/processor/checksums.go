@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// hashProgressInterval is how often checksumming a directory up front logs how far it got
+const hashProgressInterval = time.Second
+
+// hashedFile is a checksum worked out before its file was sent, only used while the file is unchanged
+type hashedFile struct {
+	size     int64
+	modTime  time.Time
+	checksum string
+	sample   int64
+}
+
+// HashFiles checksums the files of a directory up front, workers of them at once, so each file is ready to send
+// without being read first. Symlinks sent as links have nothing to checksum and are left out.
+func (d *DataProcessor) HashFiles(entries []DirectoryEntry, workers int, followSymlinks bool) error {
+	var paths []string
+	var total int64
+	for _, entry := range entries {
+		if !followSymlinks {
+			isLink, err := d.fileService.isSymlink(entry.Path)
+			if err != nil {
+				return err
+			}
+			if isLink {
+				continue
+			}
+		}
+		paths = append(paths, entry.Path)
+		total += entry.Size
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		files    atomic.Int64
+		bytes    atomic.Int64
+	)
+	hashed := make(map[string]hashedFile, len(paths))
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range min(workers, len(paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range jobs {
+				metadata, err := d.fileService.CreateMetadata(filePath, d.checksumSample)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("failed to checksum %s: %w", filePath, err)
+				} else if err == nil {
+					hashed[filePath] = hashedFile{metadata.Size, metadata.ModTime, metadata.Checksum, metadata.ChecksumSample}
+				}
+				mu.Unlock()
+
+				if err == nil {
+					files.Add(1)
+					bytes.Add(metadata.Size)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(hashProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("Checksummed %d of %d files, %s of %s", files.Load(), len(paths),
+					utils.FormatFileSize(bytes.Load()), utils.FormatFileSize(total))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for _, filePath := range paths {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		jobs <- filePath
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	d.hashed = hashed
+	log.Printf("Checksummed %d files (%s) in %v with %d workers", len(paths), utils.FormatFileSize(total),
+		time.Since(start).Round(time.Millisecond), workers)
+	return nil
+}
+
+// createMetadata creates the metadata of a local file, taking its checksum from HashFiles if the file hasn't changed since
+func (d *DataProcessor) createMetadata(filePath string) (*types.FileMetadata, error) {
+	hashed, ok := d.hashed[filePath]
+	if !ok {
+		return d.fileService.CreateMetadata(filePath, d.checksumSample)
+	}
+
+	metadata, err := d.fileService.describeFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Size != hashed.size || !metadata.ModTime.Equal(hashed.modTime) {
+		log.Printf("%s changed since it was checksummed, checksumming it again", filePath)
+		return d.fileService.CreateMetadata(filePath, d.checksumSample)
+	}
+
+	metadata.Checksum, metadata.ChecksumSample = hashed.checksum, hashed.sample
+	return metadata, nil
+}
@@ -0,0 +1,95 @@
+package processor
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestDirectory writes count files of size random bytes to a new directory and returns them as directory entries
+func writeTestDirectory(tb testing.TB, count, size int) []DirectoryEntry {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	entries := make([]DirectoryEntry, count)
+	content := make([]byte, size)
+	for i := range entries {
+		if _, err := rand.Read(content); err != nil {
+			tb.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("file%03d.bin", i))
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+		entries[i] = DirectoryEntry{Path: path, Dir: filepath.Base(dir), Size: int64(size)}
+	}
+	return entries
+}
+
+func TestHashFilesMatchesSerialChecksums(t *testing.T) {
+	entries := writeTestDirectory(t, 20, 64*1024)
+
+	d := NewDataProcessor()
+	if err := d.HashFiles(entries, 4, false); err != nil {
+		t.Fatalf("HashFiles() error = %v", err)
+	}
+
+	// One file changes after it was checksummed, its checksum has to be worked out again
+	changed := entries[len(entries)-1].Path
+	if err := os.WriteFile(changed, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(changed, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		got, err := d.createMetadata(entry.Path)
+		if err != nil {
+			t.Fatalf("createMetadata(%s) error = %v", entry.Path, err)
+		}
+		want, err := d.fileService.CreateMetadata(entry.Path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Checksum != want.Checksum || got.Size != want.Size {
+			t.Fatalf("%s has checksum %s of %d bytes, want %s of %d", entry.Path, got.Checksum, got.Size, want.Checksum, want.Size)
+		}
+	}
+}
+
+func TestHashFilesReportsUnreadableFile(t *testing.T) {
+	entries := writeTestDirectory(t, 8, 1024)
+	if err := os.Remove(entries[3].Path); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDataProcessor()
+	if err := d.HashFiles(entries, 4, false); err == nil {
+		t.Fatalf("HashFiles() succeeded with %s missing", entries[3].Path)
+	}
+	if d.hashed != nil {
+		t.Fatalf("checksums kept from a failed HashFiles")
+	}
+}
+
+// BenchmarkHashFiles checksums a directory of 200 1 MB files with different numbers of workers.
+// Workers only help with several cores, or storage slow enough that reads wait on it.
+func BenchmarkHashFiles(b *testing.B) {
+	entries := writeTestDirectory(b, 200, 1024*1024)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			b.SetBytes(200 * 1024 * 1024)
+			for b.Loop() {
+				if err := NewDataProcessor().HashFiles(entries, workers, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,13 +1,21 @@
 package processor
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 
+	"yapfs/internal/s3"
 	"yapfs/pkg/types"
 )
 
+// ErrSourceUnstable is returned by SelfCheck when a file reads back differently the second time
+var ErrSourceUnstable = errors.New("source file is unstable")
+
 // Data channel should be init and manage data processor internally, app layer doesn't need to know about it
 // DataProcessor coordinates file operations, chunking, and reassembly for P2P file sharing
 // Now uses composition with specialized services for better separation of concerns
@@ -22,6 +30,15 @@ type DataProcessor struct {
 
 	// Track file completion status
 	fileCompleted bool
+	typeMismatch  *types.TypeMismatch // How the last file received disagrees with its declared type, nil if it doesn't
+
+	// Resume cache of the file being sent, nil when not caching
+	resumeCache *ResumeCache
+	resumeEntry *resumeEntry
+	sentPrefix  *prefixState // Hash of what was sent of the file so far, nil when not followed
+
+	checksumSample int64                 // Bytes checksummed at each end of files prepared for sending, 0 to hash them whole
+	hashed         map[string]hashedFile // Checksums of files worked out up front by HashFiles, by path
 }
 
 // NewDataProcessor creates a new data processor with composed services
@@ -38,14 +55,27 @@ func NewDataProcessor() *DataProcessor {
 }
 
 // PrepareFileForSending opens file and validates it's ready for sending, returns metadata (delegates to ReaderService)
-func (d *DataProcessor) PrepareFileForSending(filePath string) (*types.FileMetadata, error) {
-	// Close any existing file reader
-	if d.currentReader != nil {
-		d.currentReader.close()
+// If filePath is a symlink and followSymlinks is false, the link itself is sent so the receiver recreates it
+func (d *DataProcessor) PrepareFileForSending(filePath string, followSymlinks bool) (*types.FileMetadata, error) {
+	// Only local files have their progress cached
+	d.resumeEntry, d.sentPrefix = nil, nil
+
+	if IsRemoteSource(filePath) {
+		return d.prepareRemoteForSending(filePath)
+	}
+
+	if !followSymlinks {
+		isLink, err := d.fileService.isSymlink(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if isLink {
+			return d.prepareSymlinkForSending(filePath)
+		}
 	}
 
 	// Create metadata first
-	metadata, err := d.fileService.CreateMetadata(filePath)
+	metadata, err := d.createMetadata(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create metadata: %w", err)
 	}
@@ -56,26 +86,246 @@ func (d *DataProcessor) PrepareFileForSending(filePath string) (*types.FileMetad
 		return nil, err
 	}
 
+	d.currentReader = reader
+	d.resumeEntry = d.cacheEntryFor(filePath, metadata)
+	return metadata, nil
+}
+
+// PrepareFileForFollowing prepares a local file that is still being written for sending, data appended to it is sent too
+// until following is closed. Its metadata has the size it started with and no checksum, the sender works both out as it goes.
+func (d *DataProcessor) PrepareFileForFollowing(filePath string, following <-chan struct{}) (*types.FileMetadata, error) {
+	d.resumeEntry, d.sentPrefix = nil, nil
+
+	metadata, err := d.fileService.describeFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata: %w", err)
+	}
+	metadata.Follow = true
+
+	reader, err := d.readerService.prepareFileForReading(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader.following = following
+
 	d.currentReader = reader
 	return metadata, nil
 }
 
-// StartReadingFile reads file chunks and sends them through the data channel (delegates to ReaderService)
-func (d *DataProcessor) StartReadingFile(chunkSize int) (<-chan DataChunk, <-chan error) {
+// SelfCheck reads the prepared file again and confirms it has the checksum its metadata was created with,
+// catching storage that returns different data on every read before anything is sent
+func (d *DataProcessor) SelfCheck(metadata *types.FileMetadata) error {
+	if d.currentReader == nil {
+		return fmt.Errorf("no file prepared for sending")
+	}
+
+	// Symlinks sent as links have no content to check
+	if d.currentReader.source == nil {
+		return nil
+	}
+
+	var checksum string
+	var err error
+	if metadata.ChecksumSample > 0 {
+		checksum, err = sampledChecksum(d.currentReader.source, metadata.ChecksumSample)
+	} else {
+		checksum, err = d.currentReader.source.Checksum()
+	}
+	if err != nil {
+		return err
+	}
+
+	if checksum != metadata.Checksum {
+		return fmt.Errorf("%w: %s read with checksum %s, then %s", ErrSourceUnstable, d.currentReader.filePath, metadata.Checksum, checksum)
+	}
+
+	log.Printf("Self-check passed: %s reads the same twice", d.currentReader.filePath)
+	return nil
+}
+
+// IsDirectory reports whether filePath is a directory to send, a symlink to one only counts when following symlinks
+func (d *DataProcessor) IsDirectory(filePath string, followSymlinks bool) (bool, error) {
+	if IsRemoteSource(filePath) {
+		return false, nil
+	}
+
+	stat := os.Lstat
+	if followSymlinks {
+		stat = os.Stat
+	}
+
+	info, err := stat(filePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	return info.IsDir(), nil
+}
+
+// PrepareDirectoryForSending lists the files of directory root to send and returns metadata describing the whole directory.
+// Only the files filter allows are listed. Each file is then prepared in turn with PrepareFileForSending.
+func (d *DataProcessor) PrepareDirectoryForSending(root string, followSymlinks bool, filter DirectoryFilter) ([]DirectoryEntry, *types.FileMetadata, error) {
+	name, entries, err := d.fileService.listDirectory(root, followSymlinks, filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list directory: %w", err)
+	}
+
+	metadata := &types.FileMetadata{
+		Name:     name,
+		MimeType: "inode/directory",
+	}
+	for _, entry := range entries {
+		metadata.Size += entry.Size
+	}
+
+	log.Printf("Directory prepared for sending: %s, %d files, %d bytes", root, len(entries), metadata.Size)
+
+	return entries, metadata, nil
+}
+
+// prepareSymlinkForSending prepares a symlink to be sent as a link rather than its target's contents
+func (d *DataProcessor) prepareSymlinkForSending(filePath string) (*types.FileMetadata, error) {
+	metadata, err := d.fileService.CreateSymlinkMetadata(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata: %w", err)
+	}
+
+	reader, err := d.readerService.prepareSymlinkForReading(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	d.currentReader = reader
+	return metadata, nil
+}
+
+// IsPrefixMatched checks whether the first n bytes of the prepared file match the given checksum
+func (d *DataProcessor) IsPrefixMatched(n int64, checksum string) (bool, error) {
+	if d.currentReader == nil {
+		return false, fmt.Errorf("no file prepared for sending")
+	}
+
+	if n <= 0 || d.currentReader.source == nil || n > d.currentReader.source.Size() {
+		return false, nil
+	}
+
+	prefix, err := d.prefixFromCache(n)
+	if err != nil {
+		return false, err
+	}
+
+	matched := hex.EncodeToString(prefix.hash.Sum(nil)) == checksum
+	if matched {
+		// Sending goes on from here, its hash continues from this prefix
+		d.sentPrefix = prefix
+	}
+	return matched, nil
+}
+
+// ReadHead returns up to the first n bytes of the prepared file, less if the file is shorter
+func (d *DataProcessor) ReadHead(n int) ([]byte, error) {
+	if d.currentReader == nil || d.currentReader.source == nil {
+		return nil, fmt.Errorf("no file prepared for sending")
+	}
+
+	content, err := d.currentReader.source.Open(0)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	head, err := io.ReadAll(io.LimitReader(content, int64(n)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return head, nil
+}
+
+// SeekTo positions the prepared file reader at offset so sending resumes from there (delegates to ReaderService)
+func (d *DataProcessor) SeekTo(offset int64) error {
+	if d.currentReader == nil {
+		return fmt.Errorf("no file prepared for sending")
+	}
+
+	return d.readerService.seekTo(d.currentReader, offset)
+}
+
+// SetReadSize makes files be read n bytes at a time from now on, whatever size of chunks they are sent in
+func (d *DataProcessor) SetReadSize(n int) {
+	d.readerService.readSize = n
+}
+
+// SetReadAhead makes up to n chunks of files be read ahead of the one being sent from now on
+func (d *DataProcessor) SetReadAhead(n int) {
+	d.readerService.readAhead = n
+}
+
+// StartReadingFile reads file chunks and sends them through the data channel (delegates to ReaderService).
+// chunkSize is called before every read so the peer can ask for smaller chunks mid-transfer.
+// The caller closes stop once it stops taking chunks, which ends reading and closes the file.
+// The file stays prepared, so reading can start over from another offset if the transfer is interrupted.
+func (d *DataProcessor) StartReadingFile(chunkSize func() int, stop <-chan struct{}) (<-chan DataChunk, <-chan error) {
 	if d.currentReader == nil {
 		return nil, nil
 	}
 
-	dataCh, errCh := d.readerService.startReading(d.currentReader, chunkSize)
+	return d.readerService.startReading(d.currentReader, chunkSize, stop)
+}
 
-	// Clear the reader after transfer starts (ReaderService handles cleanup)
-	d.currentReader = nil
+// SanitizeMetadata rewrites the received file name so it is valid on this platform, logging any substitution
+func (d *DataProcessor) SanitizeMetadata(metadata *types.FileMetadata) {
+	sanitized := d.fileService.sanitizeFileName(metadata.Name)
+	if sanitized != metadata.Name {
+		log.Printf("File name %q is not valid on this system, saving as %q", metadata.Name, sanitized)
+		metadata.Name = sanitized
+	}
+
+	if metadata.Dir != "" {
+		sanitizedDir := d.fileService.sanitizeDir(metadata.Dir)
+		if sanitizedDir != metadata.Dir {
+			log.Printf("Directory %q is not valid on this system, saving as %q", metadata.Dir, sanitizedDir)
+			metadata.Dir = sanitizedDir
+		}
+	}
+}
 
-	return dataCh, errCh
+// SanitizeDirectoryInfo rewrites the received directory name so it is valid on this platform, logging any substitution
+func (d *DataProcessor) SanitizeDirectoryInfo(info *types.DirectoryInfo) {
+	sanitized := d.fileService.sanitizeFileName(info.Name)
+	if sanitized != info.Name {
+		log.Printf("Directory name %q is not valid on this system, saving as %q", info.Name, sanitized)
+		info.Name = sanitized
+	}
+}
+
+// DestinationPath returns where the incoming file would be saved in destDir (delegates to WriterService)
+func (d *DataProcessor) DestinationPath(destDir string, metadata *types.FileMetadata, opts WriterOptions) string {
+	return d.writerService.resolveDestPath(destDir, metadata, opts)
+}
+
+// DirectoryDestinationPath returns where a received directory named name is saved in destDir
+func (d *DataProcessor) DirectoryDestinationPath(destDir, name string) string {
+	if s3.IsURL(destDir) {
+		return s3.JoinURL(destDir, name)
+	}
+	return filepath.Join(destDir, name)
+}
+
+// CheckDestination verifies the incoming file may be written to its destination (delegates to WriterService)
+// Returns true if an existing file means the transfer should be skipped
+func (d *DataProcessor) CheckDestination(destDir string, metadata *types.FileMetadata, opts WriterOptions) (bool, error) {
+	return d.writerService.checkDestination(destDir, metadata, opts)
+}
+
+// FindPartialFile looks for a partially received copy of the file in destDir (delegates to WriterService)
+// Returns the number of bytes already held and their checksum, or 0 if there is nothing to resume
+func (d *DataProcessor) FindPartialFile(destDir string, metadata *types.FileMetadata, opts WriterOptions) (int64, string, error) {
+	return d.writerService.findPartialFile(destDir, metadata, opts)
 }
 
 // PrepareFileForReceiving opens a destination file for writing with metadata (delegates to WriterService)
-func (d *DataProcessor) PrepareFileForReceiving(destDir string, metadata *types.FileMetadata) (string, error) {
+// A non-zero offset continues an existing partial file from that offset
+func (d *DataProcessor) PrepareFileForReceiving(destDir string, metadata *types.FileMetadata, offset int64, opts WriterOptions) (string, error) {
 	// Close any existing file writer
 	if d.currentWriter != nil {
 		d.currentWriter.close()
@@ -84,8 +334,15 @@ func (d *DataProcessor) PrepareFileForReceiving(destDir string, metadata *types.
 	// Reset completion status for new file
 	d.fileCompleted = false
 
-	// Prepare file for writing using WriterService
-	writer, destPath, err := d.writerService.prepareFileForWriting(destDir, metadata)
+	// Prepare file for writing using WriterService, symlinks sent as links are recreated right away
+	var writer *fileWriter
+	var destPath string
+	var err error
+	if metadata.SymlinkTarget != "" {
+		writer, destPath, err = d.writerService.prepareSymlinkForWriting(destDir, metadata, opts)
+	} else {
+		writer, destPath, err = d.writerService.prepareFileForWriting(destDir, metadata, offset, opts)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -99,19 +356,57 @@ func (d *DataProcessor) WriteData(data []byte) error {
 	return d.writerService.writeData(d.currentWriter, data)
 }
 
+// ReceivedSoFar returns how many bytes of the file being received are held and their checksum, or 0 if none are.
+// The file stays open, so an interrupted transfer can continue writing it from there.
+func (d *DataProcessor) ReceivedSoFar() (int64, string) {
+	if d.currentWriter == nil {
+		return 0, ""
+	}
+	return d.currentWriter.received()
+}
+
 // FinishReceiving completes the file reception and returns total bytes written (delegates to WriterService)
 func (d *DataProcessor) FinishReceiving() (uint64, error) {
-	totalBytes, err := d.writerService.finishWriting(d.currentWriter)
+	writer := d.currentWriter
+	totalBytes, err := d.writerService.finishWriting(writer)
 	d.currentWriter = nil
+	d.typeMismatch = nil
 
 	// Mark file as completed only if no error occurred
 	if err == nil {
 		d.fileCompleted = true
+		if writer.opts.CheckMime && writer.sink != nil && !writer.isUpload() {
+			d.typeMismatch = d.checkReceivedType(writer)
+		}
+		// The file is left in place for inspection, it is what the sender sent
+		if writer.opts.ValidateFormat && writer.sink != nil && !writer.isUpload() {
+			err = validateFormat(writer.destPath)
+		}
 	}
 
 	return totalBytes, err
 }
 
+// checkReceivedType compares the completed file's detected type with the MIME type the sender declared for it
+func (d *DataProcessor) checkReceivedType(writer *fileWriter) *types.TypeMismatch {
+	mismatch, err := checkDeclaredType(writer.destPath, writer.metadata)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	if mismatch != nil {
+		log.Printf("Warning: %s was declared as %s but its content looks like %s, it may be mislabeled or corrupted",
+			mismatch.Name, mismatch.Declared, mismatch.Detected)
+	}
+	return mismatch
+}
+
+// TypeMismatch returns how the content of the file last received disagrees with the MIME type declared for it,
+// nil if it agrees or wasn't checked
+func (d *DataProcessor) TypeMismatch() *types.TypeMismatch {
+	return d.typeMismatch
+}
+
 // ClearPartialFile removes a partially written file and cleans up the current writer
 // Only clears if the file is not completed (partial/incomplete)
 func (d *DataProcessor) ClearPartialFile() error {
@@ -126,7 +421,10 @@ func (d *DataProcessor) ClearPartialFile() error {
 	}
 
 	// Get the file path before closing
-	filePath := d.currentWriter.destPath
+	filePath := d.currentWriter.filePath
+	bytesWritten := d.currentWriter.totalBytesWritten
+	keepPartial := d.currentWriter.opts.Resume
+	uploading := d.currentWriter.isUpload()
 
 	// Close the file first
 	if err := d.currentWriter.close(); err != nil {
@@ -134,6 +432,20 @@ func (d *DataProcessor) ClearPartialFile() error {
 		log.Printf("Warning: failed to close file before cleanup: %v\n", err)
 	}
 
+	// Closing an unfinished upload aborted it, nothing was stored
+	if uploading {
+		d.currentWriter = nil
+		log.Printf("Upload aborted: %s (%d bytes received)\n", filePath, bytesWritten)
+		return nil
+	}
+
+	// Keep the partial file so the transfer can be resumed later
+	if keepPartial {
+		d.currentWriter = nil
+		log.Printf("Partial file kept for resume: %s (%d bytes)\n", filePath, bytesWritten)
+		return nil
+	}
+
 	// Remove the partial file
 	if err := os.Remove(filePath); err != nil {
 		d.currentWriter = nil
@@ -148,16 +460,39 @@ func (d *DataProcessor) ClearPartialFile() error {
 	return nil
 }
 
+// DiscardFile closes the file being received and removes it, even if partial files are kept for resume
+func (d *DataProcessor) DiscardFile() error {
+	if d.currentWriter == nil {
+		return nil
+	}
+
+	filePath := d.currentWriter.filePath
+	uploading := d.currentWriter.isUpload()
+	if err := d.currentWriter.close(); err != nil {
+		log.Printf("Warning: failed to close file before discarding: %v\n", err)
+	}
+	d.currentWriter = nil
+
+	// Closing an unfinished upload aborted it, nothing was stored
+	if uploading {
+		log.Printf("Discarded upload: %s\n", filePath)
+		return nil
+	}
+
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove discarded file %s: %w", filePath, err)
+	}
+
+	log.Printf("Discarded file: %s\n", filePath)
+	return nil
+}
+
 // Close closes both current file reader and writer
 func (d *DataProcessor) Close() error {
 	var errs []error
 
-	if d.currentReader != nil {
-		if err := d.currentReader.close(); err != nil {
-			errs = append(errs, err)
-		}
-		d.currentReader = nil
-	}
+	// A reader holds nothing open between reads
+	d.currentReader = nil
 
 	if d.currentWriter != nil {
 		if err := d.ClearPartialFile(); err != nil {
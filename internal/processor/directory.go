@@ -0,0 +1,225 @@
+package processor
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DirectoryEntry is a file found inside a directory being sent
+type DirectoryEntry struct {
+	Path string // Local path of the file
+	Dir  string // Slash-separated directory of the file, starting with the sent directory's name
+	Size int64  // Size of the file, 0 for a symlink sent as a link
+}
+
+// SendOrder decides the sequence the files of a directory are sent in
+type SendOrder string
+
+const (
+	SendOrderListed   SendOrder = "as-listed" // The order the directory is walked in, lexical by path
+	SendOrderName     SendOrder = "name"      // By file name, wherever in the tree the file is
+	SendOrderSizeAsc  SendOrder = "size-asc"  // Smallest file first
+	SendOrderSizeDesc SendOrder = "size-desc" // Largest file first
+)
+
+// ParseSendOrder validates a send order name
+func ParseSendOrder(name string) (SendOrder, error) {
+	switch order := SendOrder(name); order {
+	case SendOrderListed, SendOrderName, SendOrderSizeAsc, SendOrderSizeDesc:
+		return order, nil
+	default:
+		return "", fmt.Errorf("unknown send order %q, expected %s, %s, %s or %s", name, SendOrderListed, SendOrderName, SendOrderSizeAsc, SendOrderSizeDesc)
+	}
+}
+
+// SortDirectoryEntries puts the files of a directory in the order they are to be sent.
+// Files that compare equal stay in the order they were listed, and an empty order keeps that order.
+func SortDirectoryEntries(entries []DirectoryEntry, order SendOrder) {
+	var compare func(a, b DirectoryEntry) int
+	switch order {
+	case SendOrderName:
+		compare = func(a, b DirectoryEntry) int { return strings.Compare(filepath.Base(a.Path), filepath.Base(b.Path)) }
+	case SendOrderSizeAsc:
+		compare = func(a, b DirectoryEntry) int { return cmp.Compare(a.Size, b.Size) }
+	case SendOrderSizeDesc:
+		compare = func(a, b DirectoryEntry) int { return cmp.Compare(b.Size, a.Size) }
+	default:
+		return
+	}
+	slices.SortStableFunc(entries, compare)
+}
+
+// DirectoryFilter picks the files of a directory to send by glob patterns (path.Match syntax, slash-separated).
+// A pattern with a slash matches the path within the directory or a directory leading to it, e.g. "vendor/*";
+// one without matches any name along the path, e.g. "*.go".
+type DirectoryFilter struct {
+	Include []string // Only files matching one of these are sent, all files if empty
+	Exclude []string // Files matching one of these are never sent, even if included
+}
+
+// Validate checks that every pattern is well formed
+func (f DirectoryFilter) Validate() error {
+	for _, pattern := range slices.Concat(f.Include, f.Exclude) {
+		cleaned := cleanPattern(pattern)
+		if cleaned == "" {
+			return fmt.Errorf("empty pattern %q", pattern)
+		}
+		if _, err := path.Match(cleaned, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// IsEmpty reports whether the filter lets every file through
+func (f DirectoryFilter) IsEmpty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// allows reports whether the file at slash-separated path rel within the directory is to be sent
+func (f DirectoryFilter) allows(rel string) bool {
+	if f.excludes(rel) {
+		return false
+	}
+	return len(f.Include) == 0 || slices.ContainsFunc(f.Include, func(pattern string) bool { return matchPattern(pattern, rel) })
+}
+
+// excludes reports whether rel, a file or a directory whose files are then all left out, matches an exclude pattern
+func (f DirectoryFilter) excludes(rel string) bool {
+	return slices.ContainsFunc(f.Exclude, func(pattern string) bool { return matchPattern(pattern, rel) })
+}
+
+// matchPattern matches a filter pattern against slash-separated path rel, see DirectoryFilter
+func matchPattern(pattern, rel string) bool {
+	pattern = cleanPattern(pattern)
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		name := parts[i]
+		if strings.Contains(pattern, "/") {
+			name = strings.Join(parts[:i+1], "/")
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPattern drops a leading "./" and trailing slashes, which name the same paths
+func cleanPattern(pattern string) string {
+	return strings.TrimRight(strings.TrimPrefix(pattern, "./"), "/")
+}
+
+// listDirectory walks root and returns its name and the files to send, in lexical order.
+// Symlinks are sent as links unless followSymlinks is set, then the files they point to are sent instead;
+// symlinked directories are never descended into so a link cycle can't make the walk run forever.
+// Files the filter doesn't allow are left out, and excluded directories aren't walked at all.
+func (f *FileService) listDirectory(root string, followSymlinks bool, filter DirectoryFilter) (string, []DirectoryEntry, error) {
+	// Name the directory after its absolute path so "." sends the current directory's real name
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve directory: %w", err)
+	}
+	rootName := filepath.Base(absRoot)
+
+	// The walk itself never follows links, resolve a symlinked root up front
+	walkRoot := root
+	if followSymlinks {
+		resolved, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to resolve directory: %w", err)
+		}
+		walkRoot = resolved
+	}
+
+	var entries []DirectoryEntry
+	err = filepath.WalkDir(walkRoot, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", filePath, err)
+		}
+
+		relPath, err := filepath.Rel(walkRoot, filePath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", filePath, err)
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if d.IsDir() {
+			if relPath != "." && filter.excludes(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !filter.allows(relPath) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(walkRoot, filepath.Dir(filePath))
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", filePath, err)
+		}
+		entry := DirectoryEntry{
+			Path: filePath,
+			Dir:  path.Join(rootName, filepath.ToSlash(rel)),
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to get file info for %s: %w", filePath, err)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 && followSymlinks {
+			info, err = os.Stat(filePath)
+			if err != nil {
+				log.Printf("Skipping %s: cannot follow symlink: %v", filePath, err)
+				return nil
+			}
+			if info.IsDir() {
+				log.Printf("Skipping %s: symlinked directories are not followed", filePath)
+				return nil
+			}
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			// Sent as a link, no content
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+		default:
+			log.Printf("Skipping %s: not a regular file", filePath)
+			return nil
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(entries) == 0 && !filter.IsEmpty() {
+		return "", nil, fmt.Errorf("no files in %s match the include and exclude patterns", root)
+	}
+
+	return rootName, entries, nil
+}
+
+// sanitizeDir makes each component of a slash-separated directory received from a peer valid on this platform.
+// Components like ".." come out as ordinary names, so the result never leaves the destination.
+func (f *FileService) sanitizeDir(dir string) string {
+	var parts []string
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" {
+			continue
+		}
+		parts = append(parts, f.sanitizeFileName(part))
+	}
+	return strings.Join(parts, "/")
+}
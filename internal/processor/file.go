@@ -3,13 +3,17 @@ package processor
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
 )
 
 // FileService handles basic file operations
@@ -30,15 +34,20 @@ func (f *FileService) openReader(filePath string) (*os.File, error) {
 	return file, nil
 }
 
-// createWriter creates a file for writing
-func (f *FileService) createWriter(destPath string) (*os.File, error) {
+// createWriter creates a file for writing, truncating an existing one unless exclusive is set,
+// then an existing file or link fails with an error matching fs.ErrExist
+func (f *FileService) createWriter(destPath string, exclusive bool) (*os.File, error) {
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(destPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	file, err := os.Create(destPath)
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	}
+	file, err := os.OpenFile(destPath, flag, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file: %w", err)
 	}
@@ -46,6 +55,40 @@ func (f *FileService) createWriter(destPath string) (*os.File, error) {
 	return file, nil
 }
 
+// confineToDir verifies that path, with all symlinks resolved, stays inside root.
+// The parent directory of path must already exist.
+func (f *FileService) confineToDir(root, path string) error {
+	// Reject names like "../x" before touching the filesystem
+	if !utils.IsPathWithin(root, path) {
+		return fmt.Errorf("path %s escapes destination directory %s", path, root)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("failed to resolve destination directory: %w", err)
+	}
+
+	// Resolve the file itself if it already exists (it may be a symlink, possibly dangling),
+	// otherwise its parent directory
+	var realPath string
+	if _, lerr := os.Lstat(path); lerr == nil {
+		realPath, err = filepath.EvalSymlinks(path)
+	} else {
+		var realDir string
+		realDir, err = filepath.EvalSymlinks(filepath.Dir(path))
+		realPath = filepath.Join(realDir, filepath.Base(path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve destination path: %w", err)
+	}
+
+	if !utils.IsPathWithin(realRoot, realPath) {
+		return fmt.Errorf("path %s resolves to %s, outside destination directory %s", path, realPath, realRoot)
+	}
+
+	return nil
+}
+
 // GetFileInfo returns information about a file by path
 func (f *FileService) GetFileInfo(filePath string) (os.FileInfo, error) {
 	stat, err := os.Stat(filePath)
@@ -80,8 +123,151 @@ func (f *FileService) calculateFileChecksum(filePath string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// CreateMetadata creates file metadata struct for a file
-func (f *FileService) CreateMetadata(filePath string) (*types.FileMetadata, error) {
+// openForResume opens an existing partial file for appending after its first offset bytes
+func (f *FileService) openForResume(destPath string, offset int64) (*os.File, error) {
+	file, err := os.OpenFile(destPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial file: %w", err)
+	}
+
+	// Drop anything past the resume offset, it will be sent again
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate partial file: %w", err)
+	}
+
+	return file, nil
+}
+
+// CreateSymlinkMetadata creates metadata describing a symlink itself rather than its target.
+// The checksum covers the link target path, which is all that gets recreated.
+func (f *FileService) CreateSymlinkMetadata(filePath string) (*types.FileMetadata, error) {
+	stat, err := os.Lstat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get symlink info: %w", err)
+	}
+
+	target, err := os.Readlink(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read symlink: %w", err)
+	}
+
+	checksum := sha256.Sum256([]byte(target))
+
+	metadata := &types.FileMetadata{
+		Name:          filepath.Base(filePath),
+		Size:          0,
+		MimeType:      "inode/symlink",
+		Checksum:      hex.EncodeToString(checksum[:]),
+		ModTime:       stat.ModTime(),
+		SymlinkTarget: target,
+	}
+
+	return metadata, nil
+}
+
+// createSymlink creates linkPath pointing at target, replacing an existing file or link there if replace is set
+func (f *FileService) createSymlink(target, linkPath string, replace bool) error {
+	if info, err := os.Lstat(linkPath); err == nil && replace {
+		if info.IsDir() {
+			return fmt.Errorf("cannot replace directory %s with a symlink", linkPath)
+		}
+		if err := os.Remove(linkPath); err != nil {
+			return fmt.Errorf("failed to replace existing file: %w", err)
+		}
+	}
+
+	if err := os.Symlink(target, linkPath); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+
+	return nil
+}
+
+// uniquePath returns filePath if nothing exists there, otherwise the first free "name (n).ext" next to it.
+// The name may be taken before it is used, createUnique settles it by creating the file.
+func (f *FileService) uniquePath(filePath string) string {
+	for n := 0; ; n++ {
+		candidate := numberedPath(filePath, n)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// createUnique creates a new file at filePath, or at the first free "name (n).ext" next to it, and returns it with its path.
+// Each name is tried with an exclusive create, so receives running at the same time never end up with the same file.
+func (f *FileService) createUnique(filePath string) (*os.File, string, error) {
+	for n := 0; ; n++ {
+		candidate := numberedPath(filePath, n)
+		file, err := f.createWriter(candidate, true)
+		if err == nil {
+			return file, candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, "", err
+		}
+	}
+}
+
+// numberedPath returns filePath for n 0, otherwise "name (n).ext"
+func numberedPath(filePath string, n int) string {
+	if n == 0 {
+		return filePath
+	}
+	ext := filepath.Ext(filePath)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filePath, ext), n, ext)
+}
+
+// moveNoReplace moves filePath to destPath unless something exists there, then it fails with an error matching fs.ErrExist.
+// Linking the file under its new name fails rather than replace anything, unlike a rename; filesystems without
+// hard links get a check followed by a rename instead.
+func (f *FileService) moveNoReplace(filePath, destPath string) error {
+	err := os.Link(filePath, destPath)
+	if err == nil {
+		return os.Remove(filePath)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	if _, lerr := os.Lstat(destPath); lerr == nil {
+		return &os.LinkError{Op: "rename", Old: filePath, New: destPath, Err: fs.ErrExist}
+	}
+	return os.Rename(filePath, destPath)
+}
+
+// isSymlink reports whether filePath itself is a symlink
+func (f *FileService) isSymlink(filePath string) (bool, error) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	return info.Mode()&os.ModeSymlink != 0, nil
+}
+
+// CreateMetadata creates file metadata struct for a file.
+// A checksumSample above 0 only checksums that much at each end of files more than twice as long, see sampledChecksum.
+func (f *FileService) CreateMetadata(filePath string, checksumSample int64) (*types.FileMetadata, error) {
+	metadata, err := f.describeFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Calculate checksum
+	source := &fileSource{fileService: f, filePath: filePath, size: metadata.Size}
+	checksum, sample, err := sourceChecksum(filePath, source, checksumSample)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate file checksum: %w", err)
+	}
+	metadata.Checksum, metadata.ChecksumSample = checksum, sample
+
+	return metadata, nil
+}
+
+// describeFile creates the metadata of a file without its checksum
+func (f *FileService) describeFile(filePath string) (*types.FileMetadata, error) {
 	stat, err := os.Stat(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file info: %w", err)
@@ -96,17 +282,11 @@ func (f *FileService) CreateMetadata(filePath string) (*types.FileMetadata, erro
 		mimeType = "application/octet-stream" // Default for unknown types
 	}
 
-	// Calculate checksum
-	checksum, err := f.calculateFileChecksum(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to calculate file checksum: %w", err)
-	}
-
 	metadata := &types.FileMetadata{
 		Name:     filename,
 		Size:     stat.Size(),
 		MimeType: mimeType,
-		Checksum: checksum,
+		ModTime:  stat.ModTime(),
 	}
 
 	return metadata, nil
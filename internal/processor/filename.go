@@ -0,0 +1,118 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileNameReplacement substitutes characters that can't be used in a file name
+const fileNameReplacement = "_"
+
+// maxFileNameBytes is the longest file name common filesystems accept, ext4, XFS, APFS and ZFS count it in bytes,
+// NTFS in UTF-16 units which are never more than the UTF-8 bytes
+const maxFileNameBytes = 255
+
+// fileNameSuffixRoom is kept free below maxFileNameBytes for what gets appended to a received name,
+// " (n)" to make it unique and .part or .corrupt
+const fileNameSuffixRoom = 16
+
+// maxExtensionBytes is the longest extension kept when a name is shortened, anything longer is cut with the rest
+const maxExtensionBytes = 32
+
+// windowsIllegalChars can't appear anywhere in a Windows file name
+const windowsIllegalChars = `<>:"\|?*`
+
+// windowsReservedNames are device names Windows refuses as file names, with or without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName makes a file name received from a peer valid on this platform
+func (f *FileService) sanitizeFileName(name string) string {
+	return sanitizeFileNameFor(name, runtime.GOOS)
+}
+
+// ValidateFileName checks that name, given by the user rather than a peer, can be used as it is as a single file name here
+func ValidateFileName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("%q is not a file name", name)
+	}
+	if name != filepath.Base(name) {
+		return fmt.Errorf("%q is a path, only a file name is allowed", name)
+	}
+	if sanitized := sanitizeFileNameFor(name, runtime.GOOS); sanitized != name {
+		return fmt.Errorf("%q is not a valid file name here, it could be %q", name, sanitized)
+	}
+	return nil
+}
+
+// sanitizeFileNameFor makes name a valid single file name on the given GOOS.
+// Invalid UTF-8, control characters and path separators are replaced everywhere,
+// Windows additionally gets its illegal characters, trailing dots/spaces and reserved names handled.
+// A name too long for the filesystem is shortened, see shortenFileName.
+func sanitizeFileNameFor(name string, goos string) string {
+	// Invalid byte sequences can't be represented by most filesystems
+	name = strings.ToValidUTF8(name, fileNameReplacement)
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			b.WriteString(fileNameReplacement)
+		case r == '/':
+			b.WriteString(fileNameReplacement)
+		case goos == "windows" && strings.ContainsRune(windowsIllegalChars, r):
+			b.WriteString(fileNameReplacement)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = b.String()
+
+	if goos == "windows" {
+		// Windows silently strips trailing dots and spaces, which would change the name
+		name = strings.TrimRight(name, ". ")
+
+		base, _, _ := strings.Cut(name, ".")
+		if windowsReservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+			name = fileNameReplacement + name
+		}
+	}
+
+	if name == "" || name == "." || name == ".." {
+		name = fileNameReplacement + name
+	}
+
+	return shortenFileName(name)
+}
+
+// shortenFileName cuts a name longer than maxFileNameBytes, less fileNameSuffixRoom, to fit.
+// The extension is kept and a hash of the whole name is added, so different long names stay different.
+func shortenFileName(name string) string {
+	limit := maxFileNameBytes - fileNameSuffixRoom
+	if len(name) <= limit {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > maxExtensionBytes {
+		ext = ""
+	}
+	sum := sha256.Sum256([]byte(name))
+	tag := "~" + hex.EncodeToString(sum[:4])
+
+	// Cut on a character boundary so the name stays valid UTF-8
+	base := strings.TrimSuffix(name, ext)
+	cut := limit - len(tag) - len(ext)
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+	return base[:cut] + tag + ext
+}
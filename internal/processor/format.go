@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+)
+
+// ErrInvalidFormat is returned when a received file of a known format doesn't open as one
+var ErrInvalidFormat = errors.New("file is not structurally valid")
+
+// fileFormat is a format a received file can be checked against, recognised by the bytes it starts with
+type fileFormat struct {
+	name  string
+	magic []byte
+	check func(path string) error
+}
+
+// knownFormats are the formats validateFormat checks
+var knownFormats = []fileFormat{
+	{"zip", []byte("PK\x03\x04"), checkZip},
+	{"zip", []byte("PK\x05\x06"), checkZip}, // An empty archive
+	{"gzip", []byte{0x1f, 0x8b}, checkGzip},
+	{"png", []byte("\x89PNG\r\n\x1a\n"), checkPNG},
+	{"jpeg", []byte{0xff, 0xd8, 0xff}, checkJPEG},
+}
+
+// validateFormat opens the file at path the way a program reading its format would, and fails with ErrInvalidFormat
+// if it doesn't open. A file in none of the known formats is not checked.
+func validateFormat(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open received file to validate it: %w", err)
+	}
+	head := make([]byte, 8)
+	n, err := io.ReadFull(file, head)
+	file.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read received file to validate it: %w", err)
+	}
+
+	for _, format := range knownFormats {
+		if !bytes.HasPrefix(head[:n], format.magic) {
+			continue
+		}
+		if err := format.check(path); err != nil {
+			return fmt.Errorf("%w: %s looks like %s but doesn't open as one: %v", ErrInvalidFormat, path, format.name, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// checkZip reads the central directory and every entry, which checks each entry's CRC
+func checkZip(path string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name, err)
+		}
+		_, err = io.Copy(io.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkGzip decompresses every member of the stream, which checks their CRCs and lengths
+func checkGzip(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(io.Discard, reader)
+	return err
+}
+
+// checkPNG decodes the image, which checks every chunk's CRC up to IEND
+func checkPNG(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = png.Decode(bufio.NewReader(file))
+	return err
+}
+
+// checkJPEG decodes the image
+func checkJPEG(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = jpeg.Decode(bufio.NewReader(file))
+	return err
+}
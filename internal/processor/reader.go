@@ -3,100 +3,278 @@ package processor
 import (
 	"bufio"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
+	"time"
 	"yapfs/pkg/utils"
 )
 
+// Source provides the content of a file being sent: a local file, or a remote file streamed without saving it to disk
+type Source interface {
+	Size() int64                              // Length of the content in bytes
+	Checksum() (string, error)                // SHA-256 of the whole content, in hex
+	Open(offset int64) (io.ReadCloser, error) // Reads the content from offset to the end
+}
+
+// defaultReadSize is how much of a source is read at once unless SetReadSize says otherwise
+const defaultReadSize = 256 * 1024
+
 // readerService handles file reading and chunking operations
 type readerService struct {
 	fileService *FileService
+	readSize    int // Bytes read from a source at once, sliced into chunks from memory
+	readAhead   int // Chunks read and waiting to be taken while the one before them is sent
 }
 
 // newReaderService creates a new reader service
 func newReaderService(fileService *FileService) *readerService {
 	return &readerService{
 		fileService: fileService,
+		readSize:    defaultReadSize,
+		readAhead:   1,
 	}
 }
 
 // DataChunk represents a chunk of file data
 type DataChunk struct {
 	Data []byte
+	Hash string // ChunkHash of Data, set for content-defined chunks
 	EOF  bool
 }
 
-// fileReader wraps an open file for sending (internal to ReaderService)
+// fileReader reads a source for sending (internal to ReaderService).
+// Nothing stays open between reads, so the same file can be read again from another offset.
 type fileReader struct {
-	file      *os.File
-	fileInfo  os.FileInfo
-	filePath  string
-	bufReader *bufio.Reader
+	source   Source // Content to send, nil for a symlink sent as a link
+	filePath string // Path or URL the content comes from
+	offset   int64  // Where reading starts, past what the receiver already holds
+
+	// following, when set, makes reading wait for more data at the end of the file until it is closed
+	following <-chan struct{}
+}
+
+// fileSource is a file on local disk
+type fileSource struct {
+	fileService *FileService
+	filePath    string
+	size        int64
+}
+
+// Size returns the size of the file
+func (s *fileSource) Size() int64 {
+	return s.size
+}
+
+// Checksum calculates the SHA-256 checksum of the file
+func (s *fileSource) Checksum() (string, error) {
+	return s.fileService.calculateFileChecksum(s.filePath)
 }
 
-// prepareFileForReading opens file and validates it's ready for reading
+// Open opens the file positioned at offset
+func (s *fileSource) Open(offset int64) (io.ReadCloser, error) {
+	file, err := s.fileService.openReader(s.filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek file: %w", err)
+	}
+	return file, nil
+}
+
+// prepareFileForReading validates a local file is ready for reading
 func (r *readerService) prepareFileForReading(filePath string) (*fileReader, error) {
-	// Open file for reading
+	// Open file to make sure it can be read, it is opened again once sending starts
 	file, err := r.fileService.openReader(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
+	defer file.Close()
 
 	// Get file info
 	stat, err := file.Stat()
 	if err != nil {
-		file.Close()
 		return nil, fmt.Errorf("failed to get file info: %w", err)
 	}
 
 	log.Printf("File prepared for reading: %s, size: %d bytes (%s)",
 		filePath, stat.Size(), utils.FormatFileSize(stat.Size()))
 
+	source := &fileSource{
+		fileService: r.fileService,
+		filePath:    filePath,
+		size:        stat.Size(),
+	}
+
+	return r.prepareSourceForReading(filePath, source), nil
+}
+
+// prepareSourceForReading prepares any source for reading, filePath names it in logs and errors
+func (r *readerService) prepareSourceForReading(filePath string, source Source) *fileReader {
+	return &fileReader{
+		source:   source,
+		filePath: filePath,
+	}
+}
+
+// prepareSymlinkForReading prepares a symlink for sending as a link, it has no content to read
+func (r *readerService) prepareSymlinkForReading(filePath string) (*fileReader, error) {
+	if _, err := os.Lstat(filePath); err != nil {
+		return nil, fmt.Errorf("failed to get symlink info: %w", err)
+	}
+
+	log.Printf("Symlink prepared for sending as a link: %s", filePath)
+
 	reader := &fileReader{
-		file:      file,
-		fileInfo:  stat,
-		filePath:  filePath,
-		bufReader: bufio.NewReaderSize(file, 256*1024), // 256KB buffer for optimal I/O
+		filePath: filePath,
 	}
 
 	return reader, nil
 }
 
-// startReading reads file chunks and sends them through channels
-func (r *readerService) startReading(reader *fileReader, chunkSize int) (<-chan DataChunk, <-chan error) {
-	dataCh := make(chan DataChunk, 1)
+// startReading reads file chunks and sends them through channels.
+// The source is read readSize bytes at a time and each block is sliced into chunks, so the size of
+// reads from disk doesn't follow the size of messages on the wire.
+// Chunks can shrink between reads but never grow past the size chunkSize returns at the start.
+// Up to readAhead chunks are read before they are taken, so reading goes on while earlier ones are sent.
+// Closing stop makes reading end and the source close, even with chunks nobody is left to take.
+func (r *readerService) startReading(reader *fileReader, chunkSize func() int, stop <-chan struct{}) (<-chan DataChunk, <-chan error) {
+	dataCh := make(chan DataChunk, r.readAhead)
 	errCh := make(chan error, 1)
 
 	go func() {
 		defer close(dataCh)
 		defer close(errCh)
-		defer reader.close()
+
+		// A symlink sent as a link has no content
+		if reader.source == nil {
+			send(dataCh, DataChunk{Data: nil, EOF: true}, stop)
+			return
+		}
+
+		content, err := reader.source.Open(reader.offset)
+		if err != nil {
+			send(errCh, fmt.Errorf("failed to open %s: %w", reader.filePath, err), stop)
+			return
+		}
+		defer content.Close()
+		// The block is never smaller than a chunk, so no read from the source is smaller than one
+		bufReader := bufio.NewReaderSize(content, max(r.readSize, chunkSize()))
 
 		// Read and send file chunks
-		buffer := make([]byte, chunkSize)
+		buffer := make([]byte, chunkSize())
+		position := reader.offset
 		for {
-			n, err := reader.bufReader.Read(buffer)
+			n, err := bufReader.Read(buffer[:min(max(chunkSize(), 1), len(buffer))])
+			if err == io.EOF && reader.following != nil {
+				grown, err := r.awaitGrowth(reader, position, stop)
+				if err != nil {
+					send(errCh, err, stop)
+					return
+				}
+				if grown {
+					continue
+				}
+			}
 			if err == io.EOF {
-				dataCh <- DataChunk{Data: nil, EOF: true}
+				send(dataCh, DataChunk{Data: nil, EOF: true}, stop)
 				break
 			}
 			if err != nil {
-				errCh <- fmt.Errorf("failed to read file: %w", err)
+				send(errCh, fmt.Errorf("failed to read file: %w", err), stop)
 				return
 			}
 
 			// Send data chunk
+			position += int64(n)
 			data := make([]byte, n)
 			copy(data, buffer[:n])
-			dataCh <- DataChunk{Data: data, EOF: false}
+			if !send(dataCh, DataChunk{Data: data, EOF: false}, stop) {
+				return
+			}
 		}
 	}()
 
 	return dataCh, errCh
 }
 
-// close closes the internal file reader
-func (fr *fileReader) close() error {
-	return fr.file.Close()
+// followPollInterval is how often a followed file is checked for new data once everything in it has been read
+const followPollInterval = 250 * time.Millisecond
+
+// awaitGrowth waits for a followed file to grow past the read bytes, it returns false once following stops or stop closes.
+// A file that shrinks, as a log rotated by truncating it does, can't be followed any further.
+func (r *readerService) awaitGrowth(reader *fileReader, read int64, stop <-chan struct{}) (bool, error) {
+	for {
+		stopped := false
+		select {
+		case <-reader.following:
+			// Whatever was appended up to now still gets sent
+			stopped = true
+		case <-stop:
+			return false, nil
+		case <-time.After(followPollInterval):
+		}
+
+		stat, err := os.Stat(reader.filePath)
+		if err != nil {
+			return false, fmt.Errorf("failed to check %s for new data: %w", reader.filePath, err)
+		}
+		if stat.Size() < read {
+			return false, fmt.Errorf("%s shrank to %d bytes after %d were sent, it may have been truncated or rotated", reader.filePath, stat.Size(), read)
+		}
+		if stat.Size() > read || stopped {
+			return stat.Size() > read, nil
+		}
+	}
+}
+
+// send delivers v on ch unless stop is closed first, it reports whether v was delivered
+func send[T any](ch chan<- T, v T, stop <-chan struct{}) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// seekTo positions the reader at offset so that reading continues from there
+func (r *readerService) seekTo(reader *fileReader, offset int64) error {
+	if reader.source == nil {
+		if offset != 0 {
+			return fmt.Errorf("invalid offset %d for a symlink", offset)
+		}
+		return nil
+	}
+
+	if offset < 0 || offset > reader.source.Size() {
+		return fmt.Errorf("invalid offset %d for file of %d bytes", offset, reader.source.Size())
+	}
+
+	reader.offset = offset
+
+	log.Printf("File reader positioned at offset %d (%s)", offset, utils.FormatFileSize(offset))
+	return nil
+}
+
+// hashRange adds bytes from..to of the reader's source to h
+func (r *readerService) hashRange(reader *fileReader, h hash.Hash, from, to int64) error {
+	if from == to {
+		return nil
+	}
+
+	content, err := reader.source.Open(from)
+	if err != nil {
+		return fmt.Errorf("failed to open file for checksum: %w", err)
+	}
+	defer content.Close()
+
+	if _, err := io.CopyN(h, content, to-from); err != nil {
+		return fmt.Errorf("failed to calculate prefix checksum: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,284 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSource is a file whose reads are counted, each one a read syscall on the file
+type countingSource struct {
+	Source
+	reads atomic.Int64
+}
+
+// Open opens the file with its reads counted
+func (s *countingSource) Open(offset int64) (io.ReadCloser, error) {
+	content, err := s.Source.Open(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{ReadCloser: content, reads: &s.reads}, nil
+}
+
+// countingReader counts the reads of the ReadCloser it wraps
+type countingReader struct {
+	io.ReadCloser
+	reads *atomic.Int64
+}
+
+// Read reads from the wrapped reader and counts the read
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	return r.ReadCloser.Read(p)
+}
+
+// newCountingSource writes size bytes of random content to a file and returns it as a counted source
+func newCountingSource(tb testing.TB, size int) (*countingSource, []byte) {
+	tb.Helper()
+
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(tb.TempDir(), "file.bin")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+
+	fileService := NewFileService()
+	return &countingSource{Source: &fileSource{fileService: fileService, filePath: path, size: int64(size)}}, content
+}
+
+// readChunks reads source through a reader service reading readSize bytes at a time and returns the chunks
+func readChunks(tb testing.TB, source Source, readSize, chunkSize int) [][]byte {
+	tb.Helper()
+
+	r := newReaderService(NewFileService())
+	r.readSize = readSize
+	dataCh, errCh := r.startReading(r.prepareSourceForReading("file.bin", source), func() int { return chunkSize }, nil)
+
+	var chunks [][]byte
+	for chunk := range dataCh {
+		if chunk.EOF {
+			break
+		}
+		chunks = append(chunks, chunk.Data)
+	}
+	if err := <-errCh; err != nil {
+		tb.Fatal(err)
+	}
+	return chunks
+}
+
+func TestReadSizeReadsBlocksSlicedIntoChunks(t *testing.T) {
+	const (
+		size      = 4 * 1024 * 1024
+		chunkSize = 16 * 1024
+	)
+
+	tests := []struct {
+		name     string
+		readSize int
+		maxReads int64
+	}{
+		// One read per block, and one more finding the end of the file
+		{"1MB reads", 1024 * 1024, size/(1024*1024) + 1},
+		{"reads of a chunk", chunkSize, size/chunkSize + 1},
+		{"reads smaller than a chunk", 4 * 1024, size/chunkSize + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, content := newCountingSource(t, size)
+			chunks := readChunks(t, source, tt.readSize, chunkSize)
+
+			for i, chunk := range chunks {
+				if len(chunk) != chunkSize {
+					t.Fatalf("chunk %d is %d bytes, want %d", i, len(chunk), chunkSize)
+				}
+			}
+			if !bytes.Equal(bytes.Join(chunks, nil), content) {
+				t.Fatalf("chunks don't add up to the file")
+			}
+			if reads := source.reads.Load(); reads > tt.maxReads {
+				t.Fatalf("file read %d times, want at most %d", reads, tt.maxReads)
+			}
+		})
+	}
+}
+
+func BenchmarkReadSize(b *testing.B) {
+	const (
+		size      = 16 * 1024 * 1024
+		chunkSize = 16 * 1024
+	)
+
+	for _, readSize := range []int{chunkSize, defaultReadSize, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", readSize/1024), func(b *testing.B) {
+			source, _ := newCountingSource(b, size)
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			for b.Loop() {
+				readChunks(b, source, readSize, chunkSize)
+			}
+			b.ReportMetric(float64(source.reads.Load())/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// pacer makes its caller take as long as moving bytes at rate bytes per second does. Time spent elsewhere isn't
+// made up for, like a disk or a link left idle doesn't get faster afterwards.
+type pacer struct {
+	rate float64
+	busy time.Time // Until when the bytes so far keep it busy
+}
+
+// wait blocks until n more bytes have been moved
+func (p *pacer) wait(n int) {
+	p.busy = later(p.busy, time.Now()).Add(time.Duration(float64(n) / p.rate * float64(time.Second)))
+	for ahead := time.Until(p.busy); ahead > 0; ahead = time.Until(p.busy) {
+		if ahead > time.Millisecond {
+			time.Sleep(ahead)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+// later returns the later of a and b
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// pipeSource is content in memory delivered through an in-memory pipe. With a rate set, it comes in blocks
+// of a megabyte at that rate, like reads from a disk.
+type pipeSource struct {
+	content []byte
+	rate    float64
+}
+
+// Size returns the length of the content
+func (s *pipeSource) Size() int64 {
+	return int64(len(s.content))
+}
+
+// Checksum isn't needed to read the content
+func (s *pipeSource) Checksum() (string, error) {
+	return "", fmt.Errorf("pipe source has no checksum")
+}
+
+// Open writes the content from offset into a pipe and returns its read end, closing it stops the writing
+func (s *pipeSource) Open(offset int64) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		p := &pacer{rate: s.rate}
+		for rest := s.content[offset:]; len(rest) > 0; {
+			n := min(len(rest), 1024*1024)
+			if s.rate > 0 {
+				p.wait(n)
+			}
+			if _, err := pw.Write(rest[:n]); err != nil {
+				return
+			}
+			rest = rest[n:]
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+func TestReadAheadBuffersChunks(t *testing.T) {
+	const chunkSize = 16 * 1024
+
+	for _, readAhead := range []int{1, 16} {
+		t.Run(fmt.Sprintf("%d chunks", readAhead), func(t *testing.T) {
+			content := make([]byte, 64*chunkSize)
+			if _, err := rand.Read(content); err != nil {
+				t.Fatal(err)
+			}
+
+			r := newReaderService(NewFileService())
+			r.readSize, r.readAhead = chunkSize, readAhead
+			stop := make(chan struct{})
+			defer close(stop)
+			dataCh, errCh := r.startReading(r.prepareSourceForReading("pipe", &pipeSource{content: content}), func() int { return chunkSize }, stop)
+
+			// Nothing is taken, so reading stops once readAhead chunks wait
+			deadline := time.Now().Add(5 * time.Second)
+			for len(dataCh) < readAhead && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if waiting := len(dataCh); waiting != readAhead {
+				t.Fatalf("%d chunks read ahead, want %d", waiting, readAhead)
+			}
+
+			var received []byte
+			for chunk := range dataCh {
+				if chunk.EOF {
+					break
+				}
+				received = append(received, chunk.Data...)
+			}
+			select {
+			case err := <-errCh:
+				if err != nil {
+					t.Fatal(err)
+				}
+			default:
+			}
+			if !bytes.Equal(received, content) {
+				t.Fatalf("read %d bytes that differ from the %d in the pipe", len(received), len(content))
+			}
+		})
+	}
+}
+
+// BenchmarkReadAhead reads from a source and sends to a link that are both 500 MB/s. The source delivers a block
+// at a time, so with few chunks read ahead the link waits for each block; with more, reading goes on while the
+// link is busy and the transfer gets closer to that rate.
+func BenchmarkReadAhead(b *testing.B) {
+	const (
+		size      = 64 * 1024 * 1024
+		chunkSize = 64 * 1024
+		rate      = 500 * 1000 * 1000
+	)
+
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		b.Fatal(err)
+	}
+	source := &pipeSource{content: content, rate: rate}
+
+	for _, readAhead := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("%d chunks", readAhead), func(b *testing.B) {
+			b.SetBytes(size)
+
+			for b.Loop() {
+				r := newReaderService(NewFileService())
+				r.readSize, r.readAhead = chunkSize, readAhead
+				dataCh, errCh := r.startReading(r.prepareSourceForReading("pipe", source), func() int { return chunkSize }, nil)
+
+				link := &pacer{rate: rate}
+				for chunk := range dataCh {
+					link.wait(len(chunk.Data))
+				}
+				if err := <-errCh; err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// remoteHeaderTimeout bounds the wait for a remote server to start answering, not the download itself
+const remoteHeaderTimeout = 30 * time.Second
+
+// IsRemoteSource reports whether filePath is an http:// or https:// URL to stream from rather than a local path
+func IsRemoteSource(filePath string) bool {
+	return strings.HasPrefix(filePath, "http://") || strings.HasPrefix(filePath, "https://")
+}
+
+// httpSource is a file served over HTTP, read with range requests so sending can start past what the receiver holds
+type httpSource struct {
+	url      string
+	client   *http.Client
+	size     int64
+	name     string
+	mimeType string
+	modTime  time.Time
+}
+
+// newHTTPSource asks the server about the file at rawURL without downloading it
+func newHTTPSource(rawURL string) (*httpSource, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = remoteHeaderTimeout
+	source := &httpSource{
+		url:    rawURL,
+		client: &http.Client{Transport: transport},
+	}
+
+	resp, err := source.request(http.MethodHead, 0)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		// Some servers only answer GET, its headers say the same and the body is never read
+		resp.Body.Close()
+		resp, err = source.request(http.MethodGet, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", rawURL, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s: %s", rawURL, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("%s did not report its size, it can't be streamed", rawURL)
+	}
+
+	source.size = resp.ContentLength
+	source.name = remoteFileName(parsed, resp.Header)
+	source.mimeType = mediaType(resp.Header.Get("Content-Type"))
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		source.modTime = modTime
+	}
+
+	return source, nil
+}
+
+// Size returns the size the server reported
+func (s *httpSource) Size() int64 {
+	return s.size
+}
+
+// Checksum streams the whole file through SHA-256 without keeping it
+func (s *httpSource) Checksum() (string, error) {
+	content, err := s.Open(0)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, content)
+	if err != nil {
+		return "", fmt.Errorf("failed to calculate checksum: %w", err)
+	}
+	if n != s.size {
+		return "", fmt.Errorf("%s changed while reading it: got %d bytes, expected %d", s.url, n, s.size)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Open requests the file from offset on
+func (s *httpSource) Open(offset int64) (io.ReadCloser, error) {
+	resp, err := s.request(http.MethodGet, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", s.url, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			// The server ignored the range, skip what the receiver already holds
+			log.Printf("%s does not support range requests, skipping the first %d bytes", s.url, offset)
+			if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, fmt.Errorf("failed to skip to offset %d of %s: %w", offset, s.url, err)
+			}
+		}
+		return resp.Body, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", s.url, resp.Status)
+	}
+}
+
+// request sends a request for the file, starting at offset if it isn't 0
+func (s *httpSource) request(method string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bytes sent must be exactly the bytes served, never transparently decompressed
+	req.Header.Set("Accept-Encoding", "identity")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	return s.client.Do(req)
+}
+
+// remoteFileName picks the name of a remote file from its Content-Disposition header, or else the last element of its URL path
+func remoteFileName(u *url.URL, header http.Header) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+
+	if name := path.Base(u.Path); name != "." && name != "/" {
+		return name
+	}
+	return "download"
+}
+
+// prepareRemoteForSending prepares a file served over HTTP for streaming to the receiver.
+// The file is read once to calculate its checksum and again while sending, it is never saved to disk.
+func (d *DataProcessor) prepareRemoteForSending(rawURL string) (*types.FileMetadata, error) {
+	source, err := newHTTPSource(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Calculating checksum of %s (%s), this reads it once before sending", rawURL, utils.FormatFileSize(source.size))
+	checksum, sample, err := sourceChecksum(rawURL, source, d.checksumSample)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate file checksum: %w", err)
+	}
+
+	// Trust the server's type, unless it only says the content is binary
+	mimeType := source.mimeType
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = mime.TypeByExtension(filepath.Ext(source.name))
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	metadata := &types.FileMetadata{
+		Name:     source.name,
+		Size:     source.size,
+		MimeType: mimeType,
+		Checksum: checksum,
+		ModTime:  source.modTime,
+
+		ChecksumSample: sample,
+	}
+
+	log.Printf("Remote file prepared for reading: %s, size: %d bytes (%s)", rawURL, source.size, utils.FormatFileSize(source.size))
+
+	d.currentReader = d.readerService.prepareSourceForReading(rawURL, source)
+	return metadata, nil
+}
@@ -0,0 +1,238 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// resumeCheckpointInterval is how much of a file is sent between checkpoints saved to the resume cache
+const resumeCheckpointInterval = 64 * 1024 * 1024
+
+// ResumeCache keeps, for each file being sent, checkpoints of the SHA-256 of what was sent so far.
+// A sender restarted mid-transfer confirms the receiver's partial file from the last checkpoint
+// before it instead of reading the whole partial file's worth of the source again.
+type ResumeCache struct {
+	dir string
+}
+
+// resumeEntry is the cached state of one file, it only applies while the file is unchanged
+type resumeEntry struct {
+	Path        string             `json:"path"`
+	Size        int64              `json:"size"`
+	ModTime     time.Time          `json:"modTime"`
+	Checksum    string             `json:"checksum"`
+	Checkpoints []resumeCheckpoint `json:"checkpoints"`
+}
+
+// resumeCheckpoint is the hash state after the first Offset bytes of the file
+type resumeCheckpoint struct {
+	Offset int64  `json:"offset"`
+	State  []byte `json:"state"` // Marshaled SHA-256 state, base64 encoded in JSON
+}
+
+// prefixState follows the SHA-256 of the prefix of the prepared file that has been sent
+type prefixState struct {
+	hash   hash.Hash
+	offset int64 // Length of the prefix hashed so far
+	saved  int64 // Offset of the last checkpoint saved
+}
+
+// DefaultResumeCacheDir returns the directory the resume cache is kept in by default
+func DefaultResumeCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %w", err)
+	}
+	return filepath.Join(dir, "yapfs", "resume"), nil
+}
+
+// NewResumeCache creates a resume cache kept in dir
+func NewResumeCache(dir string) (*ResumeCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create resume cache directory: %w", err)
+	}
+	return &ResumeCache{dir: dir}, nil
+}
+
+// entryPath returns where the entry for the file described by entry is kept
+func (c *ResumeCache) entryPath(entry *resumeEntry) string {
+	sum := sha256.Sum256([]byte(entry.Path))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// load returns the cached checkpoints of the file described by entry, none if the file changed since they were saved
+func (c *ResumeCache) load(entry *resumeEntry) []resumeCheckpoint {
+	data, err := os.ReadFile(c.entryPath(entry))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read resume cache: %v", err)
+		return nil
+	}
+
+	cached, err := utils.DecodeJSON[resumeEntry](data)
+	if err != nil {
+		log.Printf("Warning: ignoring unreadable resume cache entry: %v", err)
+		return nil
+	}
+	if cached.Path != entry.Path || cached.Size != entry.Size || !cached.ModTime.Equal(entry.ModTime) || cached.Checksum != entry.Checksum {
+		return nil
+	}
+	return cached.Checkpoints
+}
+
+// save writes entry, replacing any earlier one for the same file
+func (c *ResumeCache) save(entry *resumeEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode resume cache entry: %w", err)
+	}
+
+	// Written aside and renamed so a sender killed mid-write leaves the previous entry
+	path := c.entryPath(entry)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write resume cache entry: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write resume cache entry: %w", err)
+	}
+	return nil
+}
+
+// remove deletes the entry for the file described by entry
+func (c *ResumeCache) remove(entry *resumeEntry) error {
+	if err := os.Remove(c.entryPath(entry)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove resume cache entry: %w", err)
+	}
+	return nil
+}
+
+// restoreHash returns a SHA-256 hash with a checkpoint's state
+func restoreHash(state []byte) (hash.Hash, error) {
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("failed to restore hash state: %w", err)
+	}
+	return h, nil
+}
+
+// SetResumeCache makes files prepared from now on use cache, nil to stop using one
+func (d *DataProcessor) SetResumeCache(cache *ResumeCache) {
+	d.resumeCache = cache
+}
+
+// cacheEntryFor starts the resume cache entry of a local file being prepared for sending, nil without a cache
+func (d *DataProcessor) cacheEntryFor(filePath string, metadata *types.FileMetadata) *resumeEntry {
+	if d.resumeCache == nil {
+		return nil
+	}
+
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		log.Printf("Warning: not caching progress of %s: %v", filePath, err)
+		return nil
+	}
+
+	entry := &resumeEntry{Path: path, Size: metadata.Size, ModTime: metadata.ModTime, Checksum: metadata.Checksum}
+	entry.Checkpoints = d.resumeCache.load(entry)
+	return entry
+}
+
+// prefixFromCache hashes the first n bytes of the prepared file starting from the last cached checkpoint before n
+func (d *DataProcessor) prefixFromCache(n int64) (*prefixState, error) {
+	state := &prefixState{hash: sha256.New()}
+	if d.resumeEntry != nil {
+		for _, checkpoint := range d.resumeEntry.Checkpoints {
+			if checkpoint.Offset <= n && checkpoint.Offset > state.offset {
+				h, err := restoreHash(checkpoint.State)
+				if err != nil {
+					return nil, err
+				}
+				state.hash, state.offset = h, checkpoint.Offset
+			}
+		}
+		if state.offset > 0 {
+			log.Printf("Confirming the receiver's %d bytes from the checkpoint cached at %d bytes", n, state.offset)
+		}
+	}
+
+	if err := d.readerService.hashRange(d.currentReader, state.hash, state.offset, n); err != nil {
+		return nil, err
+	}
+	state.offset, state.saved = n, n
+	return state, nil
+}
+
+// TrackSent starts following what is sent of the prepared file from offset, so checkpoints can be cached.
+// It only follows from the start or from a prefix IsPrefixMatched has just confirmed.
+func (d *DataProcessor) TrackSent(offset int64) {
+	if d.resumeEntry == nil {
+		d.sentPrefix = nil
+		return
+	}
+
+	if offset == 0 {
+		d.sentPrefix = &prefixState{hash: sha256.New()}
+		return
+	}
+	if d.sentPrefix == nil || d.sentPrefix.offset != offset {
+		d.sentPrefix = nil
+	}
+}
+
+// RecordSent adds the next data sent of the prepared file, saving a checkpoint every resumeCheckpointInterval bytes
+func (d *DataProcessor) RecordSent(data []byte) {
+	if d.sentPrefix == nil {
+		return
+	}
+
+	d.sentPrefix.hash.Write(data)
+	d.sentPrefix.offset += int64(len(data))
+	if d.sentPrefix.offset-d.sentPrefix.saved < resumeCheckpointInterval {
+		return
+	}
+	d.sentPrefix.saved = d.sentPrefix.offset
+
+	// Sending this part again after a restart, its checkpoint is already cached
+	if n := len(d.resumeEntry.Checkpoints); n > 0 && d.resumeEntry.Checkpoints[n-1].Offset >= d.sentPrefix.offset {
+		return
+	}
+
+	state, err := d.sentPrefix.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		log.Printf("Warning: failed to save hash state, progress is no longer cached: %v", err)
+		d.sentPrefix = nil
+		return
+	}
+	d.resumeEntry.Checkpoints = append(d.resumeEntry.Checkpoints, resumeCheckpoint{Offset: d.sentPrefix.offset, State: state})
+
+	if err := d.resumeCache.save(d.resumeEntry); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// ForgetSent drops the cached progress of the prepared file once it has been sent completely
+func (d *DataProcessor) ForgetSent() {
+	d.sentPrefix = nil
+	if d.resumeEntry == nil {
+		return
+	}
+
+	if err := d.resumeCache.remove(d.resumeEntry); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	d.resumeEntry.Checkpoints = nil
+}
@@ -0,0 +1,123 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// sampledHash fingerprints a file by its first and last sample bytes and its length, instead of all of its content.
+// It catches a truncated, padded or altogether different file quickly, but not corruption between the two ends.
+type sampledHash struct {
+	hash      hash.Hash
+	sample    int64
+	tailStart int64 // Offset the tail sample starts at, worked out from the size the file should have
+	offset    int64 // Offset in the file the next write is at
+}
+
+// newSampledHash creates a sampled hash for a file of size bytes.
+// A file up to twice the sample long is hashed whole, the two samples meet in the middle.
+func newSampledHash(size, sample int64) *sampledHash {
+	return &sampledHash{
+		hash:      sha256.New(),
+		sample:    sample,
+		tailStart: max(size-sample, sample),
+	}
+}
+
+// newSampledHashFor creates the sampled hash to verify a file received with metadata, nil if its checksum isn't sampled
+func newSampledHashFor(metadata *types.FileMetadata) *sampledHash {
+	if metadata.ChecksumSample <= 0 {
+		return nil
+	}
+	return newSampledHash(metadata.Size, metadata.ChecksumSample)
+}
+
+// Write hashes the parts of p that fall in either sample, following the file from the start
+func (h *sampledHash) Write(p []byte) (int, error) {
+	start, end := h.offset, h.offset+int64(len(p))
+	h.offset = end
+
+	if start < h.sample {
+		h.hash.Write(p[:min(end, h.sample)-start])
+	}
+	if end > h.tailStart {
+		h.hash.Write(p[max(start, h.tailStart)-start:])
+	}
+	return len(p), nil
+}
+
+// sum returns the fingerprint in hex, the hash of the samples then the length of what was written
+func (h *sampledHash) sum() string {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(h.offset))
+
+	fingerprint := sha256.Sum256(append(length[:], h.hash.Sum(nil)...))
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// sampledChecksum reads the first and last sample bytes of source, skipping the rest, and returns their fingerprint
+func sampledChecksum(source Source, sample int64) (string, error) {
+	size := source.Size()
+	h := newSampledHash(size, sample)
+
+	if err := copySection(h, source, 0, min(sample, size)); err != nil {
+		return "", err
+	}
+	if size > h.tailStart {
+		h.offset = h.tailStart
+		if err := copySection(h, source, h.tailStart, size-h.tailStart); err != nil {
+			return "", err
+		}
+	}
+
+	return h.sum(), nil
+}
+
+// copySection copies n bytes of source from offset into w
+func copySection(w io.Writer, source Source, offset, n int64) error {
+	content, err := source.Open(offset)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if _, err := io.CopyN(w, content, n); err != nil {
+		return fmt.Errorf("failed to calculate sampled checksum: %w", err)
+	}
+	return nil
+}
+
+// sourceChecksum checksums source for sending, only sampling it when it is more than twice checksumSample long.
+// It returns the checksum and how much was sampled at each end, 0 for a full SHA-256.
+func sourceChecksum(name string, source Source, checksumSample int64) (string, int64, error) {
+	if checksumSample <= 0 || source.Size() <= 2*checksumSample {
+		checksum, err := source.Checksum()
+		return checksum, 0, err
+	}
+
+	log.Printf("Warning: only checksumming the first and last %s of %s and its size, a weak fingerprint that misses corruption in between",
+		utils.FormatFileSize(checksumSample), name)
+	checksum, err := sampledChecksum(source, checksumSample)
+	return checksum, checksumSample, err
+}
+
+// warnSampled logs that the file described by metadata can only be verified by a sampled checksum
+func warnSampled(metadata *types.FileMetadata) {
+	if metadata.ChecksumSample > 0 {
+		log.Printf("Warning: the sender only checksummed the first and last %s of %s and its size, corruption in between won't be detected",
+			utils.FormatFileSize(metadata.ChecksumSample), metadata.Name)
+	}
+}
+
+// SetChecksumSample makes files prepared from now on be checksummed by their first and last n bytes only, 0 to hash them whole
+func (d *DataProcessor) SetChecksumSample(n int64) {
+	d.checksumSample = n
+}
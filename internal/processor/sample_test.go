@@ -0,0 +1,198 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"yapfs/pkg/types"
+)
+
+// testSample is the bytes checksummed at each end of files in these tests
+const testSample = 4096
+
+// randomContent returns size random bytes
+func randomContent(tb testing.TB, size int) []byte {
+	tb.Helper()
+
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		tb.Fatal(err)
+	}
+	return content
+}
+
+// newFileSource writes content to a new file and returns it as a source
+func newFileSource(tb testing.TB, content []byte) Source {
+	tb.Helper()
+
+	path := filepath.Join(tb.TempDir(), "file.bin")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return &fileSource{fileService: NewFileService(), filePath: path, size: int64(len(content))}
+}
+
+// checksumOf is the sampled checksum of content
+func checksumOf(t *testing.T, content []byte) string {
+	t.Helper()
+
+	checksum, err := sampledChecksum(newFileSource(t, content), testSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checksum
+}
+
+func TestSourceChecksumOnlySamplesLargerFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantSample int64
+	}{
+		{"smaller than a sample", testSample / 2, 0},
+		{"two samples long", 2 * testSample, 0},
+		{"a byte over two samples", 2*testSample + 1, testSample},
+		{"many samples long", 10 * testSample, testSample},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := randomContent(t, tt.size)
+			full := sha256.Sum256(content)
+
+			checksum, sample, err := sourceChecksum("file.bin", newFileSource(t, content), testSample)
+			if err != nil {
+				t.Fatalf("sourceChecksum() error = %v", err)
+			}
+			if sample != tt.wantSample {
+				t.Fatalf("sourceChecksum() sampled %d bytes, want %d", sample, tt.wantSample)
+			}
+			if tt.wantSample == 0 && checksum != hex.EncodeToString(full[:]) {
+				t.Fatalf("sourceChecksum() = %s, want the full SHA-256 %x", checksum, full)
+			}
+			if tt.wantSample > 0 && checksum == hex.EncodeToString(full[:]) {
+				t.Fatalf("sourceChecksum() returned the full SHA-256 of a sampled file")
+			}
+		})
+	}
+}
+
+func TestSampledChecksumCatchesGrossCorruption(t *testing.T) {
+	original := randomContent(t, 10*testSample)
+
+	// flip returns a copy of original with the byte at offset changed
+	flip := func(offset int) []byte {
+		changed := bytes.Clone(original)
+		changed[offset] ^= 0xff
+		return changed
+	}
+
+	tests := []struct {
+		name     string
+		received []byte
+		caught   bool
+	}{
+		{"same file", bytes.Clone(original), false},
+		{"truncated", original[:len(original)-1], true},
+		{"truncated to its samples", append(bytes.Clone(original[:testSample]), original[len(original)-testSample:]...), true},
+		{"padded", append(bytes.Clone(original), 0), true},
+		{"different head", flip(0), true},
+		{"different end of the head", flip(testSample - 1), true},
+		{"different tail", flip(len(original) - 1), true},
+		{"different start of the tail", flip(len(original) - testSample), true},
+		{"wrong file", randomContent(t, len(original)), true},
+		// Between the samples nothing is read, this is what sampling gives up
+		{"corrupt middle", flip(len(original) / 2), false},
+		{"corrupt just past the head", flip(testSample), false},
+	}
+
+	want := checksumOf(t, original)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if caught := checksumOf(t, tt.received) != want; caught != tt.caught {
+				t.Fatalf("corruption caught = %v, want %v", caught, tt.caught)
+			}
+		})
+	}
+}
+
+func TestSampledHashMatchesSampledChecksum(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize int
+		resumeAt  int // Bytes already on disk, replayed in one write before the chunks
+	}{
+		{"chunks within the samples", 10 * testSample, 1000, 0},
+		{"chunks larger than a sample", 10 * testSample, 3 * testSample, 0},
+		{"one write", 10 * testSample, 10 * testSample, 0},
+		{"hashed whole", 2 * testSample, 1000, 0},
+		{"resumed in the head", 10 * testSample, 1000, testSample / 2},
+		{"resumed in the middle", 10 * testSample, 1000, 5 * testSample},
+		{"resumed in the tail", 10 * testSample, 1000, 9*testSample + 100},
+		{"resumed across the samples of a short file", 2*testSample - 10, 1000, testSample + 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := randomContent(t, tt.size)
+			want, err := sampledChecksum(newFileSource(t, content), testSample)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := newSampledHashFor(&types.FileMetadata{Size: int64(tt.size), ChecksumSample: testSample})
+			h.Write(content[:tt.resumeAt])
+			for offset := tt.resumeAt; offset < tt.size; offset += tt.chunkSize {
+				h.Write(content[offset:min(offset+tt.chunkSize, tt.size)])
+			}
+			if got := h.sum(); got != want {
+				t.Fatalf("streamed checksum %s, sampledChecksum() %s", got, want)
+			}
+		})
+	}
+}
+
+func TestResumedWriteVerifiesSampledChecksum(t *testing.T) {
+	content := randomContent(t, 10*testSample)
+	checksum, sample, err := sourceChecksum("file.bin", newFileSource(t, content), testSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &types.FileMetadata{Name: "file.bin", Size: int64(len(content)), Checksum: checksum, ChecksumSample: sample}
+
+	// The partial file ends in the middle, so the tail sample all comes from the chunks still to arrive
+	for _, resumeAt := range []int{testSample / 2, 5 * testSample, 9*testSample + 100} {
+		destDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(destDir, "file.bin"), content[:resumeAt], 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		w := newWriterService(NewFileService())
+		writer, destPath, err := w.prepareFileForWriting(destDir, metadata, int64(resumeAt), WriterOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for offset := resumeAt; offset < len(content); offset += 1000 {
+			if err := w.writeData(writer, content[offset:min(offset+1000, len(content))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := w.finishWriting(writer); err != nil {
+			t.Fatalf("resumed at %d: finishWriting() error = %v", resumeAt, err)
+		}
+
+		received, err := os.ReadFile(destPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, content) {
+			t.Fatalf("resumed at %d: received %d bytes that differ from the %d sent", resumeAt, len(received), len(content))
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"yapfs/pkg/types"
+)
+
+// errSequenceMismatch is returned when received data isn't the sequence in order, see sequenceChecker
+var errSequenceMismatch = errors.New("received data is out of sequence")
+
+// sequenceSource generates content where every byte tells its own offset: the 8-byte word at each
+// multiple of 8 holds its index, big-endian. Data arriving out of place then shows exactly where it came from.
+type sequenceSource struct {
+	size int64
+}
+
+// sequenceByte returns the byte of the sequence at offset
+func sequenceByte(offset int64) byte {
+	return byte(uint64(offset/8) >> (56 - 8*(offset%8)))
+}
+
+// Size returns the length of the sequence
+func (s *sequenceSource) Size() int64 {
+	return s.size
+}
+
+// Checksum calculates the SHA-256 checksum of the sequence
+func (s *sequenceSource) Checksum() (string, error) {
+	reader, _ := s.Open(0)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Open generates the sequence from offset to the end
+func (s *sequenceSource) Open(offset int64) (io.ReadCloser, error) {
+	return io.NopCloser(&sequenceReader{pos: offset, size: s.size}), nil
+}
+
+// sequenceReader reads a sequenceSource
+type sequenceReader struct {
+	pos, size int64
+}
+
+// Read fills p with the sequence from the current position
+func (r *sequenceReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), r.size-r.pos))
+	for i := range n {
+		p[i] = sequenceByte(r.pos + int64(i))
+	}
+	r.pos += int64(n)
+	return n, nil
+}
+
+// sequenceChecker checks that the data of a file being received is the sequence, chunk by chunk as it arrives.
+// The first chunk out of place is reported by its number and the offset its data was sent from, so a chunk
+// that was duplicated, reordered or lost is pinpointed rather than showing up as a checksum mismatch at the end.
+type sequenceChecker struct {
+	offset int64 // Where the next chunk belongs
+	chunk  int64 // Number of the next chunk, counting from 0 at the offset checking started
+}
+
+// check compares a received chunk with the sequence at the current offset and moves past it
+func (c *sequenceChecker) check(data []byte) error {
+	defer func() {
+		c.offset += int64(len(data))
+		c.chunk++
+	}()
+
+	bad := sequenceMismatch(data, c.offset)
+	if bad < 0 {
+		return nil
+	}
+
+	from := sequenceOrigin(data)
+	switch {
+	case from < 0 && bad > 0:
+		return fmt.Errorf("%w: chunk %d at offset %d is corrupted from offset %d", errSequenceMismatch, c.chunk, c.offset, c.offset+int64(bad))
+	case from < 0:
+		return fmt.Errorf("%w: chunk %d at offset %d holds data that isn't from the sequence", errSequenceMismatch, c.chunk, c.offset)
+	case from < c.offset:
+		return fmt.Errorf("%w: chunk %d at offset %d holds data sent from offset %d again, %d bytes back (duplicated or reordered)",
+			errSequenceMismatch, c.chunk, c.offset, from, c.offset-from)
+	default:
+		return fmt.Errorf("%w: chunk %d at offset %d holds data sent from offset %d, %d bytes ahead (lost or reordered)",
+			errSequenceMismatch, c.chunk, c.offset, from, from-c.offset)
+	}
+}
+
+// sequenceOrigin returns the offset data was sent from if all of it is a stretch of the sequence, -1 if it isn't.
+// Whichever of its first 8 bytes starts a word, that word holds its index.
+func sequenceOrigin(data []byte) int64 {
+	for skip := 0; skip < 8 && skip+8 <= len(data); skip++ {
+		from := int64(binary.BigEndian.Uint64(data[skip:skip+8])*8) - int64(skip)
+		if from >= 0 && sequenceMismatch(data, from) < 0 {
+			return from
+		}
+	}
+	return -1
+}
+
+// sequenceMismatch returns the index of the first byte of data that isn't the sequence starting at offset, -1 if none
+func sequenceMismatch(data []byte, offset int64) int {
+	for i, b := range data {
+		if b != sequenceByte(offset+int64(i)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sequenceChunks reads a sequence of size bytes into chunks of chunkSize the way a file is read for sending
+func sequenceChunks(t *testing.T, size int64, chunkSize int) [][]byte {
+	t.Helper()
+
+	r := newReaderService(NewFileService())
+	reader := r.prepareSourceForReading("sequence", &sequenceSource{size: size})
+	dataCh, errCh := r.startReading(reader, func() int { return chunkSize }, nil)
+
+	var chunks [][]byte
+	for chunk := range dataCh {
+		if chunk.EOF {
+			break
+		}
+		chunks = append(chunks, chunk.Data)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("reading the sequence: %v", err)
+	}
+	return chunks
+}
+
+func TestSequenceReassembly(t *testing.T) {
+	const size, chunkSize = 100_003, 1000
+
+	source := &sequenceSource{size: size}
+	checksum, err := source.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWriterService(NewFileService())
+	metadata := &types.FileMetadata{Name: "sequence.bin", Size: size, Checksum: checksum}
+	writer, destPath, err := w.prepareFileForWriting(t.TempDir(), metadata, 0, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker := &sequenceChecker{}
+	for _, data := range sequenceChunks(t, size, chunkSize) {
+		if err := checker.check(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.writeData(writer, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.finishWriting(writer); err != nil {
+		t.Fatalf("finishWriting() error = %v", err)
+	}
+
+	written, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(written)) != size || sequenceMismatch(written, 0) >= 0 {
+		t.Fatalf("written file isn't the sequence, %d bytes, first bad byte at %d", len(written), sequenceMismatch(written, 0))
+	}
+}
+
+func TestSequenceCheckerFindsChunk(t *testing.T) {
+	const chunkSize = 1000
+
+	tests := []struct {
+		name    string
+		reorder func(chunks [][]byte) [][]byte
+		wantErr string
+	}{
+		{
+			name:    "in order",
+			reorder: func(chunks [][]byte) [][]byte { return chunks },
+		},
+		{
+			name: "duplicated",
+			reorder: func(chunks [][]byte) [][]byte {
+				return append(append(append([][]byte{}, chunks[:3]...), chunks[2]), chunks[3:]...)
+			},
+			wantErr: "chunk 3 at offset 3000 holds data sent from offset 2000 again, 1000 bytes back",
+		},
+		{
+			name: "reordered",
+			reorder: func(chunks [][]byte) [][]byte {
+				chunks[4], chunks[5] = chunks[5], chunks[4]
+				return chunks
+			},
+			wantErr: "chunk 4 at offset 4000 holds data sent from offset 5000, 1000 bytes ahead",
+		},
+		{
+			name: "lost",
+			reorder: func(chunks [][]byte) [][]byte {
+				return append(append([][]byte{}, chunks[:2]...), chunks[3:]...)
+			},
+			wantErr: "chunk 2 at offset 2000 holds data sent from offset 3000, 1000 bytes ahead",
+		},
+		{
+			name: "corrupted",
+			reorder: func(chunks [][]byte) [][]byte {
+				chunks[6][17] ^= 0xff
+				return chunks
+			},
+			wantErr: "chunk 6 at offset 6000 is corrupted from offset 6017",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &sequenceChecker{}
+			var err error
+			for _, data := range tt.reorder(sequenceChunks(t, 10*chunkSize, chunkSize)) {
+				if err = checker.check(data); err != nil {
+					break
+				}
+			}
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("check() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errSequenceMismatch) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("check() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"yapfs/pkg/types"
+)
+
+// sniffLen is how many leading bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// ErrContentMismatch is returned when a file's content doesn't match the type its extension implies
+var ErrContentMismatch = errors.New("file content does not match its extension")
+
+// textualTypes are non-text/* media types whose content sniffs as plain text
+var textualTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/yaml",
+	"application/x-sh",
+	"application/x-yaml",
+	"image/svg+xml",
+}
+
+// zipBasedTypes are media types stored as zip archives, which sniff as application/zip
+var zipBasedTypes = []string{
+	"application/epub+zip",
+	"application/java-archive",
+	"application/vnd.android.package-archive",
+	"application/vnd.oasis.opendocument.",
+	"application/vnd.openxmlformats-officedocument.",
+}
+
+// sniffContentType compares the type detected from the first bytes of a file against the type implied by name.
+// It returns both types and whether they agree; a file with an unknown extension or undetectable content always agrees.
+func sniffContentType(name string, head []byte) (expected, detected string, ok bool) {
+	expected = mediaType(mime.TypeByExtension(filepath.Ext(name)))
+	detected = mediaType(http.DetectContentType(head))
+
+	if expected == "" || len(head) == 0 {
+		return expected, detected, true
+	}
+
+	return expected, detected, typesAgree(expected, detected)
+}
+
+// checkDeclaredType compares the type detected from the start of the written file at path with the MIME type
+// the sender declared for it. It returns the mismatch, or nil if they agree or the declared type says nothing.
+func checkDeclaredType(path string, metadata *types.FileMetadata) (*types.TypeMismatch, error) {
+	declared := mediaType(metadata.MimeType)
+	if declared == "" || declared == "application/octet-stream" || strings.HasPrefix(declared, "inode/") {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open received file to detect its type: %w", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read received file to detect its type: %w", err)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	// Content that is not text at all contradicts a declared text type, whatever else it may be
+	detected := mediaType(http.DetectContentType(head[:n]))
+	binaryText := strings.HasPrefix(declared, "text/") && detected == "application/octet-stream"
+	if typesAgree(declared, detected) && !binaryText {
+		return nil, nil
+	}
+	return &types.TypeMismatch{Name: metadata.Name, Declared: declared, Detected: detected}, nil
+}
+
+// typesAgree reports whether content detected as detected may be a file of type expected
+func typesAgree(expected, detected string) bool {
+	switch {
+	case expected == detected:
+		return true
+	case detected == "application/octet-stream":
+		// Nothing recognisable in the content, it can't contradict the extension
+		return true
+	case detected == "text/plain" || detected == "text/xml":
+		return strings.HasPrefix(expected, "text/") || strings.HasSuffix(expected, "+xml") ||
+			strings.HasSuffix(expected, "+json") || hasPrefixIn(expected, textualTypes)
+	case strings.HasPrefix(detected, "text/"):
+		return strings.HasPrefix(expected, "text/")
+	case detected == "application/zip":
+		return hasPrefixIn(expected, zipBasedTypes)
+	default:
+		return false
+	}
+}
+
+// mediaType strips parameters like "; charset=utf-8" from a MIME type
+func mediaType(mimeType string) string {
+	if mimeType == "" {
+		return ""
+	}
+
+	parsed, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return mimeType
+	}
+	return parsed
+}
+
+// hasPrefixIn reports whether s starts with any of prefixes
+func hasPrefixIn(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
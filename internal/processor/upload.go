@@ -0,0 +1,170 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"yapfs/internal/config"
+	"yapfs/internal/s3"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// resolveObjectURL builds the s3:// URL of the object a received file is uploaded to, like resolveDestPath does for local files
+func (w *writerService) resolveObjectURL(destURL string, metadata *types.FileMetadata, opts WriterOptions) string {
+	if metadata.Dir != "" {
+		return s3.JoinURL(destURL, metadata.Dir, metadata.Name)
+	}
+	if opts.As != "" {
+		return s3.JoinURL(destURL, opts.As)
+	}
+	if subDir := w.routeByTag(opts.RouteByTag, metadata); subDir != "" {
+		return s3.JoinURL(destURL, subDir, metadata.Name)
+	}
+	if subDir := routeByMimeType(opts.MimeRoutes, metadata.MimeType); subDir != "" {
+		return s3.JoinURL(destURL, subDir, metadata.Name)
+	}
+	return s3.JoinURL(destURL, metadata.Name)
+}
+
+// prepareUpload starts uploading a received file to the object storage at destURL.
+// Nothing appears in the bucket until the upload is completed by finishWriting, and only if the file verifies.
+func (w *writerService) prepareUpload(destURL string, metadata *types.FileMetadata, offset int64, opts WriterOptions) (*fileWriter, string, error) {
+	if offset > 0 {
+		return nil, "", fmt.Errorf("uploads to object storage cannot be resumed")
+	}
+
+	objectURL := w.resolveObjectURL(destURL, metadata, opts)
+	bucket, key, err := s3.ParseURL(objectURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The join already cleaned out "..", still make sure the key stays under the destination prefix
+	if _, prefix, _ := s3.ParseURL(destURL); prefix != "" && !strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/") {
+		return nil, "", fmt.Errorf("file name %q escapes destination prefix", metadata.Name)
+	}
+
+	client, err := s3.NewClient(s3Options(opts.S3))
+	if err != nil {
+		return nil, "", err
+	}
+
+	header := http.Header{}
+	if metadata.MimeType != "" {
+		header.Set("Content-Type", metadata.MimeType)
+	}
+	// A sampled checksum isn't the SHA-256 of the object
+	if metadata.ChecksumSample == 0 {
+		header.Set("X-Amz-Meta-Sha256", metadata.Checksum)
+	}
+
+	upload := client.NewUpload(context.Background(), bucket, key, header, opts.S3.PartSizeMB*1024*1024)
+
+	log.Printf("File prepared for uploading: %s (original: %s, size: %d bytes, type: %s, checksum: %s)",
+		objectURL, metadata.Name, metadata.Size, metadata.MimeType, metadata.Checksum)
+	warnSampled(metadata)
+
+	writer := &fileWriter{
+		sink:     upload,
+		destPath: objectURL,
+		filePath: objectURL,
+		metadata: metadata,
+		hash:     sha256.New(),
+		sample:   newSampledHashFor(metadata),
+		opts:     opts,
+	}
+
+	return writer, objectURL, nil
+}
+
+// finishUpload verifies the received data and only then completes the upload,
+// then reads the stored object back to confirm the bucket holds exactly what was sent
+func (w *writerService) finishUpload(writer *fileWriter, upload *s3.Upload) (uint64, error) {
+	totalBytes := writer.totalBytesWritten
+	objectURL := writer.destPath
+
+	calculatedChecksum := writer.checksum()
+	expectedChecksum := writer.metadata.Checksum
+
+	// Files shorter than the sniff length are checked once complete
+	if !writer.headChecked {
+		if err := w.checkContentType(writer); err != nil {
+			upload.Abort()
+			return totalBytes, err
+		}
+	}
+
+	if calculatedChecksum != expectedChecksum {
+		upload.Abort()
+		return totalBytes, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expectedChecksum, calculatedChecksum)
+	}
+
+	if writer.opts.VerifyCode != "" {
+		if !strings.HasPrefix(calculatedChecksum, writer.opts.VerifyCode) {
+			upload.Abort()
+			return totalBytes, fmt.Errorf("%w: expected checksum starting with %s, got %s", ErrVerifyCodeMismatch, writer.opts.VerifyCode, calculatedChecksum)
+		}
+		log.Printf("Verification code %s matches received file", utils.FormatVerifyCode(calculatedChecksum))
+	}
+
+	if err := upload.Close(); err != nil {
+		return totalBytes, fmt.Errorf("failed to complete upload: %w", err)
+	}
+
+	storedChecksum, err := w.objectChecksum(upload, writer.metadata)
+	if err != nil {
+		return totalBytes, fmt.Errorf("failed to verify uploaded object %s: %w", objectURL, err)
+	}
+	if storedChecksum != expectedChecksum {
+		if err := upload.Delete(); err != nil {
+			log.Printf("Warning: failed to delete corrupted object %s: %v", objectURL, err)
+		}
+		return totalBytes, fmt.Errorf("uploaded object %w: expected %s, got %s", ErrChecksumMismatch, expectedChecksum, storedChecksum)
+	}
+
+	log.Printf("File upload completed: %s, %d bytes uploaded, %s of the stored object verified", objectURL, totalBytes, writer.checksumKind())
+	return totalBytes, nil
+}
+
+// objectChecksum calculates the checksum of the uploaded object as stored, sampled like the metadata's if it is
+func (w *writerService) objectChecksum(upload *s3.Upload, metadata *types.FileMetadata) (string, error) {
+	object, err := upload.Open()
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	hash := sha256.New()
+	sample := newSampledHashFor(metadata)
+	stored := io.Writer(hash)
+	if sample != nil {
+		stored = sample
+	}
+	if _, err := io.Copy(stored, object); err != nil {
+		return "", fmt.Errorf("failed to read uploaded object: %w", err)
+	}
+
+	if sample != nil {
+		return sample.sum(), nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// s3Options converts the S3 configuration to client options
+func s3Options(cfg config.S3Config) s3.Options {
+	return s3.Options{
+		Endpoint:        cfg.Endpoint,
+		Region:          cfg.Region,
+		AccessKeyID:     cfg.AccessKeyID,
+		SecretAccessKey: cfg.SecretAccessKey,
+		SessionToken:    cfg.SessionToken,
+		ForcePathStyle:  cfg.ForcePathStyle,
+	}
+}
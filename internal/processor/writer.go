@@ -1,15 +1,35 @@
 package processor
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"yapfs/internal/config"
+	"yapfs/internal/s3"
 	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// Errors rejecting a received file, wrapped with the details
+var (
+	ErrChecksumMismatch   = errors.New("checksum validation failed")
+	ErrVerifyCodeMismatch = errors.New("verification code mismatch")
+	ErrExistingNewer      = errors.New("existing file is newer than the incoming file")
+	ErrDestinationExists  = errors.New("destination file already exists")
 )
 
 // writerService handles file writing operations
@@ -24,40 +44,420 @@ func newWriterService(fileService *FileService) *writerService {
 	}
 }
 
+// ConflictPolicy decides what happens when the destination file already exists
+type ConflictPolicy string
+
+const (
+	ConflictFail      ConflictPolicy = "fail"      // Refuse the transfer and keep the existing file
+	ConflictOverwrite ConflictPolicy = "overwrite" // Replace the existing file
+	ConflictRename    ConflictPolicy = "rename"    // Save under a new name like "file (1).txt"
+	ConflictSkip      ConflictPolicy = "skip"      // Keep the existing file and don't transfer
+)
+
+// ParseConflictPolicy validates a conflict policy name
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictFail, ConflictOverwrite, ConflictRename, ConflictSkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q, expected %s, %s, %s or %s", name, ConflictFail, ConflictOverwrite, ConflictRename, ConflictSkip)
+	}
+}
+
+// WriteMode decides how file data reaches its final path
+type WriteMode string
+
+const (
+	WriteModeDirect WriteMode = "direct" // Write straight to the final path
+	WriteModeAtomic WriteMode = "atomic" // Write to a ".part" file next to it and rename it into place once verified
+)
+
+// partSuffix is appended to the final path for files being written in atomic mode
+const partSuffix = ".part"
+
+// ParseWriteMode validates a write mode name
+func ParseWriteMode(name string) (WriteMode, error) {
+	switch mode := WriteMode(name); mode {
+	case WriteModeDirect, WriteModeAtomic:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown write mode %q, expected %s or %s", name, WriteModeDirect, WriteModeAtomic)
+	}
+}
+
+// ParseFileMode validates permissions given in octal, like 0640 or 640
+func ParseFileMode(s string) (os.FileMode, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "0o"), "0O")
+	mode, err := strconv.ParseUint(digits, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q, expected octal permissions like 0640", s)
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q, only permission bits up to 0777 can be set", s)
+	}
+	if mode == 0 {
+		return 0, fmt.Errorf("invalid file mode %q, it would leave the file unreadable even by its owner", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// WriterOptions configures how received files are written
+type WriterOptions struct {
+	KeepOnMismatch bool               // Keep a file that fails checksum validation as destPath+".corrupt" instead of deleting it
+	Resume         bool               // Keep partial files on interruption so a later transfer can resume them
+	MimeRoutes     []config.MimeRoute // Route files into subdirectories of the destination by MIME type
+	NoClobberNewer bool               // Refuse to overwrite an existing file that is newer than the incoming one
+	VerifyCode     string             // Hex prefix the received file's checksum must start with, as read out by the sender
+	OnConflict     ConflictPolicy     // What to do when the destination file already exists, fail if empty
+	SkipIdentical  bool               // Skip the transfer if the existing file has the same checksum, regardless of OnConflict
+	WriteMode      WriteMode          // How data reaches the final path, direct if empty
+	StrictMime     bool               // Reject a file whose content doesn't match its extension instead of only warning
+	CheckMime      bool               // Compare the written file's detected type with the declared MIME type once complete
+	ValidateFormat bool               // Open a completed zip, gzip, png or jpeg file as its format and fail the file if it doesn't
+	RouteByTag     string             // Route files into the subdirectory named by the value of this metadata tag, before MIME routes
+	As             string             // Save a single file straight in the destination under this name instead of its own, without routing
+	FileMode       os.FileMode        // Exact permissions of received files regardless of umask, 0 keeps the default
+	WriteBuffer    int                // Bytes of data gathered before they are written to a local file, 0 writes each chunk as it comes
+	S3             config.S3Config    // Storage used when the destination is an s3:// URL
+}
+
+// fileSink is where the data of a file being received goes: a local file, or an object being uploaded
+type fileSink interface {
+	io.Writer
+	Close() error
+}
+
+// bufferedFile gathers writes to a local file so small chunks don't each cost a write to disk, closing it writes out the rest
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+// Close writes out the buffered data and closes the file
+func (b *bufferedFile) Close() error {
+	if err := b.Flush(); err != nil {
+		b.file.Close()
+		return fmt.Errorf("failed to write buffered data: %w", err)
+	}
+	return b.file.Close()
+}
+
 // fileWriter wraps an open file for receiving (internal to WriterService)
 type fileWriter struct {
-	file              *os.File
-	destPath          string
+	sink              fileSink
+	destPath          string // Final path of the file
+	filePath          string // Path data is written to, destPath itself unless writing atomically
 	totalBytesWritten uint64
 	metadata          *types.FileMetadata // Metadata of the file being received
-	hash              hash.Hash     // SHA-256 hash for checksum validation
+	hash              hash.Hash           // SHA-256 hash for checksum validation
+	sample            *sampledHash        // Checked instead of hash when the sender only sampled the file, nil otherwise
+	head              []byte              // First bytes of the file, kept to sniff its content type
+	headChecked       bool                // Content type has been checked against the extension
+	opts              WriterOptions
+}
+
+// resolveDestPath builds the destination path for the file, applying MIME type routing.
+// Files of a directory transfer keep their place in the tree instead.
+func (w *writerService) resolveDestPath(destDir string, metadata *types.FileMetadata, opts WriterOptions) string {
+	if s3.IsURL(destDir) {
+		return w.resolveObjectURL(destDir, metadata, opts)
+	}
+	if metadata.Dir != "" {
+		return filepath.Join(destDir, filepath.FromSlash(metadata.Dir), metadata.Name)
+	}
+	if opts.As != "" {
+		return filepath.Join(destDir, opts.As)
+	}
+	if subDir := w.routeByTag(opts.RouteByTag, metadata); subDir != "" {
+		return filepath.Join(destDir, subDir, metadata.Name)
+	}
+	if subDir := routeByMimeType(opts.MimeRoutes, metadata.MimeType); subDir != "" {
+		return filepath.Join(destDir, subDir, metadata.Name)
+	}
+	return filepath.Join(destDir, metadata.Name)
+}
+
+// writePath returns the path data for destPath is written to under opts
+func (w *writerService) writePath(destPath string, opts WriterOptions) string {
+	if opts.WriteMode == WriteModeAtomic {
+		return destPath + partSuffix
+	}
+	return destPath
+}
+
+// routeByTag returns the subdirectory named by the value of the file's tag key, sanitized to a single file name,
+// or "" if the file doesn't have the tag
+func (w *writerService) routeByTag(key string, metadata *types.FileMetadata) string {
+	if key == "" || metadata.Tags[key] == "" {
+		return ""
+	}
+	return w.fileService.sanitizeFileName(metadata.Tags[key])
+}
+
+// routeByMimeType returns the subdirectory of the first route matching mimeType, or "" if none match
+func routeByMimeType(routes []config.MimeRoute, mimeType string) string {
+	// Match on the bare media type, without parameters like "; charset=utf-8"
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = mimeType
+	}
+
+	for _, route := range routes {
+		if matched, _ := path.Match(route.Pattern, mediaType); matched {
+			return route.Dir
+		}
+	}
+	return ""
+}
+
+// checkDestination verifies the incoming file may be written to its destination.
+// It returns true if the transfer should be skipped because of an existing file.
+func (w *writerService) checkDestination(destDir string, metadata *types.FileMetadata, opts WriterOptions) (bool, error) {
+	// An object is only replaced once its upload has completed and verified, there is nothing to check up front
+	if s3.IsURL(destDir) {
+		return false, nil
+	}
+
+	destPath := w.resolveDestPath(destDir, metadata, opts)
+
+	stat, err := os.Stat(destPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get destination file info: %w", err)
+	}
+
+	// An identical copy is already here, nothing to transfer
+	if opts.SkipIdentical && stat.Mode().IsRegular() && stat.Size() == metadata.Size {
+		var checksum string
+		if metadata.ChecksumSample > 0 {
+			source := &fileSource{fileService: w.fileService, filePath: destPath, size: stat.Size()}
+			checksum, err = sampledChecksum(source, metadata.ChecksumSample)
+		} else {
+			checksum, err = w.fileService.calculateFileChecksum(destPath)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to checksum existing file: %w", err)
+		}
+		if checksum == metadata.Checksum {
+			log.Printf("Existing file %s is identical to the incoming file, skipping", destPath)
+			return true, nil
+		}
+	}
+
+	switch opts.OnConflict {
+	case ConflictSkip:
+		log.Printf("File %s already exists, skipping", destPath)
+		return true, nil
+	case ConflictRename:
+		// A new name is picked when the file is prepared, nothing gets overwritten
+		return false, nil
+	}
+
+	// Don't replace local edits with an older version of the file, whether or not overwriting is allowed
+	if opts.NoClobberNewer && !metadata.ModTime.IsZero() && stat.ModTime().After(metadata.ModTime) {
+		return false, fmt.Errorf("refusing to overwrite %s: %w (modified %s, incoming modified %s)",
+			destPath, ErrExistingNewer, stat.ModTime().Format(time.RFC3339), metadata.ModTime.Format(time.RFC3339))
+	}
+
+	if opts.OnConflict != ConflictOverwrite {
+		return false, fmt.Errorf("refusing to overwrite %s: %w", destPath, ErrDestinationExists)
+	}
+	return false, nil
+}
+
+// findPartialFile looks for a partially received copy of the file in destDir.
+// It returns the size of the partial file and the checksum of its contents, or 0 if there is nothing to resume.
+func (w *writerService) findPartialFile(destDir string, metadata *types.FileMetadata, opts WriterOptions) (int64, string, error) {
+	// Interrupted uploads are aborted, they leave nothing to resume
+	if s3.IsURL(destDir) {
+		return 0, "", nil
+	}
+
+	partialPath := w.writePath(w.resolveDestPath(destDir, metadata, opts), opts)
+
+	stat, err := os.Stat(partialPath)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get partial file info: %w", err)
+	}
+
+	// Only a regular file smaller than the incoming one can be a partial
+	if !stat.Mode().IsRegular() || stat.Size() == 0 || stat.Size() >= metadata.Size {
+		return 0, "", nil
+	}
+
+	checksum, err := w.fileService.calculateFileChecksum(partialPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to checksum partial file: %w", err)
+	}
+
+	return stat.Size(), checksum, nil
 }
 
-// prepareFileForWriting opens a destination file for writing with metadata
-func (w *writerService) prepareFileForWriting(destDir string, metadata *types.FileMetadata) (*fileWriter, string, error) {
+// prepareFileForWriting opens a destination file for writing with metadata.
+// A non-zero offset continues a partial file, keeping its first offset bytes.
+func (w *writerService) prepareFileForWriting(destDir string, metadata *types.FileMetadata, offset int64, opts WriterOptions) (*fileWriter, string, error) {
+	if s3.IsURL(destDir) {
+		return w.prepareUpload(destDir, metadata, offset, opts)
+	}
+
+	// Create full destination path using original filename from metadata
+	destPath := w.resolveDestPath(destDir, metadata, opts)
+	if !utils.IsPathWithin(destDir, destPath) {
+		return nil, "", fmt.Errorf("file name %q escapes destination directory", metadata.Name)
+	}
+
 	// Ensure destination directory exists
-	if err := w.fileService.ensureDir(destDir); err != nil {
+	if err := w.fileService.ensureDir(filepath.Dir(destPath)); err != nil {
 		return nil, "", fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
-	// Create full destination path using original filename from metadata
-	destPath := filepath.Join(destDir, metadata.Name)
+	// Keep the existing file and write next to it
+	if offset == 0 && opts.OnConflict == ConflictRename {
+		destPath = w.fileService.uniquePath(destPath)
+	}
 
-	// Create destination file
-	file, err := w.fileService.createWriter(destPath)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to create destination file: %w", err)
+	// Make sure no symlink redirects the write outside the destination
+	filePath := w.writePath(destPath, opts)
+	for _, p := range []string{destPath, filePath} {
+		if err := w.fileService.confineToDir(destDir, p); err != nil {
+			return nil, "", fmt.Errorf("unsafe destination path: %w", err)
+		}
+	}
+
+	var file *os.File
+	var err error
+	var head []byte
+	hash := sha256.New()
+	sample := newSampledHashFor(metadata)
+
+	if offset > 0 {
+		// Reopen the partial file and replay its contents into the hash so the final checksum covers the whole file
+		file, err = w.fileService.openForResume(filePath, offset)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to open partial file for resume: %w", err)
+		}
+
+		replay := io.Writer(hash)
+		if sample != nil {
+			replay = io.MultiWriter(hash, sample)
+		}
+		if _, err := io.CopyN(replay, file, offset); err != nil {
+			file.Close()
+			return nil, "", fmt.Errorf("failed to read partial file: %w", err)
+		}
+
+		// The start of the file is already on disk, sniff it from there
+		head = make([]byte, min(offset, sniffLen))
+		if _, err := file.ReadAt(head, 0); err != nil {
+			file.Close()
+			return nil, "", fmt.Errorf("failed to read partial file: %w", err)
+		}
+
+		log.Printf("Resuming partial file %s at offset %d bytes", filePath, offset)
+	} else if filePath == destPath && opts.OnConflict == ConflictRename {
+		// The name is only settled by creating the file, so a receive running at the same time can't take it too
+		file, destPath, err = w.fileService.createUnique(destPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create destination file: %w", err)
+		}
+		filePath = destPath
+	} else {
+		// Only an overwrite may replace a file that appeared at the final path since it was checked
+		exclusive := filePath == destPath && opts.OnConflict != ConflictOverwrite
+		file, err = w.fileService.createWriter(filePath, exclusive)
+		if errors.Is(err, fs.ErrExist) {
+			return nil, "", fmt.Errorf("refusing to overwrite %s: %w", destPath, ErrDestinationExists)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create destination file: %w", err)
+		}
+	}
+
+	// Set after opening rather than at create time so the umask doesn't strip bits, a .part file keeps them when renamed
+	if opts.FileMode != 0 {
+		if err := file.Chmod(opts.FileMode); err != nil {
+			file.Close()
+			return nil, "", fmt.Errorf("failed to set file mode %04o: %w", opts.FileMode, err)
+		}
 	}
 
 	log.Printf("File prepared for writing: %s (original: %s, size: %d bytes, type: %s, checksum: %s)",
-		destPath, metadata.Name, metadata.Size, metadata.MimeType, metadata.Checksum)
+		filePath, metadata.Name, metadata.Size, metadata.MimeType, metadata.Checksum)
+	warnSampled(metadata)
+
+	var sink fileSink = file
+	if opts.WriteBuffer > 0 {
+		sink = &bufferedFile{Writer: bufio.NewWriterSize(file, opts.WriteBuffer), file: file}
+	}
 
 	writer := &fileWriter{
-		file:              file,
+		sink:              sink,
 		destPath:          destPath,
-		totalBytesWritten: 0,
+		filePath:          filePath,
+		totalBytesWritten: uint64(offset),
 		metadata:          metadata,
-		hash:              sha256.New(),
+		hash:              hash,
+		sample:            sample,
+		head:              head,
+		opts:              opts,
+	}
+
+	return writer, destPath, nil
+}
+
+// prepareSymlinkForWriting recreates a symlink sent as a link and returns a writer that only verifies it
+func (w *writerService) prepareSymlinkForWriting(destDir string, metadata *types.FileMetadata, opts WriterOptions) (*fileWriter, string, error) {
+	if s3.IsURL(destDir) {
+		return nil, "", fmt.Errorf("cannot store symlink %s in object storage", metadata.Name)
+	}
+
+	destPath := w.resolveDestPath(destDir, metadata, opts)
+	if !utils.IsPathWithin(destDir, destPath) {
+		return nil, "", fmt.Errorf("file name %q escapes destination directory", metadata.Name)
+	}
+
+	if err := w.fileService.ensureDir(filepath.Dir(destPath)); err != nil {
+		return nil, "", fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	if opts.OnConflict == ConflictRename {
+		destPath = w.fileService.uniquePath(destPath)
+	}
+
+	// The link itself replaces whatever is at destPath, only its directory has to stay inside the destination
+	if err := w.fileService.confineToDir(destDir, filepath.Dir(destPath)); err != nil {
+		return nil, "", fmt.Errorf("unsafe destination path: %w", err)
+	}
+
+	if err := w.fileService.createSymlink(metadata.SymlinkTarget, destPath, opts.OnConflict == ConflictOverwrite); err != nil {
+		return nil, "", err
+	}
+
+	if filepath.IsAbs(metadata.SymlinkTarget) || !filepath.IsLocal(metadata.SymlinkTarget) {
+		log.Printf("Warning: symlink %s points outside the destination directory: %s", destPath, metadata.SymlinkTarget)
+	}
+	log.Printf("Symlink created: %s -> %s", destPath, metadata.SymlinkTarget)
+
+	// Checksum what was actually created, so finishWriting verifies the link target
+	target, err := os.Readlink(destPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read created symlink: %w", err)
+	}
+	hash := sha256.New()
+	hash.Write([]byte(target))
+
+	writer := &fileWriter{
+		destPath:    destPath,
+		filePath:    destPath,
+		metadata:    metadata,
+		hash:        hash,
+		headChecked: true, // A link has no content to sniff
+		opts:        opts,
 	}
 
 	return writer, destPath, nil
@@ -68,15 +468,47 @@ func (w *writerService) writeData(writer *fileWriter, data []byte) error {
 	if writer == nil {
 		return fmt.Errorf("no file prepared for writing")
 	}
+	if writer.sink == nil {
+		return fmt.Errorf("unexpected file data for symlink %s", writer.destPath)
+	}
 
-	n, err := writer.file.Write(data)
+	n, err := writer.sink.Write(data)
 	if err != nil {
 		return fmt.Errorf("failed to write data: %w", err)
 	}
 
 	// Update hash with the written data
 	writer.hash.Write(data[:n])
+	if writer.sample != nil {
+		writer.sample.Write(data[:n])
+	}
 	writer.totalBytesWritten += uint64(n)
+
+	// Check the content type as soon as there is enough of the file to sniff
+	if !writer.headChecked {
+		writer.head = append(writer.head, data[:min(n, sniffLen-len(writer.head))]...)
+		if len(writer.head) >= sniffLen {
+			return w.checkContentType(writer)
+		}
+	}
+	return nil
+}
+
+// checkContentType compares the sniffed content type of the file with its extension.
+// A mismatch is only logged unless StrictMime is set.
+func (w *writerService) checkContentType(writer *fileWriter) error {
+	writer.headChecked = true
+
+	expected, detected, ok := sniffContentType(writer.metadata.Name, writer.head)
+	if ok {
+		return nil
+	}
+
+	if writer.opts.StrictMime {
+		return fmt.Errorf("%w: %s should be %s but its content looks like %s", ErrContentMismatch, writer.metadata.Name, expected, detected)
+	}
+
+	log.Printf("Warning: %s should be %s by its extension but its content looks like %s", writer.metadata.Name, expected, detected)
 	return nil
 }
 
@@ -85,12 +517,16 @@ func (w *writerService) finishWriting(writer *fileWriter) (uint64, error) {
 	if writer == nil {
 		return 0, fmt.Errorf("no file prepared for writing")
 	}
+	if upload, ok := writer.sink.(*s3.Upload); ok {
+		return w.finishUpload(writer, upload)
+	}
 
 	totalBytes := writer.totalBytesWritten
 	destPath := writer.destPath
+	filePath := writer.filePath
 
 	// Calculate final checksum
-	calculatedChecksum := hex.EncodeToString(writer.hash.Sum(nil))
+	calculatedChecksum := writer.checksum()
 	expectedChecksum := writer.metadata.Checksum
 
 	// Close the file first
@@ -99,21 +535,108 @@ func (w *writerService) finishWriting(writer *fileWriter) (uint64, error) {
 		return totalBytes, fmt.Errorf("failed to close file: %w", err)
 	}
 
+	// Files shorter than the sniff length are checked once complete
+	if !writer.headChecked {
+		if err := w.checkContentType(writer); err != nil {
+			os.Remove(filePath)
+			return totalBytes, err
+		}
+	}
+
 	// Validate checksum
 	if calculatedChecksum != expectedChecksum {
-		// Delete the corrupted file
-		os.Remove(destPath)
-		return totalBytes, fmt.Errorf("checksum validation failed: expected %s, got %s", expectedChecksum, calculatedChecksum)
+		if writer.opts.KeepOnMismatch {
+			// Keep the corrupted file around for inspection
+			corruptPath := destPath + ".corrupt"
+			if err := os.Rename(filePath, corruptPath); err != nil {
+				log.Printf("Warning: failed to keep corrupted file %s: %v", destPath, err)
+			} else {
+				log.Printf("Checksum mismatch for %s (expected %s, got %s), corrupted file kept at %s",
+					destPath, expectedChecksum, calculatedChecksum, corruptPath)
+			}
+		} else {
+			// Delete the corrupted file
+			os.Remove(filePath)
+		}
+		return totalBytes, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expectedChecksum, calculatedChecksum)
+	}
+
+	// Check against the out-of-band code, independent of the checksum sent in metadata
+	if writer.opts.VerifyCode != "" {
+		if !strings.HasPrefix(calculatedChecksum, writer.opts.VerifyCode) {
+			if writer.opts.KeepOnMismatch {
+				corruptPath := destPath + ".corrupt"
+				if err := os.Rename(filePath, corruptPath); err != nil {
+					log.Printf("Warning: failed to keep unverified file %s: %v", destPath, err)
+				} else {
+					log.Printf("Verification code mismatch for %s, file kept at %s", destPath, corruptPath)
+				}
+			} else {
+				os.Remove(filePath)
+			}
+			return totalBytes, fmt.Errorf("%w: expected checksum starting with %s, got %s", ErrVerifyCodeMismatch, writer.opts.VerifyCode, calculatedChecksum)
+		}
+		log.Printf("Verification code %s matches received file", utils.FormatVerifyCode(calculatedChecksum))
+	}
+
+	// Only a verified file replaces whatever is at the final path, and only if it may be overwritten
+	if filePath != destPath {
+		if writer.opts.OnConflict == ConflictOverwrite {
+			err = os.Rename(filePath, destPath)
+		} else {
+			err = w.fileService.moveNoReplace(filePath, destPath)
+		}
+		if errors.Is(err, fs.ErrExist) {
+			return totalBytes, fmt.Errorf("refusing to overwrite %s, created while the file was received (kept at %s): %w", destPath, filePath, ErrDestinationExists)
+		}
+		if err != nil {
+			return totalBytes, fmt.Errorf("failed to move %s into place: %w", filePath, err)
+		}
 	}
 
-	log.Printf("File writing completed: %s, %d bytes written, checksum verified", destPath, totalBytes)
+	log.Printf("File writing completed: %s, %d bytes written, %s verified", destPath, totalBytes, writer.checksumKind())
 	return totalBytes, nil
 }
 
 // close closes the internal file writer
 func (fw *fileWriter) close() error {
-	if fw.file == nil {
+	if fw.sink == nil {
 		return nil
 	}
-	return fw.file.Close()
+
+	// An upload closed before it was finished is abandoned, completing it would publish a partial object
+	if upload, ok := fw.sink.(*s3.Upload); ok {
+		return upload.Abort()
+	}
+	return fw.sink.Close()
+}
+
+// checksum returns the checksum of everything written, to compare with the metadata's
+func (fw *fileWriter) checksum() string {
+	if fw.sample != nil {
+		return fw.sample.sum()
+	}
+	return hex.EncodeToString(fw.hash.Sum(nil))
+}
+
+// checksumKind describes the checksum verified, for logs
+func (fw *fileWriter) checksumKind() string {
+	if fw.sample != nil {
+		return "sampled checksum"
+	}
+	return "checksum"
+}
+
+// received returns the number of bytes written so far and their checksum, the hash keeps running
+func (fw *fileWriter) received() (int64, string) {
+	if fw.totalBytesWritten == 0 {
+		return 0, ""
+	}
+	return int64(fw.totalBytesWritten), hex.EncodeToString(fw.hash.Sum(nil))
+}
+
+// isUpload reports whether the file is being uploaded to object storage rather than written locally
+func (fw *fileWriter) isUpload() bool {
+	_, ok := fw.sink.(*s3.Upload)
+	return ok
 }
@@ -0,0 +1,167 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"yapfs/pkg/types"
+)
+
+func TestCheckDestinationNoClobberNewer(t *testing.T) {
+	incoming := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		existing   time.Time
+		onConflict ConflictPolicy
+		wantErr    error
+	}{
+		{"newer file, default policy", incoming.Add(time.Hour), "", ErrExistingNewer},
+		{"newer file, fail", incoming.Add(time.Hour), ConflictFail, ErrExistingNewer},
+		{"newer file, overwrite", incoming.Add(time.Hour), ConflictOverwrite, ErrExistingNewer},
+		{"older file, default policy", incoming.Add(-time.Hour), "", ErrDestinationExists},
+		{"older file, overwrite", incoming.Add(-time.Hour), ConflictOverwrite, nil},
+		{"newer file, rename", incoming.Add(time.Hour), ConflictRename, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			destPath := filepath.Join(dir, "file.txt")
+			if err := os.WriteFile(destPath, []byte("local edits"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(destPath, tt.existing, tt.existing); err != nil {
+				t.Fatal(err)
+			}
+
+			w := newWriterService(NewFileService())
+			metadata := &types.FileMetadata{Name: "file.txt", Size: 20, ModTime: incoming}
+			skip, err := w.checkDestination(dir, metadata, WriterOptions{NoClobberNewer: true, OnConflict: tt.onConflict})
+
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("checkDestination() error = %v, want %v", err, tt.wantErr)
+			}
+			if skip {
+				t.Fatalf("checkDestination() skipped the file")
+			}
+		})
+	}
+}
+
+// countingSink counts the writes reaching the sink it wraps
+type countingSink struct {
+	fileSink
+	writes int
+}
+
+// Write counts the write and passes it on
+func (s *countingSink) Write(p []byte) (int, error) {
+	s.writes++
+	return s.fileSink.Write(p)
+}
+
+// writeChunked writes content in chunks of chunkSize to a new file through a writer service buffering writeBuffer
+// bytes, and returns what ended up in the file and how many writes reached it
+func writeChunked(tb testing.TB, content []byte, chunkSize, writeBuffer int) ([]byte, int) {
+	tb.Helper()
+
+	w := newWriterService(NewFileService())
+	checksum := sha256.Sum256(content)
+	metadata := &types.FileMetadata{Name: "file.bin", Size: int64(len(content)), Checksum: hex.EncodeToString(checksum[:])}
+	writer, destPath, err := w.prepareFileForWriting(tb.TempDir(), metadata, 0, WriterOptions{WriteBuffer: writeBuffer})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// Count what reaches the file itself, under the buffer if there is one
+	var counted *countingSink
+	if buffered, ok := writer.sink.(*bufferedFile); ok {
+		counted = &countingSink{fileSink: buffered.file}
+		buffered.Reset(counted)
+	} else {
+		counted = &countingSink{fileSink: writer.sink}
+		writer.sink = counted
+	}
+
+	for offset := 0; offset < len(content); offset += chunkSize {
+		if err := w.writeData(writer, content[offset:min(offset+chunkSize, len(content))]); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if _, err := w.finishWriting(writer); err != nil {
+		tb.Fatalf("finishWriting() error = %v", err)
+	}
+
+	written, err := os.ReadFile(destPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return written, counted.writes
+}
+
+func TestWriteBufferGathersWrites(t *testing.T) {
+	const (
+		size      = 4 * 1024 * 1024
+		chunkSize = 1024
+	)
+
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		writeBuffer int
+		wantWrites  int
+	}{
+		{"direct", 0, size / chunkSize},
+		{"1MB buffer", 1024 * 1024, size / (1024 * 1024)},
+		{"64KB buffer", 64 * 1024, size / (64 * 1024)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written, writes := writeChunked(t, content, chunkSize, tt.writeBuffer)
+			if !bytes.Equal(written, content) {
+				t.Fatalf("wrote %d bytes that differ from the %d received", len(written), len(content))
+			}
+			if writes != tt.wantWrites {
+				t.Fatalf("file written %d times, want %d", writes, tt.wantWrites)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	const (
+		size      = 16 * 1024 * 1024
+		chunkSize = 1024
+	)
+
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, writeBuffer := range []int{0, 64 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", writeBuffer/1024), func(b *testing.B) {
+			b.SetBytes(size)
+			var writes int
+			for b.Loop() {
+				_, n := writeChunked(b, content, chunkSize, writeBuffer)
+				writes += n
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// The dashboard is redrawn a few times a second, the throughput graph gets a new sample every second
+const (
+	dashboardRedrawInterval = 250 * time.Millisecond
+	dashboardSampleInterval = time.Second
+	dashboardGraphHeight    = 6
+	dashboardLogLines       = 6
+)
+
+// Escape sequences switching to the terminal's alternate screen and back, so the dashboard leaves no trace
+const (
+	enterAltScreen = "\x1b[?1049h\x1b[?25l"
+	leaveAltScreen = "\x1b[?25h\x1b[?1049l"
+	redrawScreen   = "\x1b[H\x1b[2J"
+)
+
+// graphLevels draws the top of a graph column in eighths of a row
+var graphLevels = []rune(" ▁▂▃▄▅▆▇█")
+
+// dashboard is the state shown by the full-screen view of a transfer
+type dashboard struct {
+	opts Options
+
+	metadata    *types.FileMetadata
+	file        *types.FileMetadata // File of a directory being transferred, nil for a single file
+	fileIndex   int
+	transferred uint64
+	rate        float64   // Current throughput reported with the last update
+	peakRate    float64   // Highest sample in the graph's history
+	samples     []float64 // Throughput once every dashboardSampleInterval, oldest first
+	startTime   time.Time
+	width       int // Terminal size, checked again with every sample so the dashboard follows a resize
+	height      int
+
+	mu   sync.Mutex // Guards logs, written by any goroutine logging while the dashboard is up
+	logs []string   // Most recent log lines, oldest first
+	part []byte     // Log output not ending in a newline yet
+}
+
+// Write keeps the log output shown under the dashboard, so logging doesn't scroll it off the screen
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.part = append(d.part, p...)
+	for {
+		i := bytes.IndexByte(d.part, '\n')
+		if i < 0 {
+			break
+		}
+		d.logs = append(d.logs, string(d.part[:i]))
+		d.part = d.part[i+1:]
+	}
+	if len(d.logs) > dashboardLogLines {
+		d.logs = d.logs[len(d.logs)-dashboardLogLines:]
+	}
+	return len(p), nil
+}
+
+// recentLogs returns a copy of the log lines to show
+func (d *dashboard) recentLogs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.logs...)
+}
+
+// update applies a progress update, the same way the progress line does
+func (d *dashboard) update(progress types.ProgressUpdate) {
+	if progress.MetaData != nil {
+		d.metadata = progress.MetaData
+		d.startTime = time.Now()
+	}
+	if progress.File != nil && progress.File != d.metadata {
+		d.file, d.fileIndex = progress.File, progress.FileIndex
+	}
+
+	if progress.CumulativeBytes > 0 {
+		d.transferred = progress.CumulativeBytes
+	} else {
+		d.transferred += progress.NewBytes
+	}
+	d.rate = progress.BytesPerSecond
+}
+
+// sample adds the current throughput to the graph's history, keeping as much as fits in width
+func (d *dashboard) sample(width int) {
+	d.samples = append(d.samples, d.rate)
+	if len(d.samples) > width {
+		d.samples = d.samples[len(d.samples)-width:]
+	}
+
+	d.peakRate = 0
+	for _, sample := range d.samples {
+		d.peakRate = max(d.peakRate, sample)
+	}
+}
+
+// runDashboard shows progress as a full-screen dashboard until progressCh is closed or ctx is done.
+// Log output is shown inside the dashboard while it is up.
+func (pr *ProgressReporter) runDashboard(ctx context.Context, progressCh <-chan types.ProgressUpdate) {
+	d := &dashboard{opts: pr.opts, startTime: time.Now()}
+	d.width, d.height = terminalSize()
+
+	previous := log.Writer()
+	log.SetOutput(d)
+	fmt.Print(enterAltScreen)
+	leave := func() {
+		fmt.Print(leaveAltScreen)
+		log.SetOutput(previous)
+	}
+
+	redraw := time.NewTicker(dashboardRedrawInterval)
+	defer redraw.Stop()
+	sample := time.NewTicker(dashboardSampleInterval)
+	defer sample.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			leave()
+			log.Println("Progress reporting stopped: user cancelled")
+			return
+		case <-redraw.C:
+			fmt.Print(d.render(pr.connectionState()))
+			pr.notifyProgress(d.metadata, d.transferred, d.rate, false)
+		case <-sample.C:
+			d.width, d.height = terminalSize()
+			d.sample(d.width - 2)
+		case progress, ok := <-progressCh:
+			if separate := pr.takeMetadata(); separate != nil {
+				d.metadata = separate
+				d.startTime = time.Now()
+			}
+
+			if !ok {
+				// Channel closed - transfer complete, the summary goes to the normal screen so it stays
+				leave()
+				if d.metadata != nil {
+					pr.printSummary(d.metadata, d.transferred, time.Since(d.startTime))
+				}
+				pr.notifyProgress(d.metadata, d.transferred, rate(d.transferred, time.Since(d.startTime)), true)
+				return
+			}
+			d.update(progress)
+		}
+	}
+}
+
+// render draws the whole dashboard
+func (d *dashboard) render(connection string) string {
+	width, height := d.width, d.height
+	var b strings.Builder
+	b.WriteString(redrawScreen)
+
+	line := func(format string, args ...any) {
+		text := fmt.Sprintf(format, args...)
+		if runes := []rune(text); len(runes) > width {
+			text = string(runes[:width])
+		}
+		b.WriteString(text + "\r\n")
+	}
+
+	line("yapfs - %s", connection)
+	line("%s", strings.Repeat("─", width))
+
+	if d.metadata == nil {
+		line("Waiting for the transfer to start")
+	} else {
+		line("Transfer: %s (%s)", d.metadata.Name, utils.FormatFileSize(d.metadata.Size))
+		if d.file != nil {
+			line("File %d: %s (%s)", d.fileIndex+1, d.file.Name, utils.FormatFileSize(d.file.Size))
+		} else {
+			line("")
+		}
+
+		var fraction float64
+		if d.metadata.Size > 0 {
+			fraction = min(float64(d.transferred)/float64(d.metadata.Size), 1)
+		}
+		barWidth := max(width-9, 10)
+		filled := int(fraction * float64(barWidth))
+		line("[%s%s] %5.1f%%", strings.Repeat("█", filled), strings.Repeat("░", barWidth-filled), fraction*100)
+
+		elapsed := time.Since(d.startTime)
+		eta := "-"
+		if d.rate > 0 && d.metadata.Size > int64(d.transferred) {
+			remaining := float64(d.metadata.Size-int64(d.transferred)) / d.rate
+			eta = (time.Duration(remaining) * time.Second).String()
+		}
+		line("Transferred: %s of %s", utils.FormatFileSize(int64(d.transferred)), utils.FormatFileSize(d.metadata.Size))
+		line("Speed: %s (average %s, peak %s)", utils.FormatRate(d.rate, d.opts.Units),
+			utils.FormatRate(rate(d.transferred, elapsed), d.opts.Units), utils.FormatRate(d.peakRate, d.opts.Units))
+		line("Elapsed: %s, remaining: %s", elapsed.Round(time.Second), eta)
+	}
+
+	line("")
+	line("Throughput (last %d s)", len(d.samples))
+	for _, row := range d.graph() {
+		line(" %s", row)
+	}
+
+	// Log lines fill what is left of the screen, so the dashboard never scrolls
+	line("%s", strings.Repeat("─", width))
+	logs := d.recentLogs()
+	if spare := height - strings.Count(b.String(), "\n") - 1; spare < len(logs) {
+		logs = logs[len(logs)-max(spare, 0):]
+	}
+	for _, entry := range logs {
+		line("%s", entry)
+	}
+
+	return b.String()
+}
+
+// graph draws the throughput history as dashboardGraphHeight rows of columns scaled to the peak sample
+func (d *dashboard) graph() []string {
+	rows := make([]string, dashboardGraphHeight)
+	if d.peakRate <= 0 {
+		return rows
+	}
+
+	levels := len(graphLevels) - 1
+	for i := range rows {
+		floor := dashboardGraphHeight - 1 - i // Rows counted from the bottom
+		var row strings.Builder
+		for _, sample := range d.samples {
+			height := int(sample / d.peakRate * float64(dashboardGraphHeight*levels))
+			row.WriteRune(graphLevels[min(max(height-floor*levels, 0), levels)])
+		}
+		rows[i] = row.String()
+	}
+	return rows
+}
+
+// terminalSize returns the terminal's columns and lines, from stty where there is one or as the shell exports them,
+// 80x24 if neither says
+func terminalSize() (width, height int) {
+	width, height = 80, 24
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 20 {
+		width = columns
+	}
+	if lines, err := strconv.Atoi(os.Getenv("LINES")); err == nil && lines > 10 {
+		height = lines
+	}
+	if runtime.GOOS == "windows" {
+		return width, height
+	}
+
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return width, height
+	}
+	var lines, columns int
+	if _, err := fmt.Sscan(string(out), &lines, &columns); err == nil && columns > 20 && lines > 10 {
+		width, height = columns, lines
+	}
+	return width, height
+}
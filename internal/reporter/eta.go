@@ -0,0 +1,63 @@
+package reporter
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// etaSmoothing is the time constant of the throughput average ETAs are estimated from, samples older than a few
+// of them hardly count any more
+const etaSmoothing = 5 * time.Second
+
+// throughputEstimator keeps an exponentially weighted moving average of throughput, sampled when progress is drawn,
+// so the ETA follows the recent rate without jumping with every burst
+type throughputEstimator struct {
+	bytesPerSecond float64
+	lastBytes      uint64
+	lastTime       time.Time
+}
+
+// sample adds the offset transferred has reached at now, and returns the smoothed throughput in bytes per second
+func (e *throughputEstimator) sample(transferred uint64, now time.Time) float64 {
+	// Start over at the first sample, and when the offset goes back as it does when the next file of a directory starts
+	if e.lastTime.IsZero() || transferred < e.lastBytes {
+		e.lastBytes, e.lastTime = transferred, now
+		return e.bytesPerSecond
+	}
+
+	elapsed := now.Sub(e.lastTime)
+	if elapsed <= 0 {
+		return e.bytesPerSecond
+	}
+	current := float64(transferred-e.lastBytes) / elapsed.Seconds()
+	e.lastBytes, e.lastTime = transferred, now
+
+	// Weigh the new sample by how long it covers, so the average doesn't depend on how often progress is drawn
+	if e.bytesPerSecond == 0 {
+		e.bytesPerSecond = current
+	} else {
+		weight := 1 - math.Exp(-elapsed.Seconds()/etaSmoothing.Seconds())
+		e.bytesPerSecond += weight * (current - e.bytesPerSecond)
+	}
+	return e.bytesPerSecond
+}
+
+// eta returns how long the remaining bytes take at bytesPerSecond, false if that can't be estimated
+// because the size is unknown or nothing is moving
+func eta(transferred uint64, size int64, bytesPerSecond float64) (time.Duration, bool) {
+	if size <= 0 || bytesPerSecond <= 0 || uint64(size) < transferred {
+		return 0, false
+	}
+	remaining := float64(uint64(size)-transferred) / bytesPerSecond
+	return time.Duration(remaining * float64(time.Second)), true
+}
+
+// formatETA formats an ETA as m:ss, or h:mm:ss from an hour up
+func formatETA(d time.Duration) string {
+	seconds := int64(d.Round(time.Second).Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -4,26 +4,147 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
 	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
 )
 
+// Options configures how progress and the completion summary are displayed
+type Options struct {
+	Units          string // Throughput units: utils.UnitsBytes (default) or utils.UnitsBits
+	SummaryOneline bool   // Print the completion summary as a single line instead of a box
+	ChecksumFormat string // Checksum encoding in the summary: utils.ChecksumHex (default) or utils.ChecksumBase64
+	TUI            bool   // Show a full-screen dashboard on a terminal instead of the progress line
+	Quiet          bool   // Draw nothing and print no summary, for a program that shows progress itself
+
+	// OnProgress, when set, is also called with the progress each time it is drawn and once the transfer's data is
+	// complete, from the goroutine running StartUpdatingProgress
+	OnProgress func(Progress)
+
+	// OnUpdate, when set, is called with every progress update as it arrives, from the goroutine running
+	// StartUpdatingProgress. It must not block.
+	OnUpdate func(types.ProgressUpdate)
+}
+
+// Progress is the state of a transfer as it is drawn
+type Progress struct {
+	Name           string  `json:"name"`
+	Size           int64   `json:"size"`
+	Transferred    uint64  `json:"transferred"` // Offset reached, counting any resumed prefix
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	Done           bool    `json:"done"` // The last call, all data has arrived
+}
+
+// Progress is redrawn in place on a terminal, anywhere else (a log file, a pipe) each redraw adds a line
+const (
+	terminalRedrawInterval = 100 * time.Millisecond
+	logRedrawInterval      = time.Second
+)
+
+// redrawInterval returns how often progress is redrawn, depending on where it goes
+func redrawInterval() time.Duration {
+	if stdoutIsTerminal() {
+		return terminalRedrawInterval
+	}
+	return logRedrawInterval
+}
+
+// stdoutIsTerminal reports whether progress is drawn on a terminal
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 // ConsoleUI implements console-based interactive UI with progress tracking
-type ProgressReporter struct{}
+type ProgressReporter struct {
+	opts Options
+
+	mu         sync.Mutex
+	metadata   *types.FileMetadata  // Set by SetMetadata when metadata doesn't come with the progress updates
+	flagged    []types.TypeMismatch // Files to flag in the summary, added by AddTypeMismatch
+	connection func() string        // Describes the peer connection for the dashboard, set by WatchConnection
+}
 
 // NewConsoleUI creates a new console-based interactive UI
-func NewProgressReporter() *ProgressReporter {
-	return &ProgressReporter{}
+func NewProgressReporter(opts Options) *ProgressReporter {
+	return &ProgressReporter{
+		opts: opts,
+	}
+}
+
+// SetMetadata hands over the transfer's metadata when it is reported separately from the progress updates.
+// It is safe to call while StartUpdatingProgress runs.
+func (pr *ProgressReporter) SetMetadata(metadata *types.FileMetadata) {
+	pr.mu.Lock()
+	pr.metadata = metadata
+	pr.mu.Unlock()
+}
+
+// takeMetadata returns metadata handed over with SetMetadata since the last call, or nil
+func (pr *ProgressReporter) takeMetadata() *types.FileMetadata {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	metadata := pr.metadata
+	pr.metadata = nil
+	return metadata
+}
+
+// AddTypeMismatch flags a received file in the completion summary as not looking like its declared type.
+// It is safe to call while StartUpdatingProgress runs.
+func (pr *ProgressReporter) AddTypeMismatch(mismatch types.TypeMismatch) {
+	pr.mu.Lock()
+	pr.flagged = append(pr.flagged, mismatch)
+	pr.mu.Unlock()
+}
+
+// WatchConnection makes the dashboard show the peer connection as state describes it, replacing any earlier one.
+// It is safe to call while StartUpdatingProgress runs.
+func (pr *ProgressReporter) WatchConnection(state func() string) {
+	pr.mu.Lock()
+	pr.connection = state
+	pr.mu.Unlock()
+}
+
+// connectionState describes the peer connection being watched
+func (pr *ProgressReporter) connectionState() string {
+	pr.mu.Lock()
+	state := pr.connection
+	pr.mu.Unlock()
+	if state == nil {
+		return "connecting"
+	}
+	return state()
+}
+
+// typeMismatches returns the files flagged with AddTypeMismatch
+func (pr *ProgressReporter) typeMismatches() []types.TypeMismatch {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.flagged
 }
 
 // InputCode prompts user to input an 8-character alphanumeric code with validation
 
 // StartUpdatingProgress starts progress tracking for file transfer
 func (pr *ProgressReporter) StartUpdatingProgress(ctx context.Context, progressCh <-chan types.ProgressUpdate) {
+	if pr.opts.TUI && !pr.opts.Quiet {
+		if stdoutIsTerminal() {
+			pr.runDashboard(ctx, progressCh)
+			return
+		}
+		log.Printf("Not showing the dashboard, output is not a terminal")
+	}
+
 	var totalSize int64
 	var transferredBytes uint64
 	var metadata *types.FileMetadata
 	startTime := time.Now()
+	interval := redrawInterval()
+	var lastDrawn time.Time
+	var estimator throughputEstimator
 
 	for {
 		select {
@@ -31,27 +152,133 @@ func (pr *ProgressReporter) StartUpdatingProgress(ctx context.Context, progressC
 			log.Println("Progress reporting stopped: user cancelled")
 			return
 		case progress, ok := <-progressCh:
+			if separate := pr.takeMetadata(); separate != nil {
+				metadata = separate
+				totalSize = metadata.Size
+				startTime = time.Now()
+				estimator = throughputEstimator{}
+			}
+
 			if !ok {
 				// Channel closed - transfer complete
-				if metadata != nil {
-					fmt.Printf("\r%60s\r", "")
-					fmt.Println("=========================================================")
-					fmt.Printf("File transfer complete!\n")
-					fmt.Printf("Duration: %.2f seconds\n", time.Since(startTime).Seconds())
-					fmt.Printf("File: %s\n", metadata.Name)
-					fmt.Printf("Total size: %d bytes\n", totalSize)
-					fmt.Printf("Checksum: %s\n", metadata.Checksum)
-					fmt.Println("=========================================================")
+				if metadata != nil && !pr.opts.Quiet {
+					fmt.Printf("\r%80s\r", "")
+					pr.printSummary(metadata, transferredBytes, time.Since(startTime))
 				}
+				pr.notifyProgress(metadata, transferredBytes, rate(transferredBytes, time.Since(startTime)), true)
 				return
 			}
 
-			// Update transferred bytes
-			transferredBytes += progress.NewBytes
+			if pr.opts.OnUpdate != nil {
+				pr.opts.OnUpdate(progress)
+			}
+
+			// Metadata arrives once at the start of the transfer
+			if progress.MetaData != nil {
+				metadata = progress.MetaData
+				totalSize = metadata.Size
+				startTime = time.Now()
+				estimator = throughputEstimator{}
+			}
+
+			// Prefer the absolute offset, it stays right even when updates were dropped
+			if progress.CumulativeBytes > 0 {
+				transferredBytes = progress.CumulativeBytes
+			} else {
+				transferredBytes += progress.NewBytes
+			}
+
+			// Updates come with every chunk, only some are drawn
+			now := time.Now()
+			if now.Sub(lastDrawn) < interval {
+				continue
+			}
+			lastDrawn = now
+			pr.notifyProgress(metadata, transferredBytes, progress.BytesPerSecond, false)
+			if pr.opts.Quiet {
+				continue
+			}
 
-			// Calculate and display progress
+			// Calculate and display progress, the ETA comes from the smoothed rate so it doesn't jump with every burst
+			smoothed := estimator.sample(transferredBytes, now)
+			if smoothed == 0 {
+				smoothed = progress.BytesPerSecond
+			}
+			throughput := utils.FormatRate(smoothed, pr.opts.Units)
+
+			// A followed file has no size to reach, nor does a stream of unknown length
+			if metadata != nil && metadata.Follow {
+				fmt.Printf("\rProgress: %d bytes, following - %s\r", transferredBytes, throughput)
+				continue
+			}
+			if totalSize <= 0 {
+				fmt.Printf("\rProgress: %d bytes - %s\r", transferredBytes, throughput)
+				continue
+			}
 			percent := float64(transferredBytes) / float64(totalSize) * 100
-			fmt.Printf("\rProgress: %d/%d bytes (%.1f%%)\r", transferredBytes, totalSize, percent)
+			if remaining, ok := eta(transferredBytes, totalSize, smoothed); ok {
+				throughput += ", ETA " + formatETA(remaining)
+			}
+			fmt.Printf("\rProgress: %d/%d bytes (%.1f%%) - %s\r", transferredBytes, totalSize, percent, throughput)
 		}
 	}
 }
+
+// notifyProgress hands the progress to Options.OnProgress, if set
+func (pr *ProgressReporter) notifyProgress(metadata *types.FileMetadata, transferred uint64, bytesPerSecond float64, done bool) {
+	if pr.opts.OnProgress == nil || metadata == nil {
+		return
+	}
+	pr.opts.OnProgress(Progress{
+		Name:           metadata.Name,
+		Size:           metadata.Size,
+		Transferred:    transferred,
+		BytesPerSecond: bytesPerSecond,
+		Done:           done,
+	})
+}
+
+// rate calculates the average throughput in bytes per second
+func rate(bytes uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// printSummary prints the completion report for a finished transfer
+func (pr *ProgressReporter) printSummary(metadata *types.FileMetadata, transferredBytes uint64, duration time.Duration) {
+	throughput := utils.FormatRate(rate(transferredBytes, duration), pr.opts.Units)
+	checksum := utils.FormatChecksum(metadata.Checksum, pr.opts.ChecksumFormat)
+	mismatches := pr.typeMismatches()
+
+	if pr.opts.SummaryOneline {
+		// Keep every field free of spaces so the line is easy to parse in scripts
+		var flagged string
+		if len(mismatches) > 0 {
+			flagged = fmt.Sprintf(" type-mismatches=%d", len(mismatches))
+		}
+		fmt.Printf("OK %s %s in %.1fs (%s) sha256=%s%s\n",
+			metadata.Name,
+			strings.ReplaceAll(utils.FormatFileSize(metadata.Size), " ", ""),
+			duration.Seconds(),
+			strings.ReplaceAll(throughput, " ", ""),
+			checksum,
+			flagged)
+		return
+	}
+
+	fmt.Println("=========================================================")
+	fmt.Printf("File transfer complete!\n")
+	fmt.Printf("Duration: %.2f seconds\n", duration.Seconds())
+	fmt.Printf("File: %s\n", metadata.Name)
+	fmt.Printf("Total size: %d bytes\n", metadata.Size)
+	fmt.Printf("Average speed: %s\n", throughput)
+	if checksum != "" {
+		fmt.Printf("Checksum: %s\n", checksum)
+	}
+	for _, mismatch := range mismatches {
+		fmt.Printf("Type mismatch: %s declared as %s but looks like %s\n", mismatch.Name, mismatch.Declared, mismatch.Detected)
+	}
+	fmt.Println("=========================================================")
+}
@@ -0,0 +1,370 @@
+// Package s3 is a minimal client for S3-compatible object storage.
+// It supports just what receiving into a bucket needs: uploading an object, in parts if it is large,
+// reading it back to verify it and deleting it, with requests signed using AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// urlScheme prefixes destinations that are S3 buckets rather than local directories
+const urlScheme = "s3://"
+
+// requestTimeout bounds a single request, a part upload included
+const requestTimeout = 5 * time.Minute
+
+// Options configures the client, empty credentials and region fall back to the standard AWS environment variables
+type Options struct {
+	Endpoint        string // Base URL of the storage service, empty for AWS
+	Region          string // Region requests are signed for
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // Only needed for temporary credentials
+	ForcePathStyle  bool   // Address buckets as endpoint/bucket instead of bucket.endpoint
+}
+
+// Client sends signed requests to an S3-compatible service
+type Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	httpClient   *http.Client
+}
+
+// IsURL reports whether dst names an S3 location like "s3://bucket/prefix"
+func IsURL(dst string) bool {
+	return strings.HasPrefix(dst, urlScheme)
+}
+
+// ParseURL splits an S3 location into its bucket and key
+func ParseURL(dst string) (string, string, error) {
+	if !IsURL(dst) {
+		return "", "", fmt.Errorf("%q is not an s3:// URL", dst)
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(dst, urlScheme), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q has no bucket name", dst)
+	}
+
+	return bucket, key, nil
+}
+
+// JoinURL appends slash-separated elements to an S3 location
+func JoinURL(base string, elem ...string) string {
+	return urlScheme + path.Join(append([]string{strings.TrimPrefix(base, urlScheme)}, elem...)...)
+}
+
+// NewClient creates a client from opts
+func NewClient(opts Options) (*Client, error) {
+	region := firstNonEmpty(opts.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	accessKey := firstNonEmpty(opts.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID"))
+	secretKey := firstNonEmpty(opts.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("no S3 credentials: set s3.access_key_id and s3.secret_access_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	endpoint := firstNonEmpty(opts.Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), "https://s3."+region+".amazonaws.com")
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Scheme == "" || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+
+	return &Client{
+		endpoint:     endpointURL,
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: firstNonEmpty(opts.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+		pathStyle:    opts.ForcePathStyle,
+		httpClient:   &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+// PutObject uploads data as the object key in a single request
+func (c *Client) PutObject(ctx context.Context, bucket, key string, data []byte, header http.Header) error {
+	resp, err := c.do(ctx, http.MethodPut, bucket, key, nil, header, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetObject opens the object key for reading, the caller closes it
+func (c *Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+// DeleteObject removes the object key
+func (c *Client) DeleteObject(ctx context.Context, bucket, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, bucket, key, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// createMultipartUpload starts a multipart upload of key and returns its upload ID
+func (c *Client) createMultipartUpload(ctx context.Context, bucket, key string, header http.Header) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("failed to start upload of %s: no upload ID in response", key)
+	}
+
+	return result.UploadID, nil
+}
+
+// uploadPart uploads one part of a multipart upload and returns its ETag
+func (c *Client) uploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {uploadID}}
+	resp, err := c.do(ctx, http.MethodPut, bucket, key, query, nil, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %d of %s: %w", partNumber, key, err)
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("failed to upload part %d of %s: no ETag in response", partNumber, key)
+	}
+	return etag, nil
+}
+
+// completedPart identifies an uploaded part when completing a multipart upload
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeMultipartUpload assembles the uploaded parts into the object
+func (c *Client) completeMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("failed to encode parts of %s: %w", key, err)
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	// Completing can fail after the 200 status has been sent, the error is then in the body
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, err)
+	}
+	if apiErr := parseError(respBody); apiErr != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, apiErr)
+	}
+	return nil
+}
+
+// abortMultipartUpload discards a multipart upload and the parts uploaded so far
+func (c *Client) abortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to abort upload of %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request and returns the response if it succeeded
+func (c *Client) do(ctx context.Context, method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	host := c.endpoint.Host
+	objectPath := strings.TrimSuffix(c.endpoint.Path, "/") + "/" + key
+	if c.pathStyle {
+		objectPath = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		host = bucket + "." + host
+	}
+
+	rawPath := uriEncode(objectPath, false)
+	rawQuery := canonicalQuery(query)
+	reqURL := c.endpoint.Scheme + "://" + host + rawPath
+	if rawQuery != "" {
+		reqURL += "?" + rawQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	c.sign(req, host, rawPath, rawQuery, body, time.Now().UTC())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if apiErr := parseError(respBody); apiErr != nil {
+			return nil, apiErr
+		}
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (c *Client) sign(req *http.Request, host, rawPath, rawQuery string, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Host = host
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	// Every header sent is signed, plus the host
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		rawPath,
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	signingKey = hmacSHA256(signingKey, c.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// apiError is an error reported by the storage service
+type apiError struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// parseError returns the error described by an S3 error response body, or nil if body isn't one
+func parseError(body []byte) error {
+	var apiErr apiError
+	if err := xml.Unmarshal(body, &apiErr); err != nil || apiErr.Code == "" {
+		return nil
+	}
+	return &apiErr
+}
+
+// canonicalQuery encodes query sorted by key, as both sent and signed
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hmacSHA256 computes the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// firstNonEmpty returns the first of values that isn't empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
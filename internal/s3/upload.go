@@ -0,0 +1,129 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, except for the last part
+const MinPartSize = 5 * 1024 * 1024
+
+// Upload streams written data to an object. Data is uploaded in parts of partSize as it arrives,
+// an object smaller than one part is uploaded with a single request when the upload is closed.
+// Nothing is visible in the bucket until Close completes the upload.
+type Upload struct {
+	ctx      context.Context
+	client   *Client
+	bucket   string
+	key      string
+	header   http.Header
+	partSize int
+	buf      []byte
+	uploadID string // Set once the first part is uploaded
+	parts    []completedPart
+	done     bool // Completed or aborted, nothing more can be written
+}
+
+// NewUpload prepares an upload of the object key, header is sent with it (e.g. Content-Type)
+func (c *Client) NewUpload(ctx context.Context, bucket, key string, header http.Header, partSize int) *Upload {
+	return &Upload{
+		ctx:      ctx,
+		client:   c,
+		bucket:   bucket,
+		key:      key,
+		header:   header,
+		partSize: max(partSize, MinPartSize),
+	}
+}
+
+// Write buffers p and uploads every full part
+func (u *Upload) Write(p []byte) (int, error) {
+	if u.done {
+		return 0, fmt.Errorf("upload of %s is already finished", u.key)
+	}
+
+	u.buf = append(u.buf, p...)
+	for len(u.buf) >= u.partSize {
+		if err := u.uploadPart(u.buf[:u.partSize]); err != nil {
+			return 0, err
+		}
+		u.buf = append(u.buf[:0], u.buf[u.partSize:]...)
+	}
+
+	return len(p), nil
+}
+
+// Close uploads the remaining data and completes the upload, making the object visible
+func (u *Upload) Close() error {
+	if u.done {
+		return nil
+	}
+	u.done = true
+
+	if u.uploadID == "" {
+		return u.client.PutObject(u.ctx, u.bucket, u.key, u.buf, u.header)
+	}
+
+	if len(u.buf) > 0 {
+		if err := u.uploadPart(u.buf); err != nil {
+			u.abort()
+			return err
+		}
+	}
+
+	if err := u.client.completeMultipartUpload(u.ctx, u.bucket, u.key, u.uploadID, u.parts); err != nil {
+		u.abort()
+		return err
+	}
+	return nil
+}
+
+// Abort discards an upload that hasn't been completed, the object it would have replaced is left untouched
+func (u *Upload) Abort() error {
+	if u.done {
+		return nil
+	}
+	u.done = true
+
+	return u.abort()
+}
+
+// Open reads back the object once the upload is complete, the caller closes it
+func (u *Upload) Open() (io.ReadCloser, error) {
+	return u.client.GetObject(u.ctx, u.bucket, u.key)
+}
+
+// Delete removes the object once the upload is complete
+func (u *Upload) Delete() error {
+	return u.client.DeleteObject(u.ctx, u.bucket, u.key)
+}
+
+// uploadPart uploads data as the next part, starting the multipart upload first if needed
+func (u *Upload) uploadPart(data []byte) error {
+	if u.uploadID == "" {
+		uploadID, err := u.client.createMultipartUpload(u.ctx, u.bucket, u.key, u.header)
+		if err != nil {
+			return err
+		}
+		u.uploadID = uploadID
+	}
+
+	partNumber := len(u.parts) + 1
+	etag, err := u.client.uploadPart(u.ctx, u.bucket, u.key, u.uploadID, partNumber, data)
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, completedPart{PartNumber: partNumber, ETag: etag})
+	return nil
+}
+
+// abort discards the multipart upload, if one was started
+func (u *Upload) abort() error {
+	u.buf = nil
+	if u.uploadID == "" {
+		return nil
+	}
+	return u.client.abortMultipartUpload(u.ctx, u.bucket, u.key, u.uploadID)
+}
@@ -0,0 +1,108 @@
+package signalling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// filePollInterval is how often the answer file is checked for an answer
+const filePollInterval = 500 * time.Millisecond
+
+// FileExchange is a signalling server without a server: the offer and answer are written to files that
+// the users carry between the machines themselves (USB stick, scp, ...). The sender writes the offer to
+// offerPath and waits for the answer at answerPath, the receiver reads the offer and writes the answer.
+type FileExchange struct {
+	offerPath   string
+	answerPath  string
+	staleAnswer []byte // Answer file content found when the offer was written, it can't answer that offer
+}
+
+// NewFileExchange creates a file exchange, both peers use the same two paths on their own machines
+func NewFileExchange(offerPath, answerPath string) *FileExchange {
+	return &FileExchange{
+		offerPath:  offerPath,
+		answerPath: answerPath,
+	}
+}
+
+// SessionID names the exchange's only session after its offer file
+func (f *FileExchange) SessionID() string {
+	return f.offerPath
+}
+
+// CreateSession writes the offer to the offer file
+func (f *FileExchange) CreateSession(ctx context.Context, offer string) (string, error) {
+	// An answer left from an earlier run belongs to another offer, only a new one will do
+	stale, err := os.ReadFile(f.answerPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("error checking answer file %s: %w", f.answerPath, err)
+	}
+	f.staleAnswer = bytes.TrimSpace(stale)
+
+	// The offer carries the ICE credentials and certificate fingerprint of the connection
+	if err := os.WriteFile(f.offerPath, []byte(offer+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("error writing offer file %s: %w", f.offerPath, err)
+	}
+
+	log.Printf("Offer written to %s, take it to the receiver (receive --offer-in) and bring its answer back as %s", f.offerPath, f.answerPath)
+	return f.SessionID(), nil
+}
+
+// GetOffer reads the offer from the offer file
+func (f *FileExchange) GetOffer(ctx context.Context, sessionID string) (string, error) {
+	offer, err := os.ReadFile(f.offerPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading offer file: %w", err)
+	}
+
+	offer = bytes.TrimSpace(offer)
+	if len(offer) == 0 {
+		return "", fmt.Errorf("offer file %s is empty", f.offerPath)
+	}
+	return string(offer), nil
+}
+
+// UpdateAnswer writes the answer to the answer file
+func (f *FileExchange) UpdateAnswer(ctx context.Context, sessionID, answer string) error {
+	if err := os.WriteFile(f.answerPath, []byte(answer+"\n"), 0600); err != nil {
+		return fmt.Errorf("error writing answer file %s: %w", f.answerPath, err)
+	}
+
+	log.Printf("Answer written to %s, take it back to the sender now, the connection is made once it reads it", f.answerPath)
+	return nil
+}
+
+// WaitForAnswer waits until a new answer appears in the answer file. Carrying it over can take a while,
+// so there is no time limit. A file still being copied is only read once it stops changing.
+func (f *FileExchange) WaitForAnswer(ctx context.Context, sessionID string) (string, error) {
+	log.Printf("Waiting for the answer at %s...", f.answerPath)
+
+	var previous []byte
+	for {
+		answer, err := os.ReadFile(f.answerPath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("error reading answer file: %w", err)
+		}
+
+		answer = bytes.TrimSpace(answer)
+		if len(answer) > 0 && !bytes.Equal(answer, f.staleAnswer) && bytes.Equal(answer, previous) {
+			return string(answer), nil
+		}
+		previous = answer
+
+		select {
+		case <-time.After(filePollInterval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// DeleteSession leaves the files where they are, they are the users' to remove
+func (f *FileExchange) DeleteSession(ctx context.Context, sessionID string) error {
+	return nil
+}
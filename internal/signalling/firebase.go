@@ -2,8 +2,13 @@ package signalling
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
 	"time"
 
 	"yapfs/internal/config"
@@ -11,17 +16,59 @@ import (
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/db"
+	"firebase.google.com/go/v4/errorutils"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 )
 
+// firebaseScopes are what credentials loaded for a client with its own transport are authorised for
+var firebaseScopes = []string{
+	"https://www.googleapis.com/auth/firebase.database",
+	"https://www.googleapis.com/auth/userinfo.email",
+}
+
+// ErrFirebaseAccessDenied is returned when the database refuses a read or write, most often because of its security rules
+var ErrFirebaseAccessDenied = errors.New("Firebase denied access — check your database security rules and credentials")
+
+// accessError wraps err with ErrFirebaseAccessDenied if the database refused the request.
+// Rules that deny a request are answered with 401 Unauthorized, credentials without access to the database with 403.
+func accessError(err error) error {
+	if errorutils.IsPermissionDenied(err) || errorutils.IsUnauthenticated(err) {
+		return fmt.Errorf("%w: %w", ErrFirebaseAccessDenied, err)
+	}
+	return err
+}
+
 type FirebaseClient struct {
-	db  *db.Client
-	ctx context.Context
-	ref *db.Ref
+	db                 *db.Client
+	ctx                context.Context
+	ref                *db.Ref
+	answerInitialDelay time.Duration // Wait after the first answer check before polling every answerPollInterval
+	offerWait          time.Duration // How long GetOffer keeps checking for a session that doesn't exist yet
+	generateCode       CodeGenerator // Codes of new sessions
 }
 
-func NewFirebaseClient(ctx context.Context, cfg *config.FirebaseConfig) (*FirebaseClient, error) {
+// answerPollInterval is how often the session is checked for the receiver's answer
+const answerPollInterval = 5 * time.Second
+
+// A session that isn't there yet is checked again after offerPollMin, backing off to every offerPollMax
+const (
+	offerPollMin = 250 * time.Millisecond
+	offerPollMax = 2 * time.Second
+)
+
+// NewFirebaseClient creates a client for the database cfg names. With transport set, tokens are fetched and
+// requests made through it, otherwise through the default transport.
+func NewFirebaseClient(ctx context.Context, cfg *config.FirebaseConfig, transport http.RoundTripper) (*FirebaseClient, error) {
 	opt := option.WithCredentialsFile(cfg.CredentialsPath)
+	if transport != nil {
+		client, err := firebaseHTTPClient(ctx, cfg.CredentialsPath, transport)
+		if err != nil {
+			return nil, err
+		}
+		opt = option.WithHTTPClient(client)
+	}
 
 	firebaseConfig := &firebase.Config{
 		DatabaseURL: cfg.DatabaseURL,
@@ -38,23 +85,49 @@ func NewFirebaseClient(ctx context.Context, cfg *config.FirebaseConfig) (*Fireba
 	}
 
 	return &FirebaseClient{
-		db:  client,
-		ctx: ctx,
-		ref: client.NewRef("sessions"),
+		db:                 client,
+		ctx:                ctx,
+		ref:                client.NewRef("sessions"),
+		answerInitialDelay: time.Duration(cfg.AnswerInitialDelayMs) * time.Millisecond,
+		offerWait:          time.Duration(cfg.OfferWaitMs) * time.Millisecond,
+		generateCode:       utils.GenerateCode,
 	}, nil
 }
 
+// firebaseHTTPClient returns an HTTP client authorised with the credentials at credentialsPath, which fetches its
+// tokens and makes its requests through transport
+func firebaseHTTPClient(ctx context.Context, credentialsPath string, transport http.RoundTripper) (*http.Client, error) {
+	data, err := os.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Firebase credentials: %w", err)
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	creds, err := google.CredentialsFromJSON(ctx, data, firebaseScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading Firebase credentials: %w", err)
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
 // Session represents a signaling session data
-// Support vanilla ICE for now,
-// TODO: support trickle ICE, add support for expire/time out and status(create, connected, failed)
+// TODO: add support for expire/time out and status(create, connected, failed)
 type Session struct {
 	ID     string `json:"sessionId"`
 	Offer  string `json:"offer"`
 	Answer string `json:"answer"`
+
+	// Candidates trickled by each peer, under "offer" and "answer", by push ID in the order they were gathered
+	Candidates map[string]map[string]string `json:"candidates,omitempty"`
+}
+
+// SetCodeGenerator makes new sessions take their codes from generate
+func (f *FirebaseClient) SetCodeGenerator(generate CodeGenerator) {
+	f.generateCode = generate
 }
 
 func (f *FirebaseClient) CreateSession(ctx context.Context, offer string) (string, error) {
-	code, err := utils.GenerateCode(8)
+	code, err := f.generateCode(sessionCodeLength)
 	if err != nil {
 		return "", fmt.Errorf("error generating session code: %w", err)
 	}
@@ -67,7 +140,7 @@ func (f *FirebaseClient) CreateSession(ctx context.Context, offer string) (strin
 	}
 	err = sessionRef.Set(f.ctx, sessionData)
 	if err != nil {
-		return "", fmt.Errorf("error creating session: %w", err)
+		return "", fmt.Errorf("error creating session: %w", accessError(err))
 	}
 
 	log.Println("Session created successfully")
@@ -80,7 +153,7 @@ func (f *FirebaseClient) UpdateAnswer(ctx context.Context, sessionID, answer str
 
 	sessionRef := f.ref.Child(sessionID)
 	if err := sessionRef.Get(f.ctx, &sessionData); err != nil {
-		return fmt.Errorf("error checking session existence for %s: %w", sessionID, err)
+		return fmt.Errorf("error checking session existence for %s: %w", sessionID, accessError(err))
 	}
 
 	if sessionData.ID == "" {
@@ -91,7 +164,7 @@ func (f *FirebaseClient) UpdateAnswer(ctx context.Context, sessionID, answer str
 		"answer": answer,
 	}
 	if err := sessionRef.Update(f.ctx, updates); err != nil {
-		return fmt.Errorf("error updating answer for session %s: %w", sessionID, err)
+		return fmt.Errorf("error updating answer for session %s: %w", sessionID, accessError(err))
 	}
 	return nil
 }
@@ -100,23 +173,43 @@ func (f *FirebaseClient) WaitForAnswer(ctx context.Context, sessionID string) (s
 	// First verify the session exists
 	var initialCheck Session
 
+	// Polling uses the caller's context, so cancelling the wait stops a request in flight too
 	sessionRef := f.ref.Child(sessionID)
-	if err := sessionRef.Get(f.ctx, &initialCheck); err != nil {
-		return "", fmt.Errorf("error checking session existence for %s: %w", sessionID, err)
+	if err := sessionRef.Get(ctx, &initialCheck); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("error checking session existence for %s: %w", sessionID, accessError(err))
 	}
 
 	if initialCheck.ID == "" {
 		return "", fmt.Errorf("session %s not found", sessionID)
 	}
 
-	time.Sleep(time.Second * 5)
+	// The receiver may have answered already
+	if initialCheck.Answer != "" {
+		return initialCheck.Answer, nil
+	}
+
 	log.Printf("Waiting for receiver to answer...")
+	select {
+	case <-time.After(f.answerInitialDelay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 
 	for i := range 10 {
 		var sessionData struct {
 			Answer string `json:"answer"`
 		}
-		if err := sessionRef.Get(f.ctx, &sessionData); err != nil {
+		if err := sessionRef.Get(ctx, &sessionData); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			// Asking again won't change the database's rules
+			if err := accessError(err); errors.Is(err, ErrFirebaseAccessDenied) {
+				return "", fmt.Errorf("error waiting for answer for session %s: %w", sessionID, err)
+			}
 			log.Println(err.Error())
 			continue
 		}
@@ -127,7 +220,7 @@ func (f *FirebaseClient) WaitForAnswer(ctx context.Context, sessionID string) (s
 
 		if i < 9 {
 			select {
-			case <-time.After(time.Second * 5):
+			case <-time.After(answerPollInterval):
 			case <-ctx.Done():
 				return "", ctx.Err()
 			}
@@ -147,7 +240,7 @@ func (f *FirebaseClient) DeleteSession(ctx context.Context, sessionID string) er
 
 	sessionRef := f.ref.Child(sessionID)
 	if err := sessionRef.Get(f.ctx, &sessionData); err != nil {
-		return fmt.Errorf("error checking session existence for %s: %w", sessionID, err)
+		return fmt.Errorf("error checking session existence for %s: %w", sessionID, accessError(err))
 	}
 
 	if sessionData.ID == "" {
@@ -157,23 +250,82 @@ func (f *FirebaseClient) DeleteSession(ctx context.Context, sessionID string) er
 	}
 
 	if err := sessionRef.Delete(f.ctx); err != nil {
-		return fmt.Errorf("error deleting session %s: %w", sessionID, err)
+		return fmt.Errorf("error deleting session %s: %w", sessionID, accessError(err))
 	}
 	return nil
 }
 
+// GetOffer reads the session's offer. A receiver may be given the code before the sender has created the session,
+// so one that isn't there is checked again with backoff for up to offerWait.
 func (f *FirebaseClient) GetOffer(ctx context.Context, sessionID string) (string, error) {
 	sessionRef := f.ref.Child(sessionID)
+	deadline := time.Now().Add(f.offerWait)
+	interval := offerPollMin
 
-	var sessionData Session
-	if err := sessionRef.Get(f.ctx, &sessionData); err != nil {
-		return "", fmt.Errorf("error fetching session from storage for session %s: %w", sessionID, err)
+	for waited := false; ; waited = true {
+		var sessionData Session
+		if err := sessionRef.Get(f.ctx, &sessionData); err != nil {
+			return "", fmt.Errorf("error fetching session from storage for session %s: %w", sessionID, accessError(err))
+		}
+
+		// Validate that the session actually exists and has an offer
+		if sessionData.ID != "" && sessionData.Offer != "" {
+			return sessionData.Offer, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", fmt.Errorf("session %s not found or has no offer", sessionID)
+		}
+		if !waited {
+			log.Printf("Session %s not found yet, waiting up to %v for the sender to create it", sessionID, f.offerWait)
+		}
+
+		select {
+		case <-time.After(min(interval, remaining)):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		interval = min(interval*2, offerPollMax)
 	}
+}
 
-	// Validate that the session actually exists and has an offer
-	if sessionData.ID == "" || sessionData.Offer == "" {
-		return "", fmt.Errorf("session %s not found or has no offer", sessionID)
+// PutRelay stores a relayed value under the session, it goes when the session is deleted
+func (f *FirebaseClient) PutRelay(ctx context.Context, sessionID, key, value string) error {
+	if err := f.ref.Child(sessionID).Child("relay").Child(key).Set(f.ctx, value); err != nil {
+		return fmt.Errorf("error relaying %s through session %s: %w", key, sessionID, accessError(err))
 	}
+	return nil
+}
 
-	return sessionData.Offer, nil
+// GetRelay reads a relayed value from the session, empty if it hasn't been stored yet
+func (f *FirebaseClient) GetRelay(ctx context.Context, sessionID, key string) (string, error) {
+	var value string
+	if err := f.ref.Child(sessionID).Child("relay").Child(key).Get(f.ctx, &value); err != nil {
+		return "", fmt.Errorf("error reading relayed %s from session %s: %w", key, sessionID, accessError(err))
+	}
+	return value, nil
+}
+
+// AddCandidate appends an ICE candidate to the session's candidates under role
+func (f *FirebaseClient) AddCandidate(ctx context.Context, sessionID, role, candidate string) error {
+	if _, err := f.ref.Child(sessionID).Child("candidates").Child(role).Push(ctx, candidate); err != nil {
+		return fmt.Errorf("error adding ICE candidate to session %s: %w", sessionID, accessError(err))
+	}
+	return nil
+}
+
+// GetCandidates reads the session's candidates under role in the order they were added
+func (f *FirebaseClient) GetCandidates(ctx context.Context, sessionID, role string) ([]string, error) {
+	var pushed map[string]string
+	if err := f.ref.Child(sessionID).Child("candidates").Child(role).Get(ctx, &pushed); err != nil {
+		return nil, fmt.Errorf("error reading ICE candidates from session %s: %w", sessionID, accessError(err))
+	}
+
+	// Push IDs sort in the order they were created
+	candidates := make([]string, 0, len(pushed))
+	for _, key := range slices.Sorted(maps.Keys(pushed)) {
+		candidates = append(candidates, pushed[key])
+	}
+	return candidates, nil
 }
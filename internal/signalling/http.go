@@ -0,0 +1,249 @@
+package signalling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"yapfs/pkg/utils"
+)
+
+// How long a request may hold the answer back for a server that long-polls, and how long the sender waits for it in all
+const (
+	httpLongPoll      = 25 * time.Second
+	httpAnswerTimeout = time.Minute
+)
+
+// An answer that isn't there yet is checked again after httpPollMin, backing off to every httpPollMax
+const (
+	httpPollMin = 250 * time.Millisecond
+	httpPollMax = 5 * time.Second
+)
+
+// httpCreateAttempts is how many codes CreateSession tries before giving up on finding one the server doesn't already hold
+const httpCreateAttempts = 3
+
+// HTTPSignalingClient signals through a plain HTTP server that keeps each session as a JSON document
+// ({"sessionId", "offer", "answer"}) at baseURL/sessions/{id}:
+//
+//   - PUT /sessions/{id} creates it from {"offer"}, answering 409 Conflict if the code is taken
+//   - GET /sessions/{id} returns it, 404 Not Found if it doesn't exist; with ?wait=N the server may hold the
+//     request for up to N seconds until the session has an answer
+//   - PUT /sessions/{id}/answer stores {"answer"}
+//   - DELETE /sessions/{id} removes it
+//
+// A server that doesn't long-poll answers right away, the answer is then polled for with backoff.
+type HTTPSignalingClient struct {
+	baseURL      string
+	client       *http.Client
+	generateCode CodeGenerator // Codes of new sessions
+}
+
+// httpSession is a session as the server stores it
+type httpSession struct {
+	ID     string `json:"sessionId"`
+	Offer  string `json:"offer,omitempty"`
+	Answer string `json:"answer,omitempty"`
+}
+
+// NewHTTPSignalingClient creates a client for the signalling server at baseURL, making requests through transport,
+// or the default transport if it is nil
+func NewHTTPSignalingClient(baseURL string, transport http.RoundTripper) *HTTPSignalingClient {
+	return &HTTPSignalingClient{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		client:       &http.Client{Transport: transport, Timeout: httpLongPoll + 10*time.Second},
+		generateCode: utils.GenerateCode,
+	}
+}
+
+// SetCodeGenerator makes new sessions take their codes from generate
+func (h *HTTPSignalingClient) SetCodeGenerator(generate CodeGenerator) {
+	h.generateCode = generate
+}
+
+// CreateSession stores the offer under a new code
+func (h *HTTPSignalingClient) CreateSession(ctx context.Context, offer string) (string, error) {
+	for range httpCreateAttempts {
+		code, err := h.generateCode(sessionCodeLength)
+		if err != nil {
+			return "", fmt.Errorf("error generating session code: %w", err)
+		}
+
+		status, err := h.do(ctx, http.MethodPut, h.sessionURL(code), httpSession{ID: code, Offer: offer}, nil)
+		if err != nil {
+			return "", fmt.Errorf("error creating session: %w", err)
+		}
+		if status == http.StatusConflict {
+			continue
+		}
+		if err := expectOK(status); err != nil {
+			return "", fmt.Errorf("error creating session: %w", err)
+		}
+
+		log.Println("Session created successfully")
+		return code, nil
+	}
+	return "", fmt.Errorf("error creating session: no free code after %d attempts", httpCreateAttempts)
+}
+
+// GetOffer reads the session's offer
+func (h *HTTPSignalingClient) GetOffer(ctx context.Context, sessionID string) (string, error) {
+	session, found, err := h.getSession(ctx, sessionID, 0)
+	if err != nil {
+		return "", fmt.Errorf("error fetching session %s: %w", sessionID, err)
+	}
+	if !found || session.Offer == "" {
+		return "", fmt.Errorf("session %s not found or has no offer", sessionID)
+	}
+	return session.Offer, nil
+}
+
+// UpdateAnswer stores the answer in an existing session
+func (h *HTTPSignalingClient) UpdateAnswer(ctx context.Context, sessionID, answer string) error {
+	status, err := h.do(ctx, http.MethodPut, h.sessionURL(sessionID)+"/answer", httpSession{ID: sessionID, Answer: answer}, nil)
+	if err != nil {
+		return fmt.Errorf("error updating answer for session %s: %w", sessionID, err)
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+	if err := expectOK(status); err != nil {
+		return fmt.Errorf("error updating answer for session %s: %w", sessionID, err)
+	}
+	return nil
+}
+
+// WaitForAnswer waits for the receiver's answer, long-polling a server that supports it and backing off otherwise.
+// The session is deleted if no answer comes within httpAnswerTimeout.
+func (h *HTTPSignalingClient) WaitForAnswer(ctx context.Context, sessionID string) (string, error) {
+	deadline := time.Now().Add(httpAnswerTimeout)
+	interval := httpPollMin
+	log.Printf("Waiting for receiver to answer...")
+
+	for {
+		asked := time.Now()
+		session, found, err := h.getSession(ctx, sessionID, httpLongPoll)
+		switch {
+		case ctx.Err() != nil:
+			return "", ctx.Err()
+		case err != nil:
+			log.Printf("Error checking session %s for an answer: %v", sessionID, err)
+		case !found:
+			return "", fmt.Errorf("session %s not found", sessionID)
+		case session.Answer != "":
+			return session.Answer, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		// A server that held the request already waited, ask again right away
+		if time.Since(asked) < interval {
+			select {
+			case <-time.After(min(interval, remaining)):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			interval = min(interval*2, httpPollMax)
+		}
+	}
+
+	if err := h.DeleteSession(ctx, sessionID); err != nil {
+		return "", fmt.Errorf("error deleting session: %w", err)
+	}
+	return "", fmt.Errorf("timeout waiting for answer")
+}
+
+// DeleteSession removes the session, one that is already gone is not an error
+func (h *HTTPSignalingClient) DeleteSession(ctx context.Context, sessionID string) error {
+	status, err := h.do(ctx, http.MethodDelete, h.sessionURL(sessionID), nil, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting session %s: %w", sessionID, err)
+	}
+	if status == http.StatusNotFound {
+		log.Printf("Session %s not found, skipping deletion", sessionID)
+		return nil
+	}
+	if err := expectOK(status); err != nil {
+		return fmt.Errorf("error deleting session %s: %w", sessionID, err)
+	}
+	return nil
+}
+
+// getSession fetches a session, reporting false if it doesn't exist. With wait above 0 the server may hold the
+// request until the session has an answer.
+func (h *HTTPSignalingClient) getSession(ctx context.Context, sessionID string, wait time.Duration) (httpSession, bool, error) {
+	sessionURL := h.sessionURL(sessionID)
+	if wait > 0 {
+		sessionURL += fmt.Sprintf("?wait=%d", int(wait.Seconds()))
+	}
+
+	var session httpSession
+	status, err := h.do(ctx, http.MethodGet, sessionURL, nil, &session)
+	if err != nil {
+		return session, false, err
+	}
+	if status == http.StatusNotFound {
+		return session, false, nil
+	}
+	if err := expectOK(status); err != nil {
+		return session, false, err
+	}
+	return session, true, nil
+}
+
+// sessionURL returns the URL of a session
+func (h *HTTPSignalingClient) sessionURL(sessionID string) string {
+	return h.baseURL + "/sessions/" + url.PathEscape(sessionID)
+}
+
+// do sends a request with body encoded as JSON, if any, and decodes a successful response into out, if given.
+// It returns the response status, only failing if the request couldn't be made or its response read.
+func (h *HTTPSignalingClient) do(ctx context.Context, method, reqURL string, body, out any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding request: %w", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil && expectOK(resp.StatusCode) == nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return 0, fmt.Errorf("error decoding response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// expectOK fails for any status but a 2xx one
+func expectOK(status int) error {
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("server answered %d %s", status, http.StatusText(status))
+	}
+	return nil
+}
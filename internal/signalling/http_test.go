@@ -0,0 +1,45 @@
+package signalling
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"yapfs/pkg/utils"
+)
+
+func TestHTTPCreateSessionUsesCodeGenerator(t *testing.T) {
+	// The first code is already held by the server, so the client has to move on to the second
+	var mu sync.Mutex
+	taken := map[string]bool{"AAAAAAAA": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		code := strings.TrimPrefix(r.URL.Path, "/sessions/")
+		if r.Method != http.MethodPut || taken[code] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		taken[code] = true
+	}))
+	defer server.Close()
+
+	random := bytes.NewReader(append(bytes.Repeat([]byte{0}, 8), []byte{7, 4, 11, 11, 14, 52, 53, 54}...))
+	client := NewHTTPSignalingClient(server.URL, nil)
+	client.SetCodeGenerator(func(length int) (string, error) {
+		return utils.GenerateCodeFrom(random, length)
+	})
+
+	code, err := client.CreateSession(context.Background(), "offer")
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	if code != "HELLO012" {
+		t.Fatalf("CreateSession() = %q, want the forced code HELLO012", code)
+	}
+}
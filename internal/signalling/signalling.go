@@ -2,8 +2,11 @@ package signalling
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 
 	"yapfs/internal/config"
 	"yapfs/pkg/utils"
@@ -11,6 +14,16 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// ErrInvalidRemoteSDP is returned when the SDP received from the other peer can't be used
+var ErrInvalidRemoteSDP = errors.New("received SDP from peer is invalid — the code may be stale or corrupted")
+
+// CodeGenerator generates the code of a new session, length characters long. The clients use utils.GenerateCode,
+// reading crypto/rand, unless given another with SetCodeGenerator.
+type CodeGenerator func(length int) (string, error)
+
+// sessionCodeLength is how many characters the code of a new session has
+const sessionCodeLength = 8
+
 // SignalingServer defines the interface for signaling storage operations
 type SignalingServer interface {
 	CreateSession(ctx context.Context, offer string) (sessionID string, err error)
@@ -20,11 +33,23 @@ type SignalingServer interface {
 	DeleteSession(ctx context.Context, sessionID string) error
 }
 
+// RelayStore is implemented by signalling servers that can also carry file data, for peers that can't connect directly
+type RelayStore interface {
+	PutRelay(ctx context.Context, sessionID, key, value string) error
+	GetRelay(ctx context.Context, sessionID, key string) (value string, err error) // Empty until key has been written
+}
+
+// FixedSession is implemented by signalling servers whose single session both peers know up front, no code is exchanged
+type FixedSession interface {
+	SessionID() string
+}
+
 // SDPHandler defines the interface for WebRTC SDP operations
 type SDPHandler interface {
 	CreateOffer(peerConn *webrtc.PeerConnection) (*webrtc.SessionDescription, error)
 	CreateAnswer(peerConn *webrtc.PeerConnection) (*webrtc.SessionDescription, error)
 	WaitForICEGathering(ctx context.Context, peerConn *webrtc.PeerConnection) error
+	TrickleICE() bool // Send candidates as they are gathered where the signalling server can carry them
 }
 
 // SignalingService orchestrates the complete signaling flow using composition
@@ -40,49 +65,93 @@ func NewSignalingService(server SignalingServer, sdp SDPHandler) *SignalingServi
 	}
 }
 
+// NewDefaultSignalingService creates a signalling service through the server cfg.Signaling names, Firebase by default.
+// With cfg.Proxy set, the server is reached through the proxy on a transport of the service's own.
 func NewDefaultSignalingService(cfg *config.Config) (*SignalingService, error) {
-	server, err := NewFirebaseClient(context.Background(), &cfg.Firebase)
+	sdp := NewWebRTCHandler(&cfg.WebRTC)
+
+	var transport http.RoundTripper
+	if cfg.Proxy != "" {
+		proxyURL, err := utils.ParseProxyURL(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		transport = utils.ProxyTransport(proxyURL)
+	}
+
+	if cfg.Signaling.Backend == config.SignalingHTTP {
+		if err := cfg.ValidateSignaling(); err != nil {
+			return nil, fmt.Errorf("invalid signaling configuration: %w", err)
+		}
+		return NewSignalingService(NewHTTPSignalingClient(cfg.Signaling.URL, transport), sdp), nil
+	}
+
+	if err := cfg.Firebase.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid Firebase configuration: %w", err)
+	}
+
+	server, err := NewFirebaseClient(context.Background(), &cfg.Firebase, transport)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize Firebase cilent: %w", err)
 	}
 
-	sdp := &WebRTCHandler{}
-
 	return NewSignalingService(server, sdp), nil
 }
 
-func (s *SignalingService) StartSenderSignallingProcess(ctx context.Context, peerConn *webrtc.PeerConnection) (string, error) {
+// StartSenderSignallingProcess publishes peerConn's offer and waits for the receiver's answer.
+// onCode, if set, is called with the code for the receiver as soon as the session exists.
+func (s *SignalingService) StartSenderSignallingProcess(ctx context.Context, peerConn *webrtc.PeerConnection, onCode func(code string)) (string, error) {
+	// Candidates gathered from here on are sent once the session exists
+	store, trickle := s.trickleStore()
+	var local *localCandidates
+	if trickle {
+		local = trickleCandidates(ctx, peerConn, store, candidatesOffer)
+	}
+
 	// Create offer using SDP handler
-	_, err := s.sdp.CreateOffer(peerConn)
+	offer, err := s.sdp.CreateOffer(peerConn)
 	if err != nil {
+		local.abandon()
 		return "", fmt.Errorf("failed to create offer: %w", err)
 	}
 
-	// Wait for ICE gathering to complete
-	err = s.sdp.WaitForICEGathering(ctx, peerConn)
-	if err != nil {
-		return "", fmt.Errorf("failed to wait for ICE gathering: %w", err)
-	}
+	// A trickled offer goes without candidates, otherwise it waits for them
+	finalOffer := offer
+	if !trickle {
+		// Wait for ICE gathering to complete
+		err = s.sdp.WaitForICEGathering(ctx, peerConn)
+		if err != nil {
+			return "", fmt.Errorf("failed to wait for ICE gathering: %w", err)
+		}
 
-	// Get the final offer with ICE candidates
-	finalOffer := peerConn.LocalDescription()
-	if finalOffer == nil {
-		return "", fmt.Errorf("local description is nil after ICE gathering")
+		// Get the final offer with ICE candidates
+		finalOffer = peerConn.LocalDescription()
+		if finalOffer == nil {
+			return "", fmt.Errorf("local description is nil after ICE gathering")
+		}
 	}
 
 	// Encode offer SDP
 	encodedOffer, err := utils.Encode(*finalOffer)
 	if err != nil {
+		local.abandon()
 		return "", fmt.Errorf("failed to encode offer SDP: %w", err)
 	}
 
 	// Create session with offer using backend
 	sessionID, err := s.server.CreateSession(ctx, encodedOffer)
 	if err != nil {
+		local.abandon()
 		return "", fmt.Errorf("failed to create session with offer: %w", err)
 	}
+	local.start(sessionID)
 
-	log.Printf("Send this code to the receiver: %s\n", sessionID)
+	if _, fixed := s.server.(FixedSession); !fixed {
+		log.Printf("Send this code to the receiver: %s\n", sessionID)
+		if onCode != nil {
+			onCode(sessionID)
+		}
+	}
 
 	// Wait for answer from remote peer
 	answer, err := s.server.WaitForAnswer(ctx, sessionID)
@@ -90,16 +159,17 @@ func (s *SignalingService) StartSenderSignallingProcess(ctx context.Context, pee
 		return sessionID, fmt.Errorf("failed to wait for answer: %w", err)
 	}
 
-	answerSD, err := utils.Decode[webrtc.SessionDescription](answer)
+	answerSD, err := decodeRemoteDescription(answer, webrtc.SDPTypeAnswer)
 	if err != nil {
 		return sessionID, fmt.Errorf("failed to decode answer SDP: %w", err)
 	}
 
 	err = peerConn.SetRemoteDescription(answerSD)
 	if err != nil {
-		return sessionID, fmt.Errorf("failed to set remote description: %w", err)
+		return sessionID, fmt.Errorf("failed to set remote description: %w: %v", ErrInvalidRemoteSDP, err)
 	}
 
+	s.receiveCandidates(ctx, peerConn, sessionID, answerSD, candidatesAnswer)
 	return sessionID, nil
 }
 
@@ -112,7 +182,7 @@ func (s *SignalingService) StartReceiverSignallingProcess(ctx context.Context, p
 	}
 
 	// Decode the received offer
-	offerSD, err := utils.Decode[webrtc.SessionDescription](encodedOffer)
+	offerSD, err := decodeRemoteDescription(encodedOffer, webrtc.SDPTypeOffer)
 	if err != nil {
 		return fmt.Errorf("failed to decode offer SDP: %w", err)
 	}
@@ -120,25 +190,38 @@ func (s *SignalingService) StartReceiverSignallingProcess(ctx context.Context, p
 	// Set remote description
 	err = peerConn.SetRemoteDescription(offerSD)
 	if err != nil {
-		return fmt.Errorf("failed to set remote description: %w", err)
+		return fmt.Errorf("failed to set remote description: %w: %v", ErrInvalidRemoteSDP, err)
+	}
+	s.receiveCandidates(ctx, peerConn, sessionID, offerSD, candidatesOffer)
+
+	// Candidates gathered from here on are sent right away, the session exists
+	store, trickle := s.trickleStore()
+	var local *localCandidates
+	if trickle {
+		local = trickleCandidates(ctx, peerConn, store, candidatesAnswer)
+		local.start(sessionID)
 	}
 
 	// Create answer using SDP handler
-	_, err = s.sdp.CreateAnswer(peerConn)
+	answer, err := s.sdp.CreateAnswer(peerConn)
 	if err != nil {
 		return fmt.Errorf("failed to create answer: %w", err)
 	}
 
-	// Wait for ICE gathering to complete
-	err = s.sdp.WaitForICEGathering(ctx, peerConn)
-	if err != nil {
-		return fmt.Errorf("failed to wait for ICE gathering: %w", err)
-	}
+	// A trickled answer goes without candidates, otherwise it waits for them
+	finalAnswer := answer
+	if !trickle {
+		// Wait for ICE gathering to complete
+		err = s.sdp.WaitForICEGathering(ctx, peerConn)
+		if err != nil {
+			return fmt.Errorf("failed to wait for ICE gathering: %w", err)
+		}
 
-	// Get the final answer with ICE candidates
-	finalAnswer := peerConn.LocalDescription()
-	if finalAnswer == nil {
-		return fmt.Errorf("local description is nil after ICE gathering")
+		// Get the final answer with ICE candidates
+		finalAnswer = peerConn.LocalDescription()
+		if finalAnswer == nil {
+			return fmt.Errorf("local description is nil after ICE gathering")
+		}
 	}
 
 	// Encode answer SDP
@@ -156,7 +239,79 @@ func (s *SignalingService) StartReceiverSignallingProcess(ctx context.Context, p
 	return nil
 }
 
+// trickleStore returns the store to trickle local candidates through, if trickle ICE is on and the server can carry them
+func (s *SignalingService) trickleStore() (CandidateStore, bool) {
+	store, ok := s.server.(CandidateStore)
+	return store, ok && s.sdp.TrickleICE()
+}
+
+// receiveCandidates adds the other peer's candidates stored under role as they arrive, if its description came without them
+func (s *SignalingService) receiveCandidates(ctx context.Context, peerConn *webrtc.PeerConnection, sessionID string, remote webrtc.SessionDescription, role string) {
+	store, ok := s.server.(CandidateStore)
+	if !ok || hasCandidates(remote.SDP) {
+		return
+	}
+	go addRemoteCandidates(ctx, peerConn, store, sessionID, role)
+}
+
+// FixedSession returns the session to use if the signalling server has only the one, the receiver then needs no code
+func (s *SignalingService) FixedSession() (string, bool) {
+	fixed, ok := s.server.(FixedSession)
+	if !ok {
+		return "", false
+	}
+	return fixed.SessionID(), true
+}
+
+// SessionRelay carries values through one signalling session
+type SessionRelay struct {
+	store     RelayStore
+	sessionID string
+}
+
+// Relay returns a relay through the session sessionID, if the signalling server can carry data
+func (s *SignalingService) Relay(sessionID string) (*SessionRelay, error) {
+	store, ok := s.server.(RelayStore)
+	if !ok {
+		return nil, fmt.Errorf("the signalling server can't relay data")
+	}
+	if sessionID == "" {
+		return nil, fmt.Errorf("no signalling session to relay data through")
+	}
+
+	return &SessionRelay{store: store, sessionID: sessionID}, nil
+}
+
+// Put writes value under key in the session
+func (r *SessionRelay) Put(ctx context.Context, key, value string) error {
+	return r.store.PutRelay(ctx, r.sessionID, key, value)
+}
+
+// Get reads the value under key in the session, empty if it hasn't been written yet
+func (r *SessionRelay) Get(ctx context.Context, key string) (string, error) {
+	return r.store.GetRelay(ctx, r.sessionID, key)
+}
+
 // ClearSession deletes a session by its ID
 func (s *SignalingService) ClearSession(ctx context.Context, sessionID string) error {
 	return s.server.DeleteSession(ctx, sessionID)
 }
+
+// decodeRemoteDescription decodes an SDP received from the other peer and checks it's usable before it reaches pion
+func decodeRemoteDescription(encoded string, expectedType webrtc.SDPType) (webrtc.SessionDescription, error) {
+	sd, err := utils.Decode[webrtc.SessionDescription](encoded)
+	if err != nil {
+		return sd, fmt.Errorf("%w: %v", ErrInvalidRemoteSDP, err)
+	}
+
+	if sd.Type != expectedType {
+		return sd, fmt.Errorf("%w: expected SDP type %q, got %q", ErrInvalidRemoteSDP, expectedType, sd.Type)
+	}
+
+	// Every SDP body starts with the protocol version line
+	if strings.TrimSpace(sd.SDP) == "" || !strings.HasPrefix(sd.SDP, "v=") {
+		return sd, fmt.Errorf("%w: SDP body is empty or truncated", ErrInvalidRemoteSDP)
+	}
+
+	return sd, nil
+}
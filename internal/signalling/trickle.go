@@ -0,0 +1,166 @@
+package signalling
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Candidates of a session are kept apart by the description of the peer that gathered them
+const (
+	candidatesOffer  = "offer"
+	candidatesAnswer = "answer"
+)
+
+// candidatesDone follows a peer's last candidate, once it has gathered them all
+const candidatesDone = "done"
+
+// candidateBuffer is how many gathered candidates may wait for the session to exist, a peer rarely has more than a few
+const candidateBuffer = 64
+
+// remoteCandidatePoll is how often the server is checked for the other peer's new candidates
+const remoteCandidatePoll = 250 * time.Millisecond
+
+// trickleTimeout is how long candidates are exchanged for, the peers have connected or failed to long before
+const trickleTimeout = 30 * time.Second
+
+// CandidateStore is implemented by signalling servers that can carry ICE candidates as they are gathered (trickle ICE).
+// With other servers each peer waits until it has gathered its candidates and sends them in its description.
+type CandidateStore interface {
+	AddCandidate(ctx context.Context, sessionID, role, candidate string) error
+	GetCandidates(ctx context.Context, sessionID, role string) (candidates []string, err error) // Every candidate added so far, in order
+}
+
+// localCandidates sends the ICE candidates of a peer to the signalling server as they are gathered.
+// Candidates gathered before the session exists wait for it.
+type localCandidates struct {
+	store      CandidateStore
+	role       string
+	candidates chan string
+	session    chan string
+}
+
+// trickleCandidates starts sending peerConn's candidates under role, it must be called before the local description is set
+func trickleCandidates(ctx context.Context, peerConn *webrtc.PeerConnection, store CandidateStore, role string) *localCandidates {
+	l := &localCandidates{
+		store:      store,
+		role:       role,
+		candidates: make(chan string, candidateBuffer),
+		session:    make(chan string, 1),
+	}
+
+	peerConn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		// Gathering is complete once there are no more candidates
+		value := candidatesDone
+		if candidate != nil {
+			encoded, err := json.Marshal(candidate.ToJSON())
+			if err != nil {
+				log.Printf("Error encoding ICE candidate: %v", err)
+				return
+			}
+			value = string(encoded)
+		}
+
+		select {
+		case l.candidates <- value:
+		default:
+			log.Printf("Warning: too many ICE candidates waiting to be sent, dropping %s", value)
+		}
+	})
+
+	go l.run(ctx)
+	return l
+}
+
+// start sends the candidates to the session sessionID, nothing is sent without localCandidates
+func (l *localCandidates) start(sessionID string) {
+	if l != nil {
+		l.session <- sessionID
+	}
+}
+
+// abandon drops the candidates, there will be no session to send them to
+func (l *localCandidates) abandon() {
+	l.start("")
+}
+
+// run sends each candidate as it comes until the last one, giving up after trickleTimeout
+func (l *localCandidates) run(ctx context.Context) {
+	var sessionID string
+	select {
+	case sessionID = <-l.session:
+	case <-ctx.Done():
+		return
+	}
+	if sessionID == "" {
+		return
+	}
+
+	timeout := time.After(trickleTimeout)
+	for {
+		select {
+		case candidate := <-l.candidates:
+			if err := l.store.AddCandidate(ctx, sessionID, l.role, candidate); err != nil {
+				log.Printf("Error sending ICE candidate: %v", err)
+			}
+			if candidate == candidatesDone {
+				return
+			}
+		case <-timeout:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addRemoteCandidates adds the other peer's candidates stored under role to peerConn as they arrive, until its last one,
+// the connection is made or trickleTimeout passes. The remote description must already be set.
+func addRemoteCandidates(ctx context.Context, peerConn *webrtc.PeerConnection, store CandidateStore, sessionID, role string) {
+	deadline := time.Now().Add(trickleTimeout)
+	added := 0
+
+	for time.Now().Before(deadline) {
+		switch peerConn.ICEConnectionState() {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted,
+			webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			return
+		}
+
+		candidates, err := store.GetCandidates(ctx, sessionID, role)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error checking for the peer's ICE candidates: %v", err)
+		}
+		for added < len(candidates) {
+			candidate := candidates[added]
+			added++
+			if candidate == candidatesDone {
+				return
+			}
+
+			var init webrtc.ICECandidateInit
+			if err := json.Unmarshal([]byte(candidate), &init); err != nil {
+				log.Printf("Ignoring undecodable ICE candidate from peer: %v", err)
+				continue
+			}
+			if err := peerConn.AddICECandidate(init); err != nil {
+				log.Printf("Ignoring ICE candidate from peer: %v", err)
+			}
+		}
+
+		select {
+		case <-time.After(remoteCandidatePoll):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// hasCandidates reports whether an SDP carries ICE candidates, one without them comes from a peer trickling its candidates
+func hasCandidates(sdp string) bool {
+	return strings.Contains(sdp, "a=candidate:")
+}
@@ -3,12 +3,38 @@ package signalling
 import (
 	"context"
 	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"yapfs/internal/config"
 
 	"github.com/pion/webrtc/v4"
 )
 
+// candidatePollInterval is how often gathered candidates are counted while waiting for enough of them
+const candidatePollInterval = 20 * time.Millisecond
+
 // WebRTCHandler implements SDPHandler for WebRTC operations
-type WebRTCHandler struct{}
+type WebRTCHandler struct {
+	minCandidates  int  // Proceed once this many candidates are gathered, 0 disables the gate
+	proceedOnSrflx bool // Proceed once a host and a server reflexive candidate are gathered
+	trickle        bool // Send candidates as they are gathered instead of waiting for them
+}
+
+// NewWebRTCHandler creates a WebRTC handler using the ICE gathering settings from cfg
+func NewWebRTCHandler(cfg *config.WebRTCConfig) *WebRTCHandler {
+	return &WebRTCHandler{
+		minCandidates:  cfg.MinICECandidates,
+		proceedOnSrflx: cfg.ICEProceedOnSrflx,
+		trickle:        cfg.TrickleICE,
+	}
+}
+
+// TrickleICE reports whether candidates are sent as they are gathered, where the signalling server can carry them
+func (h *WebRTCHandler) TrickleICE() bool {
+	return h.trickle
+}
 
 // CreateOffer creates and sets an SDP offer for the peer connection
 func (h *WebRTCHandler) CreateOffer(peerConn *webrtc.PeerConnection) (*webrtc.SessionDescription, error) {
@@ -40,12 +66,67 @@ func (h *WebRTCHandler) CreateAnswer(peerConn *webrtc.PeerConnection) (*webrtc.S
 	return &answer, nil
 }
 
-// WaitForICEGathering waits for ICE gathering to complete
+// WaitForICEGathering waits for ICE gathering to complete, or until enough candidates are gathered if a gate is configured
 func (h *WebRTCHandler) WaitForICEGathering(ctx context.Context, peerConn *webrtc.PeerConnection) error {
-	select {
-	case <-webrtc.GatheringCompletePromise(peerConn):
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+	gatheringComplete := webrtc.GatheringCompletePromise(peerConn)
+
+	// No gate configured, wait for every candidate
+	if h.minCandidates == 0 && !h.proceedOnSrflx {
+		select {
+		case <-gatheringComplete:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+
+	ticker := time.NewTicker(candidatePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gatheringComplete:
+			return nil
+		case <-ticker.C:
+			if h.enoughCandidates(peerConn) {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// enoughCandidates reports whether the candidates gathered so far satisfy the configured gate
+func (h *WebRTCHandler) enoughCandidates(peerConn *webrtc.PeerConnection) bool {
+	// The local description includes every candidate gathered so far
+	localDesc := peerConn.LocalDescription()
+	if localDesc == nil {
+		return false
+	}
+
+	total, host, srflx := 0, 0, 0
+	for _, line := range strings.Split(localDesc.SDP, "\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		total++
+		switch {
+		case strings.Contains(line, " typ host"):
+			host++
+		case strings.Contains(line, " typ srflx"):
+			srflx++
+		}
+	}
+
+	if h.minCandidates > 0 && total >= h.minCandidates {
+		log.Printf("Gathered %d ICE candidates, proceeding without waiting for the rest", total)
+		return true
+	}
+	if h.proceedOnSrflx && host > 0 && srflx > 0 {
+		log.Printf("Gathered host and server reflexive ICE candidates, proceeding without waiting for the rest")
+		return true
+	}
+
+	return false
 }
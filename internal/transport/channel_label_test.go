@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestReceiverRejectsFirstChannelWithOtherLabel(t *testing.T) {
+	srcPath, _ := writeTestFile(t, 64*1024)
+
+	recvOpts := ReceiveOptions{DestPath: t.TempDir(), ChannelLabel: "expected"}
+	tr := startTestTransfer(t, context.Background(), newTestConfig(), SendOptions{FilePath: srcPath}, recvOpts, nil)
+	defer tr.close()
+
+	// The sender only learns once its connection times out, the receiver knows at once
+	if receiveErr := tr.receiver.WaitForCompletion(testTransferTimeout); !errors.Is(receiveErr, ErrChannelLabelMismatch) {
+		t.Fatalf("receive error = %v, want %v", receiveErr, ErrChannelLabelMismatch)
+	}
+}
+
+func TestReceiverClosesLaterChannelWithOtherLabel(t *testing.T) {
+	srcPath, content := writeTestFile(t, 2*1024*1024)
+	destDir := t.TempDir()
+
+	// A slow transfer is still going when the other channel arrives
+	sendOpts := SendOptions{FilePath: srcPath, Schedule: "00:00-00:00=4MB"}
+	tr := startTestTransfer(t, context.Background(), newTestConfig(), sendOpts, ReceiveOptions{DestPath: destDir}, nil)
+	if _, err := tr.senderConn.CreateDataChannel("other", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sendErr, receiveErr := tr.wait(t)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("transfer failed: send error = %v, receive error = %v", sendErr, receiveErr)
+	}
+	checkReceived(t, destDir, "file.bin", content)
+}
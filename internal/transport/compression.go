@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+
+	"yapfs/pkg/types"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of a file whose data chunks are each compressed on their own, named in its metadata
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ErrInvalidCompressAlgo is returned for a compression algorithm other than gzip or zstd
+var ErrInvalidCompressAlgo = errors.New("compression algorithm must be gzip or zstd")
+
+// ParseCompressAlgo parses a compression algorithm, gzip or zstd; empty is gzip
+func ParseCompressAlgo(algo string) (string, error) {
+	switch algo {
+	case "", CompressionGzip:
+		return CompressionGzip, nil
+	case CompressionZstd:
+		return CompressionZstd, nil
+	}
+	return "", fmt.Errorf("%w, got %q", ErrInvalidCompressAlgo, algo)
+}
+
+// Compression levels, from the fastest to the one compressing the most. Only the sender needs to know the level.
+const (
+	CompressLevelFast = gzip.BestSpeed
+	CompressLevelBest = gzip.BestCompression
+)
+
+// ErrInvalidCompressLevel is returned for a compression level that isn't 1 to 9, fast or best
+var ErrInvalidCompressLevel = errors.New("compression level must be 1 to 9, fast or best")
+
+// ParseCompressLevel parses a compression level: 1 (fast) to 9 (best), or the names fast and best; empty is fast
+func ParseCompressLevel(level string) (int, error) {
+	switch level {
+	case "", "fast":
+		return CompressLevelFast, nil
+	case "best":
+		return CompressLevelBest, nil
+	}
+
+	n, err := strconv.Atoi(level)
+	if err != nil || n < CompressLevelFast || n > CompressLevelBest {
+		return 0, fmt.Errorf("%w, got %q", ErrInvalidCompressLevel, level)
+	}
+	return n, nil
+}
+
+// A file is only compressed if it is at least compressMinSize long, and its first compressSampleSize bytes
+// compress to at most compressMaxRatio of their size
+const (
+	compressMinSize    = 4096
+	compressSampleSize = 256 * 1024
+	compressMaxRatio   = 0.9
+)
+
+// Each chunk of a compressed file starts with a byte saying how the rest of it is sent,
+// a chunk that doesn't shrink goes raw
+const (
+	chunkRaw  byte = 0
+	chunkGzip byte = 1
+	chunkZstd byte = 2
+)
+
+// compressionOverhead is how many bytes framing adds to a chunk of a compressed file at most
+const compressionOverhead = 1
+
+// chunkCompressor compresses the chunks of files with one algorithm at one level
+type chunkCompressor struct {
+	algo    string        // CompressionGzip or CompressionZstd, what the metadata of files it compresses names
+	level   int           // 1 (fast) to 9 (best)
+	encoder *zstd.Encoder // Compresses chunks for zstd, nil for gzip
+}
+
+// newChunkCompressor creates a compressor for algo at level, see ParseCompressAlgo and ParseCompressLevel
+func newChunkCompressor(algo string, level int) (*chunkCompressor, error) {
+	c := &chunkCompressor{algo: algo, level: level}
+	if algo == CompressionZstd {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstdLevel(level)), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd encoder: %w", err)
+		}
+		c.encoder = encoder
+	}
+	return c, nil
+}
+
+// zstdLevel maps a level of 1 to 9 onto zstd's four encoder levels, so fast and best are its fastest and best
+func zstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level <= 2:
+		return zstd.SpeedFastest
+	case level <= 5:
+		return zstd.SpeedDefault
+	case level <= 8:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+// compress compresses data on its own and returns it with the framing byte saying how
+func (c *chunkCompressor) compress(data []byte) ([]byte, byte, error) {
+	if c.encoder != nil {
+		return c.encoder.EncodeAll(data, nil), chunkZstd, nil
+	}
+	compressed, err := gzipBytes(data, c.level)
+	return compressed, chunkGzip, err
+}
+
+// worthCompressing reports whether sample, the start of a file, shrinks enough for compressing the file to pay off
+func (c *chunkCompressor) worthCompressing(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	compressed, _, err := c.compress(sample)
+	if err != nil {
+		return false
+	}
+	return float64(len(compressed)) <= float64(len(sample))*compressMaxRatio
+}
+
+// compressChunk frames a chunk of a compressed file, compressed if that makes it smaller
+func (c *chunkCompressor) compressChunk(data []byte) ([]byte, error) {
+	compressed, framing, err := c.compress(data)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing data: %w", err)
+	}
+	if len(compressed) < len(data) {
+		return append([]byte{framing}, compressed...), nil
+	}
+	return append([]byte{chunkRaw}, data...), nil
+}
+
+// gzipBytes compresses data at level into a gzip stream of its own
+func gzipBytes(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// zstdDecoder decompresses zstd chunks for every receiver, it is safe for concurrent use
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true), zstd.WithDecoderConcurrency(0))
+})
+
+// decompressChunk undoes compressChunk for a file compressed with algo, failing if the chunk holds more than
+// limit bytes of file data or is framed for another algorithm
+func decompressChunk(data []byte, algo string, limit int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("compressed chunk is empty")
+	}
+
+	switch {
+	case data[0] == chunkRaw:
+		return data[1:], nil
+	case data[0] == chunkGzip && algo == CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %w", err)
+		}
+		defer reader.Close()
+
+		// Read one byte past the limit to tell a chunk that fits from one that expands beyond it
+		chunk, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %w", err)
+		}
+		if len(chunk) > limit {
+			return nil, fmt.Errorf("compressed chunk expands past the %d byte chunk size", limit)
+		}
+		return chunk, nil
+	case data[0] == chunkZstd && algo == CompressionZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd decoder: %w", err)
+		}
+
+		// Decoding stops at the capacity, so a chunk can't expand beyond the chunk size
+		chunk, err := decoder.DecodeAll(data[1:], make([]byte, 0, limit))
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, fmt.Errorf("compressed chunk expands past the %d byte chunk size", limit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %w", err)
+		}
+		return chunk, nil
+	default:
+		return nil, fmt.Errorf("compressed chunk has framing %d, unknown for %s compression", data[0], algo)
+	}
+}
+
+// chooseCompression sets the compression of a file about to be sent, if compressing is on and its start compresses well
+func (s *SenderChannel) chooseCompression(metadata *types.FileMetadata) error {
+	metadata.Compression = ""
+	if !s.compress || metadata.SymlinkTarget != "" || metadata.Size < compressMinSize {
+		return nil
+	}
+
+	sample, err := s.dataProcessor.ReadHead(compressSampleSize)
+	if err != nil {
+		return fmt.Errorf("error sampling %s for compression: %w", metadata.Name, err)
+	}
+	if !s.compressor.worthCompressing(sample) {
+		log.Printf("%s doesn't compress well, sending it uncompressed", metadata.Name)
+		return nil
+	}
+
+	metadata.Compression = s.compressor.algo
+	return nil
+}
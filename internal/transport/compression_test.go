@@ -0,0 +1,225 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"yapfs/pkg/types"
+)
+
+// writeTextFile writes size bytes of log-like text, which compresses well, to a new file and returns its path and content
+func writeTextFile(tb testing.TB, size int) (string, []byte) {
+	tb.Helper()
+
+	words := []string{"GET", "POST", "/api/v1/files", "/health", "200", "404", "user", "session", "upload", "ms", "ok", "error"}
+	rng := rand.New(rand.NewSource(int64(size)))
+	content := make([]byte, 0, size+128)
+	for len(content) < size {
+		content = fmt.Appendf(content, "2025-01-02T15:04:%02d.%06dZ %s %s %s %d%s\n", rng.Intn(60), rng.Intn(1000000),
+			words[rng.Intn(len(words))], words[rng.Intn(len(words))], words[rng.Intn(len(words))], rng.Intn(5000), words[rng.Intn(len(words))])
+	}
+	content = content[:size]
+
+	path := filepath.Join(tb.TempDir(), "file.log")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return path, content
+}
+
+// newTestCompressor creates a compressor for algo at level
+func newTestCompressor(tb testing.TB, algo string, level int) *chunkCompressor {
+	tb.Helper()
+
+	c, err := newChunkCompressor(algo, level)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestParseCompressAlgo(t *testing.T) {
+	tests := []struct {
+		algo    string
+		want    string
+		wantErr error
+	}{
+		{"", CompressionGzip, nil},
+		{"gzip", CompressionGzip, nil},
+		{"zstd", CompressionZstd, nil},
+		{"brotli", "", ErrInvalidCompressAlgo},
+		{"ZSTD", "", ErrInvalidCompressAlgo},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseCompressAlgo(tt.algo)
+		if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) || got != tt.want {
+			t.Errorf("ParseCompressAlgo(%q) = %q, %v, want %q, %v", tt.algo, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCompressLevel(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    int
+		wantErr error
+	}{
+		{"", CompressLevelFast, nil},
+		{"fast", CompressLevelFast, nil},
+		{"best", CompressLevelBest, nil},
+		{"1", 1, nil},
+		{"6", 6, nil},
+		{"9", 9, nil},
+		{"0", 0, ErrInvalidCompressLevel},
+		{"10", 0, ErrInvalidCompressLevel},
+		{"fastest", 0, ErrInvalidCompressLevel},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseCompressLevel(tt.level)
+		if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) || got != tt.want {
+			t.Errorf("ParseCompressLevel(%q) = %d, %v, want %d, %v", tt.level, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCompressLevelBestSendsLessThanFast(t *testing.T) {
+	ctx := context.Background()
+	srcPath, content := writeTextFile(t, 1024*1024)
+	cfg := newTestConfig()
+
+	onWire := map[string]int{}
+	for _, level := range []string{"fast", "best"} {
+		destDir := t.TempDir()
+		recorder := &chunkRecorder{}
+		tr := startTestTransfer(t, ctx, cfg, SendOptions{FilePath: srcPath, Compress: true, CompressLevel: level},
+			ReceiveOptions{DestPath: destDir}, recorder.wrap)
+		sendErr, receiveErr := tr.wait(t)
+		if sendErr != nil || receiveErr != nil {
+			t.Fatalf("%s transfer failed: send error = %v, receive error = %v", level, sendErr, receiveErr)
+		}
+		checkReceived(t, destDir, "file.log", content)
+
+		for _, size := range recorder.recorded() {
+			onWire[level] += size
+		}
+	}
+
+	if onWire["best"] >= onWire["fast"] {
+		t.Fatalf("best sent %d bytes of file data, fast %d, want best to send less", onWire["best"], onWire["fast"])
+	}
+	if onWire["fast"] >= len(content) {
+		t.Fatalf("fast sent %d bytes for a %d byte file, it wasn't compressed", onWire["fast"], len(content))
+	}
+	t.Logf("%d byte file sent as %d bytes at fast, %d at best", len(content), onWire["fast"], onWire["best"])
+}
+
+func TestZstdSendsLessThanGzip(t *testing.T) {
+	ctx := context.Background()
+	srcPath, content := writeTextFile(t, 1024*1024)
+	cfg := newTestConfig()
+
+	onWire := map[string]int{}
+	for _, algo := range []string{CompressionGzip, CompressionZstd} {
+		destDir := t.TempDir()
+		recorder := &chunkRecorder{}
+		var compression string
+		tr := startTestTransfer(t, ctx, cfg,
+			SendOptions{FilePath: srcPath, Compress: true, CompressAlgo: algo},
+			ReceiveOptions{DestPath: destDir, OnMetadata: func(metadata *types.FileMetadata) { compression = metadata.Compression }},
+			recorder.wrap)
+		sendErr, receiveErr := tr.wait(t)
+		if sendErr != nil || receiveErr != nil {
+			t.Fatalf("%s transfer failed: send error = %v, receive error = %v", algo, sendErr, receiveErr)
+		}
+		if compression != algo {
+			t.Fatalf("%s transfer received metadata with compression %q", algo, compression)
+		}
+		checkReceived(t, destDir, "file.log", content)
+
+		for _, size := range recorder.recorded() {
+			onWire[algo] += size
+		}
+	}
+
+	if onWire[CompressionZstd] >= onWire[CompressionGzip] {
+		t.Fatalf("zstd sent %d bytes of file data, gzip %d, want zstd to send less", onWire[CompressionZstd], onWire[CompressionGzip])
+	}
+	t.Logf("%d byte file sent as %d bytes with gzip, %d with zstd", len(content), onWire[CompressionGzip], onWire[CompressionZstd])
+}
+
+func TestDecompressChunk(t *testing.T) {
+	_, content := writeTextFile(t, 16*1024)
+	gzipped, err := newTestCompressor(t, CompressionGzip, CompressLevelFast).compressChunk(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstded, err := newTestCompressor(t, CompressionZstd, CompressLevelFast).compressChunk(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		chunk   []byte
+		algo    string
+		limit   int
+		wantErr bool
+	}{
+		{"gzip", gzipped, CompressionGzip, len(content), false},
+		{"zstd", zstded, CompressionZstd, len(content), false},
+		{"raw in a zstd file", append([]byte{chunkRaw}, content...), CompressionZstd, len(content), false},
+		{"gzip in a zstd file", gzipped, CompressionZstd, len(content), true},
+		{"zstd in a gzip file", zstded, CompressionGzip, len(content), true},
+		{"gzip past the chunk size", gzipped, CompressionGzip, len(content) - 1, true},
+		{"zstd past the chunk size", zstded, CompressionZstd, len(content) - 1, true},
+		{"unknown framing", append([]byte{9}, content...), CompressionZstd, len(content), true},
+		{"empty", nil, CompressionZstd, len(content), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decompressChunk(tt.chunk, tt.algo, tt.limit)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decompressChunk() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decompressChunk() error = %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("decompressChunk() returned %d bytes that differ from the %d compressed", len(got), len(content))
+			}
+		})
+	}
+}
+
+func BenchmarkCompressChunk(b *testing.B) {
+	_, content := writeTextFile(b, 16*1024)
+
+	for _, algo := range []string{CompressionGzip, CompressionZstd} {
+		for _, level := range []int{CompressLevelFast, 6, CompressLevelBest} {
+			b.Run(fmt.Sprintf("%s level %d", algo, level), func(b *testing.B) {
+				c := newTestCompressor(b, algo, level)
+				b.SetBytes(int64(len(content)))
+				var compressed []byte
+				for b.Loop() {
+					var err error
+					if compressed, err = c.compressChunk(content); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(compressed))/float64(len(content)), "ratio")
+			})
+		}
+	}
+}
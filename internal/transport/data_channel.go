@@ -2,6 +2,8 @@ package transport
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"yapfs/internal/config"
 	"yapfs/pkg/types"
@@ -9,6 +11,12 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// ErrHandedOff ends a transfer the receiver handed off, another receiver is expected to take it over
+var ErrHandedOff = errors.New("transfer handed off to another receiver")
+
+// DefaultChannelLabel is the label of the data channel file data is sent on, unless both peers agree on another
+const DefaultChannelLabel = "fileTransfer"
+
 // DataChannelService manages data channel operations and flow control
 // This is a facade that composes sender and receiver channels
 type DataChannelService struct {
@@ -25,8 +33,8 @@ func NewDataChannelService(cfg *config.Config) *DataChannelService {
 }
 
 // CreateFileSenderDataChannel creates a data channel configured for sending files and initializes everything needed for transfer
-func (d *DataChannelService) CreateFileSenderDataChannel(ctx context.Context, peerConn *webrtc.PeerConnection, label string, filePath string) error {
-	return d.sender.CreateFileSenderDataChannel(ctx, peerConn, label, filePath)
+func (d *DataChannelService) CreateFileSenderDataChannel(ctx context.Context, peerConn *webrtc.PeerConnection, label string, opts SendOptions) error {
+	return d.sender.CreateFileSenderDataChannel(ctx, peerConn, label, opts)
 }
 
 // SendFile performs a blocking file transfer (call this after connection is established)
@@ -34,12 +42,79 @@ func (d *DataChannelService) SendFile() (<-chan types.ProgressUpdate, error) {
 	return d.sender.SendFile()
 }
 
+// SendMetadata returns the metadata of the file prepared for sending
+func (d *DataChannelService) SendMetadata() *types.FileMetadata {
+	return d.sender.Metadata()
+}
+
+// SendResult returns a summary of the last send, valid once the progress channel from SendFile is closed
+func (d *DataChannelService) SendResult() *types.TransferResult {
+	return d.sender.Result()
+}
+
+// SendErr returns the error that ended the last send, valid once the progress channel from SendFile is closed
+func (d *DataChannelService) SendErr() error {
+	return d.sender.Err()
+}
+
+// HandoffRequested signals each time the receiver hands the transfer off, connect the next receiver with HandOver
+func (d *DataChannelService) HandoffRequested() <-chan struct{} {
+	return d.sender.HandoffRequested()
+}
+
+// HandOver continues a handed off transfer on peerConn, call it before signalling so the offer carries the data channel
+func (d *DataChannelService) HandOver(peerConn *webrtc.PeerConnection) error {
+	return d.sender.HandOver(peerConn)
+}
+
+// StopSend tells the receiver the transfer ends with err before the connection is closed
+func (d *DataChannelService) StopSend(err error) {
+	d.sender.Stop(err)
+}
+
+// SendViaRelay sends the file through relay once the peer connection failed before the data channel opened,
+// it returns false if the channel had opened and the transfer can't move
+func (d *DataChannelService) SendViaRelay(relay Relay) bool {
+	return d.sender.UseRelay(relay)
+}
+
 // SetupFileReceiver sets up handlers for receiving files
-func (d *DataChannelService) SetupFileReceiver(ctx context.Context, peerConn *webrtc.PeerConnection, destPath string) error {
-	return d.receiver.SetupFileReceiver(ctx, peerConn, destPath)
+func (d *DataChannelService) SetupFileReceiver(ctx context.Context, peerConn *webrtc.PeerConnection, opts ReceiveOptions) error {
+	return d.receiver.SetupFileReceiver(ctx, peerConn, opts)
+}
+
+// WaitForReceive waits up to timeout for the receive to finish and returns the error that ended it, if any
+func (d *DataChannelService) WaitForReceive(timeout time.Duration) error {
+	return d.receiver.WaitForCompletion(timeout)
+}
+
+// ReceiveResult returns a summary of the last receive, complete once WaitForReceive has returned
+func (d *DataChannelService) ReceiveResult() *types.TransferResult {
+	return d.receiver.Result()
 }
 
 // ReceiveFile performs a blocking file receive (call this after connection is established)
 func (d *DataChannelService) ReceiveFile() (<-chan types.ProgressUpdate, error) {
 	return d.receiver.ReceiveFile()
 }
+
+// HandOff stops receiving mid-transfer, keeping the partial file, and asks the sender to wait for another receiver
+func (d *DataChannelService) HandOff() error {
+	return d.receiver.HandOff()
+}
+
+// AbortReceive ends the transfer being received with err and removes its partial file
+func (d *DataChannelService) AbortReceive(err error) {
+	d.receiver.Abort(err)
+}
+
+// StopReceive ends the transfer being received with err, its partial file is only kept if partial files are kept for resume
+func (d *DataChannelService) StopReceive(err error) {
+	d.receiver.Stop(err)
+}
+
+// ReceiveViaRelay receives the file through relay once the peer connection failed before a data channel opened.
+// It blocks until the transfer is over, WaitForReceive then reports how it went. It returns false if a channel had opened.
+func (d *DataChannelService) ReceiveViaRelay(relay Relay) bool {
+	return d.receiver.ReceiveViaRelay(relay)
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// orderedQueueSize is how many ordered messages may wait for the handler before the data channel read loop blocks
+const orderedQueueSize = 128
+
+// messageDispatcher routes incoming data channel messages by type.
+// File data and the control messages that frame it are handled one at a time in arrival order,
+// other control messages are handled concurrently so they don't wait behind queued file data.
+type messageDispatcher struct {
+	handler   func(webrtc.DataChannelMessage)
+	orderedCh chan webrtc.DataChannelMessage
+	slots     chan struct{} // Bounds the number of control messages handled at once
+	wg        sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newMessageDispatcher creates a dispatcher that calls handler for every message,
+// running at most concurrency unordered handlers at once
+func newMessageDispatcher(concurrency int, handler func(webrtc.DataChannelMessage)) *messageDispatcher {
+	d := &messageDispatcher{
+		handler:   handler,
+		orderedCh: make(chan webrtc.DataChannelMessage, orderedQueueSize),
+		slots:     make(chan struct{}, max(concurrency, 1)),
+	}
+
+	d.wg.Add(1)
+	go d.runOrdered()
+
+	return d
+}
+
+// dispatch queues a message for its handler, messages arriving after close are dropped
+func (d *messageDispatcher) dispatch(msg webrtc.DataChannelMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	if isOrderedMessage(msg) {
+		d.orderedCh <- msg
+		return
+	}
+
+	d.slots <- struct{}{}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() { <-d.slots }()
+		d.handler(msg)
+	}()
+}
+
+// queued returns how many ordered messages are waiting for the handler
+func (d *messageDispatcher) queued() int {
+	return len(d.orderedCh)
+}
+
+// close stops accepting messages and waits for queued and running handlers to finish
+func (d *messageDispatcher) close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.orderedCh)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// runOrdered handles ordered messages sequentially until the dispatcher is closed
+func (d *messageDispatcher) runOrdered() {
+	defer d.wg.Done()
+
+	for msg := range d.orderedCh {
+		d.handler(msg)
+	}
+}
+
+// isOrderedMessage reports whether a message belongs to the ordered transfer sequence
+func isOrderedMessage(msg webrtc.DataChannelMessage) bool {
+	// File data is always sent as binary
+	if !msg.IsString {
+		return true
+	}
+
+	msgType, _ := parseControlMessage(msg.Data)
+	switch msgType {
+	case MSG_IDENTITY, MSG_SESSION_KEY, MSG_DIRECTORY, MSG_METADATA, MSG_DEDUP_INDEX, MSG_METADATA_ACK, MSG_TRANSFER_START, MSG_CHUNK_REF, MSG_SEGMENT, MSG_EOF, MSG_SESSION_END:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// sessionKeySize is the size of the ephemeral AES-256 key file data is encrypted with
+const sessionKeySize = 32
+
+// sessionCipher encrypts file data with a key that only lives as long as the transfer.
+// Each chunk is sealed with AES-GCM under a random nonce, which is sent in front of it.
+type sessionCipher struct {
+	aead cipher.AEAD
+}
+
+// newSessionKey generates a random session key
+func newSessionKey() ([]byte, error) {
+	key := make([]byte, sessionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating session key: %w", err)
+	}
+	return key, nil
+}
+
+// newSessionCipher creates a cipher for the given session key
+func newSessionCipher(key []byte) (*sessionCipher, error) {
+	if len(key) != sessionKeySize {
+		return nil, fmt.Errorf("session key is %d bytes, expected %d", len(key), sessionKeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session cipher: %w", err)
+	}
+
+	return &sessionCipher{aead: aead}, nil
+}
+
+// overhead returns how many bytes sealing adds to a chunk
+func (c *sessionCipher) overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// seal encrypts a chunk, the result starts with its nonce
+func (c *sessionCipher) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts a chunk sealed by seal, failing if it was altered on the way
+func (c *sessionCipher) open(data []byte) ([]byte, error) {
+	if len(data) < c.overhead() {
+		return nil, fmt.Errorf("encrypted chunk of %d bytes is too short", len(data))
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// chunkCipher encrypts file data chunk by chunk, sealed chunks are opened in the order they were sealed
+type chunkCipher interface {
+	overhead() int
+	seal(plaintext []byte) ([]byte, error)
+	open(data []byte) ([]byte, error)
+}
+
+// Passphrase keys are derived with scrypt at these costs from a random salt, a new one for every transfer
+const (
+	scryptN            = 1 << 15
+	scryptR            = 8
+	scryptP            = 1
+	passphraseSaltSize = 16
+)
+
+// counterSize is how many bytes of a passphrase-sealed chunk carry the counter its nonce is made from
+const counterSize = 8
+
+// Errors transferring file data encrypted with a passphrase
+var (
+	ErrDecryptionFailed      = errors.New("file data failed to decrypt, the passphrase may be wrong or the data was altered")
+	ErrPassphraseNotUsed     = errors.New("sender doesn't encrypt with a passphrase")
+	ErrEncryptWithPassphrase = errors.New("a passphrase already encrypts file data, it can't be combined with encrypting under a session key")
+)
+
+// passphraseCipher encrypts file data with a key derived from a passphrase both users know, the key never crosses the wire.
+// Each chunk is sealed under a nonce made from a counter, which is sent in front of it. The receiver only accepts
+// counters above the last one it opened, so chunks can't be replayed or reordered, while the sender's counter
+// keeps going across reconnects so no nonce is used twice.
+type passphraseCipher struct {
+	aead cipher.AEAD
+	salt []byte
+	next uint64 // Counter the next chunk is sealed with, or the lowest one accepted when opening
+}
+
+// newPassphraseSalt generates the salt for a transfer's passphrase key
+func newPassphraseSalt() ([]byte, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating passphrase salt: %w", err)
+	}
+	return salt, nil
+}
+
+// newPassphraseCipher derives the key for passphrase and salt and creates a cipher for it
+func newPassphraseCipher(passphrase string, salt []byte) (*passphraseCipher, error) {
+	if len(salt) != passphraseSaltSize {
+		return nil, fmt.Errorf("passphrase salt is %d bytes, expected %d", len(salt), passphraseSaltSize)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, sessionKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key from passphrase: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating passphrase cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating passphrase cipher: %w", err)
+	}
+
+	return &passphraseCipher{aead: aead, salt: salt}, nil
+}
+
+// overhead returns how many bytes sealing adds to a chunk
+func (c *passphraseCipher) overhead() int {
+	return counterSize + c.aead.Overhead()
+}
+
+// seal encrypts a chunk under the next counter, the result starts with the counter
+func (c *passphraseCipher) seal(plaintext []byte) ([]byte, error) {
+	counter := c.next
+	c.next++
+
+	// The counter is authenticated through the nonce, altering it fails the chunk
+	sealed := binary.BigEndian.AppendUint64(make([]byte, 0, counterSize+len(plaintext)+c.aead.Overhead()), counter)
+	return c.aead.Seal(sealed, c.nonce(counter), plaintext, nil), nil
+}
+
+// open decrypts a chunk sealed by seal, failing with ErrDecryptionFailed if it doesn't authenticate or comes out of order
+func (c *passphraseCipher) open(data []byte) ([]byte, error) {
+	if len(data) < c.overhead() {
+		return nil, fmt.Errorf("%w: encrypted chunk of %d bytes is too short", ErrDecryptionFailed, len(data))
+	}
+
+	counter := binary.BigEndian.Uint64(data[:counterSize])
+	if counter < c.next {
+		return nil, fmt.Errorf("%w: chunk %d arrived after chunk %d", ErrDecryptionFailed, counter, c.next-1)
+	}
+	plaintext, err := c.aead.Open(nil, c.nonce(counter), data[counterSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
+	}
+
+	c.next = counter + 1
+	return plaintext, nil
+}
+
+// nonce returns the GCM nonce for counter, the counter right-aligned in zeros
+func (c *passphraseCipher) nonce(counter uint64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-counterSize:], counter)
+	return nonce
+}
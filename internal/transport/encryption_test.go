@@ -0,0 +1,18 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSenderRejectsEncryptWithPassphrase(t *testing.T) {
+	srcPath, _ := writeTestFile(t, 1024)
+	sender := NewSenderChannel(newTestConfig())
+
+	err := sender.CreateFileSenderDataChannel(context.Background(), newTestPeerConnection(t), DefaultChannelLabel,
+		SendOptions{FilePath: srcPath, Encrypt: true, Passphrase: "secret"})
+	if !errors.Is(err, ErrEncryptWithPassphrase) {
+		t.Fatalf("CreateFileSenderDataChannel() error = %v, want %v", err, ErrEncryptWithPassphrase)
+	}
+}
@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"time"
+
+	"yapfs/pkg/types"
+)
+
+// How often, and after how much data at the latest, a file being followed gets a segment checksum
+const (
+	followSegmentInterval = time.Second
+	followSegmentMaxBytes = 16 * 1024 * 1024
+)
+
+// ErrSegmentMismatch means a segment of a followed file was received differently from how it was sent
+var ErrSegmentMismatch = errors.New("segment checksum mismatch")
+
+// followState tracks the checksums of a file followed as it grows, segment by segment and as a whole.
+// The sender and the receiver each keep one over the data they send or write.
+type followState struct {
+	file    hash.Hash // Everything since the start of the file
+	segment hash.Hash // Data since the last segment
+	start   int64     // Offset the current segment starts at
+	size    int64     // Bytes in the current segment
+}
+
+// newFollowState starts tracking a followed file from its beginning
+func newFollowState() *followState {
+	return &followState{file: sha256.New(), segment: sha256.New()}
+}
+
+// write adds the next data of the file
+func (f *followState) write(data []byte) {
+	f.file.Write(data)
+	f.segment.Write(data)
+	f.size += int64(len(data))
+}
+
+// takeSegment returns the segment completed since the last one and starts the next, false if no data was added
+func (f *followState) takeSegment() (types.Segment, bool) {
+	if f.size == 0 {
+		return types.Segment{}, false
+	}
+
+	segment := types.Segment{Offset: f.start, Size: f.size, Checksum: hex.EncodeToString(f.segment.Sum(nil))}
+	f.segment.Reset()
+	f.start, f.size = f.start+f.size, 0
+	return segment, true
+}
+
+// checksum returns the checksum of the whole file so far, in hex
+func (f *followState) checksum() string {
+	return hex.EncodeToString(f.file.Sum(nil))
+}
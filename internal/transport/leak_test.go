@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+func TestCompletedTransferLeavesNoGoroutines(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+	srcPath, content := writeTestFile(t, 1024*1024)
+	destDir := t.TempDir()
+
+	tr := startTestTransfer(t, context.Background(), newTestConfig(), SendOptions{FilePath: srcPath}, ReceiveOptions{DestPath: destDir}, nil)
+	sendErr, receiveErr := tr.wait(t)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("transfer failed: send error = %v, receive error = %v", sendErr, receiveErr)
+	}
+	checkReceived(t, destDir, "file.bin", content)
+
+	tr.close()
+	goleak.VerifyNone(t, ignore)
+}
+
+func TestCancelledTransferLeavesNoGoroutines(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+	srcPath, _ := writeTestFile(t, 8*1024*1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A rate limit all day keeps the transfer going until it is cancelled
+	sendOpts := SendOptions{FilePath: srcPath, Schedule: "00:00-00:00=1MB"}
+	tr := startTestTransfer(t, ctx, newTestConfig(), sendOpts, ReceiveOptions{DestPath: t.TempDir()}, nil)
+
+	// Cancel once file data is arriving, stopping the send the way the app does
+	timeout := time.After(testTransferTimeout)
+	for received := false; !received; {
+		select {
+		case update := <-tr.recvCh:
+			received = update.NewBytes > 0
+		case <-timeout:
+			t.Fatalf("no file data within %v", testTransferTimeout)
+		}
+	}
+	cancel()
+	tr.sender.Stop(ctx.Err())
+	tr.wait(t)
+
+	tr.close()
+	goleak.VerifyNone(t, ignore)
+}
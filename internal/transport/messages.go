@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"yapfs/pkg/utils"
+)
+
+// repeatLog logs what can happen for every message of a transfer, at most once a second per message
+var repeatLog = utils.NewThrottledLogger(time.Second)
+
+// Control message types exchanged over the data channel.
+// Control messages are sent as text in the form "TYPE" or "TYPE:<json payload>",
+// file data is always sent as binary messages.
+const (
+	MSG_DIRECTORY      = "DIRECTORY"      // Sender -> receiver: a directory transfer follows, one METADATA ... EOF sequence per file
+	MSG_IDENTITY       = "IDENTITY"       // Sender -> receiver: the name the sender goes by, before anything else is sent
+	MSG_SESSION_KEY    = "SESSION_KEY"    // Sender -> receiver: file data that follows is encrypted with this key
+	MSG_METADATA       = "METADATA"       // Sender -> receiver: file metadata
+	MSG_DEDUP_INDEX    = "DEDUP_INDEX"    // Receiver -> sender: chunk hashes of an existing copy of the file, sent before METADATA_ACK
+	MSG_METADATA_ACK   = "METADATA_ACK"   // Receiver -> sender: metadata accepted, carries resume offset
+	MSG_TRANSFER_START = "TRANSFER_START" // Sender -> receiver: offset file data will start from
+	MSG_CHUNK_REF      = "CHUNK_REF"      // Sender -> receiver: the next chunk of file data is one from DEDUP_INDEX, copy it from the existing file
+	MSG_SEGMENT        = "SEGMENT"        // Sender -> receiver: checksum of the file data sent since the last SEGMENT, while following a growing file
+	MSG_EOF            = "EOF"            // Sender -> receiver: all file data has been sent
+	MSG_SESSION_END    = "SESSION_END"    // Sender -> receiver: nothing more will be sent; the receiver echoes it once everything before it is handled
+	MSG_RECONFIGURE    = "RECONFIGURE"    // Receiver -> sender: use smaller chunks for the data still to be sent
+	MSG_HANDOFF        = "HANDOFF"        // Receiver -> sender: the receiver is leaving mid-transfer, wait for another to take it over
+	MSG_ERROR          = "ERROR"          // Either direction: fatal error, transfer is aborted
+	MSG_PING           = "PING"           // Either direction: liveness check, answered with PONG
+	MSG_PONG           = "PONG"           // Either direction: reply to PING, echoes its payload
+)
+
+// encodeControlMessage builds a control message of the given type with an optional JSON payload
+func encodeControlMessage(msgType string, payload any) (string, error) {
+	if payload == nil {
+		return msgType, nil
+	}
+
+	payloadBytes, err := utils.EncodeJSON(payload)
+	if err != nil {
+		return "", fmt.Errorf("error encoding %s payload: %w", msgType, err)
+	}
+
+	return msgType + ":" + string(payloadBytes), nil
+}
+
+// pongMessage builds the PONG reply to a PING, echoing its payload
+func pongMessage(pingPayload []byte) string {
+	if len(pingPayload) == 0 {
+		return MSG_PONG
+	}
+	return MSG_PONG + ":" + string(pingPayload)
+}
+
+// parseControlMessage splits a control message into its type and raw payload
+func parseControlMessage(data []byte) (string, []byte) {
+	msgType, payload, _ := bytes.Cut(data, []byte(":"))
+	return string(msgType), payload
+}
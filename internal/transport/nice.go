@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"yapfs/pkg/utils"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Tuning of nice mode, which paces file data by the round trip time instead of a fixed rate. Queueing delay is how far
+// the round trip time is above the lowest one seen lately; past the target, other traffic is taken to be competing.
+const (
+	niceCheckInterval = 200 * time.Millisecond
+	niceLogInterval   = 10 * time.Second
+	niceBaseWindow    = 2 * time.Minute // Older lows are forgotten, so a route change doesn't look like queueing forever
+	niceTargetDelay   = 25 * time.Millisecond
+	niceBurst         = 20 * time.Millisecond
+	niceStartRate     = 256 * 1024 // Bytes per second
+	niceMinRate       = 16 * 1024
+	niceBackoff       = 0.7  // Rate is multiplied by this each check the delay is over target
+	niceGain          = 0.25 // Most the rate grows by each check, when there is no queueing delay at all
+	niceChunkSize     = 8 * 1024
+)
+
+// niceLimiter is a token bucket whose rate follows the round trip time: it backs off when queueing delay builds up,
+// a sign of other traffic on the link, and speeds up again while the link stays idle
+type niceLimiter struct {
+	rtt      func() time.Duration // Current smoothed round trip time, 0 when not known yet
+	rate     float64              // Current rate in bytes per second
+	tokens   float64              // Bytes that may be sent right away
+	filled   time.Time            // When tokens was last topped up
+	checked  time.Time            // When the round trip time was last checked
+	sent     int64                // Bytes let through since the last check
+	base     [2]time.Duration     // Lowest round trip time in the current and previous half of niceBaseWindow, 0 for none
+	baseFrom time.Time            // When the current half started
+	logged   time.Time
+}
+
+// newNiceLimiter creates a limiter pacing by the round trip times rtt reports
+func newNiceLimiter(rtt func() time.Duration) *niceLimiter {
+	return &niceLimiter{rtt: rtt, rate: niceStartRate}
+}
+
+// wait blocks until n more bytes may be sent, or ctx is done
+func (l *niceLimiter) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	if l.checked.IsZero() {
+		l.checked, l.filled = now, now
+	} else if elapsed := now.Sub(l.checked); elapsed >= niceCheckInterval {
+		l.adjust(now, elapsed)
+	}
+	l.sent += int64(n)
+
+	burst := max(l.rate*niceBurst.Seconds(), float64(n))
+	l.tokens = min(l.tokens+now.Sub(l.filled).Seconds()*l.rate, burst)
+	l.filled = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return nil
+	}
+
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// adjust sets the rate from the queueing delay seen now, elapsed after the last check
+func (l *niceLimiter) adjust(now time.Time, elapsed time.Duration) {
+	sent := float64(l.sent) / elapsed.Seconds()
+	l.checked, l.sent = now, 0
+
+	rtt := l.rtt()
+	if rtt <= 0 {
+		return
+	}
+	if now.Sub(l.baseFrom) >= niceBaseWindow/2 {
+		l.base[1], l.base[0], l.baseFrom = l.base[0], 0, now
+	}
+	if l.base[0] == 0 || rtt < l.base[0] {
+		l.base[0] = rtt
+	}
+	base := l.base[0]
+	if l.base[1] > 0 && l.base[1] < base {
+		base = l.base[1]
+	}
+
+	delay := rtt - base
+	if delay > niceTargetDelay {
+		l.rate = max(l.rate*niceBackoff, niceMinRate)
+	} else {
+		// Grow in proportion to how far under target the delay is, but not far past what is actually being sent,
+		// or a rate built up while something else held sending back would take long to come down
+		l.rate *= 1 + niceGain*float64(niceTargetDelay-delay)/float64(niceTargetDelay)
+		l.rate = min(l.rate, max(2*sent, niceStartRate))
+	}
+
+	if now.Sub(l.logged) >= niceLogInterval {
+		l.logged = now
+		log.Printf("Nice mode sending at up to %s/s, round trip time %v (%v above the lowest lately)",
+			utils.FormatFileSize(int64(l.rate)), rtt.Round(time.Millisecond), delay.Round(time.Millisecond))
+	}
+}
+
+// sctpRoundTripTime returns the smoothed round trip time SCTP measured on the peer connection, 0 if it has none yet
+func sctpRoundTripTime(peerConn *webrtc.PeerConnection) time.Duration {
+	for _, stat := range peerConn.GetStats() {
+		if sctpStats, ok := stat.(webrtc.SCTPTransportStats); ok {
+			return time.Duration(sctpStats.SmoothedRoundTripTime * float64(time.Second))
+		}
+	}
+	return 0
+}
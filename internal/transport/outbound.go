@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// messageSender is the send side of a data channel
+type messageSender interface {
+	Send(data []byte) error
+	SendText(text string) error
+}
+
+// delayedSender is a messageSender that holds messages back before they reach the channel, like netsim.Link
+type delayedSender interface {
+	messageSender
+	Flush(ctx context.Context) error // Blocks until every message held back has reached the channel
+	Close()                          // Drops the messages still held back
+}
+
+// outboundWrapper wraps the send side of a data channel, tests use it to impair the link
+type outboundWrapper func(dataChannel *webrtc.DataChannel) messageSender
+
+// newOutbound returns the sender outgoing messages on dataChannel go through, the channel itself unless wrap is set
+func newOutbound(wrap outboundWrapper, dataChannel *webrtc.DataChannel) messageSender {
+	if wrap == nil {
+		return dataChannel
+	}
+	return wrap(dataChannel)
+}
+
+// flushOutbound waits for messages outbound holds back to reach the channel
+func flushOutbound(ctx context.Context, outbound messageSender) error {
+	if delayed, ok := outbound.(delayedSender); ok {
+		return delayed.Flush(ctx)
+	}
+	return nil
+}
+
+// closeOutbound drops messages outbound still holds back once its channel has closed
+func closeOutbound(outbound messageSender) {
+	if delayed, ok := outbound.(delayedSender); ok {
+		delayed.Close()
+	}
+}
@@ -2,14 +2,20 @@ package transport
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
 
 	"yapfs/internal/config"
+	"yapfs/pkg/utils"
 
 	"github.com/pion/webrtc/v4"
 )
 
+// ErrUnexpectedICERole is returned when a connected peer isn't in the ICE role its part in the offer/answer exchange gives it
+var ErrUnexpectedICERole = errors.New("unexpected ICE role")
+
 // PeerConnection wraps webrtc.PeerConnection with state management
 type PeerConnection struct {
 	*webrtc.PeerConnection
@@ -39,7 +45,12 @@ func (p *PeerService) CreatePeerConnection(ctx context.Context, role string, onE
 		ICEServers: p.config.WebRTC.ICEServers,
 	}
 
-	pc, err := webrtc.NewPeerConnection(webrtcConfig)
+	api, err := p.newAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := api.NewPeerConnection(webrtcConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
@@ -69,6 +80,15 @@ func (p *PeerService) CreatePeerConnection(ctx context.Context, role string, onE
 			}
 		case webrtc.PeerConnectionStateConnected:
 			log.Printf("Peer connection established successfully (%s)", role)
+			if err := wrappedPC.checkICERole(); err != nil {
+				if p.config.WebRTC.StrictICERole {
+					if wrappedPC.onError != nil {
+						wrappedPC.onError(err)
+					}
+					return
+				}
+				log.Printf("Warning: %v", err)
+			}
 			if wrappedPC.onConnected != nil {
 				wrappedPC.onConnected()
 			}
@@ -84,6 +104,26 @@ func (p *PeerService) CreatePeerConnection(ctx context.Context, role string, onE
 	return wrappedPC, nil
 }
 
+// newAPI creates the WebRTC API peer connections are made with, reaching TURN servers over TCP through the proxy if one is set
+func (p *PeerService) newAPI() (*webrtc.API, error) {
+	if p.config.Proxy == "" {
+		return webrtc.NewAPI(), nil
+	}
+
+	proxyURL, err := utils.ParseProxyURL(p.config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := utils.ProxyDialer(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings webrtc.SettingEngine
+	settings.SetICEProxyDialer(dialer)
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings)), nil
+}
+
 // IsConnected checks if the peer connection is in a connected state
 func (pc *PeerConnection) IsConnected() bool {
 	return !pc.closed && pc.ConnectionState() == webrtc.PeerConnectionStateConnected
@@ -99,6 +139,84 @@ func (pc *PeerConnection) Role() string {
 	return pc.role
 }
 
+// RemoteAddress describes the remote end of the selected ICE candidate pair, or "" if not connected
+func (pc *PeerConnection) RemoteAddress() string {
+	sctp := pc.SCTP()
+	if sctp == nil {
+		return ""
+	}
+
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d (%s)", pair.Remote.Address, pair.Remote.Port, pair.Remote.Typ)
+}
+
+// ICERole returns the ICE role this end is in, unknown before ICE has started
+func (pc *PeerConnection) ICERole() webrtc.ICERole {
+	sctp := pc.SCTP()
+	if sctp == nil {
+		return webrtc.ICERoleUnknown
+	}
+	return sctp.Transport().ICETransport().Role()
+}
+
+// checkICERole logs the ICE role of a connected peer and fails if it isn't the one its description gives it:
+// the peer that made the offer controls and the one that answered is controlled.
+// Both peers in the same role points to a bug in how descriptions were exchanged.
+func (pc *PeerConnection) checkICERole() error {
+	role := pc.ICERole()
+	log.Printf("ICE role: %s (%s)", role, pc.role)
+
+	made, expected := "answered", webrtc.ICERoleControlled
+	if local := pc.LocalDescription(); local != nil && local.Type == webrtc.SDPTypeOffer {
+		made, expected = "made the offer", webrtc.ICERoleControlling
+	}
+	if role != expected {
+		return fmt.Errorf("%w: the %s %s but is %s, expected %s", ErrUnexpectedICERole, pc.role, made, role, expected)
+	}
+	return nil
+}
+
+// LocalFingerprint returns the fingerprint of this end's DTLS certificate, for the peer to pin out of band
+func (pc *PeerConnection) LocalFingerprint() (string, error) {
+	certificates := pc.GetConfiguration().Certificates
+	if len(certificates) == 0 {
+		return "", fmt.Errorf("peer connection has no certificate")
+	}
+
+	fingerprints, err := certificates[0].GetFingerprints()
+	if err != nil {
+		return "", fmt.Errorf("failed to get certificate fingerprint: %w", err)
+	}
+	for _, fp := range fingerprints {
+		if fp.Algorithm == utils.FingerprintAlgorithm {
+			return utils.ParseFingerprint(fp.Value)
+		}
+	}
+	return "", fmt.Errorf("certificate has no %s fingerprint", utils.FingerprintAlgorithm)
+}
+
+// remoteFingerprint returns the fingerprint of the certificate the peer presented in the DTLS handshake.
+// DTLS has already checked it against the fingerprint in the peer's session description,
+// comparing it to one conveyed out of band also catches a description replaced on the way.
+func remoteFingerprint(pc *webrtc.PeerConnection) (string, error) {
+	sctp := pc.SCTP()
+	if sctp == nil {
+		return "", fmt.Errorf("peer connection has no transport")
+	}
+
+	certificate := sctp.Transport().GetRemoteCertificate()
+	if len(certificate) == 0 {
+		return "", fmt.Errorf("peer has not presented a certificate")
+	}
+
+	digest := sha256.Sum256(certificate)
+	return utils.FormatFingerprint(digest[:]), nil
+}
+
 // Close gracefully closes the peer connection
 func (pc *PeerConnection) Close() error {
 	if pc.closed {
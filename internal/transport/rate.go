@@ -0,0 +1,47 @@
+package transport
+
+import "time"
+
+// rateSample records how many bytes had been transferred at a point in time
+type rateSample struct {
+	at    time.Time
+	bytes uint64
+}
+
+// rateMeter measures throughput over a sliding window, so it follows the current speed instead of the average
+type rateMeter struct {
+	window  time.Duration
+	samples []rateSample
+}
+
+// newRateMeter creates a meter averaging over the given window
+func newRateMeter(window time.Duration) *rateMeter {
+	return &rateMeter{window: window}
+}
+
+// update records the bytes transferred so far and returns the rate over the window in bytes per second.
+// The rate is 0 until the samples span a tenth of the window, a shorter span mostly measures how fast buffers fill.
+func (m *rateMeter) update(bytes uint64, now time.Time) float64 {
+	// Data dropped for a retry is transferred again, measure from here
+	if n := len(m.samples); n > 0 && bytes < m.samples[n-1].bytes {
+		m.samples = m.samples[:0]
+	}
+	m.samples = append(m.samples, rateSample{at: now, bytes: bytes})
+
+	// Keep the newest sample at or before the start of the window, it is what the window is measured from
+	cutoff := now.Add(-m.window)
+	drop := 0
+	for drop+1 < len(m.samples) && !m.samples[drop+1].at.After(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		m.samples = append(m.samples[:0], m.samples[drop:]...)
+	}
+
+	first := m.samples[0]
+	elapsed := now.Sub(first.at)
+	if elapsed <= 0 || elapsed < m.window/10 {
+		return 0
+	}
+	return float64(bytes-first.bytes) / elapsed.Seconds()
+}
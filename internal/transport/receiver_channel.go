@@ -3,9 +3,15 @@ package transport
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"yapfs/internal/config"
 	"yapfs/internal/processor"
@@ -15,23 +21,125 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// ErrFingerprintMismatch means the peer's DTLS certificate is not the one pinned, the session description may have been tampered with
+var ErrFingerprintMismatch = errors.New("sender certificate fingerprint mismatch")
+
+// ErrSenderNotAccepted means the sender didn't identify as one of the names the receiver accepts
+var ErrSenderNotAccepted = errors.New("sender is not accepted")
+
+// ErrChunkAccounting is returned with a failed file when the data the sender read, sent and the receiver wrote don't add up
+var ErrChunkAccounting = errors.New("chunk accounting mismatch")
+
+// ErrChannelLabelMismatch means the sender opened its data channel with a label other than the one expected
+var ErrChannelLabelMismatch = errors.New("data channel label mismatch")
+
+// ReceiveOptions configures how an incoming file transfer is handled
+type ReceiveOptions struct {
+	DestPath       string // Destination directory to save the received file, or an s3:// URL to upload it to
+	KeepOnMismatch bool   // Keep a file that fails checksum validation instead of deleting it
+	Resume         bool   // Keep partial files and offer to resume them from where they left off
+	NoClobberNewer bool   // Refuse to overwrite an existing file newer than the incoming one
+	VerifyCode     string // Checksum hex prefix the sender displayed out of band, empty to skip
+	SyncProgress   bool   // Deliver every progress update, blocking the transfer while the consumer is busy
+	OnConflict     string // What to do when the destination file exists: fail (the default), overwrite, rename or skip
+	Force          bool   // Overwrite an existing destination file, whatever OnConflict says
+	SkipIdentical  bool   // Skip the transfer when an existing file has the same checksum
+	WriteMode      string // How data reaches the final path: direct or atomic (temp file then rename)
+	StrictMime     bool   // Reject a file whose content doesn't match its extension instead of only warning
+	CheckMime      bool   // Flag received files whose detected content type disagrees with the declared MIME type
+	Passphrase     string // Only accept file data encrypted with a key derived from this, empty to accept unencrypted data
+	ValidateFormat bool   // Fail a received zip, gzip, png or jpeg file that doesn't open as its format
+	FileMode       string // Octal permissions set on received files regardless of umask, empty keeps the default
+	Handoff        bool   // Keep partial files like Resume so HandOff can leave them for the receiver taking over
+	PinFingerprint string // Sender's DTLS certificate fingerprint conveyed out of band, empty to accept any
+	Dedup          bool   // Offer chunks of an existing file being replaced, so the sender only sends what changed
+	ChannelLabel   string // Label the sender's data channel must have, empty for DefaultChannelLabel
+	RouteByTag     string // Tag whose value names the subdirectory a file goes in, empty to not route by tag
+	As             string // Name a single file is saved under instead of its own, a directory transfer is rejected
+
+	// AcceptFrom, when set, lists the sender identities accepted, a sender that identifies as none of them
+	// (or not at all) is rejected before any file is offered. Identities are not authenticated.
+	AcceptFrom []string
+
+	// OnMetadata, when set, is called with the transfer's metadata instead of it arriving as a zero-byte progress update,
+	// and progress updates without new bytes are left out. It is called from the transfer goroutine and must not block.
+	OnMetadata func(metadata *types.FileMetadata)
+
+	// OnTypeMismatch, when set, is called for each file CheckMime flags, from the transfer goroutine before the
+	// transfer completes. It must not block.
+	OnTypeMismatch func(mismatch types.TypeMismatch)
+}
+
 // ReceiverChannel manages data channel operations for receiving files
 type ReceiverChannel struct {
 	ctx              context.Context
 	config           *config.Config
-	dataChannel      *webrtc.DataChannel
+	peerConn         *webrtc.PeerConnection
+	dataChannel      *webrtc.DataChannel // Channel the transfer runs on, set under mu
+	channelClosed    chan struct{}       // Closed once dataChannel has closed and its handlers are done
+	outbound         messageSender       // Sends to the peer, the data channel itself unless a test wrapped it, set under mu
+	wrapOutbound     outboundWrapper     // Set by tests to impair the link, nil in normal use
 	dataProcessor    *processor.DataProcessor
 	destPath         string
+	writerOpts       processor.WriterOptions
+	pinFingerprint   string   // Fingerprint the sender's certificate must have, empty to accept any
+	acceptFrom       []string // Sender identities accepted, empty to accept any
+	senderIdentity   string   // Name the sender identified as, empty until it does
+	passphrase       string   // File data must be encrypted with a key derived from this, empty to accept it unencrypted
+	syncProgress     bool
+	onMetadata       func(*types.FileMetadata)
+	onTypeMismatch   func(types.TypeMismatch)
+	dispatcher       *messageDispatcher
 	readyCh          chan struct{} // Signals when data channel is open and ready for file transfer
 	doneCh           chan struct{} // Signals when file transfer is complete
 	progressCh       chan types.ProgressUpdate
 	metadataReceived bool // Track if metadata has been received
 
+	progressMu     sync.Mutex // Held while sending on progressCh, so it isn't closed mid-send
+	progressClosed bool       // progressCh is closed, updates reported since are dropped
+
 	// Progress tracking
-	fileMetadata *types.FileMetadata
+	fileMetadata *types.FileMetadata // Describes the whole transfer, a directory transfer's summary included
+	currentFile  *types.FileMetadata // File currently being received
+	rate         *rateMeter          // Throughput reported with progress updates, guarded by mu
+	cipher       chunkCipher         // Decrypts file data when the sender sent a session key or a passphrase salt
+
+	// Dedup: chunks of an existing copy of the current file are copied from it instead of being sent
+	dedupEnabled bool
+	dedup        *processor.DedupSource // Existing copy offered for the current file, guarded by mu
+	fileDeduped  int64                  // Bytes of the current file copied from dedup
+	dedupChunks  int                    // Chunks of the current file copied from dedup
+
+	// Directory transfers
+	directory *types.DirectoryInfo // Set once the sender announces a directory
+	filesDone int                  // Files of the directory received or already present
+
+	// Chunk size last asked for with RECONFIGURE, 0 if never asked
+	requestedChunkSize int
+
+	// Reconnects: the sender may replace a channel lost mid-transfer and continue the file
+	awaitingReconnect bool  // The channel was lost mid-transfer and a replacement may be claimed, guarded by mu
+	rejoining         bool  // A replacement channel was claimed, the next metadata repeats the file being sent
+	continuing        bool  // Offered to continue the open file, the transfer start confirms or declines it
+	fileStart         int64 // Offset the current file started from, past what was held before this run
+	countedFrom       int64 // Offset of the last TRANSFER_START, the sender's EOF counts start there
+	chunkSize         int   // Chunk size of the last TRANSFER_START, what a compressed chunk may expand to at most
+	bytesWritten      int64 // File data written since countedFrom, reconciled with the sender's counts at EOF
+
+	// Checksums of the file the sender follows as it grows, verified against its segments, nil when not following
+	follow *followState
+
+	// Set once the transfer was handed off, nothing from the sender is handled after that
+	handedOff atomic.Bool
 
 	// Synchronization
-	doneOnce sync.Once
+	readyOnce sync.Once
+	doneOnce  sync.Once
+
+	// Outcome, guarded by mu since error messages are handled concurrently with file data
+	mu          sync.Mutex
+	stats       transferStats
+	transferErr error
 }
 
 // NewReceiverChannel creates a new data channel receiver
@@ -42,40 +150,228 @@ func NewReceiverChannel(cfg *config.Config) *ReceiverChannel {
 		readyCh:          make(chan struct{}),
 		doneCh:           make(chan struct{}),
 		metadataReceived: false,
+		rate:             newRateMeter(time.Duration(cfg.RateWindowMs) * time.Millisecond),
 	}
 }
 
 // SetupFileReceiver sets up handlers for receiving files
-func (r *ReceiverChannel) SetupFileReceiver(ctx context.Context, peerConn *webrtc.PeerConnection, destPath string) error {
+func (r *ReceiverChannel) SetupFileReceiver(ctx context.Context, peerConn *webrtc.PeerConnection, opts ReceiveOptions) error {
+	var fileMode os.FileMode
+	if opts.FileMode != "" {
+		mode, err := processor.ParseFileMode(opts.FileMode)
+		if err != nil {
+			return err
+		}
+		fileMode = mode
+	}
+
 	r.ctx = ctx
-	r.destPath = destPath
+	r.peerConn = peerConn
+	r.destPath = opts.DestPath
+	r.syncProgress = opts.SyncProgress
+	r.pinFingerprint = opts.PinFingerprint
+	r.onMetadata = opts.OnMetadata
+	r.onTypeMismatch = opts.OnTypeMismatch
+	r.dedupEnabled = opts.Dedup
+	r.acceptFrom = opts.AcceptFrom
+	r.passphrase = opts.Passphrase
+	// Deduplicating against an existing file is asking for it to be replaced
+	onConflict := processor.ConflictPolicy(opts.OnConflict)
+	if opts.Force || (opts.Dedup && (onConflict == "" || onConflict == processor.ConflictFail)) {
+		onConflict = processor.ConflictOverwrite
+	}
+	r.writerOpts = processor.WriterOptions{
+		KeepOnMismatch: opts.KeepOnMismatch,
+		Resume:         opts.Resume || opts.Handoff,
+		MimeRoutes:     r.config.Receiver.MimeRoutes,
+		S3:             r.config.S3,
+		NoClobberNewer: opts.NoClobberNewer,
+		VerifyCode:     opts.VerifyCode,
+		OnConflict:     onConflict,
+		SkipIdentical:  opts.SkipIdentical,
+		WriteMode:      processor.WriteMode(opts.WriteMode),
+		StrictMime:     opts.StrictMime,
+		CheckMime:      opts.CheckMime,
+		ValidateFormat: opts.ValidateFormat,
+		RouteByTag:     opts.RouteByTag,
+		As:             opts.As,
+		FileMode:       fileMode,
+		WriteBuffer:    r.config.Receiver.WriteBufferSize,
+	}
 
 	// OnDataChannel sets an event handler which is invoked when a data channel message arrives from a remote peer.
+	label := opts.ChannelLabel
+	if label == "" {
+		label = DefaultChannelLabel
+	}
 	peerConn.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+		// One transfer uses one channel at a time, an extra one would replace the handlers of the first mid-transfer
+		if !r.claimChannel(dataChannel, label) {
+			log.Printf("Error: unexpected additional data channel %s-%d while another is in use, closing it",
+				dataChannel.Label(), dataChannel.ID())
+			if err := dataChannel.Close(); err != nil {
+				log.Printf("Error closing additional data channel: %v", err)
+			}
+			return
+		}
+
+		// A sender that doesn't agree on the label isn't the one expected, or speaks another protocol on it.
+		// Only the first channel gets here with another label, a later one isn't claimed.
+		if dataChannel.Label() != label {
+			r.reject(peerConn, fmt.Errorf("%w: expected %q, got %q", ErrChannelLabelMismatch, label, dataChannel.Label()))
+			return
+		}
+
+		// Nothing from the peer is handled until it has proven to be the sender the user expects
+		if opts.PinFingerprint != "" {
+			if err := checkFingerprint(peerConn, opts.PinFingerprint); err != nil {
+				r.reject(peerConn, err)
+				return
+			}
+			log.Printf("Sender certificate fingerprint matches the pinned fingerprint")
+		}
+
+		r.attachChannel(dataChannel)
+	})
+
+	return nil
+}
+
+// reject ends the transfer with err before anything on the claimed channel was handled and closes the connection
+func (r *ReceiverChannel) reject(peerConn *webrtc.PeerConnection, err error) {
+	log.Printf("Error: %v, closing the connection", err)
+	r.finish(err)
+
+	// The channel never got handlers, nothing is left to finish once it closes
+	r.mu.Lock()
+	close(r.channelClosed)
+	r.mu.Unlock()
+
+	// Closing from within a peer connection callback would wait on that callback
+	go peerConn.Close()
+}
+
+// claimChannel decides whether dataChannel may carry the transfer. The first channel is always claimed, whatever
+// its label, so no later channel is taken for the first. A later one only replaces a channel lost mid-transfer,
+// which may not have finished closing on this side yet, and must have the expected label.
+func (r *ReceiverChannel) claimChannel(dataChannel *webrtc.DataChannel, label string) bool {
+	r.mu.Lock()
+	previous, previousClosed := r.dataChannel, r.channelClosed
+	if previous == nil {
 		r.dataChannel = dataChannel
-		log.Printf("Received data channel: %s-%d", r.dataChannel.Label(), r.dataChannel.ID())
+		r.channelClosed = make(chan struct{})
+		r.mu.Unlock()
+		return true
+	}
+	r.mu.Unlock()
 
-		r.dataChannel.OnOpen(func() {
-			log.Printf("File transfer data channel opened: %s-%d. Waiting for metadata...", r.dataChannel.Label(), r.dataChannel.ID())
-			close(r.readyCh)
-		})
+	if r.config.WebRTC.ReconnectAttempts == 0 || dataChannel.Label() != label {
+		return false
+	}
 
-		r.dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-			r.handleMessage(msg)
-		})
+	select {
+	case <-previousClosed:
+	case <-time.After(time.Duration(r.config.WebRTC.ReconnectTimeoutMs) * time.Millisecond):
+		return false
+	}
 
-		r.dataChannel.OnClose(func() {
-			log.Printf("File transfer data channel closed")
-			r.dataProcessor.Close()
-		})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.awaitingReconnect || r.dataChannel != previous {
+		return false
+	}
+
+	log.Printf("Sender reconnected on data channel %s-%d", dataChannel.Label(), dataChannel.ID())
+	r.awaitingReconnect = false
+	r.dataChannel = dataChannel
+	r.channelClosed = make(chan struct{})
+	r.rejoining = true
+	r.metadataReceived = false
+	return true
+}
+
+// attachChannel sets up the handlers of a claimed channel
+func (r *ReceiverChannel) attachChannel(dataChannel *webrtc.DataChannel) {
+	r.mu.Lock()
+	closed := r.channelClosed
+	r.mu.Unlock()
+
+	outbound := newOutbound(r.wrapOutbound, dataChannel)
+	log.Printf("Received data channel: %s-%d", dataChannel.Label(), dataChannel.ID())
+
+	dataChannel.OnOpen(func() {
+		log.Printf("File transfer data channel opened: %s-%d. Waiting for metadata...", dataChannel.Label(), dataChannel.ID())
+		r.readyOnce.Do(func() { close(r.readyCh) })
+	})
+
+	// File data stays ordered, other control messages are handled concurrently
+	dispatcher := newMessageDispatcher(r.config.WebRTC.ControlMessageConcurrency, r.handleMessage)
+	// Stop and Abort close the dispatcher from other goroutines
+	r.mu.Lock()
+	r.outbound, r.dispatcher = outbound, dispatcher
+	r.mu.Unlock()
+	dataChannel.OnMessage(dispatcher.dispatch)
 
-		r.dataChannel.OnError(func(err error) {
-			log.Printf("File transfer data channel error: %v", err)
+	dataChannel.OnClose(func() {
+		log.Printf("File transfer data channel closed")
+		dispatcher.close()
+		closeOutbound(outbound)
+
+		// Queued messages are handled by now, a transfer still unfinished waits for data that can no longer arrive
+		// unless the sender reconnects
+		if !r.awaitReconnect(dataChannel) {
+			select {
+			case <-r.doneCh:
+			default:
+				r.finish(fmt.Errorf("data channel closed before the transfer completed"))
+			}
 			r.dataProcessor.Close()
-		})
+		}
+		close(closed)
 	})
 
-	return nil
+	dataChannel.OnError(func(err error) {
+		log.Printf("File transfer data channel error: %v", err)
+		dispatcher.close()
+	})
+}
+
+// awaitReconnect keeps an unfinished transfer open after its channel was lost, so the sender can continue it on a new one.
+// It reports false if the transfer is over or can't continue. Without a new channel in time the transfer fails.
+func (r *ReceiverChannel) awaitReconnect(lost *webrtc.DataChannel) bool {
+	select {
+	case <-r.doneCh:
+		return false
+	default:
+	}
+
+	if r.config.WebRTC.ReconnectAttempts == 0 || r.peerConn.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return false
+	}
+
+	timeout := time.Duration(r.config.WebRTC.ReconnectTimeoutMs) * time.Millisecond
+	log.Printf("Data channel lost mid-transfer, waiting up to %v for the sender to reconnect", timeout)
+
+	r.mu.Lock()
+	r.awaitingReconnect = true
+	r.mu.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		gaveUp := r.awaitingReconnect && r.dataChannel == lost
+		if gaveUp {
+			r.awaitingReconnect = false
+		}
+		r.mu.Unlock()
+		if !gaveUp {
+			return
+		}
+
+		r.finish(fmt.Errorf("data channel closed before the transfer completed, the sender did not reconnect within %v", timeout))
+		r.dataProcessor.Close()
+	})
+
+	return true
 }
 
 // ReceiveFile performs a non-blocking file receive, returns progress channel immediately
@@ -84,12 +380,14 @@ func (r *ReceiverChannel) ReceiveFile() (<-chan types.ProgressUpdate, error) {
 
 	// Start file receive in a goroutine
 	go func() {
-		defer close(r.progressCh)
+		defer r.closeProgress()
 
 		// Wait for data channel to be ready
 		select {
 		case <-r.readyCh:
 			log.Printf("Data channel ready, waiting for file transfer")
+		case <-r.doneCh:
+			return
 		case <-r.ctx.Done():
 			log.Printf("Cancelled while waiting for data channel: %v", r.ctx.Err())
 			return
@@ -107,6 +405,105 @@ func (r *ReceiverChannel) ReceiveFile() (<-chan types.ProgressUpdate, error) {
 	return r.progressCh, nil
 }
 
+// closeProgress closes the progress channel. Messages may still be handled after a cancel closed it,
+// whatever progress they report is dropped.
+func (r *ReceiverChannel) closeProgress() {
+	r.progressMu.Lock()
+	defer r.progressMu.Unlock()
+	r.progressClosed = true
+	close(r.progressCh)
+}
+
+// HandOff ends the transfer here and asks the sender to wait for another receiver to take it over.
+// The partial file stays where it is, a receiver with access to it resumes from there and any other starts afresh.
+func (r *ReceiverChannel) HandOff() error {
+	select {
+	case <-r.doneCh:
+		return fmt.Errorf("the transfer has already ended, there is nothing to hand off")
+	default:
+	}
+
+	r.mu.Lock()
+	dataChannel := r.dataChannel
+	r.mu.Unlock()
+	if dataChannel == nil || dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("no transfer in progress to hand off")
+	}
+	if !r.writerOpts.Resume {
+		return fmt.Errorf("partial files are not kept, the transfer can't be handed off")
+	}
+
+	r.handedOff.Store(true)
+	if err := r.sendControlMessage(MSG_HANDOFF, nil); err != nil {
+		r.handedOff.Store(false)
+		return fmt.Errorf("error asking the sender to wait for another receiver: %w", err)
+	}
+
+	log.Printf("Transfer handed off, the sender will wait for another receiver")
+	r.finish(ErrHandedOff)
+	return nil
+}
+
+// Abort ends a transfer in progress with err, reports it to the sender and removes the file being received,
+// even when partial files are kept for resume. Files of a directory that were already complete are kept.
+func (r *ReceiverChannel) Abort(err error) {
+	select {
+	case <-r.doneCh:
+		return
+	default:
+	}
+
+	// Stop handling messages first, nothing may write to the file while it is removed
+	r.mu.Lock()
+	dispatcher := r.dispatcher
+	r.mu.Unlock()
+	if dispatcher != nil {
+		dispatcher.close()
+	}
+
+	r.sendErrorAndFail(err)
+
+	if discardErr := r.dataProcessor.DiscardFile(); discardErr != nil {
+		log.Printf("Error removing aborted file: %v", discardErr)
+	}
+}
+
+// Stop ends a transfer in progress with err and reports it to the sender. Unlike Abort, the file being received
+// is cleared like one interrupted any other way, so it is kept if partial files are kept for resume.
+func (r *ReceiverChannel) Stop(err error) {
+	select {
+	case <-r.doneCh:
+		return
+	default:
+	}
+
+	// Stop handling messages first, nothing may write to the file while it is cleared
+	r.mu.Lock()
+	dispatcher := r.dispatcher
+	r.mu.Unlock()
+	if dispatcher != nil {
+		dispatcher.close()
+	}
+
+	r.sendErrorAndFail(err)
+
+	if clearErr := r.ClearPartialFile(); clearErr != nil {
+		log.Printf("Error clearing partial file: %v", clearErr)
+	}
+}
+
+// checkFingerprint makes sure the peer's DTLS certificate is the one pinned
+func checkFingerprint(peerConn *webrtc.PeerConnection, pinned string) error {
+	actual, err := remoteFingerprint(peerConn)
+	if err != nil {
+		return fmt.Errorf("failed to verify sender fingerprint: %w", err)
+	}
+	if actual != pinned {
+		return fmt.Errorf("%w: expected %s, got %s", ErrFingerprintMismatch, pinned, actual)
+	}
+	return nil
+}
+
 // ClearPartialFile removes any partially written file
 func (r *ReceiverChannel) ClearPartialFile() error {
 	if r.dataProcessor != nil {
@@ -118,54 +515,367 @@ func (r *ReceiverChannel) ClearPartialFile() error {
 
 // handleMessage dispatches messages to appropriate handlers based on type
 func (r *ReceiverChannel) handleMessage(msg webrtc.DataChannelMessage) {
-	// Determine message type and dispatch to appropriate handler
-	switch {
-	case !r.metadataReceived && bytes.HasPrefix(msg.Data, []byte("METADATA:")):
-		r.handleMetadataPhase(msg)
-	case string(msg.Data) == "EOF":
-		r.handleEOFPhase(msg)
-	default:
+	// Whatever was in flight when the transfer was handed off is sent again to the next receiver
+	if r.handedOff.Load() {
+		return
+	}
+
+	// File data is always sent as binary, control messages as text
+	if !msg.IsString {
 		r.handleFileDataPhase(msg)
+		return
+	}
+
+	msgType, payload := parseControlMessage(msg.Data)
+	switch msgType {
+	case MSG_IDENTITY:
+		r.handleIdentity(payload)
+	case MSG_SESSION_KEY:
+		r.handleSessionKey(payload)
+	case MSG_DIRECTORY:
+		if !r.senderAccepted() {
+			return
+		}
+		r.handleDirectoryPhase(payload)
+	case MSG_METADATA:
+		if r.metadataReceived {
+			log.Printf("Received duplicate metadata, ignoring")
+			return
+		}
+		if !r.senderAccepted() {
+			return
+		}
+		r.handleMetadataPhase(payload)
+	case MSG_TRANSFER_START:
+		r.handleTransferStartPhase(payload)
+	case MSG_CHUNK_REF:
+		r.handleChunkRef(payload)
+	case MSG_SEGMENT:
+		r.handleSegment(payload)
+	case MSG_EOF:
+		r.handleEOFPhase(payload)
+	case MSG_SESSION_END:
+		r.handleSessionEnd()
+	case MSG_PING:
+		if err := r.outbound.SendText(pongMessage(payload)); err != nil {
+			repeatLog.Printf("Error answering ping: %v", err)
+		}
+	case MSG_PONG:
+		// Nothing waits on pongs yet, receiving one is enough to know the sender is alive
+	case MSG_ERROR:
+		r.handleErrorMessage(payload)
+	default:
+		repeatLog.Printf("Received unknown control message: %s", msgType)
 	}
 }
 
-// handleMetadataPhase processes metadata messages
-func (r *ReceiverChannel) handleMetadataPhase(msg webrtc.DataChannelMessage) {
-	metadata, err := r.processMetadata(msg.Data)
+// handleIdentity checks the name the sender identifies as against the identities accepted
+func (r *ReceiverChannel) handleIdentity(payload []byte) {
+	identity, err := utils.DecodeJSON[types.Identity](payload)
 	if err != nil {
-		log.Printf("Error handling metadata: %v", err)
-		r.doneOnce.Do(func() { close(r.doneCh) })
+		r.sendErrorAndFail(fmt.Errorf("error decoding sender identity: %w", err))
 		return
 	}
 
-	// Set up progress tracking with metadata
-	r.fileMetadata = metadata
+	if len(r.acceptFrom) > 0 && !slices.Contains(r.acceptFrom, identity.Name) {
+		r.sendErrorAndFail(fmt.Errorf("%w: it identifies as %q", ErrSenderNotAccepted, identity.Name))
+		return
+	}
+	r.senderIdentity = identity.Name
+
+	log.Printf("Sender identifies as %q", identity.Name)
+}
+
+// senderAccepted makes sure an accepted sender identified itself before it offers a file, failing the transfer if not
+func (r *ReceiverChannel) senderAccepted() bool {
+	if len(r.acceptFrom) == 0 || r.senderIdentity != "" {
+		return true
+	}
 
-	// Send initial progress (non-blocking)
+	// Already rejected, what the sender sent before hearing about it is ignored
 	select {
-	case r.progressCh <- types.ProgressUpdate{
-		NewBytes: 0,
-		MetaData: metadata,
-	}:
+	case <-r.doneCh:
+		return false
 	default:
+	}
+
+	r.sendErrorAndFail(fmt.Errorf("%w: it did not identify itself", ErrSenderNotAccepted))
+	return false
+}
+
+// handleSessionKey sets up decryption with the key the sender will encrypt file data with
+func (r *ReceiverChannel) handleSessionKey(payload []byte) {
+	sessionKey, err := utils.DecodeJSON[types.SessionKey](payload)
+	if err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error decoding session key: %w", err))
+		return
+	}
+
+	cipher, err := newSessionCipher(sessionKey.Key)
+	if err != nil {
+		r.sendErrorAndFail(err)
+		return
+	}
+	r.cipher = cipher
+
+	log.Printf("Sender encrypts file data with a session key")
+}
+
+// usePassphrase sets up decryption of the file's data with the key derived from the passphrase and the file's salt.
+// A receiver with a passphrase only accepts data encrypted with one, and one without can't read it.
+func (r *ReceiverChannel) usePassphrase(metadata *types.FileMetadata) error {
+	if len(metadata.PassphraseSalt) == 0 {
+		if r.passphrase != "" {
+			return fmt.Errorf("%w: %s is not encrypted", ErrPassphraseNotUsed, metadata.Name)
+		}
+		return nil
+	}
+	if r.passphrase == "" {
+		return fmt.Errorf("%s is encrypted with a passphrase, receive it with --passphrase", metadata.Name)
+	}
+
+	// The files of a transfer share the salt, the key is derived once
+	if current, ok := r.cipher.(*passphraseCipher); ok && bytes.Equal(current.salt, metadata.PassphraseSalt) {
+		return nil
+	}
+	cipher, err := newPassphraseCipher(r.passphrase, metadata.PassphraseSalt)
+	if err != nil {
+		return err
+	}
+	r.cipher = cipher
+
+	log.Printf("Sender encrypts file data with the passphrase")
+	return nil
+}
+
+// handleDirectoryPhase starts a directory transfer, its files then arrive one at a time with their own metadata
+func (r *ReceiverChannel) handleDirectoryPhase(payload []byte) {
+	if r.directory != nil || r.metadataReceived {
+		log.Printf("Received unexpected directory info, ignoring")
+		return
+	}
+
+	if len(payload) > r.config.Receiver.MaxMetadataSize {
+		r.sendErrorAndFail(fmt.Errorf("directory info is %d bytes, larger than the %d bytes allowed", len(payload), r.config.Receiver.MaxMetadataSize))
+		return
+	}
+
+	info, err := utils.DecodeJSON[types.DirectoryInfo](payload)
+	if err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error decoding directory info: %w", err))
+		return
+	}
+	r.dataProcessor.SanitizeDirectoryInfo(&info)
+	if r.writerOpts.As != "" {
+		r.sendErrorAndFail(fmt.Errorf("the destination names a single file, but the sender is sending directory %s", info.Name))
+		return
+	}
+	r.directory = &info
+
+	log.Printf("Receiving directory %s: %d files, %d bytes", info.Name, info.Files, info.Size)
+
+	// Progress and the result describe the whole directory
+	r.fileMetadata = &types.FileMetadata{Name: info.Name, Size: info.Size, MimeType: "inode/directory"}
+
+	r.mu.Lock()
+	r.stats.path = r.dataProcessor.DirectoryDestinationPath(r.destPath, info.Name)
+	r.stats.files = info.Files
+	r.mu.Unlock()
+
+	if !r.reportProgress(types.ProgressUpdate{NewBytes: 0, MetaData: r.fileMetadata}) {
 		log.Printf("Progress channel full, skipping metadata progress update")
 	}
+}
 
-	// Prepare file for receiving with metadata
-	finalPath, err := r.dataProcessor.PrepareFileForReceiving(r.destPath, metadata)
+// handleMetadataPhase processes metadata messages and replies with a metadata ACK
+func (r *ReceiverChannel) handleMetadataPhase(payload []byte) {
+	metadata, err := r.processMetadata(payload)
 	if err != nil {
-		log.Printf("Error preparing file for receiving: %v", err)
-		r.doneOnce.Do(func() { close(r.doneCh) })
+		r.sendErrorAndFail(fmt.Errorf("error handling metadata: %w", err))
 		return
 	}
 
-	log.Printf("Ready to receive file to: %s", finalPath)
+	if r.rejoining {
+		r.rejoining = false
+		if r.rejoinFile(metadata) {
+			return
+		}
+	}
+	r.currentFile = metadata
+	r.closeDedup()
+
+	writerOpts := r.writerOpts
+	if r.directory != nil {
+		if !isInDirectory(metadata, r.directory.Name) {
+			r.sendErrorAndFail(fmt.Errorf("file %s/%s is outside directory %s", metadata.Dir, metadata.Name, r.directory.Name))
+			return
+		}
+
+		// Files already complete from an earlier run are skipped, which lets an interrupted directory transfer continue
+		writerOpts.SkipIdentical = true
+	} else {
+		// Set up progress tracking with metadata
+		r.fileMetadata = metadata
+
+		r.mu.Lock()
+		r.stats.files = 1
+		r.mu.Unlock()
+
+		// Send initial progress
+		if !r.reportProgress(types.ProgressUpdate{NewBytes: 0, MetaData: metadata}) {
+			log.Printf("Progress channel full, skipping metadata progress update")
+		}
+	}
+
+	ack := types.MetadataAck{MaxChunkSize: r.config.Receiver.MaxChunkSize}
+	if metadata.Follow {
+		log.Printf("Sender is following %s as it grows, receiving what is appended to it until the sender stops", metadata.Name)
+	}
+
+	// Offer to resume from a partial file left by an earlier transfer, a followed file has no known size to resume to
+	if r.writerOpts.Resume && !metadata.Follow {
+		offset, prefixChecksum, err := r.dataProcessor.FindPartialFile(r.destPath, metadata, writerOpts)
+		if err != nil {
+			log.Printf("Warning: failed to check for partial file, starting from the beginning: %v", err)
+		} else if offset > 0 {
+			log.Printf("Found partial file with %d of %d bytes, requesting resume", offset, metadata.Size)
+			ack.ResumeOffset = offset
+			ack.PrefixChecksum = prefixChecksum
+		}
+	}
+
+	// A file we are not resuming may conflict with an existing one, check what the policy says
+	if ack.ResumeOffset == 0 {
+		skip, err := r.dataProcessor.CheckDestination(r.destPath, metadata, writerOpts)
+		if errors.Is(err, processor.ErrDestinationExists) {
+			err = fmt.Errorf("%w, receive with --force to replace it or --on-conflict rename to keep both", err)
+		}
+		if err != nil {
+			r.sendErrorAndFail(err)
+			return
+		}
+		ack.Skip = skip
+	}
+
+	// Offer what an existing copy holds, the sender then only sends chunks that changed
+	if r.dedupEnabled && ack.ResumeOffset == 0 && !ack.Skip && !metadata.Follow {
+		ack.Dedup = r.offerDedup(metadata, writerOpts)
+	}
+
+	if err := r.sendControlMessage(MSG_METADATA_ACK, ack); err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error sending metadata ack: %w", err))
+		return
+	}
+
+	// Nothing more will arrive for a skipped file
+	if ack.Skip {
+		log.Printf("Transfer of %s skipped, existing file kept", metadata.Name)
+
+		if r.directory != nil {
+			r.mu.Lock()
+			r.stats.skippedFiles++
+			r.stats.skippedBytes += uint64(metadata.Size)
+			offset := r.stats.offset()
+			r.mu.Unlock()
+
+			r.reportProgress(types.ProgressUpdate{NewBytes: uint64(metadata.Size), CumulativeBytes: offset})
+			r.nextFile()
+			return
+		}
+
+		r.mu.Lock()
+		r.stats.skipped = true
+		r.stats.path = r.dataProcessor.DestinationPath(r.destPath, metadata, r.writerOpts)
+		r.mu.Unlock()
+		r.finish(nil)
+	}
+}
+
+// dedupIndexBatch is how many chunk hashes go in one DEDUP_INDEX message, which keeps messages around 32KB
+const dedupIndexBatch = 900
+
+// offerDedup indexes the existing file the incoming one replaces and sends its chunk hashes to the sender.
+// It reports whether there is anything to offer, failing to index the file only means sending all of it.
+func (r *ReceiverChannel) offerDedup(metadata *types.FileMetadata, opts processor.WriterOptions) bool {
+	source, err := r.dataProcessor.OpenDedupSource(r.destPath, metadata, opts)
+	if err != nil {
+		log.Printf("Warning: failed to index existing file, receiving all of it: %v", err)
+		return false
+	}
+	if source == nil {
+		return false
+	}
+
+	hashes := source.Hashes()
+	for len(hashes) > 0 {
+		n := min(len(hashes), dedupIndexBatch)
+		if err := r.sendControlMessage(MSG_DEDUP_INDEX, types.DedupIndex{Hashes: hashes[:n]}); err != nil {
+			log.Printf("Warning: failed to send dedup index, receiving all of it: %v", err)
+			source.Close()
+			return false
+		}
+		hashes = hashes[n:]
+	}
+
+	r.mu.Lock()
+	r.dedup = source
+	r.mu.Unlock()
+	return true
+}
+
+// closeDedup closes the existing copy offered for the current file, if any
+func (r *ReceiverChannel) closeDedup() {
+	r.mu.Lock()
+	source := r.dedup
+	r.dedup = nil
+	r.mu.Unlock()
+
+	if source != nil {
+		if err := source.Close(); err != nil {
+			log.Printf("Error closing existing file: %v", err)
+		}
+	}
+}
+
+// rejoinFile answers the metadata the sender repeats after reconnecting, offering to continue the file
+// from what arrived before the channel was lost. It returns false if there is nothing to continue,
+// anything started is then dropped and the file negotiated like any other.
+func (r *ReceiverChannel) rejoinFile(metadata *types.FileMetadata) bool {
+	held, checksum := r.dataProcessor.ReceivedSoFar()
+	if held == 0 || !sameFile(r.currentFile, metadata) {
+		if err := r.dataProcessor.ClearPartialFile(); err != nil {
+			log.Printf("Error clearing interrupted file: %v", err)
+		}
+		return false
+	}
+
+	log.Printf("Offering to continue %s from the %d bytes received before reconnecting", metadata.Name, held)
+	r.continuing = true
+
+	ack := types.MetadataAck{
+		MaxChunkSize:   r.config.Receiver.MaxChunkSize,
+		ResumeOffset:   held,
+		PrefixChecksum: checksum,
+	}
+	if err := r.sendControlMessage(MSG_METADATA_ACK, ack); err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error sending metadata ack: %w", err))
+	}
+	return true
+}
+
+// sameFile reports whether two metadata messages describe the same file
+func sameFile(a, b *types.FileMetadata) bool {
+	return a != nil && b != nil && a.Name == b.Name && a.Dir == b.Dir && a.Size == b.Size && a.Checksum == b.Checksum
 }
 
-// processMetadata extracts and decodes metadata from message
-func (r *ReceiverChannel) processMetadata(msg []byte) (*types.FileMetadata, error) {
-	metadataBytes := msg[9:] // Remove "METADATA:" prefix
-	metadata, err := utils.DecodeJSON[types.FileMetadata](metadataBytes)
+// processMetadata decodes metadata from the message payload
+func (r *ReceiverChannel) processMetadata(payload []byte) (*types.FileMetadata, error) {
+	// Bound what we are willing to parse, the payload comes straight from the peer
+	if len(payload) > r.config.Receiver.MaxMetadataSize {
+		return nil, fmt.Errorf("metadata is %d bytes, larger than the %d bytes allowed", len(payload), r.config.Receiver.MaxMetadataSize)
+	}
+
+	metadata, err := utils.DecodeJSON[types.FileMetadata](payload)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding metadata: %w", err)
 	}
@@ -173,56 +883,572 @@ func (r *ReceiverChannel) processMetadata(msg []byte) (*types.FileMetadata, erro
 	log.Printf("Received metadata: %s (size: %d bytes, type: %s)",
 		metadata.Name, metadata.Size, metadata.MimeType)
 
+	// The name comes from the sender's platform, make it valid for ours
+	r.dataProcessor.SanitizeMetadata(&metadata)
+
+	// The sender may use either checksum encoding, work with hex from here on.
+	// A followed file's checksum only arrives with its EOF.
+	if !metadata.Follow || metadata.Checksum != "" {
+		checksum, err := utils.NormalizeChecksum(metadata.Checksum)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum in metadata: %w", err)
+		}
+		metadata.Checksum = checksum
+	}
+
+	if metadata.Compression != "" && metadata.Compression != CompressionGzip && metadata.Compression != CompressionZstd {
+		return nil, fmt.Errorf("unsupported compression %q", metadata.Compression)
+	}
+
+	if err := r.usePassphrase(&metadata); err != nil {
+		return nil, err
+	}
+
 	r.metadataReceived = true
 
 	return &metadata, nil
 }
 
+// handleTransferStartPhase prepares the destination file once the sender has confirmed the start offset
+func (r *ReceiverChannel) handleTransferStartPhase(payload []byte) {
+	if !r.metadataReceived {
+		log.Printf("Received transfer start before metadata, ignoring")
+		return
+	}
+
+	start, err := utils.DecodeJSON[types.TransferStart](payload)
+	if err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error decoding transfer start: %w", err))
+		return
+	}
+
+	// The sender counts what it reads and sends from here
+	r.mu.Lock()
+	r.countedFrom, r.bytesWritten = start.Offset, 0
+	r.mu.Unlock()
+	r.chunkSize = start.ChunkSize
+
+	if r.continuing {
+		r.continuing = false
+		if r.continueFile(start) {
+			return
+		}
+	}
+
+	// The existing copy is read while the new one is written, so it must stay intact until the new one is complete
+	writerOpts := r.writerOpts
+	r.mu.Lock()
+	if r.dedup != nil {
+		writerOpts.WriteMode = processor.WriteModeAtomic
+	}
+	r.fileDeduped, r.dedupChunks = 0, 0
+	r.mu.Unlock()
+
+	// Prepare file for receiving with metadata
+	finalPath, err := r.dataProcessor.PrepareFileForReceiving(r.destPath, r.currentFile, start.Offset, writerOpts)
+	if err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error preparing file for receiving: %w", err))
+		return
+	}
+
+	r.follow = nil
+	if r.currentFile.Follow {
+		r.follow = newFollowState()
+	}
+
+	r.mu.Lock()
+	if r.directory == nil {
+		r.stats.path = finalPath
+	}
+	r.stats.resumedFrom += start.Offset
+	r.fileStart = start.Offset
+	if r.stats.startTime.IsZero() {
+		r.stats.startTime = time.Now()
+	}
+	offset := r.stats.offset()
+	r.mu.Unlock()
+
+	// Account for the bytes we already hold when resuming
+	if start.Offset > 0 {
+		r.reportProgress(types.ProgressUpdate{NewBytes: uint64(start.Offset), CumulativeBytes: offset})
+	}
+
+	log.Printf("Ready to receive file to: %s (chunk size %d bytes)", finalPath, start.ChunkSize)
+}
+
+// continueFile keeps writing the open file if the sender confirmed the offer to continue it after a reconnect.
+// It returns false if the sender starts the file over, what was received of it is then discarded.
+func (r *ReceiverChannel) continueFile(start types.TransferStart) bool {
+	held, _ := r.dataProcessor.ReceivedSoFar()
+	if start.Offset == held {
+		log.Printf("Continuing %s at %d bytes (chunk size %d bytes)", r.currentFile.Name, held, start.ChunkSize)
+		return true
+	}
+
+	log.Printf("Sender could not confirm the %d bytes received of %s, receiving it again", held, r.currentFile.Name)
+	r.mu.Lock()
+	r.stats.bytes -= uint64(held - r.fileStart - r.fileDeduped)
+	r.stats.dedupedBytes -= uint64(r.fileDeduped)
+	r.stats.resumedFrom -= r.fileStart
+	r.mu.Unlock()
+
+	if err := r.dataProcessor.DiscardFile(); err != nil {
+		log.Printf("Error discarding interrupted file: %v", err)
+	}
+	return false
+}
+
+// reconcile compares the sender's counts of the file data read and sent with what was written of it.
+// It returns where they diverge, or "" if they agree or the sender sent no counts.
+func (r *ReceiverChannel) reconcile(payload []byte) string {
+	if len(payload) == 0 || r.currentFile == nil {
+		return ""
+	}
+	counts, err := utils.DecodeJSON[types.EOF](payload)
+	if err != nil {
+		log.Printf("Error decoding EOF counts, not reconciling them: %v", err)
+		return ""
+	}
+
+	r.mu.Lock()
+	expected := r.currentFile.Size - r.countedFrom
+	written := r.bytesWritten
+	r.mu.Unlock()
+
+	var diverged []string
+	if counts.BytesRead != expected {
+		diverged = append(diverged, fmt.Sprintf("the sender read %d of the %d bytes expected", counts.BytesRead, expected))
+	}
+	if counts.BytesSent != counts.BytesRead {
+		diverged = append(diverged, fmt.Sprintf("the sender sent %d of the %d bytes it read", counts.BytesSent, counts.BytesRead))
+	}
+	if written != counts.BytesSent {
+		diverged = append(diverged, fmt.Sprintf("the receiver wrote %d of the %d bytes sent", written, counts.BytesSent))
+	}
+	if len(diverged) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("read %d, sent %d, written %d bytes from offset %d: %s",
+		counts.BytesRead, counts.BytesSent, written, r.countedFrom, strings.Join(diverged, ", "))
+}
+
+// handleSegment verifies a segment of a followed file against what was written of it
+func (r *ReceiverChannel) handleSegment(payload []byte) {
+	select {
+	case <-r.doneCh:
+		return
+	default:
+	}
+
+	sent, err := utils.DecodeJSON[types.Segment](payload)
+	if err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error decoding segment: %w", err))
+		return
+	}
+	if r.follow == nil {
+		r.sendErrorAndFail(fmt.Errorf("received a segment checksum, but no followed file is being received"))
+		return
+	}
+
+	written, _ := r.follow.takeSegment()
+	if written != sent {
+		r.sendErrorAndFail(fmt.Errorf("%w: sender sent %d bytes at offset %d with checksum %s, received %d bytes at offset %d with checksum %s",
+			ErrSegmentMismatch, sent.Size, sent.Offset, sent.Checksum, written.Size, written.Offset, written.Checksum))
+		return
+	}
+	repeatLog.Printf("Verified %s of %s so far", utils.FormatFileSize(sent.Offset+sent.Size), r.currentFile.Name)
+}
+
+// endFollowedFile completes the metadata of a followed file with the size and checksum the sender ended it with
+func (r *ReceiverChannel) endFollowedFile(payload []byte) error {
+	eof, err := utils.DecodeJSON[types.EOF](payload)
+	if err != nil {
+		return fmt.Errorf("error decoding EOF of followed file: %w", err)
+	}
+	checksum, err := utils.NormalizeChecksum(eof.Checksum)
+	if err != nil {
+		return fmt.Errorf("invalid checksum at the end of followed file: %w", err)
+	}
+
+	r.currentFile.Size, r.currentFile.Checksum = eof.Size, checksum
+	log.Printf("Sender stopped following %s at %s", r.currentFile.Name, utils.FormatFileSize(eof.Size))
+	return nil
+}
+
 // handleEOFPhase processes EOF messages and completes transfer
-func (r *ReceiverChannel) handleEOFPhase(_ webrtc.DataChannelMessage) {
+func (r *ReceiverChannel) handleEOFPhase(payload []byte) {
+	if r.currentFile != nil && r.currentFile.Follow {
+		if err := r.endFollowedFile(payload); err != nil {
+			r.sendErrorAndFail(err)
+			return
+		}
+	}
+
+	// Lost data shows up in the counts before it fails the checksum
+	discrepancy := r.reconcile(payload)
+	if discrepancy != "" {
+		log.Printf("Chunk accounting mismatch for %s: %s", r.currentFile.Name, discrepancy)
+	}
+
+	// The existing copy is replaced once the new one is complete
+	r.mu.Lock()
+	deduped, chunks, reused := r.dedup != nil, r.dedupChunks, r.fileDeduped
+	r.mu.Unlock()
+	if deduped {
+		log.Printf("Reused %d chunks (%s) of %s from the existing file", chunks, utils.FormatFileSize(reused), r.currentFile.Name)
+	}
+	r.closeDedup()
+
 	totalBytes, err := r.dataProcessor.FinishReceiving()
+	if err != nil && discrepancy != "" {
+		err = fmt.Errorf("%w (%s): %w", ErrChunkAccounting, discrepancy, err)
+	}
 	if err != nil {
 		log.Printf("Error processing EOF signal: %v", err)
 	}
 
 	log.Printf("File transfer complete: %d bytes received", totalBytes)
 
-	// Send final progress (non-blocking)
-	update := types.ProgressUpdate{
-		NewBytes: 0,
+	mismatch := r.dataProcessor.TypeMismatch()
+	if err == nil && mismatch != nil && r.onTypeMismatch != nil {
+		r.onTypeMismatch(*mismatch)
 	}
 
-	select {
-	case r.progressCh <- update:
-	default:
+	r.mu.Lock()
+	if err == nil && mismatch != nil {
+		r.stats.mismatches = append(r.stats.mismatches, *mismatch)
 	}
+	r.stats.endTime = time.Now()
+	offset := r.stats.offset()
+	r.mu.Unlock()
 
-	// Signal completion
-	r.doneOnce.Do(func() { close(r.doneCh) })
+	// The directory is complete only once the sender ends the session
+	if r.directory != nil && err == nil {
+		r.nextFile()
+		return
+	}
+
+	// Send final progress
+	r.reportProgress(types.ProgressUpdate{NewBytes: 0, CumulativeBytes: offset})
+
+	// Signal completion, the sender waits for the session to end so it still hears about a failure
+	if err != nil {
+		r.sendErrorAndFail(err)
+		return
+	}
+	r.finish(nil)
+}
+
+// nextFile gets ready for the next file of a directory transfer
+func (r *ReceiverChannel) nextFile() {
+	r.filesDone++
+	r.currentFile = nil
+	r.metadataReceived = false
+}
+
+// isInDirectory reports whether metadata describes a file inside the directory transfer named dirName
+func isInDirectory(metadata *types.FileMetadata, dirName string) bool {
+	return metadata.Dir == dirName || strings.HasPrefix(metadata.Dir, dirName+"/")
+}
+
+// handleSessionEnd echoes SESSION_END back to the sender so it can close the channel.
+// It runs on the ordered queue, so everything the sender sent before it has been handled.
+func (r *ReceiverChannel) handleSessionEnd() {
+	// After a failure the sender is waiting for our ERROR instead, echoing would let it report success
+	r.mu.Lock()
+	failed := r.transferErr != nil
+	r.mu.Unlock()
+	if failed {
+		return
+	}
+
+	// Every file of a directory has been verified on its own, make sure none is missing
+	if r.directory != nil {
+		if r.filesDone != r.directory.Files {
+			r.sendErrorAndFail(fmt.Errorf("directory transfer ended after %d of %d files", r.filesDone, r.directory.Files))
+			return
+		}
+
+		log.Printf("Directory %s complete: %d files", r.directory.Name, r.filesDone)
+		r.reportProgress(types.ProgressUpdate{NewBytes: 0})
+		r.finish(nil)
+	}
+
+	if err := r.sendControlMessage(MSG_SESSION_END, nil); err != nil {
+		log.Printf("Error acknowledging session end: %v", err)
+	}
+}
+
+// handleErrorMessage processes an error reported by the sender and aborts the transfer
+func (r *ReceiverChannel) handleErrorMessage(payload []byte) {
+	errMsg, err := utils.DecodeJSON[types.ErrorMessage](payload)
+	if err != nil {
+		log.Printf("Sender reported an error (undecodable): %v", err)
+		r.finish(fmt.Errorf("sender reported an undecodable error: %w", err))
+		return
+	}
+
+	log.Printf("Sender reported an error: %s", errMsg.Message)
+	r.finish(fmt.Errorf("sender reported an error: %s", errMsg.Message))
 }
 
 // handleFileDataPhase processes file data messages
 func (r *ReceiverChannel) handleFileDataPhase(msg webrtc.DataChannelMessage) {
 	if !r.metadataReceived {
-		log.Printf("Received file data before metadata, ignoring")
+		repeatLog.Printf("Received file data before metadata, ignoring")
+		return
+	}
+
+	// Data still in flight after the transfer was aborted has nowhere to go
+	select {
+	case <-r.doneCh:
+		return
+	default:
+	}
+
+	data := msg.Data
+	if r.cipher != nil {
+		opened, err := r.cipher.open(data)
+		if err != nil {
+			r.sendErrorAndFail(fmt.Errorf("error decrypting file data: %w", err))
+			return
+		}
+		data = opened
+	}
+	if r.currentFile.Compression != "" {
+		decompressed, err := decompressChunk(data, r.currentFile.Compression, r.chunkSize)
+		if err != nil {
+			r.sendErrorAndFail(err)
+			return
+		}
+		data = decompressed
+	}
+
+	if !r.writeFileData(data) {
+		return
+	}
+
+	r.mu.Lock()
+	r.stats.bytes += uint64(len(data))
+	offset := r.stats.offset()
+	r.mu.Unlock()
+
+	// Send progress update
+	r.reportProgress(types.ProgressUpdate{NewBytes: uint64(len(data)), CumulativeBytes: offset})
+
+	r.relieveMemoryPressure(len(msg.Data))
+}
+
+// handleChunkRef copies a chunk the sender referenced from the existing file, in place of file data
+func (r *ReceiverChannel) handleChunkRef(payload []byte) {
+	if !r.metadataReceived {
+		repeatLog.Printf("Received chunk reference before metadata, ignoring")
 		return
 	}
 
-	// Write data using DataProcessor
-	err := r.dataProcessor.WriteData(msg.Data)
+	select {
+	case <-r.doneCh:
+		return
+	default:
+	}
+
+	ref, err := utils.DecodeJSON[types.ChunkRef](payload)
 	if err != nil {
-		log.Printf("Error writing data: %v", err)
+		r.sendErrorAndFail(fmt.Errorf("error decoding chunk reference: %w", err))
 		return
 	}
 
-	// Send progress update (non-blocking)
-	update := types.ProgressUpdate{
-		NewBytes: uint64(len(msg.Data)),
+	r.mu.Lock()
+	source := r.dedup
+	r.mu.Unlock()
+	if source == nil {
+		r.sendErrorAndFail(fmt.Errorf("sender referenced chunk %s, but no existing file was offered", ref.Hash))
+		return
+	}
+
+	data, err := source.Read(ref.Hash)
+	if err != nil {
+		r.sendErrorAndFail(fmt.Errorf("error reusing chunk of existing file: %w", err))
+		return
+	}
+	if len(data) != ref.Size {
+		r.sendErrorAndFail(fmt.Errorf("sender referenced chunk %s as %d bytes, it has %d", ref.Hash, ref.Size, len(data)))
+		return
+	}
+
+	if !r.writeFileData(data) {
+		return
+	}
+
+	r.mu.Lock()
+	r.stats.dedupedBytes += uint64(len(data))
+	r.fileDeduped += int64(len(data))
+	r.dedupChunks++
+	offset := r.stats.offset()
+	r.mu.Unlock()
+
+	r.reportProgress(types.ProgressUpdate{NewBytes: uint64(len(data)), CumulativeBytes: offset})
+}
+
+// writeFileData writes the next part of the file being received, reporting whether it was written.
+// Content that doesn't match the file's type ends the transfer, like any error writing it, a full disk included.
+func (r *ReceiverChannel) writeFileData(data []byte) bool {
+	err := r.dataProcessor.WriteData(data)
+	if errors.Is(err, processor.ErrContentMismatch) {
+		if discardErr := r.dataProcessor.DiscardFile(); discardErr != nil {
+			log.Printf("Error discarding rejected file: %v", discardErr)
+		}
+		r.sendErrorAndFail(err)
+		return false
+	}
+	if err != nil {
+		// Errors from the file itself already read "failed to write data: ...", keeping what caused them
+		r.sendErrorAndFail(err)
+		return false
+	}
+
+	if r.follow != nil {
+		r.follow.write(data)
+	}
+
+	r.mu.Lock()
+	r.bytesWritten += int64(len(data))
+	r.mu.Unlock()
+	return true
+}
+
+// relieveMemoryPressure asks the sender for chunks half the size of chunkLen when more file data
+// than MaxQueuedBytes is waiting to be written. It asks again only once smaller chunks arrive and still pile up.
+func (r *ReceiverChannel) relieveMemoryPressure(chunkLen int) {
+	limit := r.config.Receiver.MaxQueuedBytes
+	if limit == 0 {
+		return
+	}
+
+	queued := r.dispatcher.queued() * chunkLen
+	if queued <= limit {
+		return
+	}
+
+	// Smaller chunks would mostly slow the transfer down, so halving stops there
+	size := max(chunkLen/2, config.EfficientChunkSize)
+	if size >= chunkLen || (r.requestedChunkSize > 0 && size >= r.requestedChunkSize) {
+		return
+	}
+	r.requestedChunkSize = size
+
+	log.Printf("%d bytes of file data waiting to be written, asking the sender for %d byte chunks", queued, size)
+	if err := r.sendControlMessage(MSG_RECONFIGURE, types.Reconfigure{ChunkSize: size}); err != nil {
+		log.Printf("Error asking the sender for smaller chunks: %v", err)
+	}
+}
+
+// reportProgress hands an update to the progress consumer and reports whether it was delivered.
+// Updates are dropped when the consumer falls behind, unless SyncProgress asked for every update.
+func (r *ReceiverChannel) reportProgress(update types.ProgressUpdate) bool {
+	if r.progressCh == nil {
+		return false
+	}
+	update.FileIndex, update.File = r.filesDone, r.currentFile
+	r.mu.Lock()
+	update.BytesPerSecond = r.rate.update(r.stats.bytes, time.Now())
+	r.mu.Unlock()
+
+	// With metadata reported on its own, every update moves the transfer on
+	if r.onMetadata != nil {
+		if update.MetaData != nil {
+			r.onMetadata(update.MetaData)
+			return true
+		}
+		if update.NewBytes == 0 {
+			return true
+		}
+	}
+
+	r.progressMu.Lock()
+	defer r.progressMu.Unlock()
+	if r.progressClosed {
+		return false
+	}
+
+	if r.syncProgress {
+		select {
+		case r.progressCh <- update:
+			return true
+		case <-r.ctx.Done():
+			return false
+		}
 	}
 
 	select {
 	case r.progressCh <- update:
+		return true
 	default:
 		// Progress channel full, skip this update to avoid blocking data transfer
+		return false
+	}
+}
+
+// sendControlMessage sends a control message with an optional payload to the sender
+func (r *ReceiverChannel) sendControlMessage(msgType string, payload any) error {
+	msg, err := encodeControlMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+
+	return r.outbound.SendText(msg)
+}
+
+// sendErrorAndFail reports a fatal error to the sender and ends the transfer
+func (r *ReceiverChannel) sendErrorAndFail(err error) {
+	log.Printf("Transfer failed: %v", err)
+
+	if sendErr := r.sendControlMessage(MSG_ERROR, types.ErrorMessage{Message: err.Error()}); sendErr != nil {
+		log.Printf("Error reporting failure to sender: %v", sendErr)
+	}
+
+	r.finish(err)
+}
+
+// finish ends the transfer, recording err as its outcome if it's the first one
+func (r *ReceiverChannel) finish(err error) {
+	r.mu.Lock()
+	if r.transferErr == nil {
+		r.transferErr = err
+	}
+	r.mu.Unlock()
+
+	r.doneOnce.Do(func() { close(r.doneCh) })
+	r.closeDedup()
+}
+
+// WaitForCompletion waits up to timeout for the transfer to finish and returns its error.
+// The connection can close while the last messages are still being handled, so give them a moment.
+func (r *ReceiverChannel) WaitForCompletion(timeout time.Duration) error {
+	select {
+	case <-r.doneCh:
+	case <-time.After(timeout):
+		return fmt.Errorf("connection closed before the transfer completed")
 	}
+
+	r.mu.Lock()
+	err, closed := r.transferErr, r.channelClosed
+	r.mu.Unlock()
+
+	// A failed file is cleared once its channel has closed, so it is gone by the time this returns
+	if err != nil && closed != nil {
+		select {
+		case <-closed:
+		case <-time.After(timeout):
+		}
+	}
+	return err
+}
+
+// Result returns a summary of the transfer, complete once WaitForCompletion has returned
+func (r *ReceiverChannel) Result() *types.TransferResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats.result(r.fileMetadata, r.config.ChecksumEncoding)
 }
@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"yapfs/internal/config"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// chunkRecorder records the size of every file data message sent on the channels it wraps
+type chunkRecorder struct {
+	mu    sync.Mutex
+	sizes []int
+}
+
+// wrap is the outboundWrapper recording file data on its way to dataChannel
+func (c *chunkRecorder) wrap(dataChannel *webrtc.DataChannel) messageSender {
+	return &recordingSender{DataChannel: dataChannel, recorder: c}
+}
+
+// recorded returns the sizes recorded so far
+func (c *chunkRecorder) recorded() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.sizes...)
+}
+
+// recordingSender is the send side of a channel a chunkRecorder watches
+type recordingSender struct {
+	*webrtc.DataChannel
+	recorder *chunkRecorder
+}
+
+// Send records the size of data and sends it
+func (s *recordingSender) Send(data []byte) error {
+	s.recorder.mu.Lock()
+	s.recorder.sizes = append(s.recorder.sizes, len(data))
+	s.recorder.mu.Unlock()
+	return s.DataChannel.Send(data)
+}
+
+// textRecorder is a messageSender keeping the text messages sent through it
+type textRecorder struct {
+	texts []string
+}
+
+// Send drops data, only text is kept
+func (s *textRecorder) Send(data []byte) error { return nil }
+
+// SendText keeps text
+func (s *textRecorder) SendText(text string) error {
+	s.texts = append(s.texts, text)
+	return nil
+}
+
+func TestTransferShrinksChunksOnReconfigure(t *testing.T) {
+	const shrunk = 4 * 1024
+
+	ctx := context.Background()
+	srcPath, content := writeTestFile(t, 1024*1024)
+	destDir := t.TempDir()
+	cfg := newTestConfig()
+	recorder := &chunkRecorder{}
+
+	// The rate limit leaves most of the file unsent by the time the request reaches the sender
+	tr := startTestTransfer(t, ctx, cfg, SendOptions{FilePath: srcPath, Schedule: "00:00-00:00=1MB"},
+		ReceiveOptions{DestPath: destDir}, recorder.wrap)
+	for update := range tr.recvCh {
+		if update.NewBytes > 0 {
+			break
+		}
+	}
+	if err := tr.receiver.sendControlMessage(MSG_RECONFIGURE, types.Reconfigure{ChunkSize: shrunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	sendErr, receiveErr := tr.wait(t)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("transfer failed: send error = %v, receive error = %v", sendErr, receiveErr)
+	}
+	checkReceived(t, destDir, "file.bin", content)
+
+	sizes := recorder.recorded()
+	if len(sizes) == 0 || sizes[0] != cfg.WebRTC.ChunkSize {
+		t.Fatalf("first chunk sizes %v, want the agreed %d first", sizes[:min(len(sizes), 4)], cfg.WebRTC.ChunkSize)
+	}
+	shrunkAt := -1
+	for i, size := range sizes {
+		if i > 0 && size > sizes[i-1] {
+			t.Fatalf("chunk %d grew from %d to %d bytes", i, sizes[i-1], size)
+		}
+		if shrunkAt < 0 && size <= shrunk {
+			shrunkAt = i
+		}
+	}
+	if shrunkAt < 0 {
+		t.Fatalf("no chunk of at most %d bytes was sent", shrunk)
+	}
+	if rest := len(content) - shrunkAt*cfg.WebRTC.ChunkSize; rest < len(content)/2 {
+		t.Fatalf("chunks only shrank with %d of %d bytes left", rest, len(content))
+	}
+}
+
+func TestReceiverAsksForSmallerChunksWhenDataQueues(t *testing.T) {
+	const chunkLen = 16 * 1024
+
+	sent := &textRecorder{}
+	r := NewReceiverChannel(newTestConfig())
+	r.config.Receiver.MaxQueuedBytes = 2 * chunkLen
+	r.outbound = sent
+
+	// Messages pile up in the dispatcher while its handler is held
+	release := make(chan struct{})
+	r.dispatcher = newMessageDispatcher(1, func(webrtc.DataChannelMessage) { <-release })
+	defer func() {
+		close(release)
+		r.dispatcher.close()
+	}()
+	queue := func(n int) {
+		for range n {
+			r.dispatcher.dispatch(webrtc.DataChannelMessage{Data: make([]byte, chunkLen)})
+		}
+	}
+
+	queue(2)
+	r.relieveMemoryPressure(chunkLen)
+	if len(sent.texts) != 0 {
+		t.Fatalf("asked for smaller chunks with the backlog under the limit: %q", sent.texts)
+	}
+
+	// Each size is asked for once, and again smaller only when the smaller chunks pile up too
+	queue(2)
+	r.relieveMemoryPressure(chunkLen)
+	r.relieveMemoryPressure(chunkLen)
+	queue(6)
+	r.relieveMemoryPressure(chunkLen / 2)
+	queue(30)
+	r.relieveMemoryPressure(chunkLen / 8)
+	r.relieveMemoryPressure(config.EfficientChunkSize)
+
+	want := []int{chunkLen / 2, chunkLen / 4, config.EfficientChunkSize}
+	if len(sent.texts) != len(want) {
+		t.Fatalf("sent %q, want requests for %v byte chunks", sent.texts, want)
+	}
+	for i, text := range sent.texts {
+		msgType, payload := parseControlMessage([]byte(text))
+		req, err := utils.DecodeJSON[types.Reconfigure](payload)
+		if msgType != MSG_RECONFIGURE || err != nil || req.ChunkSize != want[i] {
+			t.Fatalf("request %d is %q, want chunks of %d bytes", i, text, want[i])
+		}
+	}
+}
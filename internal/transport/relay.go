@@ -0,0 +1,351 @@
+package transport
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"yapfs/internal/processor"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// Relay carries values through the signalling session, the last resort when the peers can't connect directly.
+// Nothing relayed is protected by DTLS, only the checksums say the file arrived intact.
+type Relay interface {
+	Put(ctx context.Context, key, value string) error
+	Get(ctx context.Context, key string) (string, error) // Empty until key has been written
+}
+
+// Keys the relayed transfer is written under: the offer and metadata by the sender, then one key per chunk,
+// and the status once the receiver is done
+const (
+	relayOfferKey    = "offer"
+	relayMetadataKey = "metadata"
+	relayStatusKey   = "status"
+	relayChunkKey    = "chunk/%d"
+)
+
+// errNotRelayed is returned by the receiver when the sender never relayed the file, there is nobody to report back to
+var errNotRelayed = errors.New("no direct connection to the sender, and the file wasn't relayed")
+
+// relaySlownessWarning is logged on both ends when a transfer falls back to the relay
+const relaySlownessWarning = "Warning: no direct connection could be made, relaying the file through the signalling server. " +
+	"This is much slower than a direct transfer, and the data is stored on the server on the way"
+
+// UseRelay sends the file through relay instead of the data channel, once the peer connection failed before the channel opened.
+// It returns false if the channel had already opened, the transfer is then past the point where it can move.
+func (s *SenderChannel) UseRelay(relay Relay) bool {
+	select {
+	case <-s.readyCh:
+		return false
+	default:
+	}
+
+	select {
+	case s.relayCh <- relay:
+	default:
+	}
+	return true
+}
+
+// sendViaRelay sends the prepared file through relay and waits for the receiver to report how it went
+func (s *SenderChannel) sendViaRelay(progressCh chan<- types.ProgressUpdate, relay Relay) error {
+	if reason := s.relayDeclined(); reason != "" {
+		if err := s.putRelayJSON(relay, relayOfferKey, types.RelayOffer{Declined: reason}); err != nil {
+			log.Printf("Error telling the receiver the file won't be relayed: %v", err)
+		}
+		return fmt.Errorf("no direct connection to the receiver, and the file can't be relayed: %s", reason)
+	}
+
+	log.Print(relaySlownessWarning)
+
+	// Send file metadata
+	s.sendMetadataPhase(progressCh)
+
+	chunkSize := s.config.Relay.ChunkSize
+	chunks := int((s.metadata.Size + int64(chunkSize) - 1) / int64(chunkSize))
+
+	// The metadata goes first, the receiver starts looking for chunks once it sees the offer
+	if err := s.putRelayJSON(relay, relayMetadataKey, s.wireMetadata(s.metadata)); err != nil {
+		return err
+	}
+	if err := s.putRelayJSON(relay, relayOfferKey, types.RelayOffer{Chunks: chunks}); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	dataCh, errCh := s.dataProcessor.StartReadingFile(func() int { return chunkSize }, stop)
+	if dataCh == nil || errCh == nil {
+		return fmt.Errorf("no file prepared for transfer")
+	}
+
+	s.stats.startTime = time.Now()
+	for n := 0; ; {
+		select {
+		case chunk, ok := <-dataCh:
+			if !ok {
+				return fmt.Errorf("file reader stopped unexpectedly")
+			}
+			if chunk.EOF {
+				if n != chunks {
+					return fmt.Errorf("file changed while relaying it: read %d chunks, offered %d", n, chunks)
+				}
+				s.stats.endTime = time.Now()
+				return s.awaitRelayStatus(relay)
+			}
+
+			if err := relay.Put(s.ctx, fmt.Sprintf(relayChunkKey, n), base64.StdEncoding.EncodeToString(chunk.Data)); err != nil {
+				return fmt.Errorf("error relaying chunk %d: %w", n, err)
+			}
+			n++
+
+			s.stats.bytes += uint64(len(chunk.Data))
+			s.reportProgress(progressCh, types.ProgressUpdate{NewBytes: uint64(len(chunk.Data)), CumulativeBytes: s.stats.offset()})
+
+		case err, ok := <-errCh:
+			if !ok {
+				// The EOF chunk may still be waiting in dataCh
+				errCh = nil
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error during file transfer: %v", err)
+			}
+
+		case <-s.ctx.Done():
+			return fmt.Errorf("file transfer cancelled: %v", s.ctx.Err())
+		}
+	}
+}
+
+// relayDeclined returns why the prepared transfer can't be relayed, or "" if it can
+func (s *SenderChannel) relayDeclined() string {
+	if s.directory {
+		return "directories are not relayed"
+	}
+	if s.encrypt {
+		return "encrypted transfers are not relayed, the session key would be stored next to the data"
+	}
+	if s.passphrase != "" {
+		return "transfers encrypted with a passphrase are not relayed"
+	}
+	if s.metadata.Size > s.config.Relay.MaxBytes {
+		return fmt.Sprintf("%s is %s, larger than the %s relay limit",
+			s.metadata.Name, utils.FormatFileSize(s.metadata.Size), utils.FormatFileSize(s.config.Relay.MaxBytes))
+	}
+	return ""
+}
+
+// awaitRelayStatus waits for the receiver to verify the relayed file
+func (s *SenderChannel) awaitRelayStatus(relay Relay) error {
+	value, err := waitForRelay(s.ctx, relay, relayStatusKey, s.config.Relay.PollIntervalMs, s.config.Relay.TimeoutMs)
+	if err != nil {
+		return fmt.Errorf("error waiting for the receiver to confirm the relayed file: %w", err)
+	}
+
+	status, err := utils.DecodeJSON[types.RelayStatus]([]byte(value))
+	if err != nil {
+		return fmt.Errorf("receiver reported an undecodable relay status: %w", err)
+	}
+	if status.Error != "" {
+		return fmt.Errorf("receiver reported an error: %s", status.Error)
+	}
+	if status.Skipped {
+		log.Printf("Receiver kept its existing copy of the file, nothing was needed")
+		s.stats.skipped = true
+	}
+
+	log.Printf("Receiver confirmed the relayed file")
+	return nil
+}
+
+// putRelayJSON writes value to the relay as JSON
+func (s *SenderChannel) putRelayJSON(relay Relay, key string, value any) error {
+	data, err := utils.EncodeJSON(value)
+	if err != nil {
+		return fmt.Errorf("error encoding relayed %s: %w", key, err)
+	}
+	if err := relay.Put(s.ctx, key, string(data)); err != nil {
+		return fmt.Errorf("error relaying %s: %w", key, err)
+	}
+	return nil
+}
+
+// ReceiveViaRelay receives the file through relay instead of the data channel, once the peer connection failed before a channel opened.
+// It blocks until the transfer is over and returns false if a channel had already opened, the transfer is then past the point
+// where it can move. The outcome is reported like that of any transfer, by WaitForCompletion and Result.
+func (r *ReceiverChannel) ReceiveViaRelay(relay Relay) bool {
+	r.mu.Lock()
+	claimed := r.dataChannel != nil
+	r.mu.Unlock()
+	if claimed {
+		return false
+	}
+
+	err := r.receiveViaRelay(relay)
+	if err != nil {
+		log.Printf("Relayed transfer failed: %v", err)
+	}
+
+	// The sender waits for the status of a file it relayed, the session it is written to is its to clear
+	if !errors.Is(err, errNotRelayed) {
+		r.mu.Lock()
+		status := types.RelayStatus{Skipped: r.stats.skipped}
+		r.mu.Unlock()
+		if err != nil {
+			status.Error = err.Error()
+		}
+
+		if data, encodeErr := utils.EncodeJSON(status); encodeErr != nil {
+			log.Printf("Error encoding relay status: %v", encodeErr)
+		} else if putErr := relay.Put(r.ctx, relayStatusKey, string(data)); putErr != nil {
+			log.Printf("Error reporting the relayed transfer to the sender: %v", putErr)
+		}
+	}
+
+	// Progress stops with the transfer, nothing may be reported after finishing it
+	r.finish(err)
+	r.dataProcessor.Close()
+	return true
+}
+
+// receiveViaRelay reads the relayed file, chunk by chunk, as the sender writes it
+func (r *ReceiverChannel) receiveViaRelay(relay Relay) error {
+	// Only the DTLS handshake proves who the sender is, the relay doesn't have one
+	if r.pinFingerprint != "" {
+		return fmt.Errorf("the pinned fingerprint can't be verified for a relayed transfer")
+	}
+
+	pollMs, timeoutMs := r.config.Relay.PollIntervalMs, r.config.Relay.TimeoutMs
+	value, err := waitForRelay(r.ctx, relay, relayOfferKey, pollMs, timeoutMs)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotRelayed, err)
+	}
+
+	offer, err := utils.DecodeJSON[types.RelayOffer]([]byte(value))
+	if err != nil {
+		return fmt.Errorf("error decoding relay offer: %w", err)
+	}
+	if offer.Declined != "" {
+		return fmt.Errorf("%w: %s", errNotRelayed, offer.Declined)
+	}
+
+	log.Print(relaySlownessWarning)
+
+	value, err = relay.Get(r.ctx, relayMetadataKey)
+	if err != nil {
+		return fmt.Errorf("error reading relayed metadata: %w", err)
+	}
+	metadata, err := r.processMetadata([]byte(value))
+	if err != nil {
+		return fmt.Errorf("error handling metadata: %w", err)
+	}
+
+	// The sender's limit may differ from ours, and the offer must add up to the file it describes
+	if metadata.Size > r.config.Relay.MaxBytes {
+		return fmt.Errorf("%s is %s, larger than the %s relay limit",
+			metadata.Name, utils.FormatFileSize(metadata.Size), utils.FormatFileSize(r.config.Relay.MaxBytes))
+	}
+	if offer.Chunks < 0 || int64(offer.Chunks) > metadata.Size {
+		return fmt.Errorf("relay offer of %d chunks doesn't fit a %d byte file", offer.Chunks, metadata.Size)
+	}
+
+	r.currentFile = metadata
+	r.fileMetadata = metadata
+	r.mu.Lock()
+	r.stats.files = 1
+	r.mu.Unlock()
+	r.reportProgress(types.ProgressUpdate{NewBytes: 0, MetaData: metadata})
+
+	skip, err := r.dataProcessor.CheckDestination(r.destPath, metadata, r.writerOpts)
+	if err != nil {
+		return err
+	}
+	if skip {
+		log.Printf("Transfer of %s skipped, existing file kept", metadata.Name)
+		r.mu.Lock()
+		r.stats.skipped = true
+		r.stats.path = r.dataProcessor.DestinationPath(r.destPath, metadata, r.writerOpts)
+		r.mu.Unlock()
+		return nil
+	}
+
+	finalPath, err := r.dataProcessor.PrepareFileForReceiving(r.destPath, metadata, 0, r.writerOpts)
+	if err != nil {
+		return fmt.Errorf("error preparing file for receiving: %w", err)
+	}
+
+	r.mu.Lock()
+	r.stats.path = finalPath
+	r.stats.startTime = time.Now()
+	r.mu.Unlock()
+
+	for n := range offer.Chunks {
+		value, err := waitForRelay(r.ctx, relay, fmt.Sprintf(relayChunkKey, n), pollMs, timeoutMs)
+		if err != nil {
+			return fmt.Errorf("error waiting for chunk %d of %d: %w", n, offer.Chunks, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("error decoding chunk %d: %w", n, err)
+		}
+
+		if err := r.dataProcessor.WriteData(data); err != nil {
+			if errors.Is(err, processor.ErrContentMismatch) {
+				if discardErr := r.dataProcessor.DiscardFile(); discardErr != nil {
+					log.Printf("Error discarding rejected file: %v", discardErr)
+				}
+			}
+			return err
+		}
+
+		r.mu.Lock()
+		r.stats.bytes += uint64(len(data))
+		offset := r.stats.offset()
+		r.mu.Unlock()
+		r.reportProgress(types.ProgressUpdate{NewBytes: uint64(len(data)), CumulativeBytes: offset})
+	}
+
+	totalBytes, err := r.dataProcessor.FinishReceiving()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.stats.endTime = time.Now()
+	r.mu.Unlock()
+
+	log.Printf("Relayed file transfer complete: %d bytes received", totalBytes)
+	return nil
+}
+
+// waitForRelay polls relay until key has been written, for up to timeoutMs
+func waitForRelay(ctx context.Context, relay Relay, key string, pollMs, timeoutMs int) (string, error) {
+	deadline := time.After(time.Duration(timeoutMs) * time.Millisecond)
+	ticker := time.NewTicker(time.Duration(pollMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		value, err := relay.Get(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		if value != "" {
+			return value, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return "", fmt.Errorf("nothing relayed under %s within %v", key, time.Duration(timeoutMs)*time.Millisecond)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
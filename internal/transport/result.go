@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"time"
+
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// transferStats accumulates what a channel observed during a transfer
+type transferStats struct {
+	path         string
+	files        int
+	bytes        uint64
+	resumedFrom  int64
+	skipped      bool
+	skippedFiles int
+	skippedBytes uint64               // Size of the directory's files the receiver already had
+	dedupedBytes uint64               // File data the receiver copied from an existing file instead of it being sent
+	mismatches   []types.TypeMismatch // Received files whose content disagrees with their declared type
+	startTime    time.Time
+	endTime      time.Time
+}
+
+// offset returns how far into the file the transfer has got, counting any resumed prefix.
+// For a directory it covers all files so far, including those the receiver already had.
+func (t *transferStats) offset() uint64 {
+	return t.skippedBytes + t.dedupedBytes + uint64(t.resumedFrom) + t.bytes
+}
+
+// result builds a TransferResult from the stats and the transferred file's metadata, with the checksum in encoding
+func (t *transferStats) result(metadata *types.FileMetadata, encoding string) *types.TransferResult {
+	result := &types.TransferResult{
+		Path:         t.path,
+		Files:        t.files,
+		Bytes:        t.bytes,
+		ResumedFrom:  t.resumedFrom,
+		Skipped:      t.skipped,
+		SkippedFiles: t.skippedFiles,
+		DedupedBytes: t.dedupedBytes,
+
+		TypeMismatches: t.mismatches,
+	}
+
+	if metadata != nil {
+		result.Name = metadata.Name
+		result.Size = metadata.Size
+		result.Checksum = utils.FormatChecksum(metadata.Checksum, encoding)
+	}
+
+	if !t.startTime.IsZero() && t.endTime.After(t.startTime) {
+		result.Duration = t.endTime.Sub(t.startTime)
+		result.BytesPerSecond = float64(t.bytes) / result.Duration.Seconds()
+	}
+
+	return result
+}
@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"yapfs/pkg/utils"
+)
+
+// How often the schedule is checked for a new rate during a transfer, and how much sending may run ahead of it
+const (
+	scheduleCheckInterval = time.Second
+	limiterBurst          = 100 * time.Millisecond
+)
+
+// RateSchedule limits the send rate depending on the local time of day, the first window containing the time applies
+type RateSchedule []RateWindow
+
+// RateWindow is a daily time span with its rate limit, it runs past midnight if End is not after Start
+type RateWindow struct {
+	Start time.Duration // Offset from midnight
+	End   time.Duration
+	Rate  int64 // Bytes per second
+}
+
+// ParseRateSchedule parses a schedule like "09:00-17:00=1MB,17:00-09:00=10MB", rates in bytes per second with an
+// optional KB, MB or GB suffix
+func ParseRateSchedule(spec string) (RateSchedule, error) {
+	var schedule RateSchedule
+	for _, entry := range strings.Split(spec, ",") {
+		span, rate, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("schedule entry %q is not start-end=rate", entry)
+		}
+		from, to, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("schedule entry %q is not start-end=rate", entry)
+		}
+
+		var window RateWindow
+		var err error
+		if window.Start, err = parseTimeOfDay(from); err != nil {
+			return nil, err
+		}
+		if window.End, err = parseTimeOfDay(to); err != nil {
+			return nil, err
+		}
+		if window.Rate, err = parseRate(rate); err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, window)
+	}
+	return schedule, nil
+}
+
+// parseTimeOfDay parses HH:MM into its offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseRate parses a rate like 500KB or 10MB, in bytes per second
+func parseRate(rate string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(rate))
+	multiplier := int64(1)
+	for suffix, size := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			s, multiplier = number, size
+			break
+		}
+	}
+	s = strings.TrimSuffix(s, "B")
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected a positive size like 500KB or 10MB", rate)
+	}
+	return max(int64(value*float64(multiplier)), 1), nil
+}
+
+// RateAt returns the rate limit in force at t, 0 if no window contains it
+func (s RateSchedule) RateAt(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	for _, window := range s {
+		if window.contains(offset) {
+			return window.Rate
+		}
+	}
+	return 0
+}
+
+// contains reports whether offset from midnight falls in the window
+func (w RateWindow) contains(offset time.Duration) bool {
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// rateLimiter is a token bucket whose rate follows a schedule, checked again every scheduleCheckInterval
+type rateLimiter struct {
+	schedule RateSchedule
+	rate     int64     // Current limit in bytes per second, 0 for none
+	checked  time.Time // When the schedule was last checked
+	tokens   float64   // Bytes that may be sent right away
+	filled   time.Time // When tokens was last topped up
+}
+
+// newRateLimiter creates a limiter following schedule
+func newRateLimiter(schedule RateSchedule) *rateLimiter {
+	return &rateLimiter{schedule: schedule}
+}
+
+// wait blocks until n more bytes may be sent, or ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	if now.Sub(l.checked) >= scheduleCheckInterval {
+		l.checked = now
+		if rate := l.schedule.RateAt(now); rate != l.rate {
+			if rate == 0 {
+				log.Printf("Send rate no longer limited, outside the schedule")
+			} else {
+				log.Printf("Send rate limited to %s/s by the schedule", utils.FormatFileSize(rate))
+			}
+			l.rate, l.tokens, l.filled = rate, 0, now
+		}
+	}
+	if l.rate == 0 {
+		return nil
+	}
+
+	// Top up for the time passed, a chunk larger than the burst still gets through once enough has built up
+	burst := max(float64(l.rate)*limiterBurst.Seconds(), float64(n))
+	l.tokens = min(l.tokens+now.Sub(l.filled).Seconds()*float64(l.rate), burst)
+	l.filled = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return nil
+	}
+
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,8 +2,11 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"yapfs/internal/config"
@@ -14,15 +17,72 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// ErrPeerUnreachable is returned when data queued for the peer stops draining without the connection reporting an error
+var ErrPeerUnreachable = errors.New("peer appears unreachable")
+
+// ErrClosedBeforeEOF is returned when the data channel closed before the end of a file could be sent, the receiver
+// has all of the file's data but never learns it's complete
+var ErrClosedBeforeEOF = errors.New("data channel closed before the end of the file was sent")
+
 // SenderChannel manages data channel operations for sending files
 type SenderChannel struct {
 	ctx             context.Context
+	peerConn        *webrtc.PeerConnection
+	label           string
 	config          *config.Config
 	dataChannel     *webrtc.DataChannel
+	outbound        messageSender   // Sends to the peer, the data channel itself unless a test wrapped it
+	wrapOutbound    outboundWrapper // Set by tests to impair the link, nil in normal use
 	dataProcessor   *processor.DataProcessor
+	dispatcher      *messageDispatcher
+	syncProgress    bool
+	followSymlinks  bool
+	selfCheck       bool
+	chunkSize       int                        // Chunk size agreed with the receiver
+	chunkLimit      atomic.Int64               // Smallest chunk size the receiver asked for with RECONFIGURE, 0 if it never asked
+	directory       bool                       // A directory is being sent, metadata then describes the whole directory
+	files           []processor.DirectoryEntry // Files of the directory being sent
+	stats           transferStats
+	drainRate       float64      // Estimated bytes per second the send buffer drains at, 0 until measured
+	rate            *rateMeter   // Throughput reported with progress updates
+	encrypt         bool         // File data is encrypted with a session key
+	passphrase      string       // File data is encrypted with a key derived from this, empty for none
+	compress        bool         // Files that compress well have their data compressed on the wire
+	compressedIn    int64        // File data compressed since the last TRANSFER_START
+	compressedOut   int64        // What compressedIn took on the wire
+	identity        string       // Name sent to the receiver before the transfer, empty to send none
+	limiter         *rateLimiter // Holds file data back to the scheduled rate, nil when not limited
+	nice            *niceLimiter // Paces file data to yield to other traffic, nil unless sending in nice mode
+	follow          *followState // Checksums of the file followed as it grows, nil when not following
+	onMetadata      func(*types.FileMetadata)
+	compressor      *chunkCompressor    // Compresses file data when compress is set
+	cipher          chunkCipher         // Encrypts file data with the current receiver's session key or passphrase key, nil when not encrypting
 	metadata        *types.FileMetadata // TODO: remove this
+	tags            map[string]string   // Key=value tags sent in every file's metadata, nil for none
 	bufferControlCh chan struct{}       // Signals when WebRTC buffer is ready for more data (flow control)
 	readyCh         chan struct{}       // Signals when data channel is open and ready for file transfer
+	closedCh        chan struct{}       // Closed once the data channel has closed, nothing sent after that can arrive
+	fileStart       int64               // Offset the current file's transfer started from, past what the receiver held before this run
+	filePos         int64               // How far into the current file sending has got
+	bytesRead       int64               // File data read since the last TRANSFER_START, reported in EOF
+	bytesSent       int64               // File data sent since the last TRANSFER_START, reported in EOF
+	currentFile     *types.FileMetadata // File currently being sent, progress updates are tagged with it
+	fileIndex       int                 // Position of currentFile among the files being sent
+	dedupHashes     map[string]bool     // Chunks of the receiver's existing copy of the current file, nil to send it all
+	dedupRefs       []dedupRef          // Chunks of the current file sent as references
+	ackCh           chan types.MetadataAck
+	remoteErrCh     chan error    // Signals a fatal error reported by the receiver
+	sessionEndCh    chan struct{} // Signals the receiver has handled everything sent before SESSION_END
+	handoffCh       chan struct{} // Signals the app that the receiver handed the transfer off
+	handedOverCh    chan struct{} // Signals the transfer goroutine that HandOver attached a channel to the next receiver
+	relayCh         chan Relay    // Hands over the relay to send through when the peer connection failed before the channel opened
+	transferErr     error         // Error that ended the last transfer, valid once the progress channel is closed
+}
+
+// dedupRef is a chunk of the current file the receiver copied from its existing file
+type dedupRef struct {
+	pos  int64 // Offset of the chunk in the file
+	size int64
 }
 
 // NewSenderChannel creates a new data channel sender
@@ -31,59 +91,288 @@ func NewSenderChannel(cfg *config.Config) *SenderChannel {
 		config:          cfg,
 		dataProcessor:   processor.NewDataProcessor(),
 		bufferControlCh: make(chan struct{}),
-		readyCh:         make(chan struct{}),
+		ackCh:           make(chan types.MetadataAck, 1),
+		remoteErrCh:     make(chan error, 1),
+		sessionEndCh:    make(chan struct{}, 1),
+		handoffCh:       make(chan struct{}, 1),
+		handedOverCh:    make(chan struct{}, 1),
+		relayCh:         make(chan Relay, 1),
+		rate:            newRateMeter(time.Duration(cfg.RateWindowMs) * time.Millisecond),
 	}
 }
 
+// SendOptions configures what is sent and how
+type SendOptions struct {
+	FilePath       string // Path to the file to send
+	FollowSymlinks bool   // Send a symlink's target contents, otherwise the link itself is recreated on the receiver
+	SelfCheck      bool   // Read every file a second time and abort if its checksum changed, before sending it
+	Encrypt        bool   // Encrypt file data with a random key sent to the receiver before the transfer starts
+	Passphrase     string // Encrypt file data with a key derived from this, the receiver needs the same passphrase; not with Encrypt
+	Identity       string // Name to identify as to the receiver, empty to send none
+	Resume         bool   // Cache checkpoints of what was sent, so a restarted sender confirms a partial file quickly
+	SyncProgress   bool   // Deliver every progress update, blocking the transfer while the consumer is busy
+	Schedule       string // Send rate limits by time of day, see ParseRateSchedule, empty for no limit
+	ChecksumSample int64  // Only checksum this many bytes at each end of files more than twice as long, 0 to hash them whole
+	Follow         bool   // Keep sending data appended to the file, like tail -f, until StopFollowing is closed
+	Compress       bool   // Compress the data of files whose start compresses well, others are sent raw
+	CompressAlgo   string // Algorithm to compress with, see ParseCompressAlgo; empty is gzip
+	CompressLevel  string // Level to compress at, see ParseCompressLevel; empty is the fastest
+	HashWorkers    int    // Checksum this many files of a directory at once before sending any, 1 or less checksums each as it is sent
+	Order          string // Sequence the files of a directory are sent in, see processor.SendOrder; empty sends them as listed
+	Nice           bool   // Send in small chunks, backing off when the round trip time rises so other traffic goes first
+
+	// Include and Exclude pick the files of a directory to send by glob pattern, see processor.DirectoryFilter
+	Include []string
+	Exclude []string
+
+	// Tags are key=value pairs sent in the metadata of every file, nil for none
+	Tags map[string]string
+
+	// StopFollowing is closed to end a followed file with what has been appended to it so far
+	StopFollowing <-chan struct{}
+
+	// OnMetadata, when set, is called with the transfer's metadata instead of it arriving as a zero-byte progress update,
+	// and progress updates without new bytes are left out. It is called from the transfer goroutine and must not block.
+	OnMetadata func(metadata *types.FileMetadata)
+}
+
 // CreateFileSenderDataChannel creates a data channel configured for sending files and initializes everything needed for transfer
-func (s *SenderChannel) CreateFileSenderDataChannel(ctx context.Context, peerConn *webrtc.PeerConnection, label string, filePath string) error {
+func (s *SenderChannel) CreateFileSenderDataChannel(ctx context.Context, peerConn *webrtc.PeerConnection, label string, opts SendOptions) error {
+	if opts.Encrypt && opts.Passphrase != "" {
+		return ErrEncryptWithPassphrase
+	}
+	compressAlgo, err := ParseCompressAlgo(opts.CompressAlgo)
+	if err != nil {
+		return err
+	}
+	compressLevel, err := ParseCompressLevel(opts.CompressLevel)
+	if err != nil {
+		return err
+	}
+	compressor, err := newChunkCompressor(compressAlgo, compressLevel)
+	if err != nil {
+		return err
+	}
+
 	s.ctx = ctx
+	s.peerConn = peerConn
+	s.label = label
+	s.syncProgress = opts.SyncProgress
+	s.followSymlinks = opts.FollowSymlinks
+	s.selfCheck = opts.SelfCheck
+	s.encrypt = opts.Encrypt
+	s.passphrase = opts.Passphrase
+	s.compress = opts.Compress
+	s.compressor = compressor
+	s.identity = opts.Identity
+	s.tags = opts.Tags
+	s.onMetadata = opts.OnMetadata
+	s.stats = transferStats{path: opts.FilePath, files: 1}
+
+	if opts.Schedule != "" {
+		schedule, err := ParseRateSchedule(opts.Schedule)
+		if err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+		s.limiter = newRateLimiter(schedule)
+	}
+	if opts.Nice {
+		s.nice = newNiceLimiter(func() time.Duration { return sctpRoundTripTime(s.peerConn) })
+	}
+
+	s.dataProcessor.SetChecksumSample(opts.ChecksumSample)
+	s.dataProcessor.SetReadSize(s.config.WebRTC.ReadSize)
+	s.dataProcessor.SetReadAhead(s.config.WebRTC.ReadAhead)
+
+	if opts.Resume {
+		dir, err := processor.DefaultResumeCacheDir()
+		if err != nil {
+			return err
+		}
+		cache, err := processor.NewResumeCache(dir)
+		if err != nil {
+			return err
+		}
+		s.dataProcessor.SetResumeCache(cache)
+	}
+
+	dataChannel, err := s.createChannel()
+	if err != nil {
+		return err
+	}
+	s.attachChannel(dataChannel)
+
+	// Prepare file for sending and get metadata, the files of a directory are prepared one at a time while sending
+	s.directory, err = s.dataProcessor.IsDirectory(opts.FilePath, opts.FollowSymlinks)
+	if err != nil {
+		return fmt.Errorf("failed to prepare file for sending: %w", err)
+	}
+	if !s.directory && (len(opts.Include) > 0 || len(opts.Exclude) > 0) {
+		return fmt.Errorf("include and exclude patterns pick the files of a directory, %s is a file", opts.FilePath)
+	}
+	if opts.Follow {
+		if s.directory {
+			return fmt.Errorf("a directory can't be followed, only a file")
+		}
+		s.metadata, err = s.dataProcessor.PrepareFileForFollowing(opts.FilePath, opts.StopFollowing)
+		if err != nil {
+			return fmt.Errorf("failed to prepare file for following: %w", err)
+		}
+		log.Printf("Following %s, data appended to it is sent until stopped", opts.FilePath)
+	} else if s.directory {
+		s.files, s.metadata, err = s.dataProcessor.PrepareDirectoryForSending(opts.FilePath, opts.FollowSymlinks, processor.DirectoryFilter{
+			Include: opts.Include,
+			Exclude: opts.Exclude,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to prepare directory for sending: %w", err)
+		}
+		s.stats.files = len(s.files)
+		processor.SortDirectoryEntries(s.files, processor.SendOrder(opts.Order))
+		if opts.HashWorkers > 1 {
+			if err := s.dataProcessor.HashFiles(s.files, opts.HashWorkers, opts.FollowSymlinks); err != nil {
+				return fmt.Errorf("failed to prepare directory for sending: %w", err)
+			}
+		}
+	} else {
+		s.metadata, err = s.dataProcessor.PrepareFileForSending(opts.FilePath, opts.FollowSymlinks)
+		if err != nil {
+			return fmt.Errorf("failed to prepare file for sending: %w", err)
+		}
+		if s.selfCheck {
+			if err := s.dataProcessor.SelfCheck(s.metadata); err != nil {
+				return fmt.Errorf("self-check failed: %w", err)
+			}
+		}
+	}
 
+	return nil
+}
+
+// createChannel creates the ordered data channel file data is sent on
+func (s *SenderChannel) createChannel() (*webrtc.DataChannel, error) {
 	ordered := true
 
 	options := &webrtc.DataChannelInit{
 		Ordered: &ordered,
 	}
 
-	dataChannel, err := peerConn.CreateDataChannel(label, options)
+	dataChannel, err := s.peerConn.CreateDataChannel(s.label, options)
 	if err != nil {
-		return fmt.Errorf("failed to create file data channel: %w", err)
+		return nil, fmt.Errorf("failed to create file data channel: %w", err)
 	}
 
-	s.dataChannel = dataChannel
+	return dataChannel, nil
+}
 
-	// Prepare file for sending and get metadata
-	s.metadata, err = s.dataProcessor.PrepareFileForSending(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to prepare file for sending: %w", err)
-	}
+// attachChannel makes dataChannel the one the transfer runs on, each channel gets its own handlers and signals.
+// The reader stops with the send loop, so closing a channel leaves the prepared file in place for a reconnect.
+func (s *SenderChannel) attachChannel(dataChannel *webrtc.DataChannel) {
+	readyCh := make(chan struct{})
+	closedCh := make(chan struct{})
+	var closeOnce sync.Once
+
+	// File data stays ordered, other control messages are handled concurrently
+	dispatcher := newMessageDispatcher(s.config.WebRTC.ControlMessageConcurrency, s.handleMessage)
+	outbound := newOutbound(s.wrapOutbound, dataChannel)
+
+	s.dataChannel = dataChannel
+	s.outbound = outbound
+	s.dispatcher = dispatcher
+	s.readyCh, s.closedCh = readyCh, closedCh
 
 	// OnOpen sets an event handler which is invoked when the underlying data transport has been established (or re-established).
-	s.dataChannel.OnOpen(func() {
-		log.Printf("File data channel opened: %s-%d", s.dataChannel.Label(), s.dataChannel.ID())
-		close(s.readyCh)
+	dataChannel.OnOpen(func() {
+		log.Printf("File data channel opened: %s-%d", dataChannel.Label(), dataChannel.ID())
+		close(readyCh)
 	})
 
 	// Set up flow control
-	s.dataChannel.SetBufferedAmountLowThreshold(s.config.WebRTC.BufferedAmountLowThreshold)
-	s.dataChannel.OnBufferedAmountLow(func() {
+	dataChannel.SetBufferedAmountLowThreshold(s.config.WebRTC.BufferedAmountLowThreshold)
+	dataChannel.OnBufferedAmountLow(func() {
 		select {
 		case s.bufferControlCh <- struct{}{}:
 		default:
 		}
 	})
 
-	s.dataChannel.OnClose(func() {
+	dataChannel.OnMessage(dispatcher.dispatch)
+
+	if s.config.WebRTC.BufferWatchdogMs > 0 {
+		go s.watchBuffer(dataChannel, closedCh)
+	}
+
+	// Handlers are done once closedCh is closed, a replacement channel can take over from there
+	dataChannel.OnClose(func() {
 		log.Printf("File transfer data channel closed")
-		s.dataProcessor.Close()
+		dispatcher.close()
+		closeOutbound(outbound)
+		closeOnce.Do(func() { close(closedCh) })
 	})
 
-	s.dataChannel.OnError(func(err error) {
+	dataChannel.OnError(func(err error) {
 		log.Printf("File transfer data channel error: %v", err)
-		s.dataProcessor.Close()
+		dispatcher.close()
 	})
+}
 
-	return nil
+// reconnect replaces a data channel lost mid-transfer with a new one on the same peer connection.
+// Only the channel can be replaced, a failed peer connection would need signalling again.
+func (s *SenderChannel) reconnect() error {
+	timeout := time.Duration(s.config.WebRTC.ReconnectTimeoutMs) * time.Millisecond
+
+	// The old channel's handlers must be done before the new channel's take over
+	select {
+	case <-s.closedCh:
+	default:
+		s.dataChannel.Close()
+		select {
+		case <-s.closedCh:
+		case <-time.After(timeout):
+			return fmt.Errorf("lost data channel did not close within %v", timeout)
+		}
+	}
+
+	if state := s.peerConn.ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+		return fmt.Errorf("peer connection is %s, a new data channel cannot be opened", state)
+	}
+
+	dataChannel, err := s.createChannel()
+	if err != nil {
+		return err
+	}
+	s.attachChannel(dataChannel)
+
+	// An ACK the old channel delivered belongs to a negotiation that is being redone
+	select {
+	case <-s.ackCh:
+	default:
+	}
+
+	select {
+	case <-s.readyCh:
+		log.Printf("Data channel reopened, resuming transfer")
+		return nil
+	case <-s.closedCh:
+		return fmt.Errorf("new data channel closed before opening")
+	case <-s.ctx.Done():
+		return fmt.Errorf("cancelled while reopening data channel: %v", s.ctx.Err())
+	case <-time.After(timeout):
+		s.dataChannel.Close()
+		return fmt.Errorf("new data channel did not open within %v", timeout)
+	}
+}
+
+// channelLost reports whether the data channel has closed or is closing, rather than the transfer failing on its own
+func (s *SenderChannel) channelLost() bool {
+	select {
+	case <-s.closedCh:
+		return true
+	default:
+	}
+
+	state := s.dataChannel.ReadyState()
+	return state == webrtc.DataChannelStateClosing || state == webrtc.DataChannelStateClosed
 }
 
 // SendFile performs a non-blocking file transfer, returns progress channel immediately
@@ -94,62 +383,558 @@ func (s *SenderChannel) SendFile() (<-chan types.ProgressUpdate, error) {
 	go func() {
 		defer close(progressCh)
 
-		// Wait for data channel to be ready
-		select {
-		case <-s.readyCh:
-			log.Printf("Data channel ready, starting file transfer")
-		case <-s.ctx.Done():
-			log.Printf("Cancelled while waiting for data channel: %v", s.ctx.Err())
-			return
+		// A handed off transfer starts over with the next receiver, which resumes from whatever it can reach
+		for {
+			err := s.transfer(progressCh)
+			if !errors.Is(err, ErrHandedOff) {
+				s.transferErr = err
+				return
+			}
+
+			if err := s.awaitReceiver(); err != nil {
+				s.transferErr = err
+				return
+			}
 		}
+	}()
 
-		// Send file metadata
-		if err := s.sendMetadataPhase(progressCh); err != nil {
-			log.Printf("Error sending metadata: %v", err)
-			return
+	return progressCh, nil
+}
+
+// transfer runs the whole transfer on the current data channel once it opens
+func (s *SenderChannel) transfer(progressCh chan<- types.ProgressUpdate) error {
+	// Wait for data channel to be ready
+	select {
+	case <-s.readyCh:
+		log.Printf("Data channel ready, starting file transfer")
+	case relay := <-s.relayCh:
+		return s.sendViaRelay(progressCh, relay)
+	case <-s.closedCh:
+		return fmt.Errorf("data channel closed before the transfer started")
+	case <-s.ctx.Done():
+		log.Printf("Cancelled while waiting for data channel: %v", s.ctx.Err())
+		return nil
+	}
+
+	// The receiver may only accept certain senders, it checks before anything else arrives
+	if s.identity != "" {
+		if err := s.sendControlMessage(MSG_IDENTITY, types.Identity{Name: s.identity}); err != nil {
+			return fmt.Errorf("error sending identity: %w", err)
+		}
+	}
+
+	if s.encrypt {
+		if err := s.sendSessionKey(); err != nil {
+			return err
+		}
+	}
+	if s.passphrase != "" {
+		if err := s.usePassphrase(); err != nil {
+			return err
 		}
+	}
+
+	if s.directory {
+		if err := s.sendDirectoryPhase(progressCh); err != nil {
+			log.Printf("Error sending directory: %v", err)
+			return err
+		}
+		return nil
+	}
+
+	// Send file metadata
+	s.sendMetadataPhase(progressCh)
+
+	skip, err := s.transferFile(progressCh, s.metadata)
+	if err != nil {
+		log.Printf("Error during file transfer: %v", err)
+		return err
+	}
+	if skip {
+		log.Printf("Receiver kept its existing copy of the file, nothing to send")
+		s.stats.skipped = true
+		s.dataProcessor.ForgetSent()
+		return nil
+	}
+
+	if err := s.closeSession(); err != nil {
+		log.Printf("Error ending session: %v", err)
+		return err
+	}
+	s.dataProcessor.ForgetSent()
+	return nil
+}
+
+// awaitReceiver lets the app know the receiver handed the transfer off and waits for HandOver to connect the next one.
+// Stats start over, they describe what the receiver that completes the transfer got.
+func (s *SenderChannel) awaitReceiver() error {
+	log.Printf("Receiver handed the transfer off, waiting for another receiver to take it over")
+
+	select {
+	case s.handoffCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-s.handedOverCh:
+	case <-s.ctx.Done():
+		return fmt.Errorf("cancelled while waiting for a receiver to take over: %v", s.ctx.Err())
+	}
+
+	// Nothing the previous receiver sent applies to the next one
+	select {
+	case <-s.ackCh:
+	default:
+	}
+	select {
+	case <-s.remoteErrCh:
+	default:
+	}
+	select {
+	case <-s.sessionEndCh:
+	default:
+	}
+
+	s.stats = transferStats{path: s.stats.path, files: s.stats.files}
+	return nil
+}
+
+// HandoffRequested signals each time the receiver hands the transfer off
+func (s *SenderChannel) HandoffRequested() <-chan struct{} {
+	return s.handoffCh
+}
+
+// HandOver opens a data channel on peerConn, a connection to the receiver taking over a handed off transfer.
+// It has to be called before signalling on peerConn so the offer carries the channel.
+func (s *SenderChannel) HandOver(peerConn *webrtc.PeerConnection) error {
+	s.peerConn = peerConn
+	dataChannel, err := s.createChannel()
+	if err != nil {
+		return err
+	}
+	s.attachChannel(dataChannel)
 
-		// Start file data transfer
-		if err := s.sendFileDataPhase(progressCh); err != nil {
-			log.Printf("Error during file transfer: %v", err)
+	select {
+	case s.handedOverCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Metadata returns the metadata of the file prepared for sending
+func (s *SenderChannel) Metadata() *types.FileMetadata {
+	return s.metadata
+}
+
+// Result returns a summary of the last transfer.
+// It is only valid after the progress channel returned by SendFile has been closed.
+func (s *SenderChannel) Result() *types.TransferResult {
+	return s.stats.result(s.metadata, s.config.ChecksumEncoding)
+}
+
+// Err returns the error that ended the last transfer, if any.
+// It is only valid after the progress channel returned by SendFile has been closed.
+func (s *SenderChannel) Err() error {
+	return s.transferErr
+}
+
+// handleMessage dispatches control messages received from the receiver
+func (s *SenderChannel) handleMessage(msg webrtc.DataChannelMessage) {
+	if !msg.IsString {
+		repeatLog.Printf("Received unexpected binary message from receiver, ignoring")
+		return
+	}
+
+	msgType, payload := parseControlMessage(msg.Data)
+	switch msgType {
+	case MSG_METADATA_ACK:
+		ack, err := utils.DecodeJSON[types.MetadataAck](payload)
+		if err != nil {
+			s.reportRemoteError(fmt.Errorf("error decoding metadata ack: %w", err))
 			return
 		}
-	}()
+		select {
+		case s.ackCh <- ack:
+		default:
+			log.Printf("Received duplicate metadata ack, ignoring")
+		}
+	case MSG_DEDUP_INDEX:
+		s.handleDedupIndex(payload)
+	case MSG_SESSION_END:
+		select {
+		case s.sessionEndCh <- struct{}{}:
+		default:
+		}
+	case MSG_RECONFIGURE:
+		s.handleReconfigure(payload)
+	case MSG_HANDOFF:
+		s.reportRemoteError(ErrHandedOff)
+	case MSG_PING:
+		if err := s.outbound.SendText(pongMessage(payload)); err != nil {
+			repeatLog.Printf("Error answering ping: %v", err)
+		}
+	case MSG_PONG:
+		// Nothing waits on pongs yet, receiving one is enough to know the receiver is alive
+	case MSG_ERROR:
+		errMsg, err := utils.DecodeJSON[types.ErrorMessage](payload)
+		if err != nil {
+			s.reportRemoteError(fmt.Errorf("receiver reported an undecodable error: %w", err))
+			return
+		}
+		s.reportRemoteError(fmt.Errorf("receiver reported an error: %s", errMsg.Message))
+	default:
+		repeatLog.Printf("Received unknown control message: %s", msgType)
+	}
+}
 
-	return progressCh, nil
+// reportRemoteError hands an error reported by the receiver to the transfer goroutine
+func (s *SenderChannel) reportRemoteError(err error) {
+	select {
+	case s.remoteErrCh <- err:
+	default:
+	}
 }
 
-// sendMetadataPhase handles sending file metadata
-func (s *SenderChannel) sendMetadataPhase(progressCh chan<- types.ProgressUpdate) error {
-	// Send initial progress with metadata (non-blocking)
-	progressCh <- types.ProgressUpdate{
-		NewBytes: 0,
-		MetaData: s.metadata,
+// Stop tells the receiver the transfer ends with err, so it doesn't wait for the sender to reconnect once the connection closes.
+// The channel is then closed, which only happens after what was queued on it has been sent.
+func (s *SenderChannel) Stop(err error) {
+	if s.outbound == nil || s.channelLost() {
+		return
+	}
+	if sendErr := s.sendControlMessage(MSG_ERROR, types.ErrorMessage{Message: err.Error()}); sendErr != nil {
+		log.Printf("Error reporting failure to receiver: %v", sendErr)
+		return
 	}
 
-	metadataBytes, err := utils.EncodeJSON(s.metadata)
+	closed := make(chan struct{})
+	go func() {
+		s.dataChannel.GracefulClose()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Duration(s.config.WebRTC.SessionEndTimeoutMs) * time.Millisecond):
+	}
+}
+
+// sendControlMessage sends a control message with an optional payload to the receiver
+func (s *SenderChannel) sendControlMessage(msgType string, payload any) error {
+	msg, err := encodeControlMessage(msgType, payload)
 	if err != nil {
-		return fmt.Errorf("error encoding file metadata: %w", err)
+		return err
 	}
 
-	// Send metadata with "METADATA:" prefix
-	metadataMsg := append([]byte("METADATA:"), metadataBytes...)
-	err = s.dataChannel.Send(metadataMsg)
+	return s.outbound.SendText(msg)
+}
+
+// sendSessionKey generates a key for this receiver and sends it ahead of everything else, file data is encrypted with it from then on
+func (s *SenderChannel) sendSessionKey() error {
+	key, err := newSessionKey()
 	if err != nil {
-		return fmt.Errorf("error sending metadata: %w", err)
+		return err
+	}
+	cipher, err := newSessionCipher(key)
+	if err != nil {
+		return err
 	}
 
+	if err := s.sendControlMessage(MSG_SESSION_KEY, types.SessionKey{Key: key}); err != nil {
+		return fmt.Errorf("error sending session key: %w", err)
+	}
+	s.cipher = cipher
+
+	log.Printf("Encrypting file data with a session key")
 	return nil
 }
 
+// usePassphrase derives a key from the passphrase under a new salt, file data is encrypted with it from then on.
+// The salt goes to the receiver in each file's metadata, the key itself is never sent.
+func (s *SenderChannel) usePassphrase() error {
+	salt, err := newPassphraseSalt()
+	if err != nil {
+		return err
+	}
+	cipher, err := newPassphraseCipher(s.passphrase, salt)
+	if err != nil {
+		return err
+	}
+	s.cipher = cipher
+
+	log.Printf("Encrypting file data with the passphrase")
+	return nil
+}
+
+// sendMetadataPhase reports the file's metadata to the progress consumer, transferFile sends it to the receiver
+func (s *SenderChannel) sendMetadataPhase(progressCh chan<- types.ProgressUpdate) {
+	s.currentFile, s.fileIndex = s.metadata, 0
+	s.reportMetadata(progressCh)
+
+	// Advertise our preferred chunk size, the receiver answers with the largest it accepts
+	s.metadata.ChunkSize = s.config.WebRTC.ChunkSize
+}
+
+// transferFile sends the prepared file's metadata, negotiates where to start and sends its data.
+// If the data channel is lost on the way, a new one is opened and the file is negotiated again,
+// so it continues from what the receiver holds. It returns true if the receiver skipped the file.
+func (s *SenderChannel) transferFile(progressCh chan<- types.ProgressUpdate, metadata *types.FileMetadata) (bool, error) {
+	s.fileStart, s.filePos = 0, 0
+	s.dedupRefs = nil
+	if err := s.chooseCompression(metadata); err != nil {
+		return false, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		skip, err := s.attemptFile(progressCh, metadata, attempt > 0)
+		if err == nil || errors.Is(err, ErrHandedOff) || !s.channelLost() || attempt >= s.config.WebRTC.ReconnectAttempts {
+			return skip, err
+		}
+
+		// What a followed file held when the channel was lost is gone from the reader, it can't be negotiated again
+		if metadata.Follow {
+			return false, fmt.Errorf("%w, a followed file can't continue on a new data channel", err)
+		}
+
+		log.Printf("Data channel lost while sending %s (%v), reconnecting (attempt %d of %d)",
+			metadata.Name, err, attempt+1, s.config.WebRTC.ReconnectAttempts)
+		if reconnectErr := s.reconnect(); reconnectErr != nil {
+			return false, fmt.Errorf("%w (reconnecting failed: %v)", err, reconnectErr)
+		}
+	}
+}
+
+// attemptFile makes one attempt at transferFile on the current data channel, rejoin is set after a reconnect
+func (s *SenderChannel) attemptFile(progressCh chan<- types.ProgressUpdate, metadata *types.FileMetadata, rejoin bool) (bool, error) {
+	// The receiver may list chunks it holds before acking, they are only good for this file
+	s.dedupHashes = make(map[string]bool)
+	if err := s.sendControlMessage(MSG_METADATA, s.wireMetadata(metadata)); err != nil {
+		return false, fmt.Errorf("error sending metadata: %w", err)
+	}
+
+	// Wait for the receiver to accept the metadata and agree on where to start
+	skip, err := s.negotiateStartPhase(progressCh, rejoin)
+	if err != nil || skip {
+		return skip, err
+	}
+
+	return false, s.sendFileDataPhase(progressCh)
+}
+
+// wireMetadata returns the metadata as sent to the receiver, with the checksum in the configured encoding
+func (s *SenderChannel) wireMetadata(metadata *types.FileMetadata) types.FileMetadata {
+	wire := *metadata
+	wire.Checksum = utils.FormatChecksum(metadata.Checksum, s.config.ChecksumEncoding)
+	wire.Tags = s.tags
+	if cipher, ok := s.cipher.(*passphraseCipher); ok {
+		wire.PassphraseSalt = cipher.salt
+	}
+	return wire
+}
+
+// negotiateStartPhase waits for the receiver's metadata ACK and seeks past any data it already holds
+// It returns true if the receiver chose to skip the file. rejoin is set when negotiating again after a reconnect.
+func (s *SenderChannel) negotiateStartPhase(progressCh chan<- types.ProgressUpdate, rejoin bool) (bool, error) {
+	var ack types.MetadataAck
+
+	select {
+	case ack = <-s.ackCh:
+	case err := <-s.remoteErrCh:
+		return false, err
+	case <-s.closedCh:
+		return false, fmt.Errorf("data channel closed while waiting for metadata ack")
+	case <-s.ctx.Done():
+		return false, fmt.Errorf("cancelled while waiting for metadata ack: %v", s.ctx.Err())
+	}
+
+	if ack.Skip {
+		return true, nil
+	}
+
+	var offset int64
+	if ack.ResumeOffset > 0 && s.currentFile.Follow {
+		log.Printf("Receiver offered to resume a followed file, sending it from the start")
+	} else if ack.ResumeOffset > 0 {
+		// Only resume if the receiver's partial file really is a prefix of ours
+		matched, err := s.dataProcessor.IsPrefixMatched(ack.ResumeOffset, ack.PrefixChecksum)
+		if err != nil {
+			return false, fmt.Errorf("error verifying receiver's partial file: %w", err)
+		}
+
+		if matched {
+			if err := s.dataProcessor.SeekTo(ack.ResumeOffset); err != nil {
+				return false, fmt.Errorf("error seeking to resume offset: %w", err)
+			}
+			offset = ack.ResumeOffset
+			log.Printf("Receiver already has %d bytes, resuming transfer", offset)
+		} else {
+			log.Printf("Receiver's partial file does not match, sending the whole file")
+		}
+	}
+
+	// Chunks the receiver holds can be referenced instead of sent, unless resuming makes what it holds part of the file already
+	if !ack.Dedup || offset > 0 || len(s.dedupHashes) == 0 {
+		s.dedupHashes = nil
+	} else {
+		log.Printf("Receiver holds %d chunks of an existing copy, sending the file in content-defined chunks", len(s.dedupHashes))
+	}
+
+	// Use the smaller of our chunk size and the receiver's limit
+	s.chunkSize = s.config.WebRTC.ChunkSize
+	if ack.MaxChunkSize > 0 && ack.MaxChunkSize < config.MinChunkSize {
+		return false, fmt.Errorf("receiver accepts chunks of at most %d bytes, below the minimum of %d bytes", ack.MaxChunkSize, config.MinChunkSize)
+	}
+	if ack.MaxChunkSize > 0 && ack.MaxChunkSize < s.chunkSize {
+		log.Printf("Receiver accepts chunks of at most %d bytes, reducing chunk size from %d", ack.MaxChunkSize, s.chunkSize)
+		s.chunkSize = ack.MaxChunkSize
+	}
+	if limit := int(s.chunkLimit.Load()); limit > 0 && limit < s.chunkSize {
+		log.Printf("Receiver asked for chunks of at most %d bytes earlier, reducing chunk size from %d", limit, s.chunkSize)
+		s.chunkSize = limit
+	}
+	if s.nice != nil && s.chunkSize > niceChunkSize {
+		log.Printf("Nice mode, reducing chunk size from %d to %d", s.chunkSize, niceChunkSize)
+		s.chunkSize = niceChunkSize
+	}
+
+	if err := s.sendControlMessage(MSG_TRANSFER_START, types.TransferStart{Offset: offset, ChunkSize: s.chunkSize}); err != nil {
+		return false, fmt.Errorf("error sending transfer start: %w", err)
+	}
+	s.dataProcessor.TrackSent(offset)
+
+	s.follow = nil
+	if s.currentFile.Follow {
+		s.follow = newFollowState()
+	}
+
+	if rejoin {
+		s.rejoinStats(progressCh, offset)
+		return false, nil
+	}
+
+	s.stats.resumedFrom += offset
+	s.fileStart, s.filePos = offset, offset
+	if s.stats.startTime.IsZero() {
+		s.stats.startTime = time.Now()
+	}
+
+	// Account for the bytes the receiver already holds
+	if offset > 0 {
+		s.reportProgress(progressCh, types.ProgressUpdate{NewBytes: uint64(offset), CumulativeBytes: s.stats.offset()})
+	}
+
+	return false, nil
+}
+
+// rejoinStats corrects the stats once a reconnect resumed the current file at offset.
+// Whatever was sent past offset was lost with the old channel and is sent again.
+func (s *SenderChannel) rejoinStats(progressCh chan<- types.ProgressUpdate, offset int64) {
+	// Referenced chunks past offset were lost too, but they never counted as sent
+	var lostRefs int64
+	kept := s.dedupRefs[:0]
+	for _, ref := range s.dedupRefs {
+		if ref.pos >= offset {
+			lostRefs += ref.size
+			continue
+		}
+		kept = append(kept, ref)
+	}
+	s.dedupRefs = kept
+	s.stats.dedupedBytes -= uint64(lostRefs)
+
+	if lost := s.filePos - max(offset, s.fileStart) - lostRefs; lost > 0 {
+		s.stats.bytes -= uint64(lost)
+	}
+	if offset < s.fileStart {
+		// The receiver gave up on the partial file it had before this run too
+		s.stats.resumedFrom -= s.fileStart - offset
+		s.fileStart = offset
+	}
+	s.filePos = offset
+
+	log.Printf("Resuming at %d bytes after reconnecting", offset)
+	s.reportProgress(progressCh, types.ProgressUpdate{NewBytes: 0, CumulativeBytes: s.stats.offset()})
+}
+
+// sendDirectoryPhase announces the directory and sends its files one after another,
+// each negotiated like a single file so the receiver can skip complete files and resume a partial one
+func (s *SenderChannel) sendDirectoryPhase(progressCh chan<- types.ProgressUpdate) error {
+	// Progress covers the whole directory
+	s.currentFile, s.fileIndex = nil, 0
+	s.reportMetadata(progressCh)
+
+	info := types.DirectoryInfo{Name: s.metadata.Name, Files: len(s.files), Size: s.metadata.Size}
+	if err := s.sendControlMessage(MSG_DIRECTORY, info); err != nil {
+		return fmt.Errorf("error sending directory info: %w", err)
+	}
+
+	for i, entry := range s.files {
+		metadata, err := s.dataProcessor.PrepareFileForSending(entry.Path, s.followSymlinks)
+		if err != nil {
+			return fmt.Errorf("failed to prepare %s for sending: %w", entry.Path, err)
+		}
+		if s.selfCheck {
+			if err := s.dataProcessor.SelfCheck(metadata); err != nil {
+				return fmt.Errorf("self-check failed: %w", err)
+			}
+		}
+		metadata.Dir = entry.Dir
+		metadata.ChunkSize = s.config.WebRTC.ChunkSize
+		s.currentFile, s.fileIndex = metadata, i
+
+		skip, err := s.transferFile(progressCh, metadata)
+		if err != nil {
+			return fmt.Errorf("error sending %s: %w", entry.Path, err)
+		}
+		s.dataProcessor.ForgetSent()
+		if skip {
+			log.Printf("Receiver already has %s, skipping", entry.Path)
+			s.stats.skippedFiles++
+			s.stats.skippedBytes += uint64(metadata.Size)
+			s.reportProgress(progressCh, types.ProgressUpdate{NewBytes: uint64(metadata.Size), CumulativeBytes: s.stats.offset()})
+		}
+	}
+
+	log.Printf("All %d files of %s sent (%d already on the receiver)", len(s.files), s.metadata.Name, s.stats.skippedFiles)
+
+	return s.closeSession()
+}
+
 // sendFileDataPhase handles the main file data transfer loop
 func (s *SenderChannel) sendFileDataPhase(progressCh chan<- types.ProgressUpdate) error {
-	// Start file transfer
-	dataCh, errCh := s.dataProcessor.StartReadingFile(s.config.WebRTC.ChunkSize)
+	// Start file transfer, the reader stops with this loop whichever way it returns.
+	// It calls currentChunkSize, so it must be gone before the next file or a reconnect changes what that reads.
+	stop := make(chan struct{})
+	var dataCh <-chan processor.DataChunk
+	defer func() {
+		close(stop)
+		if dataCh != nil {
+			for range dataCh {
+			}
+		}
+	}()
+
+	s.bytesRead, s.bytesSent = 0, 0
+	s.compressedIn, s.compressedOut = 0, 0
+	var errCh <-chan error
+	sendChunk := s.sendReadChunk
+	if s.dedupHashes != nil {
+		dataCh, errCh = s.dataProcessor.StartReadingContent(stop)
+		sendChunk = s.sendContentChunk
+	} else {
+		dataCh, errCh = s.dataProcessor.StartReadingFile(s.currentChunkSize, stop)
+	}
+
 	if dataCh == nil || errCh == nil {
 		return fmt.Errorf("no file prepared for transfer")
 	}
 
+	// A followed file is checked segment by segment as it is sent
+	var segmentTick <-chan time.Time
+	if s.follow != nil {
+		ticker := time.NewTicker(followSegmentInterval)
+		defer ticker.Stop()
+		segmentTick = ticker.C
+	}
+
 	// Process data chunks
 	for {
 		select {
@@ -160,43 +945,271 @@ func (s *SenderChannel) sendFileDataPhase(progressCh chan<- types.ProgressUpdate
 			}
 
 			if chunk.EOF {
+				s.logDedup()
+				s.logCompression()
+				if err := s.sendSegment(); err != nil {
+					return err
+				}
 				return s.sendEOF()
 			}
+			s.bytesRead += int64(len(chunk.Data))
 
-			if err := s.sendDataChunk(chunk, progressCh); err != nil {
+			if err := sendChunk(chunk, progressCh); err != nil {
 				return err
 			}
 
+			if s.follow != nil && s.follow.size >= followSegmentMaxBytes {
+				if err := s.sendSegment(); err != nil {
+					return err
+				}
+			}
+
 			if err := s.handleFlowControl(); err != nil {
 				return err
 			}
 
+		case <-segmentTick:
+			if err := s.sendSegment(); err != nil {
+				return err
+			}
+
 		case err, ok := <-errCh:
 			if !ok {
-				// Error channel closed, no more errors expected
-				return nil
+				// Error channel closed, no more errors expected. The EOF chunk may still be
+				// waiting in dataCh, so keep reading it instead of returning
+				errCh = nil
+				continue
 			}
 			if err != nil {
 				return fmt.Errorf("error during file transfer: %v", err)
 			}
 
+		case err := <-s.remoteErrCh:
+			return err
+
 		case <-s.ctx.Done():
 			return fmt.Errorf("file transfer cancelled: %v", s.ctx.Err())
 		}
 	}
 }
 
+// currentChunkSize returns the size to read the next chunk with, the agreed size unless the receiver has since asked for less.
+// When encrypting, room is left for what sealing adds, so chunks stay within the agreed size on the wire.
+func (s *SenderChannel) currentChunkSize() int {
+	size := s.chunkSize
+	if limit := int(s.chunkLimit.Load()); limit > 0 && limit < size {
+		size = limit
+	}
+	if s.cipher != nil {
+		size -= s.cipher.overhead()
+	}
+	if s.currentFile != nil && s.currentFile.Compression != "" {
+		size -= compressionOverhead
+	}
+	return size
+}
+
+// handleReconfigure applies a receiver's request for smaller chunks to the data still to be read.
+// Requests can only shrink chunks, a receiver that asked for less memory is never sent more.
+func (s *SenderChannel) handleReconfigure(payload []byte) {
+	req, err := utils.DecodeJSON[types.Reconfigure](payload)
+	if err != nil {
+		log.Printf("Error decoding reconfigure request, ignoring: %v", err)
+		return
+	}
+	if req.ChunkSize <= 0 {
+		log.Printf("Received reconfigure request with invalid chunk size %d, ignoring", req.ChunkSize)
+		return
+	}
+
+	size := int64(req.ChunkSize)
+	if size < config.MinChunkSize {
+		log.Printf("Receiver asked for chunks of %d bytes, below the minimum, using %d bytes", size, config.MinChunkSize)
+		size = config.MinChunkSize
+	}
+	for {
+		limit := s.chunkLimit.Load()
+		if limit > 0 && limit <= size {
+			return
+		}
+		if s.chunkLimit.CompareAndSwap(limit, size) {
+			break
+		}
+	}
+
+	log.Printf("Receiver asked for chunks of at most %d bytes, shrinking chunks for the rest of the transfer", size)
+}
+
 // sendDataChunk sends a single data chunk and updates progress
 func (s *SenderChannel) sendDataChunk(chunk processor.DataChunk, progressCh chan<- types.ProgressUpdate) error {
+	data := chunk.Data
+	if s.currentFile.Compression != "" {
+		compressed, err := s.compressor.compressChunk(data)
+		if err != nil {
+			return err
+		}
+		s.compressedIn += int64(len(data))
+		s.compressedOut += int64(len(compressed))
+		data = compressed
+	}
+	if s.cipher != nil {
+		sealed, err := s.cipher.seal(data)
+		if err != nil {
+			return fmt.Errorf("error encrypting data: %w", err)
+		}
+		data = sealed
+	}
+
+	if s.limiter != nil {
+		if err := s.limiter.wait(s.ctx, len(data)); err != nil {
+			return fmt.Errorf("file transfer cancelled: %v", err)
+		}
+	}
+	if s.nice != nil {
+		if err := s.nice.wait(s.ctx, len(data)); err != nil {
+			return fmt.Errorf("file transfer cancelled: %v", err)
+		}
+	}
+
 	// Send data chunk
-	err := s.dataChannel.Send(chunk.Data)
+	err := s.outbound.Send(data)
 	if err != nil {
 		return fmt.Errorf("error sending data: %v", err)
 	}
+	s.dataProcessor.RecordSent(chunk.Data)
+	if s.follow != nil {
+		s.follow.write(chunk.Data)
+	}
+	s.bytesSent += int64(len(chunk.Data))
+	s.stats.bytes += uint64(len(chunk.Data))
+	s.filePos += int64(len(chunk.Data))
 
 	// Send progress update
-	update := types.ProgressUpdate{
-		NewBytes: uint64(len(chunk.Data)),
+	s.reportProgress(progressCh, types.ProgressUpdate{
+		NewBytes:        uint64(len(chunk.Data)),
+		CumulativeBytes: s.stats.offset(),
+	})
+
+	return nil
+}
+
+// sendContentChunk sends a content-defined chunk, as a reference if the receiver already holds it.
+// Otherwise it goes as data, split to the agreed chunk size.
+func (s *SenderChannel) sendContentChunk(chunk processor.DataChunk, progressCh chan<- types.ProgressUpdate) error {
+	if s.dedupHashes[chunk.Hash] {
+		size := len(chunk.Data)
+		if err := s.sendControlMessage(MSG_CHUNK_REF, types.ChunkRef{Hash: chunk.Hash, Size: size}); err != nil {
+			return fmt.Errorf("error sending chunk reference: %w", err)
+		}
+		s.dataProcessor.RecordSent(chunk.Data)
+		s.bytesSent += int64(size)
+		s.dedupRefs = append(s.dedupRefs, dedupRef{pos: s.filePos, size: int64(size)})
+		s.stats.dedupedBytes += uint64(size)
+		s.filePos += int64(size)
+
+		s.reportProgress(progressCh, types.ProgressUpdate{
+			NewBytes:        uint64(size),
+			CumulativeBytes: s.stats.offset(),
+		})
+		return nil
+	}
+
+	return s.sendReadChunk(chunk, progressCh)
+}
+
+// sendReadChunk sends a chunk of data, split to the current chunk size. Chunks read ahead can be larger than it
+// if the receiver asked for smaller ones after they were read.
+func (s *SenderChannel) sendReadChunk(chunk processor.DataChunk, progressCh chan<- types.ProgressUpdate) error {
+	data := chunk.Data
+	for len(data) > 0 {
+		n := min(len(data), s.currentChunkSize())
+		if err := s.sendDataChunk(processor.DataChunk{Data: data[:n]}, progressCh); err != nil {
+			return err
+		}
+		data = data[n:]
+
+		// The caller waits after the last piece
+		if len(data) > 0 {
+			if err := s.handleFlowControl(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logDedup reports how much of the current file was referenced instead of sent
+func (s *SenderChannel) logDedup() {
+	if s.dedupHashes == nil {
+		return
+	}
+
+	var reused int64
+	for _, ref := range s.dedupRefs {
+		reused += ref.size
+	}
+	log.Printf("Receiver reused %d chunks (%s) of %s from its existing copy",
+		len(s.dedupRefs), utils.FormatFileSize(reused), s.currentFile.Name)
+}
+
+// logCompression reports how much compressing shrank the current file's data
+func (s *SenderChannel) logCompression() {
+	if s.compressedIn == 0 {
+		return
+	}
+	log.Printf("Compressed %s of %s to %s (%.0f%%)", utils.FormatFileSize(s.compressedIn), s.currentFile.Name,
+		utils.FormatFileSize(s.compressedOut), float64(s.compressedOut)/float64(s.compressedIn)*100)
+}
+
+// handleDedupIndex collects the chunk hashes the receiver lists for the file being negotiated
+func (s *SenderChannel) handleDedupIndex(payload []byte) {
+	index, err := utils.DecodeJSON[types.DedupIndex](payload)
+	if err != nil {
+		log.Printf("Error decoding dedup index, ignoring: %v", err)
+		return
+	}
+	if s.dedupHashes == nil {
+		log.Printf("Received dedup index outside negotiation, ignoring")
+		return
+	}
+
+	for _, hash := range index.Hashes {
+		s.dedupHashes[hash] = true
+	}
+}
+
+// reportMetadata hands the transfer's metadata to the consumer, through OnMetadata if set or as the first progress update.
+// Unlike other updates it is never dropped.
+func (s *SenderChannel) reportMetadata(progressCh chan<- types.ProgressUpdate) {
+	if s.onMetadata != nil {
+		s.onMetadata(s.metadata)
+		return
+	}
+
+	progressCh <- types.ProgressUpdate{
+		NewBytes: 0,
+		MetaData: s.metadata,
+		File:     s.currentFile,
+	}
+}
+
+// reportProgress hands an update to the progress consumer.
+// Updates are dropped when the consumer falls behind, unless SyncProgress asked for every update.
+func (s *SenderChannel) reportProgress(progressCh chan<- types.ProgressUpdate, update types.ProgressUpdate) {
+	update.FileIndex, update.File = s.fileIndex, s.currentFile
+	update.BytesPerSecond = s.rate.update(s.stats.bytes, time.Now())
+
+	// With metadata reported on its own, every update moves the transfer on
+	if s.onMetadata != nil && update.NewBytes == 0 {
+		return
+	}
+
+	if s.syncProgress {
+		select {
+		case progressCh <- update:
+		case <-s.ctx.Done():
+		}
+		return
 	}
 
 	select {
@@ -205,20 +1218,63 @@ func (s *SenderChannel) sendDataChunk(chunk processor.DataChunk, progressCh chan
 	default:
 		// Progress channel full, skip this update to avoid blocking data transfer
 	}
-	
-	return nil
 }
 
-// sendEOF handles EOF signaling and cleanup
+// sendEOF marks the end of the current file's data
 func (s *SenderChannel) sendEOF() error {
-	// Send EOF marker
-	err := s.dataChannel.Send([]byte("EOF"))
+	// A channel the receiver dropped may still accept the message, it would never arrive
+	if s.channelLost() {
+		return ErrClosedBeforeEOF
+	}
+
+	// Send EOF marker, with the counts for the receiver to reconcile
+	eof := types.EOF{BytesRead: s.bytesRead, BytesSent: s.bytesSent}
+	if s.follow != nil {
+		// The file is only complete now, its summary describes all that was sent
+		s.currentFile.Size = s.filePos
+		s.currentFile.Checksum = s.follow.checksum()
+		eof.Size, eof.Checksum = s.currentFile.Size, utils.FormatChecksum(s.currentFile.Checksum, s.config.ChecksumEncoding)
+	}
+	err := s.sendControlMessage(MSG_EOF, eof)
+	if err != nil && s.channelLost() {
+		return fmt.Errorf("%w: %v", ErrClosedBeforeEOF, err)
+	}
 	if err != nil {
 		return fmt.Errorf("error sending EOF: %v", err)
 	}
+	s.stats.endTime = time.Now()
+
+	return nil
+}
+
+// sendSegment sends the checksum of the followed file's data sent since the last segment, if there is any
+func (s *SenderChannel) sendSegment() error {
+	if s.follow == nil {
+		return nil
+	}
+	segment, ok := s.follow.takeSegment()
+	if !ok {
+		return nil
+	}
 
-	// Close the channel after sending EOF
-	err = s.dataChannel.GracefulClose()
+	if err := s.sendControlMessage(MSG_SEGMENT, segment); err != nil {
+		return fmt.Errorf("error sending segment checksum: %w", err)
+	}
+	return nil
+}
+
+// closeSession ends the session and closes the channel once everything sent has been handled
+func (s *SenderChannel) closeSession() error {
+	// Wait until the receiver has handled everything so closing doesn't cut off trailing messages
+	if err := s.endSession(); err != nil {
+		return err
+	}
+
+	// Close the channel once the session has ended, unless the receiver already closed it
+	if s.channelLost() {
+		return nil
+	}
+	err := s.dataChannel.GracefulClose()
 	if err != nil {
 		return fmt.Errorf("error closing channel: %v", err)
 	}
@@ -226,18 +1282,109 @@ func (s *SenderChannel) sendEOF() error {
 	return nil
 }
 
-// handleFlowControl manages flow control and backpressure
+// endSession sends SESSION_END and waits for the receiver to echo it.
+// The receiver handles messages in order, so the echo means everything sent before it has been processed.
+func (s *SenderChannel) endSession() error {
+	if err := s.sendControlMessage(MSG_SESSION_END, nil); err != nil {
+		return fmt.Errorf("error sending session end: %v", err)
+	}
+
+	// Let messages held back on the way reach the channel before waiting on the reply
+	if err := flushOutbound(s.ctx, s.outbound); err != nil {
+		return fmt.Errorf("error flushing outgoing messages: %v", err)
+	}
+
+	timeout := time.Duration(s.config.WebRTC.SessionEndTimeoutMs) * time.Millisecond
+	select {
+	case <-s.sessionEndCh:
+		return nil
+	case err := <-s.remoteErrCh:
+		return err
+	case <-s.closedCh:
+		// Everything was sent, the receiver closed before acknowledging it
+		log.Printf("Data channel closed before the receiver acknowledged session end")
+		return nil
+	case <-s.ctx.Done():
+		return fmt.Errorf("file transfer cancelled: %v", s.ctx.Err())
+	case <-time.After(timeout):
+		// The receiver may predate SESSION_END, close anyway
+		log.Printf("Receiver did not acknowledge session end within %v, closing", timeout)
+		return nil
+	}
+}
+
+// handleFlowControl manages flow control and backpressure.
+// While waiting it checks that the buffer is still draining; if it stays stuck for the stall timeout the peer has silently gone away.
 func (s *SenderChannel) handleFlowControl() error {
 	// Flow control: wait if buffer is too full
-	if s.dataChannel.BufferedAmount() > s.config.WebRTC.MaxBufferedAmount {
+	if s.dataChannel.BufferedAmount() <= s.config.WebRTC.MaxBufferedAmount {
+		return nil
+	}
+
+	stallTimeout := time.Duration(s.config.WebRTC.StallTimeoutMs) * time.Millisecond
+	ticker := time.NewTicker(max(stallTimeout/10, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	waitStart := time.Now()
+	startBuffered := s.dataChannel.BufferedAmount()
+	deadline := s.flowControlDeadline(startBuffered)
+	timeout := time.After(deadline)
+	lastBuffered := startBuffered
+	lastDrained := waitStart
+
+	for {
 		select {
 		case <-s.bufferControlCh:
+			s.measureDrainRate(startBuffered, time.Since(waitStart))
 			return nil
-		case <-s.ctx.Done(): 
+		case <-ticker.C:
+			buffered := s.dataChannel.BufferedAmount()
+			if buffered < lastBuffered {
+				lastDrained = time.Now()
+			}
+			lastBuffered = buffered
+
+			if time.Since(lastDrained) >= stallTimeout {
+				return fmt.Errorf("%w: %d bytes queued have not drained for %v", ErrPeerUnreachable, buffered, stallTimeout)
+			}
+		case err := <-s.remoteErrCh:
+			return err
+		case <-s.closedCh:
+			return fmt.Errorf("data channel closed while waiting for the send buffer to drain")
+		case <-s.ctx.Done():
 			return fmt.Errorf("file transfer cancelled: %v", s.ctx.Err())
-		case <-time.After(30 * time.Second):
-			return fmt.Errorf("flow control timeout - WebRTC channel may be dead")
+		case <-timeout:
+			return fmt.Errorf("flow control timeout after %v - WebRTC channel may be dead", deadline)
 		}
 	}
-	return nil
-}
\ No newline at end of file
+}
+
+// flowControlDeadline is how long draining buffered bytes down to the low threshold may take:
+// the time it should take at the measured drain rate plus the configured margin, or the flat
+// flow control timeout until a rate has been measured
+func (s *SenderChannel) flowControlDeadline(buffered uint64) time.Duration {
+	if s.drainRate <= 0 {
+		return time.Duration(s.config.WebRTC.FlowControlTimeoutMs) * time.Millisecond
+	}
+
+	toDrain := float64(buffered - min(buffered, s.config.WebRTC.BufferedAmountLowThreshold))
+	expected := time.Duration(toDrain / s.drainRate * float64(time.Second))
+	return expected + time.Duration(s.config.WebRTC.FlowControlMarginMs)*time.Millisecond
+}
+
+// measureDrainRate folds how fast the buffer drained from startBuffered to the low threshold into the drain rate estimate
+func (s *SenderChannel) measureDrainRate(startBuffered uint64, elapsed time.Duration) {
+	drained := startBuffered - min(startBuffered, s.dataChannel.BufferedAmount())
+	if drained == 0 || elapsed <= 0 {
+		return
+	}
+
+	rate := float64(drained) / elapsed.Seconds()
+	if s.drainRate <= 0 {
+		s.drainRate = rate
+		return
+	}
+
+	// Weight recent waits more so the estimate follows a link that speeds up or slows down
+	s.drainRate = 0.7*s.drainRate + 0.3*rate
+}
@@ -0,0 +1,351 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"yapfs/internal/config"
+	"yapfs/internal/netsim"
+	"yapfs/internal/processor"
+	"yapfs/pkg/types"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// testTransferTimeout bounds a whole transfer between in-process peers
+const testTransferTimeout = 60 * time.Second
+
+// testTransfer is a sender and a receiver connected in process, each sending through wrap when it is set
+type testTransfer struct {
+	sender       *SenderChannel
+	receiver     *ReceiverChannel
+	senderConn   *webrtc.PeerConnection
+	receiverConn *webrtc.PeerConnection
+	sendCh       <-chan types.ProgressUpdate
+	recvCh       <-chan types.ProgressUpdate
+}
+
+// newTestConfig returns the default configuration without STUN servers, the peers reach each other on host candidates
+func newTestConfig() *config.Config {
+	cfg := config.NewDefaultConfig()
+	cfg.WebRTC.ICEServers = nil
+	cfg.WebRTC.ChunkSize = 16 * 1024
+	return cfg
+}
+
+// writeTestFile writes size bytes of random content to a new file and returns its path and content
+func writeTestFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, content
+}
+
+// startTestTransfer connects a sender of sendOpts to a receiver of recvOpts and starts the transfer
+func startTestTransfer(t *testing.T, ctx context.Context, cfg *config.Config, sendOpts SendOptions, recvOpts ReceiveOptions, wrap outboundWrapper) *testTransfer {
+	t.Helper()
+
+	senderConn, receiverConn := newTestPeerConnection(t), newTestPeerConnection(t)
+	tr := &testTransfer{
+		sender:       NewSenderChannel(cfg),
+		receiver:     NewReceiverChannel(cfg),
+		senderConn:   senderConn,
+		receiverConn: receiverConn,
+	}
+	tr.sender.wrapOutbound = wrap
+	tr.receiver.wrapOutbound = wrap
+
+	if err := tr.sender.CreateFileSenderDataChannel(ctx, senderConn, DefaultChannelLabel, sendOpts); err != nil {
+		t.Fatalf("CreateFileSenderDataChannel() error = %v", err)
+	}
+	if err := tr.receiver.SetupFileReceiver(ctx, receiverConn, recvOpts); err != nil {
+		t.Fatalf("SetupFileReceiver() error = %v", err)
+	}
+	signalTestPeers(t, senderConn, receiverConn)
+
+	var err error
+	if tr.recvCh, err = tr.receiver.ReceiveFile(); err != nil {
+		t.Fatalf("ReceiveFile() error = %v", err)
+	}
+	if tr.sendCh, err = tr.sender.SendFile(); err != nil {
+		t.Fatalf("SendFile() error = %v", err)
+	}
+	return tr
+}
+
+// wait waits for both ends to finish and returns the errors they ended with.
+// The sender closes its connection once done, like the app does.
+func (tr *testTransfer) wait(t *testing.T) (sendErr, receiveErr error) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range tr.recvCh {
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range tr.sendCh {
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTransferTimeout):
+		t.Fatalf("send didn't finish within %v", testTransferTimeout)
+	}
+	tr.senderConn.Close()
+
+	receiveErr = tr.receiver.WaitForCompletion(testTransferTimeout)
+	wg.Wait()
+	return tr.sender.Err(), receiveErr
+}
+
+// close closes both peer connections
+func (tr *testTransfer) close() {
+	tr.senderConn.Close()
+	tr.receiverConn.Close()
+}
+
+// newTestPeerConnection creates a peer connection closed when the test ends
+func newTestPeerConnection(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+
+	peerConn, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peerConn.Close() })
+	return peerConn
+}
+
+// signalTestPeers exchanges offer and answer between the peers, each carrying all of their candidates
+func signalTestPeers(t *testing.T, offerer, answerer *webrtc.PeerConnection) {
+	t.Helper()
+
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// impairedLinks wraps the send side of every data channel in a netsim.Link with the same conditions
+type impairedLinks struct {
+	cond  netsim.Conditions
+	under outboundWrapper // What the links deliver to, the data channel itself when nil
+
+	mu    sync.Mutex
+	links []*netsim.Link
+}
+
+// wrap is the outboundWrapper putting dataChannel behind a new link
+func (l *impairedLinks) wrap(dataChannel *webrtc.DataChannel) messageSender {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cond := l.cond
+	cond.Seed += int64(len(l.links))
+	link := netsim.NewLink(newOutbound(l.under, dataChannel), cond)
+	l.links = append(l.links, link)
+	return link
+}
+
+// retransmitted returns how many messages the links dropped and delivered again
+func (l *impairedLinks) retransmitted() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var n int64
+	for _, link := range l.links {
+		n += link.Retransmitted()
+	}
+	return n
+}
+
+// channelCut counts the file data reaching data channels and closes the first channel once cutAfter bytes
+// reached it, like a transient failure would
+type channelCut struct {
+	cutAfter int
+
+	mu        sync.Mutex
+	cuts      int
+	delivered int // File data that reached any channel
+}
+
+// wrap is the outboundWrapper counting file data on its way to dataChannel
+func (c *channelCut) wrap(dataChannel *webrtc.DataChannel) messageSender {
+	return &cuttingSender{DataChannel: dataChannel, cut: c}
+}
+
+// cuttingSender is the send side of a channel a channelCut watches
+type cuttingSender struct {
+	*webrtc.DataChannel
+	cut  *channelCut
+	sent int
+}
+
+// Send sends data, closing the channel once enough was sent if it is the first
+func (s *cuttingSender) Send(data []byte) error {
+	if err := s.DataChannel.Send(data); err != nil {
+		return err
+	}
+
+	s.sent += len(data)
+	s.cut.mu.Lock()
+	s.cut.delivered += len(data)
+	cut := s.cut.cuts == 0 && s.sent >= s.cut.cutAfter
+	if cut {
+		s.cut.cuts++
+	}
+	s.cut.mu.Unlock()
+
+	if cut {
+		s.DataChannel.Close()
+	}
+	return nil
+}
+
+// lossyConditions are the adverse network the transfer tests run on: 100ms latency and 5% of messages lost, each
+// delivered again 200ms later like a reliable channel resends a lost packet. The window keeps the sender from getting
+// far ahead of what the receiver has, as on a real link.
+var lossyConditions = netsim.Conditions{
+	Latency:     100 * time.Millisecond,
+	Jitter:      20 * time.Millisecond,
+	DropRate:    0.05,
+	DropControl: true,
+	Retransmit:  200 * time.Millisecond,
+	Window:      256 * 1024,
+	Seed:        1,
+}
+
+// checkReceived fails the test unless destDir holds content under name
+func checkReceived(t *testing.T, destDir, name string, content []byte) {
+	t.Helper()
+
+	received, err := os.ReadFile(filepath.Join(destDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(received), len(content))
+	}
+}
+
+func TestTransferCompletesUnderLatencyAndLoss(t *testing.T) {
+	ctx := context.Background()
+	srcPath, content := writeTestFile(t, 2*1024*1024)
+	destDir := t.TempDir()
+	links := &impairedLinks{cond: lossyConditions}
+
+	tr := startTestTransfer(t, ctx, newTestConfig(), SendOptions{FilePath: srcPath}, ReceiveOptions{DestPath: destDir}, links.wrap)
+	sendErr, receiveErr := tr.wait(t)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("transfer failed: send error = %v, receive error = %v", sendErr, receiveErr)
+	}
+
+	checkReceived(t, destDir, "file.bin", content)
+	if links.retransmitted() == 0 {
+		t.Fatalf("no message was retransmitted, the link wasn't lossy")
+	}
+}
+
+func TestTransferReconnectsUnderLatencyAndLoss(t *testing.T) {
+	ctx := context.Background()
+	srcPath, content := writeTestFile(t, 2*1024*1024)
+	destDir := t.TempDir()
+	cut := &channelCut{cutAfter: 512 * 1024}
+	links := &impairedLinks{cond: lossyConditions, under: cut.wrap}
+
+	tr := startTestTransfer(t, ctx, newTestConfig(), SendOptions{FilePath: srcPath}, ReceiveOptions{DestPath: destDir}, links.wrap)
+	sendErr, receiveErr := tr.wait(t)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("transfer failed: send error = %v, receive error = %v", sendErr, receiveErr)
+	}
+
+	checkReceived(t, destDir, "file.bin", content)
+	if cut.cuts != 1 {
+		t.Fatalf("data channel was cut %d times, want 1", cut.cuts)
+	}
+	if cut.delivered >= len(content)+cut.cutAfter {
+		t.Fatalf("%d bytes reached the receiver for a %d-byte file, the reconnect started over", cut.delivered, len(content))
+	}
+}
+
+func TestTransferResumesUnderLatencyAndLoss(t *testing.T) {
+	ctx := context.Background()
+	srcPath, content := writeTestFile(t, 2*1024*1024)
+	destDir := t.TempDir()
+	partial := len(content) * 2 / 5
+	if err := os.WriteFile(filepath.Join(destDir, "file.bin.part"), content[:partial], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := &impairedLinks{cond: lossyConditions}
+
+	tr := startTestTransfer(t, ctx, newTestConfig(), SendOptions{FilePath: srcPath},
+		ReceiveOptions{DestPath: destDir, Resume: true, WriteMode: string(processor.WriteModeAtomic)}, links.wrap)
+	sendErr, receiveErr := tr.wait(t)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("transfer failed: send error = %v, receive error = %v", sendErr, receiveErr)
+	}
+
+	checkReceived(t, destDir, "file.bin", content)
+	result := tr.receiver.Result()
+	if result.ResumedFrom != int64(partial) || result.Bytes != uint64(len(content)-partial) {
+		t.Fatalf("resumed from %d receiving %d bytes, want from %d receiving %d", result.ResumedFrom, result.Bytes, partial, len(content)-partial)
+	}
+}
+
+func TestTransferDetectsLostData(t *testing.T) {
+	ctx := context.Background()
+	srcPath, _ := writeTestFile(t, 1024*1024)
+	destDir := t.TempDir()
+	cond := lossyConditions
+	cond.DropControl, cond.Retransmit = false, 0
+	links := &impairedLinks{cond: cond}
+
+	tr := startTestTransfer(t, ctx, newTestConfig(), SendOptions{FilePath: srcPath}, ReceiveOptions{DestPath: destDir}, links.wrap)
+	if _, receiveErr := tr.wait(t); !errors.Is(receiveErr, processor.ErrChecksumMismatch) {
+		t.Fatalf("receive error = %v, want %v", receiveErr, processor.ErrChecksumMismatch)
+	}
+
+	if _, err := os.Stat(filepath.Join(destDir, "file.bin")); !os.IsNotExist(err) {
+		t.Fatalf("file with lost data was kept: %v", err)
+	}
+}
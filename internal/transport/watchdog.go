@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// bufferWatchdogInterval is how often the watchdog samples the send buffer
+const bufferWatchdogInterval = 250 * time.Millisecond
+
+// watchBuffer samples dataChannel's send buffer until closed is closed and logs a warning once it has been full
+// without draining for BufferWatchdogMs, which means the receiver isn't taking data. Full means above the low
+// threshold the sender waits for once it reaches MaxBufferedAmount: what SCTP has in flight is no longer buffered,
+// so a stuck buffer settles a little below the maximum. It warns once per episode, before the stall and flow
+// control timeouts give up on the peer.
+func (s *SenderChannel) watchBuffer(dataChannel *webrtc.DataChannel, closed <-chan struct{}) {
+	threshold := time.Duration(s.config.WebRTC.BufferWatchdogMs) * time.Millisecond
+	ticker := time.NewTicker(bufferWatchdogInterval)
+	defer ticker.Stop()
+
+	var pinnedSince time.Time
+	var lastBuffered uint64
+	warned := false
+
+	for {
+		select {
+		case <-ticker.C:
+			buffered := dataChannel.BufferedAmount()
+			draining := buffered < lastBuffered
+			lastBuffered = buffered
+			if draining || buffered <= s.config.WebRTC.BufferedAmountLowThreshold {
+				pinnedSince, warned = time.Time{}, false
+				continue
+			}
+			if pinnedSince.IsZero() {
+				pinnedSince = time.Now()
+				continue
+			}
+
+			if pinned := time.Since(pinnedSince); !warned && pinned >= threshold {
+				log.Printf("Warning: send buffer stuck at max for %.0fs — receiver may be stalled (%d bytes queued)", pinned.Seconds(), buffered)
+				warned = true
+			}
+		case <-closed:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
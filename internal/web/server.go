@@ -0,0 +1,372 @@
+// Package web serves a local page to start and monitor transfers, as an alternative to the send and receive commands
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"yapfs/internal/app"
+	"yapfs/internal/config"
+	"yapfs/internal/reporter"
+	"yapfs/internal/signalling"
+	"yapfs/internal/transport"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+//go:embed index.html
+var indexPage []byte
+
+// tokenPlaceholder is replaced with the server's token in the page it serves
+var tokenPlaceholder = []byte("{{token}}")
+
+// csrfHeader must carry the server's token on every request that starts or stops a transfer. The token is random
+// for each run and only found in the page served here, so no other page can use the API.
+const csrfHeader = "X-Yapfs"
+
+// ErrBusy is returned when a transfer is started while another one is running
+var ErrBusy = errors.New("a transfer is already running")
+
+// ServicesFunc creates the services for one transfer, each transfer gets its own
+type ServicesFunc func() (*transport.PeerService, *transport.DataChannelService, *signalling.SignalingService)
+
+// event is a server-sent event, Type is one of started, code, progress, done and error
+type event struct {
+	Type string
+	Data any
+}
+
+// Server runs one transfer at a time on behalf of the page and streams its events to it
+type Server struct {
+	config      *config.Config
+	addr        string // Address the server is reached at, the only Host accepted besides loopback names
+	token       string // Random for each server, see csrfHeader
+	newServices ServicesFunc
+	report      reporter.Options
+
+	mu          sync.Mutex
+	cancel      context.CancelFunc // Stops the running transfer, nil when none is running
+	history     []event            // Events of the current or last transfer, replayed to a page that connects late
+	subscribers map[chan event]struct{}
+}
+
+// NewServer creates a web server for addr starting transfers with services from newServices and displaying them with report
+func NewServer(cfg *config.Config, addr string, newServices ServicesFunc, report reporter.Options) *Server {
+	return &Server{
+		config:      cfg,
+		addr:        addr,
+		token:       rand.Text(),
+		newServices: newServices,
+		report:      report,
+		subscribers: make(map[chan event]struct{}),
+	}
+}
+
+// Handler returns the HTTP handler serving the page and its API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("POST /send", s.guard(s.handleSend))
+	mux.HandleFunc("POST /receive", s.guard(s.handleReceive))
+	mux.HandleFunc("POST /cancel", s.guard(s.handleCancel))
+	return s.checkHost(mux)
+}
+
+// checkHost rejects requests for a Host other than the server's address or a loopback name. A page on another site
+// whose name is rebound to this machine is then still refused, though the browser treats it as the same origin.
+func (s *Server) checkHost(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !strings.EqualFold(r.Host, s.addr) && !IsLoopback(host) {
+			http.Error(w, fmt.Sprintf("unknown host %q", r.Host), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// guard rejects requests without the server's token in csrfHeader
+func (s *Server) guard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(s.token)) != 1 {
+			http.Error(w, fmt.Sprintf("missing or wrong %s header", csrfHeader), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(bytes.Replace(indexPage, tokenPlaceholder, []byte(s.token), 1))
+}
+
+// handleSend sends the file at the form's path, or a file uploaded with the form which is removed once sent
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	path := r.FormValue("path")
+	cleanup := func() {}
+
+	if path == "" {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "a path or a file to send is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		if path, cleanup, err = saveUpload(file, header.Filename); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if _, err := os.Stat(path); err != nil {
+		http.Error(w, fmt.Sprintf("cannot access file: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.start(w, "send", filepath.Base(path), func(ctx context.Context) (*types.TransferResult, error) {
+		defer cleanup()
+
+		peerService, dataChannelService, signalingService := s.newServices()
+		opts := &app.SenderOptions{
+			FilePath:       path,
+			FollowSymlinks: true,
+			Report:         s.reportOptions(),
+			OnCode: func(code string) {
+				s.publish(event{Type: "code", Data: map[string]string{"code": code}})
+			},
+		}
+		return app.NewSenderApp(s.config, peerService, dataChannelService, signalingService).Run(ctx, opts)
+	})
+}
+
+// handleReceive receives the file for the form's code into its destination directory, the current one by default
+func (s *Server) handleReceive(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	if !utils.IsValidCode(code) {
+		http.Error(w, "code must be exactly 8 alphanumeric characters", http.StatusBadRequest)
+		return
+	}
+
+	dst := r.FormValue("dst")
+	if dst == "" {
+		dst = "."
+	}
+	dst, err := utils.ResolveDestinationPath(dst)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid destination path: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.start(w, "receive", code, func(ctx context.Context) (*types.TransferResult, error) {
+		peerService, dataChannelService, signalingService := s.newServices()
+		opts := &app.ReceiverOptions{
+			DestPath: dst,
+			Code:     code,
+			Report:   s.reportOptions(),
+		}
+		return app.NewReceiverApp(s.config, peerService, dataChannelService, signalingService).Run(ctx, opts)
+	})
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.mu.Unlock()
+
+	if cancel == nil {
+		http.Error(w, "no transfer is running", http.StatusConflict)
+		return
+	}
+	cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEvents streams the events of the current transfer, starting with those that already happened
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	eventCh := make(chan event, 64)
+	s.mu.Lock()
+	history := append([]event(nil), s.history...)
+	s.subscribers[eventCh] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, eventCh)
+		s.mu.Unlock()
+	}()
+
+	for _, e := range history {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-eventCh:
+			writeEvent(w, e)
+			flusher.Flush()
+		}
+	}
+}
+
+// start runs transfer in the background unless one is already running, answering the request either way
+func (s *Server) start(w http.ResponseWriter, direction, name string, transfer func(ctx context.Context) (*types.TransferResult, error)) {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.mu.Unlock()
+		http.Error(w, ErrBusy.Error(), http.StatusConflict)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.history = nil
+	s.mu.Unlock()
+
+	s.publish(event{Type: "started", Data: map[string]string{"direction": direction, "name": name}})
+	w.WriteHeader(http.StatusAccepted)
+
+	go func() {
+		result, err := transfer(ctx)
+
+		s.mu.Lock()
+		s.cancel = nil
+		s.mu.Unlock()
+		cancel()
+
+		if err != nil {
+			log.Printf("Transfer failed: %v", err)
+			s.publish(event{Type: "error", Data: map[string]string{"message": err.Error()}})
+			return
+		}
+		s.publish(event{Type: "done", Data: summary(result)})
+	}()
+}
+
+// publish records an event and hands it to every page listening, one too slow to keep up misses it
+func (s *Server) publish(e event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only the latest progress is worth replaying
+	if n := len(s.history); e.Type == "progress" && n > 0 && s.history[n-1].Type == "progress" {
+		s.history[n-1] = e
+	} else {
+		s.history = append(s.history, e)
+	}
+
+	for eventCh := range s.subscribers {
+		select {
+		case eventCh <- e:
+		default:
+		}
+	}
+}
+
+// reportOptions are the server's display options with progress also published to the page
+func (s *Server) reportOptions() reporter.Options {
+	report := s.report
+	report.TUI = false // The console isn't the server's to take over
+	report.OnProgress = func(progress reporter.Progress) {
+		s.publish(event{Type: "progress", Data: progress})
+	}
+	return report
+}
+
+// writeEvent writes e in the server-sent events format
+func writeEvent(w io.Writer, e event) {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", e.Type, err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+}
+
+// summary is what the page shows of a finished transfer
+func summary(result *types.TransferResult) map[string]any {
+	if result == nil {
+		return map[string]any{}
+	}
+	return map[string]any{
+		"path":           result.Path,
+		"name":           result.Name,
+		"size":           result.Size,
+		"files":          result.Files,
+		"skipped":        result.Skipped,
+		"seconds":        result.Duration.Seconds(),
+		"bytesPerSecond": result.BytesPerSecond,
+		"checksum":       result.Checksum,
+	}
+}
+
+// saveUpload saves an uploaded file under its own name in a new temporary directory, cleanup removes both
+func saveUpload(file io.Reader, name string) (path string, cleanup func(), err error) {
+	dir, err := os.MkdirTemp("", "yapfs-web-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	cleanup = func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: Failed to remove uploaded file: %v", err)
+		}
+	}
+
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = "upload"
+	}
+	path = filepath.Join(dir, name)
+
+	out, err := os.Create(path)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to save uploaded file: %w", err)
+	}
+	if _, err := io.Copy(out, file); err != nil {
+		out.Close()
+		cleanup()
+		return "", nil, fmt.Errorf("failed to save uploaded file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to save uploaded file: %w", err)
+	}
+	return path, cleanup, nil
+}
+
+// IsLoopback reports whether host only accepts connections from this machine
+func IsLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"yapfs/internal/config"
+	"yapfs/internal/reporter"
+)
+
+// tokenMeta finds the token in the served page
+var tokenMeta = regexp.MustCompile(`<meta name="yapfs-token" content="([^"]+)">`)
+
+// serve sends a request for path to handler with the given Host and token, empty for none, and returns the response
+func serve(t *testing.T, handler http.Handler, method, path, host, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, path, nil)
+	r.Host = host
+	if token != "" {
+		r.Header.Set(csrfHeader, token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestServerRejectsOtherHosts(t *testing.T) {
+	handler := NewServer(config.NewDefaultConfig(), "0.0.0.0:8080", nil, reporter.Options{}).Handler()
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"localhost:8080", http.StatusOK},
+		{"LOCALHOST:8080", http.StatusOK},
+		{"127.0.0.1:8080", http.StatusOK},
+		{"[::1]:8080", http.StatusOK},
+		{"0.0.0.0:8080", http.StatusOK},
+		{"attacker.example:8080", http.StatusForbidden},
+		{"attacker.example", http.StatusForbidden},
+		{"192.168.1.5:8080", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if got := serve(t, handler, http.MethodGet, "/", tt.host, "").Code; got != tt.want {
+			t.Errorf("GET / for host %q answered %d, want %d", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestServerRequiresPageToken(t *testing.T) {
+	handler := NewServer(config.NewDefaultConfig(), "localhost:8080", nil, reporter.Options{}).Handler()
+
+	page, err := io.ReadAll(serve(t, handler, http.MethodGet, "/", "localhost:8080", "").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := tokenMeta.FindSubmatch(page)
+	if match == nil {
+		t.Fatal("served page has no token")
+	}
+	token := string(match[1])
+
+	other := NewServer(config.NewDefaultConfig(), "localhost:8080", nil, reporter.Options{})
+	if other.token == token {
+		t.Fatal("two servers have the same token")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		// With the token, cancelling reaches the handler, which has no transfer to stop
+		{"page token", token, http.StatusConflict},
+		{"no token", "", http.StatusForbidden},
+		{"fixed header value", "1", http.StatusForbidden},
+		{"another server's token", other.token, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if got := serve(t, handler, http.MethodPost, "/cancel", "localhost:8080", tt.token).Code; got != tt.want {
+			t.Errorf("POST /cancel with %s answered %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
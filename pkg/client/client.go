@@ -0,0 +1,207 @@
+// Package client sends and receives files from another Go program, the way the send and receive commands do
+// without their command line: nothing is read from the console or printed, and every error is returned.
+// Transfers still log what they do through the standard log package, redirect it with log.SetOutput.
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"yapfs/internal/app"
+	"yapfs/internal/config"
+	"yapfs/internal/reporter"
+	"yapfs/internal/signalling"
+	"yapfs/internal/transport"
+	"yapfs/pkg/types"
+	"yapfs/pkg/utils"
+)
+
+// progressBuffer is how many progress updates wait for the program to read them before newer ones are dropped
+const progressBuffer = 64
+
+// Config configures transfers, start from DefaultConfig
+type Config = config.Config
+
+// DefaultConfig returns the configuration the commands use without a config file, signalling still has to be set up
+func DefaultConfig() *Config {
+	return config.NewDefaultConfig()
+}
+
+// transfer is a send or receive running in the background
+type transfer struct {
+	progress chan types.ProgressUpdate
+	abandon  <-chan struct{} // Closed when the program cancelled the transfer, it may no longer be reading progress
+
+	// Updates are sent holding mu for reading, so they don't hold each other up; closing progress holds it for writing
+	mu     sync.RWMutex
+	closed bool // The last update was sent and progress closed, updates still arriving are dropped
+}
+
+// SendFile starts sending the file or directory at filePath and returns once there is a code for the receiver,
+// or with the error that ended the transfer before that. The code is the first update on the returned channel,
+// and comes in an update of its own again if the receiver hands the transfer off.
+// The channel is closed after the last update, which has Done set and the transfer's Result or Err.
+// A program that stops reading the channel must cancel ctx, the transfer otherwise waits to hand it the last update.
+func SendFile(ctx context.Context, cfg *Config, filePath string) (<-chan types.ProgressUpdate, error) {
+	if err := prepare(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, fmt.Errorf("cannot access file: %w", err)
+	}
+
+	peerService, dataChannelService, signalingService, err := newServices(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTransfer(ctx)
+	codeCh := make(chan struct{})
+	var codeOnce sync.Once
+	opts := &app.SenderOptions{
+		FilePath:       filePath,
+		FollowSymlinks: true,
+		Report:         t.reportOptions(cfg),
+		OnCode: func(code string) {
+			t.deliver(types.ProgressUpdate{Code: code})
+			codeOnce.Do(func() { close(codeCh) })
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- t.run(func() (*types.TransferResult, error) {
+			return app.NewSenderApp(cfg, peerService, dataChannelService, signalingService).Run(ctx, opts)
+		})
+	}()
+
+	select {
+	case <-codeCh:
+		return t.progress, nil
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return t.progress, nil
+	}
+}
+
+// ReceiveFile starts receiving the file the sender with code is sending into the directory destPath.
+// The returned channel is closed after the last update, which has Done set and the transfer's Result or Err.
+// A program that stops reading the channel must cancel ctx, the transfer otherwise waits to hand it the last update.
+func ReceiveFile(ctx context.Context, cfg *Config, code, destPath string) (<-chan types.ProgressUpdate, error) {
+	if err := prepare(cfg); err != nil {
+		return nil, err
+	}
+	if !utils.IsValidCode(code) {
+		return nil, fmt.Errorf("code must be exactly 8 alphanumeric characters")
+	}
+	destPath, err := utils.ResolveDestinationPath(destPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination path: %w", err)
+	}
+
+	peerService, dataChannelService, signalingService, err := newServices(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTransfer(ctx)
+	opts := &app.ReceiverOptions{
+		DestPath: destPath,
+		Code:     code,
+		Report:   t.reportOptions(cfg),
+	}
+	go t.run(func() (*types.TransferResult, error) {
+		return app.NewReceiverApp(cfg, peerService, dataChannelService, signalingService).Run(ctx, opts)
+	})
+	return t.progress, nil
+}
+
+// prepare checks cfg the way the commands check theirs before a transfer
+func prepare(cfg *Config) error {
+	if cfg == nil {
+		return fmt.Errorf("no configuration given")
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	// The signalling service reaches its server through the proxy on a transport of its own,
+	// the program's default transport is left alone
+	if cfg.Proxy != "" {
+		if _, err := utils.ParseProxyURL(cfg.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy: %w", err)
+		}
+	}
+	return nil
+}
+
+// newServices creates the services for one transfer, signalling through the server cfg.Signaling names
+func newServices(cfg *Config) (*transport.PeerService, *transport.DataChannelService, *signalling.SignalingService, error) {
+	signalingService, err := signalling.NewDefaultSignalingService(cfg)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create signaling service: %w", err)
+	}
+	return transport.NewPeerService(cfg), transport.NewDataChannelService(cfg), signalingService, nil
+}
+
+// newTransfer creates a transfer that hasn't started yet, abandoned once ctx is done
+func newTransfer(ctx context.Context) *transfer {
+	return &transfer{
+		progress: make(chan types.ProgressUpdate, progressBuffer),
+		abandon:  ctx.Done(),
+	}
+}
+
+// reportOptions draws nothing and hands progress updates to the program instead
+func (t *transfer) reportOptions(cfg *Config) reporter.Options {
+	return reporter.Options{
+		ChecksumFormat: cfg.ChecksumEncoding,
+		Quiet:          true,
+		OnUpdate:       t.update,
+	}
+}
+
+// update passes a progress update on to the program, dropping it if the program has fallen behind
+func (t *transfer) update(progress types.ProgressUpdate) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.progress <- progress:
+	default:
+	}
+}
+
+// deliver passes an update the program must not miss on to it, waiting for the program to read if it has fallen behind.
+// Once the transfer is abandoned it only passes the update on if there is room for it, rather than wait.
+func (t *transfer) deliver(progress types.ProgressUpdate) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.progress <- progress:
+	default:
+		select {
+		case t.progress <- progress:
+		case <-t.abandon:
+		}
+	}
+}
+
+// run runs the transfer, ends the progress updates with how it ended and returns its error
+func (t *transfer) run(run func() (*types.TransferResult, error)) error {
+	result, err := run()
+
+	t.deliver(types.ProgressUpdate{Done: true, Result: result, Err: err})
+	t.mu.Lock()
+	t.closed = true
+	close(t.progress)
+	t.mu.Unlock()
+	return err
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"yapfs/internal/config"
+	"yapfs/pkg/types"
+)
+
+// sessionServer is an HTTP signalling server keeping its sessions in memory, without long polling
+type sessionServer struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]string
+}
+
+// ServeHTTP handles the session requests of the http signalling backend
+func (s *sessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, answer := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/answer")
+	session, found := s.sessions[id]
+
+	var body map[string]string
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodPut && answer:
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		session["answer"] = body["answer"]
+	case r.Method == http.MethodPut:
+		if found {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.sessions[id] = map[string]string{"sessionId": id, "offer": body["offer"]}
+	case r.Method == http.MethodGet && found:
+		json.NewEncoder(w).Encode(session)
+	case r.Method == http.MethodDelete && found:
+		delete(s.sessions, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestConfig returns a configuration signalling through server, without STUN servers
+func newTestConfig(server *httptest.Server) *Config {
+	cfg := DefaultConfig()
+	cfg.WebRTC.ICEServers = nil
+	cfg.Signaling.Backend = config.SignalingHTTP
+	cfg.Signaling.URL = server.URL
+	return cfg
+}
+
+// lastUpdate reads updates until the channel closes and returns the last one
+func lastUpdate(t *testing.T, updates <-chan types.ProgressUpdate) types.ProgressUpdate {
+	t.Helper()
+
+	var last types.ProgressUpdate
+	timeout := time.After(time.Minute)
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return last
+			}
+			last = update
+		case <-timeout:
+			t.Fatal("transfer didn't end within a minute")
+		}
+	}
+}
+
+func TestSendAndReceiveFile(t *testing.T) {
+	server := httptest.NewServer(&sessionServer{sessions: map[string]map[string]string{}})
+	defer server.Close()
+	ctx := context.Background()
+
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	srcPath := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(srcPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sendUpdates, err := SendFile(ctx, newTestConfig(server), srcPath)
+	if err != nil {
+		t.Fatalf("SendFile() error = %v", err)
+	}
+	first := <-sendUpdates
+	if first.Code == "" {
+		t.Fatalf("first update of the send is %+v, want the code", first)
+	}
+
+	destDir := t.TempDir()
+	recvUpdates, err := ReceiveFile(ctx, newTestConfig(server), first.Code, destDir)
+	if err != nil {
+		t.Fatalf("ReceiveFile() error = %v", err)
+	}
+
+	for name, updates := range map[string]<-chan types.ProgressUpdate{"send": sendUpdates, "receive": recvUpdates} {
+		last := lastUpdate(t, updates)
+		if !last.Done || last.Err != nil || last.Result == nil || last.Result.Size != int64(len(content)) {
+			t.Fatalf("last update of the %s is %+v, want it done with a result for %d bytes", name, last, len(content))
+		}
+	}
+
+	received, err := os.ReadFile(filepath.Join(destDir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(received), len(content))
+	}
+}
+
+func TestInvalidProxyIsReturned(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Proxy = "http://proxy.example:8080"
+
+	if _, err := SendFile(context.Background(), cfg, "file.bin"); err == nil {
+		t.Fatal("SendFile() succeeded with an invalid proxy")
+	}
+}
+
+func TestProxyLeavesDefaultTransportAlone(t *testing.T) {
+	server := httptest.NewServer(&sessionServer{sessions: map[string]map[string]string{}})
+	defer server.Close()
+
+	srcPath := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(srcPath, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyOf := func() uintptr { return reflect.ValueOf(http.DefaultTransport.(*http.Transport).Proxy).Pointer() }
+	before := proxyOf()
+
+	// Nothing listens at the proxy, so the session can only be created if the proxy is left out
+	cfg := newTestConfig(server)
+	cfg.Proxy = "socks5://127.0.0.1:1"
+	if _, err := SendFile(context.Background(), cfg, srcPath); err == nil {
+		t.Fatal("SendFile() created a session past a proxy that isn't there")
+	}
+	if proxyOf() != before {
+		t.Fatal("SendFile() set a proxy on the program's default transport")
+	}
+}
+
+func TestAbandonedTransferEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := newTransfer(ctx)
+
+	// Nobody reads, so the buffer fills and the code has to wait for room
+	for range progressBuffer {
+		tr.update(types.ProgressUpdate{})
+	}
+	delivered := make(chan struct{})
+	go func() {
+		tr.deliver(types.ProgressUpdate{Code: "ABCD1234"})
+		close(delivered)
+	}()
+
+	updated := make(chan struct{})
+	go func() {
+		tr.update(types.ProgressUpdate{})
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("update waited for an update that can't be delivered")
+	}
+
+	ran := make(chan error, 1)
+	go func() {
+		<-delivered
+		ran <- tr.run(func() (*types.TransferResult, error) { return nil, context.Canceled })
+	}()
+	cancel()
+
+	select {
+	case err := <-ran:
+		if err != context.Canceled {
+			t.Fatalf("run() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned transfer still waits for its updates to be read")
+	}
+	if n := len(tr.progress); n != progressBuffer {
+		t.Fatalf("%d updates left for the program, want the %d that fit", n, progressBuffer)
+	}
+}
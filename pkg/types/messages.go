@@ -0,0 +1,85 @@
+package types
+
+// MetadataAck is the receiver's reply to file metadata, sent before any file data flows
+type MetadataAck struct {
+	ResumeOffset   int64  `json:"resumeOffset"`             // Bytes of the file the receiver already holds (0 for a fresh transfer)
+	PrefixChecksum string `json:"prefixChecksum,omitempty"` // SHA-256 of the first ResumeOffset bytes held by the receiver
+	MaxChunkSize   int    `json:"maxChunkSize,omitempty"`   // Largest chunk the receiver accepts, 0 for no limit
+	Skip           bool   `json:"skip,omitempty"`           // The receiver keeps its existing copy, no file data should be sent
+	Dedup          bool   `json:"dedup,omitempty"`          // The receiver sent DEDUP_INDEX, chunks it holds can be sent as CHUNK_REF
+}
+
+// EOF closes the data of a file with what the sender read and sent of it since TRANSFER_START, so the receiver
+// can reconcile them with what it wrote. Chunks sent as CHUNK_REF count with the size they stand for.
+type EOF struct {
+	BytesRead int64 `json:"bytesRead"` // File data read from the source
+	BytesSent int64 `json:"bytesSent"` // File data handed to the data channel
+
+	// Set for a file followed as it grew, whose size and checksum weren't known when its metadata was sent
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Segment carries the SHA-256 of the data of a followed file sent since the previous segment,
+// so the receiver verifies it as it arrives rather than only once the file ends
+type Segment struct {
+	Offset   int64  `json:"offset"` // Where in the file the segment starts
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // In hex
+}
+
+// DedupIndex lists chunk hashes of the receiver's existing copy of a file, a long list is split over several messages
+type DedupIndex struct {
+	Hashes []string `json:"hashes"`
+}
+
+// ChunkRef stands in for a content-defined chunk the receiver already holds
+type ChunkRef struct {
+	Hash string `json:"hash"` // Hash from DEDUP_INDEX
+	Size int    `json:"size"` // Length of the chunk in bytes
+}
+
+// TransferStart tells the receiver the offset the sender will start sending file data from
+type TransferStart struct {
+	Offset    int64 `json:"offset"`
+	ChunkSize int   `json:"chunkSize,omitempty"` // Chunk size agreed for this transfer
+}
+
+// Reconfigure asks the sender to change how the rest of the transfer is sent
+type Reconfigure struct {
+	ChunkSize int `json:"chunkSize"` // Largest chunk the receiver wants from now on
+}
+
+// DirectoryInfo announces a directory transfer, each of its files follows with its own metadata
+type DirectoryInfo struct {
+	Name  string `json:"name"`  // Name of the directory being sent
+	Files int    `json:"files"` // Number of files that will follow
+	Size  int64  `json:"size"`  // Total size of all files in bytes
+}
+
+// Identity names the sender, as the user running it chose. It is not authenticated.
+type Identity struct {
+	Name string `json:"name"`
+}
+
+// SessionKey carries the ephemeral key the sender encrypts file data with
+type SessionKey struct {
+	Key []byte `json:"key"` // AES-256 key, base64 encoded in JSON
+}
+
+// ErrorMessage carries a fatal error reported by the remote peer
+type ErrorMessage struct {
+	Message string `json:"message"`
+}
+
+// RelayOffer is what the sender relays through the signalling session when no direct connection could be made
+type RelayOffer struct {
+	Chunks   int    `json:"chunks"`             // Number of chunks the file data is relayed in
+	Declined string `json:"declined,omitempty"` // Why the file won't be relayed, nothing else follows
+}
+
+// RelayStatus is how a relayed transfer ended on the receiver
+type RelayStatus struct {
+	Error   string `json:"error,omitempty"`   // Why the transfer failed, empty when the file was received and verified
+	Skipped bool   `json:"skipped,omitempty"` // The receiver kept its existing copy
+}
@@ -1,15 +1,41 @@
 package types
 
+import "time"
+
 // FileMetadata contains information about the file being transferred
 type FileMetadata struct {
-	Name     string `json:"name"`     // Original filename
-	Size     int64  `json:"size"`     // File size in bytes
-	MimeType string `json:"mimeType"` // MIME type of the file
-	Checksum string `json:"checksum"` // SHA-256 checksum
+	Name     string    `json:"name"`     // Original filename
+	Size     int64     `json:"size"`     // File size in bytes
+	MimeType string    `json:"mimeType"` // MIME type of the file
+	Checksum string    `json:"checksum"` // SHA-256 checksum
+	ModTime  time.Time `json:"modTime"`  // Last modification time of the source file
+
+	SymlinkTarget string `json:"symlinkTarget,omitempty"` // Set when the file is a symlink to recreate, its target path
+	ChunkSize     int    `json:"chunkSize,omitempty"`     // Sender's preferred chunk size in bytes
+	Dir           string `json:"dir,omitempty"`           // Slash-separated directory of the file inside a directory transfer, starting with the directory's name
+
+	ChecksumSample int64 `json:"checksumSample,omitempty"` // Set when Checksum only fingerprints this many bytes at each end of the file and its size
+	Follow         bool  `json:"follow,omitempty"`         // The file is sent as it grows, Size is only what it held at the start and EOF carries the checksum
+
+	Compression string `json:"compression,omitempty"` // How the file's data chunks are compressed on the wire, empty when sent raw
+
+	Tags map[string]string `json:"tags,omitempty"` // Key=value tags the sender attached with --meta
+
+	PassphraseSalt []byte `json:"passphraseSalt,omitempty"` // Set when file data is encrypted with a key derived from a passphrase, the salt to derive it with
 }
 
 // ProgressUpdate represents raw file transfer progress data
 type ProgressUpdate struct {
-	NewBytes uint64       // New bytes transferred in this update
-	MetaData *FileMetadata // This should only be sent once at the start
+	NewBytes        uint64        // New bytes transferred in this update
+	CumulativeBytes uint64        // Offset in the file reached so far, including any resumed prefix
+	MetaData        *FileMetadata // This should only be sent once at the start
+	FileIndex       int           // Position of File among the files of the transfer, 0 for a single file
+	File            *FileMetadata // File the update belongs to, nil before the first file of a directory
+	BytesPerSecond  float64       // Current throughput, measured over the configured rate window
+
+	// Only set by the library API in pkg/client, on updates of their own
+	Code   string          // Code the receiver connects with, each time a send gets one
+	Done   bool            // Last update, the transfer has ended with Result or Err
+	Result *TransferResult // Summary of the ended transfer, set when Done
+	Err    error           // Error the transfer ended with, set when Done and it failed
 }
@@ -0,0 +1,29 @@
+package types
+
+import "time"
+
+// TransferResult summarizes a finished transfer for the CLI and library callers
+type TransferResult struct {
+	Path           string         // Local path of the sent or received file or directory
+	Name           string         // File name as sent in metadata
+	Size           int64          // Total file size in bytes
+	Files          int            // Number of files in the transfer, 1 unless a directory was sent
+	Bytes          uint64         // Bytes transferred in this session, excluding any resumed prefix
+	ResumedFrom    int64          // Offset the transfer resumed from, 0 for a full transfer (summed over the files of a directory)
+	Skipped        bool           // The receiver kept an existing copy and no data was sent
+	SkippedFiles   int            // Files of a directory the receiver already had complete
+	DedupedBytes   uint64         // File data the receiver copied from an existing file instead of it being sent
+	TypeMismatches []TypeMismatch // Received files whose content doesn't look like their declared MIME type, when checked
+	Duration       time.Duration  // Time spent transferring file data
+	BytesPerSecond float64        // Average throughput over Duration
+	Checksum       string         // SHA-256 checksum of the file
+	PeerAddress    string         // Remote address of the connected peer, e.g. "203.0.113.5:50000 (srflx)"
+	ICERole        string         // ICE role this peer was in, controlling or controlled, empty for a relayed transfer
+}
+
+// TypeMismatch is a received file whose content was detected as a different type than the sender declared
+type TypeMismatch struct {
+	Name     string // File name as sent in metadata
+	Declared string // MIME type from the metadata
+	Detected string // MIME type detected from the start of the written file
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Checksum encodings
+const (
+	ChecksumHex    = "hex"
+	ChecksumBase64 = "base64"
+)
+
+// sriPrefix is how Subresource Integrity marks a base64 SHA-256 digest
+const sriPrefix = "sha256-"
+
+// DecodeChecksum parses a SHA-256 checksum in hex or base64, optionally with a "sha256-" prefix
+func DecodeChecksum(checksum string) ([]byte, error) {
+	switch {
+	case len(checksum) == hex.EncodedLen(sha256.Size):
+		sum, err := hex.DecodeString(checksum)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex checksum: %w", err)
+		}
+		return sum, nil
+	default:
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(checksum, sriPrefix))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("checksum %q is neither hex nor base64 SHA-256", checksum)
+		}
+		return sum, nil
+	}
+}
+
+// NormalizeChecksum converts a hex or base64 checksum to lowercase hex
+func NormalizeChecksum(checksum string) (string, error) {
+	sum, err := DecodeChecksum(checksum)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// FormatChecksum re-encodes a checksum for display or sending, leaving it as is if it can't be decoded
+func FormatChecksum(checksum, encoding string) string {
+	sum, err := DecodeChecksum(checksum)
+	if err != nil {
+		return checksum
+	}
+
+	if encoding == ChecksumBase64 {
+		return base64.StdEncoding.EncodeToString(sum)
+	}
+	return hex.EncodeToString(sum)
+}
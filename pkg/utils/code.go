@@ -2,18 +2,54 @@ package utils
 
 import (
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"math/big"
 	"regexp"
+	"time"
 )
 
 const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
+// ErrNoEntropy is returned by GenerateCode when the system's secure random source keeps failing
+var ErrNoEntropy = errors.New("the system's secure random source is unavailable, no safe code can be generated")
+
+// A failed read of crypto/rand is tried codeAttempts times in all, waiting codeRetryDelay before the first retry
+// and twice as long before each one after
+const (
+	codeAttempts   = 4
+	codeRetryDelay = 50 * time.Millisecond
+)
+
+// GenerateCode generates a random alphanumeric code of length characters from crypto/rand.
+// A failing random source is retried with a short backoff, failing with ErrNoEntropy only if it keeps failing.
 func GenerateCode(length int) (string, error) {
+	delay := codeRetryDelay
+	for attempt := 1; ; attempt++ {
+		code, err := GenerateCodeFrom(rand.Reader, length)
+		if err == nil {
+			return code, nil
+		}
+		if attempt == codeAttempts {
+			return "", fmt.Errorf("%w: %d reads failed, the last with: %v", ErrNoEntropy, codeAttempts, err)
+		}
+
+		log.Printf("Reading the secure random source failed, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// GenerateCodeFrom generates an alphanumeric code of length characters reading randomness from random, so a known
+// source gives a known code. Codes meant to be secret need a secure source like GenerateCode's.
+func GenerateCodeFrom(random io.Reader, length int) (string, error) {
 	result := make([]byte, length)
 	max := big.NewInt(int64(len(charset)))
 
 	for i := range result {
-		num, err := rand.Int(rand.Reader, max)
+		num, err := rand.Int(random, max)
 		if err != nil {
 			return "", err
 		}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestGenerateCodeFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		random  []byte
+		want    string
+		wantErr error
+	}{
+		{"each byte picks a character", []byte{0, 25, 26, 51, 52, 61, 1, 2}, "AZaz09BC", nil},
+		// Only the low 6 bits count
+		{"high bits ignored", []byte{64, 128 + 25, 192 + 26, 255 - 2, 0, 0, 0, 0}, "AZa9AAAA", nil},
+		// 62 and 63 have no character, they are skipped rather than wrapped around
+		{"62 and 63 skipped", []byte{62, 63, 126, 255, 7, 8, 9, 10, 11, 12, 13, 14}, "HIJKLMNO", nil},
+		{"source runs out", []byte{0, 1, 2}, "", io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GenerateCodeFrom(bytes.NewReader(tt.random), 8)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) || got != tt.want {
+				t.Fatalf("GenerateCodeFrom() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+			if tt.wantErr == nil && !IsValidCode(got) {
+				t.Fatalf("GenerateCodeFrom() = %q, which isn't a valid code", got)
+			}
+		})
+	}
+}
+
+func TestGenerateCodeIsValid(t *testing.T) {
+	code, err := GenerateCode(8)
+	if err != nil {
+		t.Fatalf("GenerateCode() error = %v", err)
+	}
+	if !IsValidCode(code) {
+		t.Fatalf("GenerateCode() = %q, which isn't a valid code", code)
+	}
+}
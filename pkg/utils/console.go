@@ -11,23 +11,31 @@ import (
 func AskForCode(ctx context.Context) (string, error) {
 	scanner := bufio.NewScanner(os.Stdin)
 
-	for {
-		// Create a channel to receive the input
-		inputCh := make(chan string, 1)
+	// One reader for every attempt, closing the channel when stdin ends. A read in progress can't be
+	// interrupted on cancel, the buffered channel lets the reader finish it without anyone receiving.
+	inputCh := make(chan string, 1)
+	go func() {
 		defer close(inputCh)
+		for scanner.Scan() {
+			select {
+			case inputCh <- strings.TrimSpace(scanner.Text()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
+	for {
 		fmt.Printf("Enter code from sender: ")
-		go func() {
-			if scanner.Scan() {
-				inputCh <- strings.TrimSpace(scanner.Text())
-			}
-		}()
 
 		// Wait for either input or context cancellation
 		select {
 		case <-ctx.Done():
 			return "", ctx.Err()
-		case code := <-inputCh:
+		case code, ok := <-inputCh:
+			if !ok {
+				return "", fmt.Errorf("input closed before a code was entered")
+			}
 			if IsValidCode(code) {
 				return code, nil
 			}
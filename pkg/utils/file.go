@@ -11,23 +11,42 @@ import (
 	"yapfs/pkg/types"
 )
 
-// ResolveDestinationPath resolves the destination path, validating directories
+// ResolveDestinationPath resolves the destination path, validating directories.
+// Symlinks in the path are resolved so the returned path points at the real destination.
 func ResolveDestinationPath(destPath string) (string, error) {
+	absPath, err := filepath.Abs(destPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve destination path: %w", err)
+	}
+
 	// Check if the path exists and is a directory
-	if info, err := os.Stat(destPath); err == nil {
+	if info, err := os.Stat(absPath); err == nil {
 		if info.IsDir() {
-			// Valid directory - return as is (filename will come from metadata)
-			return destPath, nil
+			// Valid directory - return its real location (filename will come from metadata)
+			resolvedPath, err := filepath.EvalSymlinks(absPath)
+			if err != nil {
+				return "", fmt.Errorf("cannot resolve symlinks in destination path: %w", err)
+			}
+			return resolvedPath, nil
 		}
 		// Path exists but is not a directory
 		return "", fmt.Errorf("destination path '%s' exists but is not a directory", destPath)
 	} else if os.IsNotExist(err) {
+		// A dangling symlink also reports as not existing, don't create directories through it
+		if linfo, lerr := os.Lstat(absPath); lerr == nil && linfo.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("destination path '%s' is a symlink to a missing target", destPath)
+		}
+
 		// Path doesn't exist - this could be a file path or non-existent directory
-		dir := filepath.Dir(destPath)
+		dir := filepath.Dir(absPath)
 		if info, dirErr := os.Stat(dir); dirErr == nil && info.IsDir() {
 			// Parent exists and is a directory - treat destPath as intended directory name
-			// We'll create it when needed
-			return destPath, nil
+			// We'll create it when needed, inside the real parent directory
+			resolvedDir, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				return "", fmt.Errorf("cannot resolve symlinks in parent directory %s: %w", dir, err)
+			}
+			return filepath.Join(resolvedDir, filepath.Base(absPath)), nil
 		}
 		// Parent doesn't exist
 		return "", fmt.Errorf("parent directory does not exist: %s", dir)
@@ -37,6 +56,15 @@ func ResolveDestinationPath(destPath string) (string, error) {
 	}
 }
 
+// IsPathWithin reports whether target is root itself or located inside root
+func IsPathWithin(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return filepath.IsLocal(rel) || rel == "."
+}
+
 // FormatFileSize formats file size in human readable format
 func FormatFileSize(size int64) string {
 	const unit = 1024
@@ -51,6 +79,32 @@ func FormatFileSize(size int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
+// Throughput display units
+const (
+	UnitsBytes = "bytes"
+	UnitsBits  = "bits"
+)
+
+// FormatRate formats a transfer rate in human readable format.
+// Bytes use the same binary units as FormatFileSize, bits use decimal network units (Mbps).
+func FormatRate(bytesPerSecond float64, units string) string {
+	if units != UnitsBits {
+		return FormatFileSize(int64(bytesPerSecond)) + "/s"
+	}
+
+	bitsPerSecond := bytesPerSecond * 8
+	const unit = 1000
+	if bitsPerSecond < unit {
+		return fmt.Sprintf("%.0f bps", bitsPerSecond)
+	}
+	div, exp := float64(unit), 0
+	for n := bitsPerSecond / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.0f %cbps", bitsPerSecond/div, "kMGTPE"[exp])
+}
+
 // calculateFileChecksum calculates SHA-256 checksum of a file
 func CalculateFileChecksum(filePath string) (string, error) {
 	file, err := os.Open(filePath)
@@ -102,6 +156,7 @@ func CreateFileMetadata(filePath string) (types.FileMetadata, error) {
 		Size:     stat.Size(),
 		MimeType: mimeType,
 		Checksum: checksum,
+		ModTime:  stat.ModTime(),
 	}
 
 	return metadata, nil
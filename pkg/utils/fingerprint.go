@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// FingerprintAlgorithm is the hash naming DTLS certificate fingerprints, as written in SDP
+const FingerprintAlgorithm = "sha-256"
+
+// fingerprintLength is the number of bytes in a SHA-256 fingerprint
+const fingerprintLength = 32
+
+// FormatFingerprint writes a certificate digest the way SDP does (e.g. "sha-256 1a:2b:...")
+func FormatFingerprint(digest []byte) string {
+	pairs := make([]string, len(digest))
+	for i, b := range digest {
+		pairs[i] = hex.EncodeToString([]byte{b})
+	}
+	return FingerprintAlgorithm + " " + strings.Join(pairs, ":")
+}
+
+// ParseFingerprint validates a fingerprint and returns it formatted like FormatFingerprint.
+// The "sha-256" prefix, colons and case are optional, since the fingerprint is typed in by hand.
+func ParseFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	if algo, value, found := strings.Cut(fingerprint, " "); found {
+		if algo != FingerprintAlgorithm {
+			return "", fmt.Errorf("unsupported fingerprint algorithm %q, expected %s", algo, FingerprintAlgorithm)
+		}
+		fingerprint = strings.TrimSpace(value)
+	}
+
+	digest, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil {
+		return "", fmt.Errorf("fingerprint is not hex: %w", err)
+	}
+	if len(digest) != fingerprintLength {
+		return "", fmt.Errorf("fingerprint must have %d bytes, got %d", fingerprintLength, len(digest))
+	}
+
+	return FormatFingerprint(digest), nil
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// AvailableMemory returns how many bytes of memory can still be allocated without swapping or hitting this process's
+// memory limit, the lower of the system's available memory and what is left under a cgroup (container) limit.
+// It reports false where neither can be read, currently anywhere but Linux.
+func AvailableMemory() (uint64, bool) {
+	if runtime.GOOS != "linux" {
+		return 0, false
+	}
+
+	available, ok := meminfoAvailable()
+	if limit, used, err := cgroupMemory(); err == nil && limit > used {
+		if !ok || limit-used < available {
+			available, ok = limit-used, true
+		}
+	}
+	return available, ok
+}
+
+// meminfoAvailable reads MemAvailable from /proc/meminfo
+func meminfoAvailable() (uint64, bool) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return kb * 1024, true
+	}
+	return 0, false
+}
+
+// cgroupMemory reads the memory limit and usage of the cgroup v2 this process runs in, failing if it has no limit
+func cgroupMemory() (limit, used uint64, err error) {
+	read := func(name string) (uint64, error) {
+		data, err := os.ReadFile("/sys/fs/cgroup/" + name)
+		if err != nil {
+			return 0, err
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, fmt.Errorf("%s is unlimited", name)
+		}
+		return strconv.ParseUint(value, 10, 64)
+	}
+
+	if limit, err = read("memory.max"); err != nil {
+		return 0, 0, err
+	}
+	if used, err = read("memory.current"); err != nil {
+		return 0, 0, err
+	}
+	return limit, used, nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds how long the notification helper may take before falling back to the bell
+const notifyTimeout = 5 * time.Second
+
+// Notify shows a desktop notification, or rings the terminal bell where none can be shown
+func Notify(title, message string) {
+	if err := desktopNotify(title, message); err != nil {
+		fmt.Print("\a")
+	}
+}
+
+// desktopNotify hands the notification to the platform's own notifier
+func desktopNotify(title, message string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(message), appleScriptString(title))
+		return runNotifier("osascript", "-e", script)
+	case "windows":
+		// The balloon is gone once the process showing it exits, so it runs on its own and outlives us
+		script := `Add-Type -AssemblyName System.Windows.Forms; ` +
+			`$n = New-Object System.Windows.Forms.NotifyIcon; ` +
+			`$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; ` +
+			`$n.ShowBalloonTip(5000, $env:YAPFS_NOTIFY_TITLE, $env:YAPFS_NOTIFY_MESSAGE, 'Info'); ` +
+			`Start-Sleep -Seconds 6; $n.Dispose()`
+		cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+		// Passed through the environment so nothing in them is read as PowerShell
+		cmd.Env = append(os.Environ(), "YAPFS_NOTIFY_TITLE="+title, "YAPFS_NOTIFY_MESSAGE="+message)
+		return cmd.Start()
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return fmt.Errorf("no graphical session to notify")
+		}
+		return runNotifier("notify-send", "--app-name=yapfs", title, message)
+	}
+}
+
+// runNotifier runs a notification helper to completion
+func runNotifier(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	return exec.CommandContext(ctx, name, args...).Run()
+}
+
+// appleScriptString quotes s as an AppleScript string literal
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ThrottledLogger logs repeating messages at most once per interval each, so a condition hit for every chunk
+// of a large file can't flood the log. Messages are told apart by their format string.
+type ThrottledLogger struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	lines map[string]*throttledLine
+}
+
+// throttledLine tracks one message of a ThrottledLogger
+type throttledLine struct {
+	logged     time.Time // When the message last got through
+	suppressed int       // Times it was held back since then
+}
+
+// NewThrottledLogger creates a logger letting each message through at most once per interval
+func NewThrottledLogger(interval time.Duration) *ThrottledLogger {
+	return &ThrottledLogger{
+		interval: interval,
+		lines:    make(map[string]*throttledLine),
+	}
+}
+
+// Printf logs like log.Printf unless the same message was logged less than the interval ago.
+// The next time it gets through, it says how many were held back in between.
+func (t *ThrottledLogger) Printf(format string, args ...any) {
+	now := time.Now()
+
+	t.mu.Lock()
+	line, ok := t.lines[format]
+	if !ok {
+		line = &throttledLine{}
+		t.lines[format] = line
+	}
+	if !line.logged.IsZero() && now.Sub(line.logged) < t.interval {
+		line.suppressed++
+		t.mu.Unlock()
+		return
+	}
+	suppressed := line.suppressed
+	line.logged, line.suppressed = now, 0
+	t.mu.Unlock()
+
+	message := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		message += fmt.Sprintf(" (%d more like this since the last one)", suppressed)
+	}
+	log.Print(message)
+}
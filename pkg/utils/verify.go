@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// VerifyCodeAlgorithm is the checksum algorithm named in verification codes
+	VerifyCodeAlgorithm = "sha256"
+	// VerifyCodeLength is the number of checksum hex characters in a verification code
+	VerifyCodeLength = 8
+	// minVerifyCodeLength is the shortest code accepted on the receiving side
+	minVerifyCodeLength = 4
+)
+
+// FormatVerifyCode builds a short out-of-band verification code (e.g. "sha256:1a2b3c4d") from a hex checksum
+func FormatVerifyCode(checksum string) string {
+	n := min(VerifyCodeLength, len(checksum))
+	return VerifyCodeAlgorithm + ":" + strings.ToLower(checksum[:n])
+}
+
+// ParseVerifyCode validates a verification code and returns its hex part.
+// The "sha256:" prefix is optional.
+func ParseVerifyCode(code string) (string, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if algo, value, found := strings.Cut(code, ":"); found {
+		if algo != VerifyCodeAlgorithm {
+			return "", fmt.Errorf("unsupported verification code algorithm %q, expected %s", algo, VerifyCodeAlgorithm)
+		}
+		code = value
+	}
+
+	if len(code) < minVerifyCodeLength {
+		return "", fmt.Errorf("verification code must have at least %d hex characters", minVerifyCodeLength)
+	}
+	for _, c := range code {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return "", fmt.Errorf("verification code contains non-hex character %q", c)
+		}
+	}
+
+	return code, nil
+}